@@ -1,4 +1,16 @@
+"use client";
+import { useEffect } from "react";
+
 export default function CancelPage() {
+    useEffect(() => {
+      const reservationId = new URLSearchParams(window.location.search).get("reservation_id");
+      if (!reservationId) return;
+
+      // Give the held tickets back straight away instead of waiting for the hold to run out
+      fetch(`http://localhost:8080/api/reservations/${reservationId}`, { method: "DELETE" })
+        .catch((error) => console.error("Error releasing reservation:", error));
+    }, []);
+
     return (
       <div className="flex flex-col items-center justify-center min-h-screen">
         <h1 className="text-4xl font-bold text-red-600 mb-4">Payment Cancelled</h1>
@@ -3,10 +3,11 @@
 import { useState } from "react";
 import { Button } from "@/components/ui/button";
 import { Input } from "@/components/ui/input";
+import { Money, formatMoney } from "@/lib/money";
 
 interface TicketTypeRowProps {
   ticketType: string;
-  price: number;
+  price: Money;
   count: number; // controlled value
   min?: number;
   max?: number;
@@ -32,7 +33,7 @@ export function TicketTypeRow({
     <div className="flex items-center justify-between p-4 border">
       <div>
         <div className="font-semibold">{ticketType}</div>
-        <div className="text-sm text-gray-500">${price.toFixed(2)}</div>
+        <div className="text-sm text-gray-500">{formatMoney(price)}</div>
       </div>
       <div className="flex items-center space-x-2">
         <Button variant="outline" size="sm" className="rounded-none" onClick={() => handleChange(count - 1)}>–</Button>
@@ -0,0 +1,115 @@
+"use client";
+import { useEffect } from "react";
+import {
+  Field,
+  FieldDescription,
+  FieldGroup,
+  FieldLabel,
+  FieldLegend,
+  FieldSet,
+} from "@/components/ui/field"
+import { Input } from "@/components/ui/input"
+
+export interface RegistrationQuestion {
+  id: number;
+  ticket_type_id: number | null; // null: asked for every ticket type
+  label: string;
+  kind: "text" | "select" | "checkbox";
+  options: string[];
+  required: boolean;
+}
+
+export interface Attendee {
+  name: string;
+  email: string;
+  answers: Record<number, string | boolean>; // question id -> answer
+}
+
+interface AttendeeFormProps {
+  eventId: number;
+  ticketSelection: Record<number, number>; // ticket type id -> quantity
+  questions: RegistrationQuestion[];
+  setQuestions: (questions: RegistrationQuestion[]) => void;
+  attendees: Record<number, Attendee[]>; // ticket type id -> one per ticket
+  setAttendees: (attendees: Record<number, Attendee[]>) => void;
+}
+
+const inputClass = "bg-white rounded-none outline-none focus:outline-none focus:ring-0 shadow-none appearance-none placeholder:text-gray-500"
+
+// toAttendeeDetails turns the form's attendees into the attendees of a
+// checkout item.
+export function toAttendeeDetails(attendees: Attendee[] | undefined) {
+  return (attendees ?? []).map((a) => ({
+    name: a.name,
+    email: a.email,
+    answers: Object.entries(a.answers).map(([id, value]) => ({ question_id: Number(id), value })),
+  }));
+}
+
+export function AttendeeForm({ eventId, ticketSelection, questions, setQuestions, attendees, setAttendees }: AttendeeFormProps) {
+  useEffect(() => {
+    fetch(`http://localhost:8080/api/events/${eventId}/questions`)
+      .then((res) => {
+        if (!res.ok) throw new Error("Failed to fetch");
+        return res.json();
+      })
+      .then((data: RegistrationQuestion[]) => setQuestions(data))
+      .catch((err) => console.error("Error loading questions:", err));
+  }, [eventId]);
+
+  if (questions.length === 0) return null;
+
+  const update = (typeId: number, index: number, change: Partial<Attendee>) => {
+    const quantity = ticketSelection[typeId];
+    const list = Array.from({ length: quantity }, (_, i) => attendees[typeId]?.[i] ?? { name: "", email: "", answers: {} });
+    list[index] = { ...list[index], ...change };
+    setAttendees({ ...attendees, [typeId]: list });
+  };
+
+  return (
+    <div className="w-full max-w-md space-y-6 pt-6">
+      {Object.entries(ticketSelection).flatMap(([typeIdStr, quantity]) => {
+        const typeId = Number(typeIdStr);
+        const asked = questions.filter((q) => q.ticket_type_id === null || q.ticket_type_id === typeId);
+
+        return Array.from({ length: quantity }, (_, i) => {
+          const attendee = attendees[typeId]?.[i] ?? { name: "", email: "", answers: {} };
+          const answer = (q: RegistrationQuestion, value: string | boolean) =>
+            update(typeId, i, { answers: { ...attendee.answers, [q.id]: value } });
+
+          return (
+            <FieldSet key={`${typeId}-${i}`}>
+              <FieldLegend><h2>Attendee {i + 1}</h2></FieldLegend>
+              <FieldDescription>Who this ticket is for.</FieldDescription>
+              <FieldGroup>
+                <Field>
+                  <FieldLabel><h3>Name:</h3></FieldLabel>
+                  <Input className={inputClass} value={attendee.name} onChange={(e) => update(typeId, i, { name: e.target.value })} />
+                </Field>
+                <Field>
+                  <FieldLabel><h3>Email Address:</h3></FieldLabel>
+                  <Input type="email" className={inputClass} value={attendee.email} onChange={(e) => update(typeId, i, { email: e.target.value })} />
+                </Field>
+                {asked.map((q) => (
+                  <Field key={q.id}>
+                    <FieldLabel><h3>{q.label}{q.required ? " *" : ""}</h3></FieldLabel>
+                    {q.kind === "select" ? (
+                      <select className={inputClass} value={String(attendee.answers[q.id] ?? "")} onChange={(e) => answer(q, e.target.value)}>
+                        <option value="">Choose…</option>
+                        {q.options.map((opt) => <option key={opt} value={opt}>{opt}</option>)}
+                      </select>
+                    ) : q.kind === "checkbox" ? (
+                      <input type="checkbox" checked={attendee.answers[q.id] === true} onChange={(e) => answer(q, e.target.checked)} />
+                    ) : (
+                      <Input className={inputClass} value={String(attendee.answers[q.id] ?? "")} onChange={(e) => answer(q, e.target.value)} />
+                    )}
+                  </Field>
+                ))}
+              </FieldGroup>
+            </FieldSet>
+          );
+        });
+      })}
+    </div>
+  );
+}
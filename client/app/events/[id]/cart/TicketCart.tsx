@@ -4,11 +4,12 @@ import { Button } from "@/components/ui/button";
 import { useState, useEffect } from "react";
 import { ShoppingCart } from 'lucide-react';
 import { Separator } from "@/components/ui/separator";
+import { Money, formatMoney } from "@/lib/money";
 
 interface TicketType {
   id: number;
   name: string;
-  price: number;
+  price: Money;
 }
 
 interface TicketCartProps {
@@ -38,8 +39,8 @@ export default function TicketCart({ ticketSelection, onCheckout }: TicketCartPr
 
   }, [ticketSelection]); // must refetch when selection changes
 
-  const getTotalPrice = () => {
-    let total = 0;
+  const getTotalPrice = (): Money => {
+    const total: Money = { amount: 0, currency: "aud" };
 
     for (const ticketIdStr of Object.keys(ticketSelection)) {
       const ticketId = Number(ticketIdStr);
@@ -48,7 +49,8 @@ export default function TicketCart({ ticketSelection, onCheckout }: TicketCartPr
 
       if (!ticket) continue; // still loading
 
-      total += ticket.price * quantity;
+      total.amount += ticket.price.amount * quantity;
+      total.currency = ticket.price.currency;
     }
 
     return total;
@@ -72,13 +74,13 @@ export default function TicketCart({ ticketSelection, onCheckout }: TicketCartPr
 
           return (
             <div className="grid grid-cols-5"key={Number(idStr)}>
-              <div className="col-span-4">{quantity} × {ticketName}</div> <div className="justify-end">${(price * quantity).toFixed(2)} </div>
+              <div className="col-span-4">{quantity} × {ticketName}</div> <div className="justify-end">{formatMoney(price, quantity)} </div>
             </div>
           );
         })}
         <br />
         <div className="grid grid-cols-5 font-semibold">
-              <div className="col-span-4">Total:</div> <div className="justify-end">${getTotalPrice().toFixed(2)}</div>
+              <div className="col-span-4">Total:</div> <div className="justify-end">{formatMoney(getTotalPrice())}</div>
             </div>
 
         <Separator />
@@ -4,17 +4,24 @@ import TicketCart from "./TicketCart"
 import React from "react";
 import { useEffect, useState } from "react"
 import { UserInfoForm } from "./UserInfoForm"
+import { AttendeeForm, Attendee, RegistrationQuestion, toAttendeeDetails } from "./AttendeeForm"
+import { useParams } from "next/navigation";
 import { E164Number } from "libphonenumber-js/core";
+import { Money } from "@/lib/money";
 
 interface TicketType {
   name: string;
-  price: number;
+  price: Money;
 }
 
 function CheckoutPage() {
     const [ticketSelection, setTicketSelection] = useState<Record<number, number>>({});
     const [email, setEmail] = useState<string>("");
     const [phone, setPhone] = useState<E164Number | undefined>();
+    const [questions, setQuestions] = useState<RegistrationQuestion[]>([]);
+    const [attendees, setAttendees] = useState<Record<number, Attendee[]>>({});
+    const params = useParams();
+    const eventId = Number(params.id);
 
     useEffect(() => {
         const selection = sessionStorage.getItem("ticketSelection");
@@ -25,6 +32,8 @@ function CheckoutPage() {
         const items = Object.entries(ticketSelection).map(([id, quantity]) => ({
             ticket_id: Number(id),
             quantity: quantity,
+            // Only sent when the event asks questions; the server checks them
+            ...(questions.length > 0 && { attendees: toAttendeeDetails(attendees[Number(id)]) }),
         }));
 
         if (items.length === 0) {
@@ -63,14 +72,24 @@ function CheckoutPage() {
 
         } catch (error) {
             console.error("Error during checkout:", error);
-            alert("Checkout failed. Please try again.");
+            alert(error instanceof Error ? error.message : "Checkout failed. Please try again.");
         }
     }
 
     return (
         <div className="grid grid-cols-2 gap-4 pt-10">
             <div className="flex justify-end">
-                <UserInfoForm email={email} setEmail={setEmail} phone={phone} setPhone={setPhone} />
+                <div>
+                    <UserInfoForm email={email} setEmail={setEmail} phone={phone} setPhone={setPhone} />
+                    <AttendeeForm
+                        eventId={eventId}
+                        ticketSelection={ticketSelection}
+                        questions={questions}
+                        setQuestions={setQuestions}
+                        attendees={attendees}
+                        setAttendees={setAttendees}
+                    />
+                </div>
             </div>
 
             <div>
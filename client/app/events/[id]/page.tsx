@@ -30,11 +30,12 @@ import { Button } from "@/components/ui/button";
 
 import EventDisplay from "@/app/events/[id]/EventInfo";
 import { TicketTypeRow } from "@/app/events/[id]/TicketCount";
+import { Money } from "@/lib/money";
 
 interface TicketType {
   id: number;
   name: string;
-  price: number;        // in dollars
+  price: Money;
   total_quantity: number;
 }
 
@@ -0,0 +1,158 @@
+"use client";
+import { useEffect, useState } from "react";
+import { Button } from "@/components/ui/button";
+import { Input } from "@/components/ui/input";
+import { Money, formatMoney } from "@/lib/money";
+
+interface Ticket {
+  id: number;
+  qr_code: string;
+  status: string;
+  ticket_type_name: string;
+  ticket_type_price: Money;
+}
+
+interface Purchase {
+  purchase_id: number;
+  total_amount: Money;
+  payment_status: string;
+  event: {
+    id: number;
+    title: string;
+    location: string;
+    start_time: string;
+  };
+  tickets: Ticket[];
+}
+
+// The lookup link's token works once, so the JWT it's exchanged for is kept
+// for the rest of the session, letting the page be reloaded
+const sessionKey = "ticketHolderToken";
+
+export default function MyTicketsPage() {
+    const [jwt, setJwt] = useState<string | null>(null);
+    const [purchases, setPurchases] = useState<Purchase[] | null>(null);
+    const [error, setError] = useState<string | null>(null);
+    const [email, setEmail] = useState("");
+    const [message, setMessage] = useState<string | null>(null);
+    const [transferTo, setTransferTo] = useState<Record<number, string>>({});
+
+    useEffect(() => {
+      const token = new URLSearchParams(window.location.search).get("token");
+      if (!token) {
+        setJwt(sessionStorage.getItem(sessionKey));
+        return;
+      }
+      window.history.replaceState(null, "", "/my-tickets");
+
+      fetch(`http://localhost:8080/api/tickets/lookup/${encodeURIComponent(token)}`, { method: "POST" })
+        .then(async (res) => {
+          const body = await res.json();
+          if (!res.ok) throw new Error(body.error || "Failed to open link");
+          sessionStorage.setItem(sessionKey, body.token);
+          setJwt(body.token);
+        })
+        .catch((error) => setError(error.message));
+    }, []);
+
+    useEffect(() => {
+      if (!jwt) return;
+      fetch("http://localhost:8080/api/my-tickets", { headers: { Authorization: `Bearer ${jwt}` } })
+        .then(async (res) => {
+          const body = await res.json();
+          if (res.status === 401) {
+            sessionStorage.removeItem(sessionKey);
+            setJwt(null);
+            throw new Error("Your session has expired. Request a new link below.");
+          }
+          if (!res.ok) throw new Error(body.error || "Failed to load tickets");
+          setPurchases(body);
+        })
+        .catch((error) => setError(error.message));
+    }, [jwt]);
+
+    const requestLink = async () => {
+      setMessage(null);
+      const res = await fetch("http://localhost:8080/api/tickets/lookup", {
+        method: "POST",
+        headers: { "Content-Type": "application/json" },
+        body: JSON.stringify({ email }),
+      });
+      const body = await res.json();
+      setMessage(res.ok ? body.message : body.error || "Failed to send link");
+    };
+
+    const resend = async (purchaseId: number) => {
+      const res = await fetch(`http://localhost:8080/api/my-tickets/${purchaseId}/resend`, {
+        method: "POST",
+        headers: { Authorization: `Bearer ${jwt}` },
+      });
+      const body = await res.json();
+      setMessage(res.ok ? body.message : body.error || "Failed to resend tickets");
+    };
+
+    const transfer = async (ticket: Ticket) => {
+      const res = await fetch("http://localhost:8080/api/tickets/transfers", {
+        method: "POST",
+        headers: { "Content-Type": "application/json", Authorization: `Bearer ${jwt}` },
+        body: JSON.stringify({ qr: ticket.qr_code, email: transferTo[ticket.id] }),
+      });
+      const body = await res.json();
+      setMessage(res.ok ? `Ticket offered to ${body.to_email}. It stays yours until they accept.` : body.error || "Failed to transfer ticket");
+    };
+
+    if (!jwt) {
+      return (
+        <div className="flex flex-col items-center justify-center min-h-screen gap-4">
+          <h1 className="text-4xl font-bold mb-4">Find My Tickets</h1>
+          {error && <p className="text-red-600">{error}</p>}
+          <p className="text-lg text-gray-700">Enter the email address you bought your tickets with and we&apos;ll send you a link to them.</p>
+          <div className="flex gap-2">
+            <Input type="email" value={email} onChange={(e) => setEmail(e.target.value)} placeholder="you@example.com" />
+            <Button onClick={requestLink} disabled={!email}>Send Link</Button>
+          </div>
+          {message && <p className="text-gray-700">{message}</p>}
+        </div>
+      );
+    }
+
+    return (
+      <div className="max-w-3xl mx-auto py-10">
+        <h1 className="text-4xl font-bold mb-8">My Tickets</h1>
+        {error && <p className="text-red-600 mb-4">{error}</p>}
+        {message && <p className="text-gray-700 mb-4">{message}</p>}
+        {purchases === null && !error && <p className="text-gray-700">Loading tickets...</p>}
+        {purchases?.length === 0 && <p className="text-gray-700">You have no tickets.</p>}
+        {purchases?.map((purchase) => (
+          <div key={purchase.purchase_id} className="border rounded-lg p-6 mb-6">
+            <h2 className="text-2xl font-semibold">{purchase.event.title}</h2>
+            <p className="text-gray-500">{new Date(purchase.event.start_time).toLocaleString()} · {purchase.event.location}</p>
+            <ul className="mt-4 space-y-4">
+              {purchase.tickets.map((ticket) => (
+                <li key={ticket.id} className="border-t pt-4">
+                  <p className="font-medium">
+                    {ticket.ticket_type_name} · {formatMoney(ticket.ticket_type_price)} · <span className="capitalize">{ticket.status}</span>
+                  </p>
+                  {ticket.status === "valid" && (
+                    <>
+                      <p className="font-mono text-xs break-all text-gray-500 mt-1">{ticket.qr_code}</p>
+                      <div className="flex gap-2 mt-2">
+                        <Input
+                          type="email"
+                          placeholder="Transfer to email"
+                          value={transferTo[ticket.id] ?? ""}
+                          onChange={(e) => setTransferTo({ ...transferTo, [ticket.id]: e.target.value })}
+                        />
+                        <Button variant="outline" onClick={() => transfer(ticket)} disabled={!transferTo[ticket.id]}>Transfer</Button>
+                      </div>
+                    </>
+                  )}
+                </li>
+              ))}
+            </ul>
+            <Button className="mt-4" onClick={() => resend(purchase.purchase_id)}>Email Me These Tickets</Button>
+          </div>
+        ))}
+      </div>
+    );
+  }
@@ -0,0 +1,104 @@
+"use client";
+import { useEffect, useState } from "react";
+
+type Transfer = {
+  id: number;
+  ticket_id: number;
+  event_title: string;
+  ticket_type: string;
+  to_email: string;
+  status: string;
+  expires_at: string;
+};
+
+export default function AcceptTransferPage() {
+    const [token, setToken] = useState<string | null>(null);
+    const [transfer, setTransfer] = useState<Transfer | null>(null);
+    const [error, setError] = useState<string | null>(null);
+    const [accepting, setAccepting] = useState(false);
+    const [accepted, setAccepted] = useState(false);
+
+    useEffect(() => {
+      const token = new URLSearchParams(window.location.search).get("token");
+      if (!token) {
+        setError("This transfer link is incomplete.");
+        return;
+      }
+      setToken(token);
+
+      fetch(`http://localhost:8080/api/transfers/${encodeURIComponent(token)}`)
+        .then(async (res) => {
+          const body = await res.json();
+          if (!res.ok) throw new Error(body.error || "Failed to load transfer");
+          setTransfer(body);
+        })
+        .catch((error) => setError(error.message));
+    }, []);
+
+    const accept = async () => {
+      if (!token) return;
+      setAccepting(true);
+      try {
+        const res = await fetch(`http://localhost:8080/api/transfers/${encodeURIComponent(token)}/accept`, { method: "POST" });
+        const body = await res.json();
+        if (!res.ok) throw new Error(body.error || "Failed to accept transfer");
+        setAccepted(true);
+      } catch (error) {
+        setError(error instanceof Error ? error.message : "Failed to accept transfer");
+      } finally {
+        setAccepting(false);
+      }
+    };
+
+    if (accepted && transfer) {
+      return (
+        <div className="flex flex-col items-center justify-center min-h-screen">
+          <h1 className="text-4xl font-bold text-green-600 mb-4">Ticket Accepted!</h1>
+          <p className="text-lg text-gray-700">Your {transfer.ticket_type} ticket for {transfer.event_title} has been emailed to {transfer.to_email}.</p>
+          <a href="/" className="mt-8 text-blue-500 hover:underline">Return Home</a>
+        </div>
+      );
+    }
+
+    if (error) {
+      return (
+        <div className="flex flex-col items-center justify-center min-h-screen">
+          <h1 className="text-4xl font-bold text-red-600 mb-4">Transfer Unavailable</h1>
+          <p className="text-lg text-gray-700">{error}</p>
+          <a href="/" className="mt-8 text-blue-500 hover:underline">Return Home</a>
+        </div>
+      );
+    }
+
+    if (!transfer) {
+      return (
+        <div className="flex flex-col items-center justify-center min-h-screen">
+          <p className="text-lg text-gray-700">Loading transfer...</p>
+        </div>
+      );
+    }
+
+    // The API reports lapsed links as expired before anyone tries to accept them
+    const pending = transfer.status === "pending";
+    return (
+      <div className="flex flex-col items-center justify-center min-h-screen">
+        <h1 className="text-4xl font-bold mb-4">You&apos;ve been sent a ticket</h1>
+        <p className="text-lg text-gray-700">{transfer.ticket_type} for {transfer.event_title}</p>
+        {pending ? (
+          <>
+            <p className="text-gray-500 mt-2">Accept by {new Date(transfer.expires_at).toLocaleString()}. The ticket will be emailed to {transfer.to_email}.</p>
+            <button
+              onClick={accept}
+              disabled={accepting}
+              className="mt-8 px-6 py-2 rounded bg-blue-600 text-white hover:bg-blue-700 disabled:opacity-50"
+            >
+              {accepting ? "Accepting..." : "Accept Ticket"}
+            </button>
+          </>
+        ) : (
+          <p className="text-lg text-red-600 mt-2">This transfer is {transfer.status}.</p>
+        )}
+        <a href="/" className="mt-8 text-blue-500 hover:underline">Return Home</a>
+      </div>
+    );
+  }
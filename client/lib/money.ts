@@ -0,0 +1,12 @@
+// Prices come from the API in minor units (cents) with an ISO currency code.
+export interface Money {
+  amount: number;
+  currency: string;
+}
+
+export function formatMoney(money: Money, quantity = 1): string {
+  return new Intl.NumberFormat("en-AU", {
+    style: "currency",
+    currency: money.currency.toUpperCase(),
+  }).format((money.amount * quantity) / 100);
+}
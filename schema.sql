@@ -23,6 +23,129 @@ SET default_tablespace = '';
 
 SET default_table_access_method = heap;
 
+--
+-- Name: broadcast_recipients; Type: TABLE; Schema: public; Owner: postgres
+--
+
+CREATE TABLE public.broadcast_recipients (
+    id integer NOT NULL,
+    broadcast_id integer NOT NULL,
+    user_id integer,
+    email text NOT NULL,
+    status text DEFAULT 'queued'::text NOT NULL,
+    attempts integer DEFAULT 0 NOT NULL,
+    last_error text,
+    sent_at timestamp with time zone,
+    CONSTRAINT broadcast_recipients_status_check CHECK ((status = ANY (ARRAY['queued'::text, 'sent'::text, 'failed'::text, 'skipped'::text])))
+);
+
+
+ALTER TABLE public.broadcast_recipients OWNER TO postgres;
+
+--
+-- Name: broadcast_recipients_id_seq; Type: SEQUENCE; Schema: public; Owner: postgres
+--
+
+CREATE SEQUENCE public.broadcast_recipients_id_seq
+    AS integer
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1;
+
+
+ALTER SEQUENCE public.broadcast_recipients_id_seq OWNER TO postgres;
+
+--
+-- Name: broadcast_recipients_id_seq; Type: SEQUENCE OWNED BY; Schema: public; Owner: postgres
+--
+
+ALTER SEQUENCE public.broadcast_recipients_id_seq OWNED BY public.broadcast_recipients.id;
+
+
+--
+-- Name: broadcasts; Type: TABLE; Schema: public; Owner: postgres
+--
+
+CREATE TABLE public.broadcasts (
+    id integer NOT NULL,
+    event_id integer NOT NULL,
+    sent_by integer,
+    subject text NOT NULL,
+    body text NOT NULL,
+    ticket_type_id integer,
+    checked_in boolean,
+    created_at timestamp with time zone DEFAULT now() NOT NULL
+);
+
+
+ALTER TABLE public.broadcasts OWNER TO postgres;
+
+--
+-- Name: broadcasts_id_seq; Type: SEQUENCE; Schema: public; Owner: postgres
+--
+
+CREATE SEQUENCE public.broadcasts_id_seq
+    AS integer
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1;
+
+
+ALTER SEQUENCE public.broadcasts_id_seq OWNER TO postgres;
+
+--
+-- Name: broadcasts_id_seq; Type: SEQUENCE OWNED BY; Schema: public; Owner: postgres
+--
+
+ALTER SEQUENCE public.broadcasts_id_seq OWNED BY public.broadcasts.id;
+
+
+--
+-- Name: disputes; Type: TABLE; Schema: public; Owner: postgres
+--
+
+CREATE TABLE public.disputes (
+    id integer NOT NULL,
+    purchase_id integer NOT NULL,
+    gateway_dispute_id text NOT NULL,
+    amount numeric(10,2) NOT NULL,
+    currency text NOT NULL,
+    reason text,
+    status text NOT NULL,
+    created_at timestamp without time zone DEFAULT now(),
+    updated_at timestamp without time zone DEFAULT now(),
+    closed_at timestamp without time zone
+);
+
+
+ALTER TABLE public.disputes OWNER TO postgres;
+
+--
+-- Name: disputes_id_seq; Type: SEQUENCE; Schema: public; Owner: postgres
+--
+
+CREATE SEQUENCE public.disputes_id_seq
+    AS integer
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1;
+
+
+ALTER SEQUENCE public.disputes_id_seq OWNER TO postgres;
+
+--
+-- Name: disputes_id_seq; Type: SEQUENCE OWNED BY; Schema: public; Owner: postgres
+--
+
+ALTER SEQUENCE public.disputes_id_seq OWNED BY public.disputes.id;
+
+
 --
 -- Name: event_images; Type: TABLE; Schema: public; Owner: postgres
 --
@@ -76,7 +199,12 @@ CREATE TABLE public.events (
     total_capacity integer,
     is_public boolean DEFAULT true,
     created_at timestamp without time zone DEFAULT now(),
-    updated_at timestamp without time zone DEFAULT now()
+    updated_at timestamp without time zone DEFAULT now(),
+    currency text DEFAULT 'aud'::text NOT NULL,
+    transfers_enabled boolean DEFAULT true NOT NULL,
+    transfer_cutoff_minutes integer DEFAULT 60 NOT NULL,
+    reminders_enabled boolean DEFAULT true NOT NULL,
+    reminder_offsets integer[] DEFAULT '{1440,120}'::integer[] NOT NULL
 );
 
 
@@ -127,7 +255,12 @@ CREATE TABLE public.organisations (
     description text,
     contact_email text,
     created_at timestamp without time zone DEFAULT now(),
-    acronym text
+    acronym text,
+    email_sender_name text,
+    email_reply_to text,
+    email_logo_url text,
+    email_brand_colour text,
+    email_footer text
 );
 
 
@@ -156,28 +289,32 @@ ALTER SEQUENCE public.organisations_id_seq OWNED BY public.organisations.id;
 
 
 --
--- Name: purchases; Type: TABLE; Schema: public; Owner: postgres
+-- Name: outbox; Type: TABLE; Schema: public; Owner: postgres
 --
 
-CREATE TABLE public.purchases (
+CREATE TABLE public.outbox (
     id integer NOT NULL,
-    user_id integer,
-    event_id integer,
-    total_amount numeric(10,2) NOT NULL,
-    payment_status text DEFAULT 'pending'::text,
-    stripe_payment_id text,
+    kind text NOT NULL,
+    payload jsonb NOT NULL,
+    status text DEFAULT 'pending'::text NOT NULL,
+    attempts integer DEFAULT 0 NOT NULL,
+    max_attempts integer DEFAULT 10 NOT NULL,
+    run_at timestamp without time zone DEFAULT now() NOT NULL,
+    locked_until timestamp without time zone,
+    last_error text,
     created_at timestamp without time zone DEFAULT now(),
-    updated_at timestamp without time zone DEFAULT now()
+    updated_at timestamp without time zone DEFAULT now(),
+    done_at timestamp without time zone
 );
 
 
-ALTER TABLE public.purchases OWNER TO postgres;
+ALTER TABLE public.outbox OWNER TO postgres;
 
 --
--- Name: purchases_id_seq; Type: SEQUENCE; Schema: public; Owner: postgres
+-- Name: outbox_id_seq; Type: SEQUENCE; Schema: public; Owner: postgres
 --
 
-CREATE SEQUENCE public.purchases_id_seq
+CREATE SEQUENCE public.outbox_id_seq
     AS integer
     START WITH 1
     INCREMENT BY 1
@@ -186,38 +323,36 @@ CREATE SEQUENCE public.purchases_id_seq
     CACHE 1;
 
 
-ALTER SEQUENCE public.purchases_id_seq OWNER TO postgres;
+ALTER SEQUENCE public.outbox_id_seq OWNER TO postgres;
 
 --
--- Name: purchases_id_seq; Type: SEQUENCE OWNED BY; Schema: public; Owner: postgres
+-- Name: outbox_id_seq; Type: SEQUENCE OWNED BY; Schema: public; Owner: postgres
 --
 
-ALTER SEQUENCE public.purchases_id_seq OWNED BY public.purchases.id;
+ALTER SEQUENCE public.outbox_id_seq OWNED BY public.outbox.id;
 
 
 --
--- Name: ticket_types; Type: TABLE; Schema: public; Owner: postgres
+-- Name: purchase_items; Type: TABLE; Schema: public; Owner: postgres
 --
 
-CREATE TABLE public.ticket_types (
+CREATE TABLE public.purchase_items (
     id integer NOT NULL,
-    event_id integer,
-    name text NOT NULL,
-    price numeric(10,2) NOT NULL,
-    total_quantity integer NOT NULL,
-    sold_quantity integer DEFAULT 0,
-    sale_start timestamp without time zone,
-    sale_end timestamp without time zone
+    purchase_id integer NOT NULL,
+    ticket_type_id integer NOT NULL,
+    quantity integer NOT NULL,
+    unit_price numeric(10,2) NOT NULL,
+    attendees jsonb
 );
 
 
-ALTER TABLE public.ticket_types OWNER TO postgres;
+ALTER TABLE public.purchase_items OWNER TO postgres;
 
 --
--- Name: ticket_types_id_seq; Type: SEQUENCE; Schema: public; Owner: postgres
+-- Name: purchase_items_id_seq; Type: SEQUENCE; Schema: public; Owner: postgres
 --
 
-CREATE SEQUENCE public.ticket_types_id_seq
+CREATE SEQUENCE public.purchase_items_id_seq
     AS integer
     START WITH 1
     INCREMENT BY 1
@@ -226,37 +361,42 @@ CREATE SEQUENCE public.ticket_types_id_seq
     CACHE 1;
 
 
-ALTER SEQUENCE public.ticket_types_id_seq OWNER TO postgres;
+ALTER SEQUENCE public.purchase_items_id_seq OWNER TO postgres;
 
 --
--- Name: ticket_types_id_seq; Type: SEQUENCE OWNED BY; Schema: public; Owner: postgres
+-- Name: purchase_items_id_seq; Type: SEQUENCE OWNED BY; Schema: public; Owner: postgres
 --
 
-ALTER SEQUENCE public.ticket_types_id_seq OWNED BY public.ticket_types.id;
+ALTER SEQUENCE public.purchase_items_id_seq OWNED BY public.purchase_items.id;
 
 
 --
--- Name: tickets; Type: TABLE; Schema: public; Owner: postgres
+-- Name: purchases; Type: TABLE; Schema: public; Owner: postgres
 --
 
-CREATE TABLE public.tickets (
+CREATE TABLE public.purchases (
     id integer NOT NULL,
-    ticket_type_id integer,
     user_id integer,
-    purchase_id integer,
-    qr_code text,
-    status text DEFAULT 'valid'::text,
-    created_at timestamp without time zone DEFAULT now()
+    event_id integer,
+    total_amount numeric(10,2) NOT NULL,
+    payment_status text DEFAULT 'pending'::text,
+    stripe_payment_id text,
+    created_at timestamp without time zone DEFAULT now(),
+    updated_at timestamp without time zone DEFAULT now(),
+    reservation_id text,
+    currency text DEFAULT 'aud'::text NOT NULL,
+    payment_id text,
+    review_reason text
 );
 
 
-ALTER TABLE public.tickets OWNER TO postgres;
+ALTER TABLE public.purchases OWNER TO postgres;
 
 --
--- Name: tickets_id_seq; Type: SEQUENCE; Schema: public; Owner: postgres
+-- Name: purchases_id_seq; Type: SEQUENCE; Schema: public; Owner: postgres
 --
 
-CREATE SEQUENCE public.tickets_id_seq
+CREATE SEQUENCE public.purchases_id_seq
     AS integer
     START WITH 1
     INCREMENT BY 1
@@ -265,37 +405,43 @@ CREATE SEQUENCE public.tickets_id_seq
     CACHE 1;
 
 
-ALTER SEQUENCE public.tickets_id_seq OWNER TO postgres;
+ALTER SEQUENCE public.purchases_id_seq OWNER TO postgres;
 
 --
--- Name: tickets_id_seq; Type: SEQUENCE OWNED BY; Schema: public; Owner: postgres
+-- Name: purchases_id_seq; Type: SEQUENCE OWNED BY; Schema: public; Owner: postgres
 --
 
-ALTER SEQUENCE public.tickets_id_seq OWNED BY public.tickets.id;
+ALTER SEQUENCE public.purchases_id_seq OWNED BY public.purchases.id;
 
 
 --
--- Name: users; Type: TABLE; Schema: public; Owner: postgres
+-- Name: refunds; Type: TABLE; Schema: public; Owner: postgres
 --
 
-CREATE TABLE public.users (
+CREATE TABLE public.refunds (
     id integer NOT NULL,
-    email text NOT NULL,
-    first_name text,
-    last_name text,
-    role text DEFAULT 'customer'::text,
+    purchase_id integer NOT NULL,
+    gateway_refund_id text,
+    amount numeric(10,2) NOT NULL,
+    currency text NOT NULL,
+    source text NOT NULL,
+    reason text,
+    created_by integer,
     created_at timestamp without time zone DEFAULT now(),
-    password_hash text NOT NULL
+    status text DEFAULT 'succeeded'::text NOT NULL,
+    idempotency_key text,
+    ticket_ids integer[],
+    CONSTRAINT refunds_status_check CHECK ((status = ANY (ARRAY['pending'::text, 'succeeded'::text, 'failed'::text])))
 );
 
 
-ALTER TABLE public.users OWNER TO postgres;
+ALTER TABLE public.refunds OWNER TO postgres;
 
 --
--- Name: users_id_seq; Type: SEQUENCE; Schema: public; Owner: postgres
+-- Name: refunds_id_seq; Type: SEQUENCE; Schema: public; Owner: postgres
 --
 
-CREATE SEQUENCE public.users_id_seq
+CREATE SEQUENCE public.refunds_id_seq
     AS integer
     START WITH 1
     INCREMENT BY 1
@@ -304,154 +450,903 @@ CREATE SEQUENCE public.users_id_seq
     CACHE 1;
 
 
-ALTER SEQUENCE public.users_id_seq OWNER TO postgres;
+ALTER SEQUENCE public.refunds_id_seq OWNER TO postgres;
 
 --
--- Name: users_id_seq; Type: SEQUENCE OWNED BY; Schema: public; Owner: postgres
+-- Name: refunds_id_seq; Type: SEQUENCE OWNED BY; Schema: public; Owner: postgres
 --
 
-ALTER SEQUENCE public.users_id_seq OWNED BY public.users.id;
+ALTER SEQUENCE public.refunds_id_seq OWNED BY public.refunds.id;
 
 
 --
--- Name: event_images id; Type: DEFAULT; Schema: public; Owner: postgres
+-- Name: registration_questions; Type: TABLE; Schema: public; Owner: postgres
 --
 
-ALTER TABLE ONLY public.event_images ALTER COLUMN id SET DEFAULT nextval('public.event_images_id_seq'::regclass);
+CREATE TABLE public.registration_questions (
+    id integer NOT NULL,
+    event_id integer NOT NULL,
+    ticket_type_id integer,
+    label text NOT NULL,
+    kind text NOT NULL,
+    options text[] DEFAULT '{}'::text[] NOT NULL,
+    required boolean DEFAULT false NOT NULL,
+    "position" integer DEFAULT 0 NOT NULL,
+    created_at timestamp without time zone DEFAULT now(),
+    CONSTRAINT registration_questions_kind_check CHECK ((kind = ANY (ARRAY['text'::text, 'select'::text, 'checkbox'::text])))
+);
+
 
+ALTER TABLE public.registration_questions OWNER TO postgres;
 
 --
--- Name: events id; Type: DEFAULT; Schema: public; Owner: postgres
+-- Name: registration_questions_id_seq; Type: SEQUENCE; Schema: public; Owner: postgres
 --
 
-ALTER TABLE ONLY public.events ALTER COLUMN id SET DEFAULT nextval('public.events_id_seq'::regclass);
+CREATE SEQUENCE public.registration_questions_id_seq
+    AS integer
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1;
 
 
+ALTER SEQUENCE public.registration_questions_id_seq OWNER TO postgres;
+
 --
--- Name: organisations id; Type: DEFAULT; Schema: public; Owner: postgres
+-- Name: registration_questions_id_seq; Type: SEQUENCE OWNED BY; Schema: public; Owner: postgres
 --
 
-ALTER TABLE ONLY public.organisations ALTER COLUMN id SET DEFAULT nextval('public.organisations_id_seq'::regclass);
+ALTER SEQUENCE public.registration_questions_id_seq OWNED BY public.registration_questions.id;
 
 
 --
--- Name: purchases id; Type: DEFAULT; Schema: public; Owner: postgres
+-- Name: stripe_events; Type: TABLE; Schema: public; Owner: postgres
 --
 
-ALTER TABLE ONLY public.purchases ALTER COLUMN id SET DEFAULT nextval('public.purchases_id_seq'::regclass);
-
+CREATE TABLE public.stripe_events (
+    event_id text NOT NULL,
+    event_type text NOT NULL,
+    processed_at timestamp without time zone DEFAULT now()
+);
 
---
--- Name: ticket_types id; Type: DEFAULT; Schema: public; Owner: postgres
---
 
-ALTER TABLE ONLY public.ticket_types ALTER COLUMN id SET DEFAULT nextval('public.ticket_types_id_seq'::regclass);
+ALTER TABLE public.stripe_events OWNER TO postgres;
 
 
 --
--- Name: tickets id; Type: DEFAULT; Schema: public; Owner: postgres
+-- Name: ticket_answers; Type: TABLE; Schema: public; Owner: postgres
 --
 
-ALTER TABLE ONLY public.tickets ALTER COLUMN id SET DEFAULT nextval('public.tickets_id_seq'::regclass);
+CREATE TABLE public.ticket_answers (
+    id integer NOT NULL,
+    ticket_id integer NOT NULL,
+    question_id integer,
+    label text NOT NULL,
+    value text NOT NULL
+);
+
 
+ALTER TABLE public.ticket_answers OWNER TO postgres;
 
 --
--- Name: users id; Type: DEFAULT; Schema: public; Owner: postgres
+-- Name: ticket_answers_id_seq; Type: SEQUENCE; Schema: public; Owner: postgres
 --
 
-ALTER TABLE ONLY public.users ALTER COLUMN id SET DEFAULT nextval('public.users_id_seq'::regclass);
+CREATE SEQUENCE public.ticket_answers_id_seq
+    AS integer
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1;
 
 
+ALTER SEQUENCE public.ticket_answers_id_seq OWNER TO postgres;
+
 --
--- Name: event_images event_images_pkey; Type: CONSTRAINT; Schema: public; Owner: postgres
+-- Name: ticket_answers_id_seq; Type: SEQUENCE OWNED BY; Schema: public; Owner: postgres
 --
 
-ALTER TABLE ONLY public.event_images
-    ADD CONSTRAINT event_images_pkey PRIMARY KEY (id);
+ALTER SEQUENCE public.ticket_answers_id_seq OWNED BY public.ticket_answers.id;
 
 
 --
--- Name: events events_pkey; Type: CONSTRAINT; Schema: public; Owner: postgres
+-- Name: ticket_events; Type: TABLE; Schema: public; Owner: postgres
 --
 
-ALTER TABLE ONLY public.events
-    ADD CONSTRAINT events_pkey PRIMARY KEY (id);
+CREATE TABLE public.ticket_events (
+    id integer NOT NULL,
+    ticket_id integer NOT NULL,
+    from_status text,
+    to_status text NOT NULL,
+    actor_id integer,
+    reason text,
+    created_at timestamp without time zone DEFAULT now()
+);
 
 
+ALTER TABLE public.ticket_events OWNER TO postgres;
+
 --
--- Name: organisation_members organisation_members_pkey; Type: CONSTRAINT; Schema: public; Owner: postgres
+-- Name: ticket_events_id_seq; Type: SEQUENCE; Schema: public; Owner: postgres
 --
 
-ALTER TABLE ONLY public.organisation_members
-    ADD CONSTRAINT organisation_members_pkey PRIMARY KEY (user_id, organisation_id);
+CREATE SEQUENCE public.ticket_events_id_seq
+    AS integer
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1;
 
 
+ALTER SEQUENCE public.ticket_events_id_seq OWNER TO postgres;
+
 --
--- Name: organisations organisations_pkey; Type: CONSTRAINT; Schema: public; Owner: postgres
+-- Name: ticket_events_id_seq; Type: SEQUENCE OWNED BY; Schema: public; Owner: postgres
 --
 
-ALTER TABLE ONLY public.organisations
-    ADD CONSTRAINT organisations_pkey PRIMARY KEY (id);
+ALTER SEQUENCE public.ticket_events_id_seq OWNED BY public.ticket_events.id;
 
 
 --
--- Name: purchases purchases_pkey; Type: CONSTRAINT; Schema: public; Owner: postgres
+-- Name: ticket_lookup_tokens; Type: TABLE; Schema: public; Owner: postgres
 --
 
-ALTER TABLE ONLY public.purchases
-    ADD CONSTRAINT purchases_pkey PRIMARY KEY (id);
+CREATE TABLE public.ticket_lookup_tokens (
+    id integer NOT NULL,
+    user_id integer NOT NULL,
+    token_hash text,
+    created_at timestamp with time zone DEFAULT now() NOT NULL,
+    expires_at timestamp with time zone NOT NULL,
+    used_at timestamp with time zone
+);
 
 
+ALTER TABLE public.ticket_lookup_tokens OWNER TO postgres;
+
 --
--- Name: ticket_types ticket_types_pkey; Type: CONSTRAINT; Schema: public; Owner: postgres
+-- Name: ticket_lookup_tokens_id_seq; Type: SEQUENCE; Schema: public; Owner: postgres
 --
 
-ALTER TABLE ONLY public.ticket_types
-    ADD CONSTRAINT ticket_types_pkey PRIMARY KEY (id);
+CREATE SEQUENCE public.ticket_lookup_tokens_id_seq
+    AS integer
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1;
 
 
+ALTER SEQUENCE public.ticket_lookup_tokens_id_seq OWNER TO postgres;
+
 --
--- Name: tickets tickets_pkey; Type: CONSTRAINT; Schema: public; Owner: postgres
+-- Name: ticket_lookup_tokens_id_seq; Type: SEQUENCE OWNED BY; Schema: public; Owner: postgres
 --
 
-ALTER TABLE ONLY public.tickets
-    ADD CONSTRAINT tickets_pkey PRIMARY KEY (id);
+ALTER SEQUENCE public.ticket_lookup_tokens_id_seq OWNED BY public.ticket_lookup_tokens.id;
 
 
 --
--- Name: tickets tickets_qr_code_key; Type: CONSTRAINT; Schema: public; Owner: postgres
+-- Name: ticket_reminders; Type: TABLE; Schema: public; Owner: postgres
 --
 
-ALTER TABLE ONLY public.tickets
-    ADD CONSTRAINT tickets_qr_code_key UNIQUE (qr_code);
+CREATE TABLE public.ticket_reminders (
+    ticket_id integer NOT NULL,
+    offset_minutes integer NOT NULL,
+    created_at timestamp with time zone DEFAULT now() NOT NULL
+);
+
+
+ALTER TABLE public.ticket_reminders OWNER TO postgres;
 
 
 --
--- Name: users users_email_key; Type: CONSTRAINT; Schema: public; Owner: postgres
+-- Name: ticket_scans; Type: TABLE; Schema: public; Owner: postgres
 --
 
-ALTER TABLE ONLY public.users
-    ADD CONSTRAINT users_email_key UNIQUE (email);
+CREATE TABLE public.ticket_scans (
+    id integer NOT NULL,
+    ticket_id integer NOT NULL,
+    scan_id text,
+    device_id text,
+    scanned_by integer,
+    scanned_at timestamp without time zone NOT NULL,
+    gate text,
+    outcome text NOT NULL,
+    synced_at timestamp without time zone DEFAULT now()
+);
+
 
+ALTER TABLE public.ticket_scans OWNER TO postgres;
 
 --
--- Name: users users_pkey; Type: CONSTRAINT; Schema: public; Owner: postgres
+-- Name: ticket_scans_id_seq; Type: SEQUENCE; Schema: public; Owner: postgres
 --
 
-ALTER TABLE ONLY public.users
-    ADD CONSTRAINT users_pkey PRIMARY KEY (id);
+CREATE SEQUENCE public.ticket_scans_id_seq
+    AS integer
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1;
+
 
+ALTER SEQUENCE public.ticket_scans_id_seq OWNER TO postgres;
 
 --
--- Name: event_images event_images_event_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: postgres
+-- Name: ticket_scans_id_seq; Type: SEQUENCE OWNED BY; Schema: public; Owner: postgres
 --
 
-ALTER TABLE ONLY public.event_images
-    ADD CONSTRAINT event_images_event_id_fkey FOREIGN KEY (event_id) REFERENCES public.events(id) ON DELETE CASCADE;
+ALTER SEQUENCE public.ticket_scans_id_seq OWNED BY public.ticket_scans.id;
 
 
 --
--- Name: events events_organisation_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: postgres
+-- Name: ticket_transfers; Type: TABLE; Schema: public; Owner: postgres
+--
+
+CREATE TABLE public.ticket_transfers (
+    id integer NOT NULL,
+    ticket_id integer NOT NULL,
+    from_user_id integer,
+    to_email text NOT NULL,
+    token_hash text,
+    status text DEFAULT 'pending'::text NOT NULL,
+    new_ticket_id integer,
+    created_at timestamp without time zone DEFAULT now(),
+    expires_at timestamp without time zone NOT NULL,
+    accepted_at timestamp without time zone
+);
+
+
+ALTER TABLE public.ticket_transfers OWNER TO postgres;
+
+--
+-- Name: ticket_transfers_id_seq; Type: SEQUENCE; Schema: public; Owner: postgres
+--
+
+CREATE SEQUENCE public.ticket_transfers_id_seq
+    AS integer
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1;
+
+
+ALTER SEQUENCE public.ticket_transfers_id_seq OWNER TO postgres;
+
+--
+-- Name: ticket_transfers_id_seq; Type: SEQUENCE OWNED BY; Schema: public; Owner: postgres
+--
+
+ALTER SEQUENCE public.ticket_transfers_id_seq OWNED BY public.ticket_transfers.id;
+
+
+--
+-- Name: ticket_types; Type: TABLE; Schema: public; Owner: postgres
+--
+
+CREATE TABLE public.ticket_types (
+    id integer NOT NULL,
+    event_id integer,
+    name text NOT NULL,
+    price numeric(10,2) NOT NULL,
+    total_quantity integer NOT NULL,
+    sold_quantity integer DEFAULT 0,
+    sale_start timestamp without time zone,
+    sale_end timestamp without time zone,
+    CONSTRAINT ticket_types_sold_quantity_check CHECK (((sold_quantity >= 0) AND (sold_quantity <= total_quantity)))
+);
+
+
+ALTER TABLE public.ticket_types OWNER TO postgres;
+
+--
+-- Name: ticket_types_id_seq; Type: SEQUENCE; Schema: public; Owner: postgres
+--
+
+CREATE SEQUENCE public.ticket_types_id_seq
+    AS integer
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1;
+
+
+ALTER SEQUENCE public.ticket_types_id_seq OWNER TO postgres;
+
+--
+-- Name: ticket_types_id_seq; Type: SEQUENCE OWNED BY; Schema: public; Owner: postgres
+--
+
+ALTER SEQUENCE public.ticket_types_id_seq OWNED BY public.ticket_types.id;
+
+
+--
+-- Name: tickets; Type: TABLE; Schema: public; Owner: postgres
+--
+
+CREATE TABLE public.tickets (
+    id integer NOT NULL,
+    ticket_type_id integer,
+    user_id integer,
+    purchase_id integer,
+    qr_code text,
+    status text DEFAULT 'valid'::text,
+    created_at timestamp without time zone DEFAULT now(),
+    refund_id integer,
+    redeemed_at timestamp without time zone,
+    redeemed_by integer,
+    redeemed_gate text,
+    CONSTRAINT tickets_status_check CHECK ((status = ANY (ARRAY['valid'::text, 'redeemed'::text, 'voided'::text, 'transferred'::text, 'refunded'::text, 'disputed'::text]))),
+    attendee_name text,
+    attendee_email text
+);
+
+
+ALTER TABLE public.tickets OWNER TO postgres;
+
+--
+-- Name: tickets_id_seq; Type: SEQUENCE; Schema: public; Owner: postgres
+--
+
+CREATE SEQUENCE public.tickets_id_seq
+    AS integer
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1;
+
+
+ALTER SEQUENCE public.tickets_id_seq OWNER TO postgres;
+
+--
+-- Name: tickets_id_seq; Type: SEQUENCE OWNED BY; Schema: public; Owner: postgres
+--
+
+ALTER SEQUENCE public.tickets_id_seq OWNED BY public.tickets.id;
+
+
+--
+-- Name: users; Type: TABLE; Schema: public; Owner: postgres
+--
+
+CREATE TABLE public.users (
+    id integer NOT NULL,
+    email text NOT NULL,
+    first_name text,
+    last_name text,
+    role text DEFAULT 'customer'::text,
+    created_at timestamp without time zone DEFAULT now(),
+    password_hash text NOT NULL
+);
+
+
+ALTER TABLE public.users OWNER TO postgres;
+
+--
+-- Name: users_id_seq; Type: SEQUENCE; Schema: public; Owner: postgres
+--
+
+CREATE SEQUENCE public.users_id_seq
+    AS integer
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1;
+
+
+ALTER SEQUENCE public.users_id_seq OWNER TO postgres;
+
+--
+-- Name: users_id_seq; Type: SEQUENCE OWNED BY; Schema: public; Owner: postgres
+--
+
+ALTER SEQUENCE public.users_id_seq OWNED BY public.users.id;
+
+
+--
+-- Name: broadcast_recipients id; Type: DEFAULT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.broadcast_recipients ALTER COLUMN id SET DEFAULT nextval('public.broadcast_recipients_id_seq'::regclass);
+
+
+--
+-- Name: broadcasts id; Type: DEFAULT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.broadcasts ALTER COLUMN id SET DEFAULT nextval('public.broadcasts_id_seq'::regclass);
+
+
+--
+-- Name: disputes id; Type: DEFAULT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.disputes ALTER COLUMN id SET DEFAULT nextval('public.disputes_id_seq'::regclass);
+
+
+--
+-- Name: event_images id; Type: DEFAULT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.event_images ALTER COLUMN id SET DEFAULT nextval('public.event_images_id_seq'::regclass);
+
+
+--
+-- Name: events id; Type: DEFAULT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.events ALTER COLUMN id SET DEFAULT nextval('public.events_id_seq'::regclass);
+
+
+--
+-- Name: organisations id; Type: DEFAULT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.organisations ALTER COLUMN id SET DEFAULT nextval('public.organisations_id_seq'::regclass);
+
+
+--
+-- Name: outbox id; Type: DEFAULT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.outbox ALTER COLUMN id SET DEFAULT nextval('public.outbox_id_seq'::regclass);
+
+
+--
+-- Name: purchase_items id; Type: DEFAULT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.purchase_items ALTER COLUMN id SET DEFAULT nextval('public.purchase_items_id_seq'::regclass);
+
+
+--
+-- Name: purchases id; Type: DEFAULT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.purchases ALTER COLUMN id SET DEFAULT nextval('public.purchases_id_seq'::regclass);
+
+
+--
+-- Name: refunds id; Type: DEFAULT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.refunds ALTER COLUMN id SET DEFAULT nextval('public.refunds_id_seq'::regclass);
+
+
+--
+-- Name: registration_questions id; Type: DEFAULT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.registration_questions ALTER COLUMN id SET DEFAULT nextval('public.registration_questions_id_seq'::regclass);
+
+
+--
+-- Name: ticket_answers id; Type: DEFAULT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.ticket_answers ALTER COLUMN id SET DEFAULT nextval('public.ticket_answers_id_seq'::regclass);
+
+
+--
+-- Name: ticket_events id; Type: DEFAULT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.ticket_events ALTER COLUMN id SET DEFAULT nextval('public.ticket_events_id_seq'::regclass);
+
+
+--
+-- Name: ticket_lookup_tokens id; Type: DEFAULT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.ticket_lookup_tokens ALTER COLUMN id SET DEFAULT nextval('public.ticket_lookup_tokens_id_seq'::regclass);
+
+
+--
+-- Name: ticket_scans id; Type: DEFAULT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.ticket_scans ALTER COLUMN id SET DEFAULT nextval('public.ticket_scans_id_seq'::regclass);
+
+
+--
+-- Name: ticket_transfers id; Type: DEFAULT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.ticket_transfers ALTER COLUMN id SET DEFAULT nextval('public.ticket_transfers_id_seq'::regclass);
+
+
+--
+-- Name: ticket_types id; Type: DEFAULT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.ticket_types ALTER COLUMN id SET DEFAULT nextval('public.ticket_types_id_seq'::regclass);
+
+
+--
+-- Name: tickets id; Type: DEFAULT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.tickets ALTER COLUMN id SET DEFAULT nextval('public.tickets_id_seq'::regclass);
+
+
+--
+-- Name: users id; Type: DEFAULT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.users ALTER COLUMN id SET DEFAULT nextval('public.users_id_seq'::regclass);
+
+
+--
+-- Name: broadcast_recipients broadcast_recipients_broadcast_id_email_key; Type: CONSTRAINT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.broadcast_recipients
+    ADD CONSTRAINT broadcast_recipients_broadcast_id_email_key UNIQUE (broadcast_id, email);
+
+
+--
+-- Name: broadcast_recipients broadcast_recipients_pkey; Type: CONSTRAINT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.broadcast_recipients
+    ADD CONSTRAINT broadcast_recipients_pkey PRIMARY KEY (id);
+
+
+--
+-- Name: broadcasts broadcasts_pkey; Type: CONSTRAINT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.broadcasts
+    ADD CONSTRAINT broadcasts_pkey PRIMARY KEY (id);
+
+
+--
+-- Name: disputes disputes_gateway_dispute_id_key; Type: CONSTRAINT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.disputes
+    ADD CONSTRAINT disputes_gateway_dispute_id_key UNIQUE (gateway_dispute_id);
+
+
+--
+-- Name: disputes disputes_pkey; Type: CONSTRAINT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.disputes
+    ADD CONSTRAINT disputes_pkey PRIMARY KEY (id);
+
+
+--
+-- Name: event_images event_images_pkey; Type: CONSTRAINT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.event_images
+    ADD CONSTRAINT event_images_pkey PRIMARY KEY (id);
+
+
+--
+-- Name: events events_pkey; Type: CONSTRAINT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.events
+    ADD CONSTRAINT events_pkey PRIMARY KEY (id);
+
+
+--
+-- Name: organisation_members organisation_members_pkey; Type: CONSTRAINT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.organisation_members
+    ADD CONSTRAINT organisation_members_pkey PRIMARY KEY (user_id, organisation_id);
+
+
+--
+-- Name: organisations organisations_pkey; Type: CONSTRAINT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.organisations
+    ADD CONSTRAINT organisations_pkey PRIMARY KEY (id);
+
+
+--
+-- Name: outbox outbox_pkey; Type: CONSTRAINT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.outbox
+    ADD CONSTRAINT outbox_pkey PRIMARY KEY (id);
+
+
+--
+-- Name: purchase_items purchase_items_pkey; Type: CONSTRAINT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.purchase_items
+    ADD CONSTRAINT purchase_items_pkey PRIMARY KEY (id);
+
+
+--
+-- Name: purchases purchases_pkey; Type: CONSTRAINT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.purchases
+    ADD CONSTRAINT purchases_pkey PRIMARY KEY (id);
+
+
+--
+-- Name: refunds refunds_gateway_refund_id_key; Type: CONSTRAINT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.refunds
+    ADD CONSTRAINT refunds_gateway_refund_id_key UNIQUE (gateway_refund_id);
+
+
+--
+-- Name: refunds refunds_pkey; Type: CONSTRAINT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.refunds
+    ADD CONSTRAINT refunds_pkey PRIMARY KEY (id);
+
+
+--
+-- Name: registration_questions registration_questions_pkey; Type: CONSTRAINT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.registration_questions
+    ADD CONSTRAINT registration_questions_pkey PRIMARY KEY (id);
+
+
+--
+-- Name: stripe_events stripe_events_pkey; Type: CONSTRAINT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.stripe_events
+    ADD CONSTRAINT stripe_events_pkey PRIMARY KEY (event_id);
+
+
+--
+-- Name: ticket_answers ticket_answers_pkey; Type: CONSTRAINT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.ticket_answers
+    ADD CONSTRAINT ticket_answers_pkey PRIMARY KEY (id);
+
+
+--
+-- Name: ticket_answers ticket_answers_ticket_id_question_id_key; Type: CONSTRAINT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.ticket_answers
+    ADD CONSTRAINT ticket_answers_ticket_id_question_id_key UNIQUE (ticket_id, question_id);
+
+
+--
+-- Name: ticket_events ticket_events_pkey; Type: CONSTRAINT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.ticket_events
+    ADD CONSTRAINT ticket_events_pkey PRIMARY KEY (id);
+
+
+--
+-- Name: ticket_lookup_tokens ticket_lookup_tokens_pkey; Type: CONSTRAINT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.ticket_lookup_tokens
+    ADD CONSTRAINT ticket_lookup_tokens_pkey PRIMARY KEY (id);
+
+
+--
+-- Name: ticket_lookup_tokens ticket_lookup_tokens_token_hash_key; Type: CONSTRAINT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.ticket_lookup_tokens
+    ADD CONSTRAINT ticket_lookup_tokens_token_hash_key UNIQUE (token_hash);
+
+
+--
+-- Name: ticket_reminders ticket_reminders_pkey; Type: CONSTRAINT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.ticket_reminders
+    ADD CONSTRAINT ticket_reminders_pkey PRIMARY KEY (ticket_id, offset_minutes);
+
+
+--
+-- Name: ticket_scans ticket_scans_pkey; Type: CONSTRAINT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.ticket_scans
+    ADD CONSTRAINT ticket_scans_pkey PRIMARY KEY (id);
+
+
+--
+-- Name: ticket_scans ticket_scans_device_id_scan_id_key; Type: CONSTRAINT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.ticket_scans
+    ADD CONSTRAINT ticket_scans_device_id_scan_id_key UNIQUE (device_id, scan_id);
+
+
+--
+-- Name: ticket_transfers ticket_transfers_pkey; Type: CONSTRAINT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.ticket_transfers
+    ADD CONSTRAINT ticket_transfers_pkey PRIMARY KEY (id);
+
+
+--
+-- Name: ticket_transfers ticket_transfers_token_hash_key; Type: CONSTRAINT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.ticket_transfers
+    ADD CONSTRAINT ticket_transfers_token_hash_key UNIQUE (token_hash);
+
+
+--
+-- Name: ticket_types ticket_types_pkey; Type: CONSTRAINT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.ticket_types
+    ADD CONSTRAINT ticket_types_pkey PRIMARY KEY (id);
+
+
+--
+-- Name: tickets tickets_pkey; Type: CONSTRAINT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.tickets
+    ADD CONSTRAINT tickets_pkey PRIMARY KEY (id);
+
+
+--
+-- Name: tickets tickets_qr_code_key; Type: CONSTRAINT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.tickets
+    ADD CONSTRAINT tickets_qr_code_key UNIQUE (qr_code);
+
+
+--
+-- Name: users users_email_key; Type: CONSTRAINT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.users
+    ADD CONSTRAINT users_email_key UNIQUE (email);
+
+
+--
+-- Name: users users_pkey; Type: CONSTRAINT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.users
+    ADD CONSTRAINT users_pkey PRIMARY KEY (id);
+
+
+--
+-- Name: broadcasts_event_id_idx; Type: INDEX; Schema: public; Owner: postgres
+--
+
+CREATE INDEX broadcasts_event_id_idx ON public.broadcasts USING btree (event_id);
+
+
+--
+-- Name: outbox_status_run_at_idx; Type: INDEX; Schema: public; Owner: postgres
+--
+
+CREATE INDEX outbox_status_run_at_idx ON public.outbox USING btree (status, run_at);
+
+
+--
+-- Name: refunds_one_pending_per_purchase; Type: INDEX; Schema: public; Owner: postgres
+--
+
+CREATE UNIQUE INDEX refunds_one_pending_per_purchase ON public.refunds USING btree (purchase_id) WHERE (status = 'pending'::text);
+
+
+--
+-- Name: registration_questions_event_id_idx; Type: INDEX; Schema: public; Owner: postgres
+--
+
+CREATE INDEX registration_questions_event_id_idx ON public.registration_questions USING btree (event_id);
+
+
+--
+-- Name: ticket_events_ticket_id_idx; Type: INDEX; Schema: public; Owner: postgres
+--
+
+CREATE INDEX ticket_events_ticket_id_idx ON public.ticket_events USING btree (ticket_id);
+
+
+--
+-- Name: ticket_lookup_tokens_user_id_created_at_idx; Type: INDEX; Schema: public; Owner: postgres
+--
+
+CREATE INDEX ticket_lookup_tokens_user_id_created_at_idx ON public.ticket_lookup_tokens USING btree (user_id, created_at);
+
+
+--
+-- Name: ticket_scans_ticket_id_idx; Type: INDEX; Schema: public; Owner: postgres
+--
+
+CREATE INDEX ticket_scans_ticket_id_idx ON public.ticket_scans USING btree (ticket_id);
+
+
+--
+-- Name: ticket_transfers_pending_ticket_idx; Type: INDEX; Schema: public; Owner: postgres
+--
+
+CREATE UNIQUE INDEX ticket_transfers_pending_ticket_idx ON public.ticket_transfers USING btree (ticket_id) WHERE (status = 'pending'::text);
+
+
+--
+-- Name: broadcast_recipients broadcast_recipients_broadcast_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.broadcast_recipients
+    ADD CONSTRAINT broadcast_recipients_broadcast_id_fkey FOREIGN KEY (broadcast_id) REFERENCES public.broadcasts(id) ON DELETE CASCADE;
+
+
+--
+-- Name: broadcast_recipients broadcast_recipients_user_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.broadcast_recipients
+    ADD CONSTRAINT broadcast_recipients_user_id_fkey FOREIGN KEY (user_id) REFERENCES public.users(id) ON DELETE SET NULL;
+
+
+--
+-- Name: broadcasts broadcasts_event_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.broadcasts
+    ADD CONSTRAINT broadcasts_event_id_fkey FOREIGN KEY (event_id) REFERENCES public.events(id) ON DELETE CASCADE;
+
+
+--
+-- Name: broadcasts broadcasts_sent_by_fkey; Type: FK CONSTRAINT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.broadcasts
+    ADD CONSTRAINT broadcasts_sent_by_fkey FOREIGN KEY (sent_by) REFERENCES public.users(id) ON DELETE SET NULL;
+
+
+--
+-- Name: broadcasts broadcasts_ticket_type_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.broadcasts
+    ADD CONSTRAINT broadcasts_ticket_type_id_fkey FOREIGN KEY (ticket_type_id) REFERENCES public.ticket_types(id) ON DELETE SET NULL;
+
+
+--
+-- Name: disputes disputes_purchase_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.disputes
+    ADD CONSTRAINT disputes_purchase_id_fkey FOREIGN KEY (purchase_id) REFERENCES public.purchases(id) ON DELETE CASCADE;
+
+
+--
+-- Name: event_images event_images_event_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.event_images
+    ADD CONSTRAINT event_images_event_id_fkey FOREIGN KEY (event_id) REFERENCES public.events(id) ON DELETE CASCADE;
+
+
+--
+-- Name: events events_organisation_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: postgres
 --
 
 ALTER TABLE ONLY public.events
@@ -474,6 +1369,22 @@ ALTER TABLE ONLY public.organisation_members
     ADD CONSTRAINT organisation_members_user_id_fkey FOREIGN KEY (user_id) REFERENCES public.users(id);
 
 
+--
+-- Name: purchase_items purchase_items_purchase_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.purchase_items
+    ADD CONSTRAINT purchase_items_purchase_id_fkey FOREIGN KEY (purchase_id) REFERENCES public.purchases(id) ON DELETE CASCADE;
+
+
+--
+-- Name: purchase_items purchase_items_ticket_type_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.purchase_items
+    ADD CONSTRAINT purchase_items_ticket_type_id_fkey FOREIGN KEY (ticket_type_id) REFERENCES public.ticket_types(id);
+
+
 --
 -- Name: purchases purchases_event_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: postgres
 --
@@ -490,6 +1401,126 @@ ALTER TABLE ONLY public.purchases
     ADD CONSTRAINT purchases_user_id_fkey FOREIGN KEY (user_id) REFERENCES public.users(id);
 
 
+--
+-- Name: refunds refunds_created_by_fkey; Type: FK CONSTRAINT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.refunds
+    ADD CONSTRAINT refunds_created_by_fkey FOREIGN KEY (created_by) REFERENCES public.users(id);
+
+
+--
+-- Name: refunds refunds_purchase_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.refunds
+    ADD CONSTRAINT refunds_purchase_id_fkey FOREIGN KEY (purchase_id) REFERENCES public.purchases(id) ON DELETE CASCADE;
+
+
+--
+-- Name: registration_questions registration_questions_event_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.registration_questions
+    ADD CONSTRAINT registration_questions_event_id_fkey FOREIGN KEY (event_id) REFERENCES public.events(id) ON DELETE CASCADE;
+
+
+--
+-- Name: registration_questions registration_questions_ticket_type_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.registration_questions
+    ADD CONSTRAINT registration_questions_ticket_type_id_fkey FOREIGN KEY (ticket_type_id) REFERENCES public.ticket_types(id) ON DELETE CASCADE;
+
+
+--
+-- Name: ticket_answers ticket_answers_question_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.ticket_answers
+    ADD CONSTRAINT ticket_answers_question_id_fkey FOREIGN KEY (question_id) REFERENCES public.registration_questions(id) ON DELETE SET NULL;
+
+
+--
+-- Name: ticket_answers ticket_answers_ticket_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.ticket_answers
+    ADD CONSTRAINT ticket_answers_ticket_id_fkey FOREIGN KEY (ticket_id) REFERENCES public.tickets(id) ON DELETE CASCADE;
+
+
+--
+-- Name: ticket_events ticket_events_actor_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.ticket_events
+    ADD CONSTRAINT ticket_events_actor_id_fkey FOREIGN KEY (actor_id) REFERENCES public.users(id);
+
+
+--
+-- Name: ticket_events ticket_events_ticket_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.ticket_events
+    ADD CONSTRAINT ticket_events_ticket_id_fkey FOREIGN KEY (ticket_id) REFERENCES public.tickets(id);
+
+
+--
+-- Name: ticket_lookup_tokens ticket_lookup_tokens_user_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.ticket_lookup_tokens
+    ADD CONSTRAINT ticket_lookup_tokens_user_id_fkey FOREIGN KEY (user_id) REFERENCES public.users(id) ON DELETE CASCADE;
+
+
+--
+-- Name: ticket_reminders ticket_reminders_ticket_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.ticket_reminders
+    ADD CONSTRAINT ticket_reminders_ticket_id_fkey FOREIGN KEY (ticket_id) REFERENCES public.tickets(id) ON DELETE CASCADE;
+
+
+--
+-- Name: ticket_scans ticket_scans_scanned_by_fkey; Type: FK CONSTRAINT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.ticket_scans
+    ADD CONSTRAINT ticket_scans_scanned_by_fkey FOREIGN KEY (scanned_by) REFERENCES public.users(id);
+
+
+--
+-- Name: ticket_scans ticket_scans_ticket_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.ticket_scans
+    ADD CONSTRAINT ticket_scans_ticket_id_fkey FOREIGN KEY (ticket_id) REFERENCES public.tickets(id);
+
+
+--
+-- Name: ticket_transfers ticket_transfers_from_user_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.ticket_transfers
+    ADD CONSTRAINT ticket_transfers_from_user_id_fkey FOREIGN KEY (from_user_id) REFERENCES public.users(id);
+
+
+--
+-- Name: ticket_transfers ticket_transfers_new_ticket_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.ticket_transfers
+    ADD CONSTRAINT ticket_transfers_new_ticket_id_fkey FOREIGN KEY (new_ticket_id) REFERENCES public.tickets(id);
+
+
+--
+-- Name: ticket_transfers ticket_transfers_ticket_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.ticket_transfers
+    ADD CONSTRAINT ticket_transfers_ticket_id_fkey FOREIGN KEY (ticket_id) REFERENCES public.tickets(id);
+
+
 --
 -- Name: ticket_types ticket_types_event_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: postgres
 --
@@ -506,6 +1537,22 @@ ALTER TABLE ONLY public.tickets
     ADD CONSTRAINT tickets_purchase_id_fkey FOREIGN KEY (purchase_id) REFERENCES public.purchases(id);
 
 
+--
+-- Name: tickets tickets_redeemed_by_fkey; Type: FK CONSTRAINT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.tickets
+    ADD CONSTRAINT tickets_redeemed_by_fkey FOREIGN KEY (redeemed_by) REFERENCES public.users(id);
+
+
+--
+-- Name: tickets tickets_refund_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.tickets
+    ADD CONSTRAINT tickets_refund_id_fkey FOREIGN KEY (refund_id) REFERENCES public.refunds(id);
+
+
 --
 -- Name: tickets tickets_ticket_type_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: postgres
 --
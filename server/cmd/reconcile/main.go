@@ -0,0 +1,60 @@
+// Command reconcile lists recent purchases whose status disagrees with
+// Stripe's record of their checkout session, such as paid sessions whose
+// webhook never arrived or purchases held for review. It exits with status 1
+// if it finds any, so it can run from cron.
+//
+//	go run ./cmd/reconcile -since 72h
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/joho/godotenv"
+	"github.com/stripe/stripe-go/v83"
+
+	"github.com/tpgcig/carneauengine/server/db"
+	"github.com/tpgcig/carneauengine/server/handlers"
+	"github.com/tpgcig/carneauengine/server/payment"
+)
+
+func main() {
+	since := flag.Duration("since", 72*time.Hour, "how far back to check purchases")
+	flag.Parse()
+
+	if err := godotenv.Load(); err != nil {
+		log.Println("No .env file found")
+	}
+	stripe.Key = os.Getenv("STRIPE_SECRET_KEY")
+
+	conn, err := db.Connect()
+	if err != nil {
+		log.Fatalf("DB connection failed: %v", err)
+	}
+	defer conn.Close()
+
+	h := &handlers.Handler{DB: conn, Payments: payment.NewStripeGateway(os.Getenv("STRIPE_WEBHOOK_SECRET"))}
+
+	issues, err := h.ReconcilePurchases(context.Background(), time.Now().Add(-*since))
+	if err != nil {
+		log.Fatalf("Reconciliation failed: %v", err)
+	}
+	if len(issues) == 0 {
+		fmt.Println("All purchases agree with Stripe.")
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "PURCHASE\tSESSION\tSTATUS\tSESSION STATUS\tEXPECTED\tPAID\tREASON")
+	for _, i := range issues {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			i.PurchaseID, i.SessionID, i.PaymentStatus, i.SessionStatus, i.Expected, i.Paid, i.Reason)
+	}
+	w.Flush()
+	os.Exit(1)
+}
@@ -0,0 +1,31 @@
+// Command ticketkey generates a key for signing ticket QR codes. It prints the
+// TICKET_SIGNING_KEY to configure and, for when the key is later retired, the
+// entry to add to TICKET_VERIFY_KEYS.
+//
+//	go run ./cmd/ticketkey -id 2026-10
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+
+	"github.com/tpgcig/carneauengine/server/qrtoken"
+)
+
+func main() {
+	keyID := flag.String("id", "", "key ID printed in each token, e.g. the month it comes into use")
+	flag.Parse()
+
+	signer, err := qrtoken.GenerateSigner(*keyID)
+	if err != nil {
+		log.Fatal(err)
+	}
+	keys := qrtoken.NewKeyring()
+	if err := keys.Add(signer.KeyID(), signer.PublicKey()); err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Printf("TICKET_SIGNING_KEY=%s\n", signer)
+	fmt.Printf("# Once retired, add to TICKET_VERIFY_KEYS: %s:%s\n", signer.KeyID(), keys.PublicKeys()[signer.KeyID()])
+}
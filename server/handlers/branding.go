@@ -0,0 +1,165 @@
+package handlers
+
+import (
+	"context"
+	"encoding/base64"
+	"html/template"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+	"github.com/skip2/go-qrcode"
+
+	"github.com/tpgcig/carneauengine/server/mailer"
+)
+
+// EmailBranding is how an organisation's emails look and who they come from.
+// Empty fields use the Carneau Engine defaults.
+type EmailBranding struct {
+	SenderName  string `json:"sender_name" binding:"max=100"`
+	ReplyTo     string `json:"reply_to" binding:"omitempty,email"`
+	LogoURL     string `json:"logo_url" binding:"omitempty,url,startswith=https://"`
+	BrandColour string `json:"brand_colour" binding:"omitempty,hexcolor"`
+	Footer      string `json:"footer" binding:"max=1000"`
+}
+
+func (b EmailBranding) mailer() mailer.Branding {
+	return mailer.Branding{
+		SenderName: b.SenderName,
+		ReplyTo:    b.ReplyTo,
+		LogoURL:    b.LogoURL,
+		Colour:     b.BrandColour,
+		Footer:     b.Footer,
+	}
+}
+
+const brandingColumns = `COALESCE(o.email_sender_name, ''), COALESCE(o.email_reply_to, ''), COALESCE(o.email_logo_url, ''),
+	COALESCE(o.email_brand_colour, ''), COALESCE(o.email_footer, '')`
+
+func scanBranding(row pgx.Row) (EmailBranding, error) {
+	var b EmailBranding
+	err := row.Scan(&b.SenderName, &b.ReplyTo, &b.LogoURL, &b.BrandColour, &b.Footer)
+	return b, err
+}
+
+// eventBranding returns the email branding of the organisation running an
+// event.
+func (h *Handler) eventBranding(ctx context.Context, eventID int) (mailer.Branding, error) {
+	b, err := scanBranding(h.DB.QueryRow(ctx,
+		"SELECT "+brandingColumns+" FROM events e JOIN organisations o ON o.id = e.organisation_id WHERE e.id = $1", eventID))
+	if err == pgx.ErrNoRows {
+		return mailer.Branding{}, nil
+	}
+	return b.mailer(), err
+}
+
+// organisationIDParam parses the :id of an organisation route and checks the
+// authenticated user is a member. It writes the error response itself and
+// returns false if not.
+func (h *Handler) organisationIDParam(c *gin.Context) (int, bool) {
+	orgID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid organisation ID"})
+		return 0, false
+	}
+	return orgID, h.authorizeOrganisationMember(c, orgID)
+}
+
+// GetEmailBranding returns an organisation's email branding.
+func (h *Handler) GetEmailBranding(c *gin.Context) {
+	orgID, ok := h.organisationIDParam(c)
+	if !ok {
+		return
+	}
+	b, err := scanBranding(h.DB.QueryRow(c.Request.Context(), "SELECT "+brandingColumns+" FROM organisations o WHERE o.id = $1", orgID))
+	if err != nil {
+		log.Printf("Error loading email branding of organisation %d: %v", orgID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load email branding"})
+		return
+	}
+	c.JSON(http.StatusOK, b)
+}
+
+// UpdateEmailBranding replaces an organisation's email branding.
+func (h *Handler) UpdateEmailBranding(c *gin.Context) {
+	var req EmailBranding
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	orgID, ok := h.organisationIDParam(c)
+	if !ok {
+		return
+	}
+	req.SenderName = strings.TrimSpace(req.SenderName)
+	req.Footer = strings.TrimSpace(req.Footer)
+
+	_, err := h.DB.Exec(c.Request.Context(), `
+		UPDATE organisations
+		SET email_sender_name = NULLIF($2, ''), email_reply_to = NULLIF($3, ''), email_logo_url = NULLIF($4, ''),
+			email_brand_colour = NULLIF($5, ''), email_footer = NULLIF($6, '')
+		WHERE id = $1`,
+		orgID, req.SenderName, req.ReplyTo, req.LogoURL, req.BrandColour, req.Footer)
+	if err != nil {
+		log.Printf("Error updating email branding of organisation %d: %v", orgID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update email branding"})
+		return
+	}
+	log.Printf("Email branding of organisation %d updated by user %d", orgID, c.GetInt("userID"))
+	c.JSON(http.StatusOK, req)
+}
+
+// PreviewEmail renders the ticket confirmation email as an organisation's
+// buyers would get it, for a sample order. The QR code is inlined as a data
+// URL so the HTML shows as it is.
+func (h *Handler) PreviewEmail(c *gin.Context) {
+	orgID, ok := h.organisationIDParam(c)
+	if !ok {
+		return
+	}
+	ctx := c.Request.Context()
+	b, err := scanBranding(h.DB.QueryRow(ctx, "SELECT "+brandingColumns+" FROM organisations o WHERE o.id = $1", orgID))
+	if err != nil {
+		log.Printf("Error loading email branding of organisation %d: %v", orgID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load email branding"})
+		return
+	}
+
+	sample := ticketEmail{
+		Recipient: "attendee@example.com",
+		Event:     emailEvent{Title: "Sample Event", Location: "Sample Venue", StartTime: time.Now().Add(7 * 24 * time.Hour).Truncate(time.Hour)},
+		Tickets:   []emailTicket{{TypeName: "General Admission", QR: "SAMPLE-TICKET"}},
+	}
+	// Their next event, if they have one, makes it look more like the real thing
+	h.DB.QueryRow(ctx, `
+		SELECT title, COALESCE(location, ''), start_time FROM events
+		WHERE organisation_id = $1 AND start_time > now()
+		ORDER BY start_time LIMIT 1`, orgID,
+	).Scan(&sample.Event.Title, &sample.Event.Location, &sample.Event.StartTime)
+	if png, err := qrcode.Encode(sample.Tickets[0].QR, qrcode.Medium, 256); err == nil {
+		sample.Tickets[0].ImageSrc = template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(png))
+	}
+
+	content, err := mailer.Render("ticket_confirmation", b.mailer(), sample)
+	if err != nil {
+		log.Printf("Error rendering email preview for organisation %d: %v", orgID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to render preview"})
+		return
+	}
+	if c.Query("format") == "html" {
+		c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(content.HTML))
+		return
+	}
+	msg := content.Message(sample.Recipient)
+	c.JSON(http.StatusOK, gin.H{
+		"sender_name": msg.From.Name, // empty for the default sender
+		"reply_to":    msg.ReplyTo,
+		"subject":     msg.Subject,
+		"text":        msg.Text,
+		"html":        msg.HTML,
+	})
+}
@@ -0,0 +1,94 @@
+package handlers_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/tpgcig/carneauengine/server/handlers"
+)
+
+func newBrandingRouter(db *pgxpool.Pool, organiserID int) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	h := &handlers.Handler{DB: db}
+	r := gin.New()
+	organiser := r.Group("/", func(c *gin.Context) {
+		c.Set("userID", organiserID)
+		c.Set("userRole", "organizer")
+	})
+	organiser.GET("/api/organisations/:id/email-branding", h.GetEmailBranding)
+	organiser.PUT("/api/organisations/:id/email-branding", h.UpdateEmailBranding)
+	organiser.GET("/api/organisations/:id/email-preview", h.PreviewEmail)
+	return r
+}
+
+func putBranding(r *gin.Engine, orgID int, b handlers.EmailBranding) *httptest.ResponseRecorder {
+	body, _ := json.Marshal(b)
+	req := httptest.NewRequest(http.MethodPut, fmt.Sprintf("/api/organisations/%d/email-branding", orgID), bytes.NewReader(body))
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestEmailBranding(t *testing.T) {
+	db := newTestDB(t)
+	f := newCheckoutFixture(t, db, 1)
+	r := newBrandingRouter(db, newOrganiser(t, db, f.orgID))
+
+	brand := handlers.EmailBranding{
+		SenderName:  "Webhook Test Org",
+		ReplyTo:     "hello@example.com",
+		LogoURL:     "https://example.com/logo.png",
+		BrandColour: "#ff6600",
+		Footer:      "1 High Street",
+	}
+	if w := putBranding(r, f.orgID, brand); w.Code != http.StatusOK {
+		t.Fatalf("update: expected 200, got %d: %s", w.Code, w.Body)
+	}
+	bad := brand
+	bad.BrandColour = "orange; background: url(x)"
+	if w := putBranding(r, f.orgID, bad); w.Code != http.StatusBadRequest {
+		t.Errorf("bad colour: expected 400, got %d", w.Code)
+	}
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, fmt.Sprintf("/api/organisations/%d/email-branding", f.orgID), nil))
+	var got handlers.EmailBranding
+	json.Unmarshal(w.Body.Bytes(), &got)
+	if got != brand {
+		t.Errorf("expected the branding back, got %+v", got)
+	}
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, fmt.Sprintf("/api/organisations/%d/email-preview", f.orgID), nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("preview: expected 200, got %d: %s", w.Code, w.Body)
+	}
+	var preview struct {
+		SenderName string `json:"sender_name"`
+		ReplyTo    string `json:"reply_to"`
+		HTML       string `json:"html"`
+		Text       string `json:"text"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &preview)
+	if preview.SenderName != brand.SenderName || preview.ReplyTo != brand.ReplyTo {
+		t.Errorf("preview: expected the branded sender, got %+v", preview)
+	}
+	for _, want := range []string{brand.LogoURL, brand.BrandColour, brand.Footer, "data:image/png;base64,"} {
+		if !strings.Contains(preview.HTML, want) {
+			t.Errorf("preview: expected %q in the HTML", want)
+		}
+	}
+
+	outsider := newBrandingRouter(db, newOrganiser(t, db, 0))
+	if w := putBranding(outsider, f.orgID, brand); w.Code != http.StatusForbidden {
+		t.Errorf("non-member: expected 403, got %d", w.Code)
+	}
+}
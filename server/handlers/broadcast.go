@@ -0,0 +1,381 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+
+	"github.com/tpgcig/carneauengine/server/mailer"
+	"github.com/tpgcig/carneauengine/server/outbox"
+)
+
+// Broadcast recipient statuses. A failed email is retried by the outbox, so
+// failed can still become sent; one that never does is dead in the outbox.
+const (
+	recipientQueued  = "queued"
+	recipientSent    = "sent"
+	recipientFailed  = "failed"
+	recipientSkipped = "skipped" // no mailer configured
+)
+
+// broadcastInterval spaces out a broadcast's emails, so a big event's go out
+// at a rate the mail server will take rather than all at once.
+const broadcastInterval = time.Second
+
+type BroadcastRequest struct {
+	Subject      string `json:"subject" binding:"required,max=200"`
+	Body         string `json:"body" binding:"required,max=10000"`
+	TicketTypeID *int   `json:"ticket_type_id"` // only holders of this ticket type
+	CheckedIn    *bool  `json:"checked_in"`     // only holders of tickets that are, or aren't, checked in
+}
+
+// BroadcastReport counts a broadcast's recipients by delivery status.
+type BroadcastReport struct {
+	Recipients int `json:"recipients"`
+	Queued     int `json:"queued"`
+	Sent       int `json:"sent"`
+	Failed     int `json:"failed"`
+	Skipped    int `json:"skipped"`
+}
+
+type Broadcast struct {
+	ID           int                  `json:"id"`
+	EventID      int                  `json:"event_id"`
+	SentBy       *int                 `json:"sent_by"`
+	Subject      string               `json:"subject"`
+	Body         string               `json:"body"`
+	TicketTypeID *int                 `json:"ticket_type_id"`
+	CheckedIn    *bool                `json:"checked_in"`
+	CreatedAt    time.Time            `json:"created_at"`
+	Report       BroadcastReport      `json:"report"`
+	Deliveries   []BroadcastRecipient `json:"deliveries,omitempty"`
+}
+
+type BroadcastRecipient struct {
+	Email     string     `json:"email"`
+	Status    string     `json:"status"`
+	Attempts  int        `json:"attempts"`
+	LastError *string    `json:"last_error"`
+	SentAt    *time.Time `json:"sent_at"`
+}
+
+type broadcastEmailJob struct {
+	RecipientID int `json:"recipient_id"`
+}
+
+// broadcastEmail is the data of the broadcast template.
+type broadcastEmail struct {
+	Subject string
+	Body    string
+	Event   emailEvent
+}
+
+const broadcastColumns = `b.id, b.event_id, b.sent_by, b.subject, b.body, b.ticket_type_id, b.checked_in, b.created_at,
+	count(r.id), count(*) FILTER (WHERE r.status = 'queued'), count(*) FILTER (WHERE r.status = 'sent'),
+	count(*) FILTER (WHERE r.status = 'failed'), count(*) FILTER (WHERE r.status = 'skipped')`
+
+func scanBroadcast(row pgx.Row) (Broadcast, error) {
+	var b Broadcast
+	err := row.Scan(&b.ID, &b.EventID, &b.SentBy, &b.Subject, &b.Body, &b.TicketTypeID, &b.CheckedIn, &b.CreatedAt,
+		&b.Report.Recipients, &b.Report.Queued, &b.Report.Sent, &b.Report.Failed, &b.Report.Skipped)
+	return b, err
+}
+
+// CreateBroadcast emails a message to an event's ticket holders, optionally
+// just those holding a ticket type or whose tickets are or aren't checked in.
+// Each holder gets one email, however many tickets they hold, queued
+// broadcastInterval apart.
+func (h *Handler) CreateBroadcast(c *gin.Context) {
+	eventID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid event ID"})
+		return
+	}
+	var req BroadcastRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	req.Subject = strings.TrimSpace(req.Subject)
+	req.Body = strings.TrimSpace(req.Body)
+	if req.Subject == "" || req.Body == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "subject and body are required"})
+		return
+	}
+	if !h.authorizeEventOrganiser(c, eventID) {
+		return
+	}
+	ctx := c.Request.Context()
+	userID := c.GetInt("userID")
+
+	if req.TicketTypeID != nil {
+		var ok bool
+		err := h.DB.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM ticket_types WHERE id = $1 AND event_id = $2)", *req.TicketTypeID, eventID).Scan(&ok)
+		if err != nil {
+			log.Printf("Error checking ticket type %d: %v", *req.TicketTypeID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to send broadcast"})
+			return
+		}
+		if !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Ticket type is not for this event"})
+			return
+		}
+	}
+
+	tx, err := h.DB.Begin(ctx)
+	if err != nil {
+		log.Printf("Error beginning broadcast transaction: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to send broadcast"})
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	var broadcastID int
+	err = tx.QueryRow(ctx, `
+		INSERT INTO broadcasts (event_id, sent_by, subject, body, ticket_type_id, checked_in)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id`,
+		eventID, userID, req.Subject, req.Body, req.TicketTypeID, req.CheckedIn,
+	).Scan(&broadcastID)
+	if err != nil {
+		log.Printf("Error creating broadcast for event %d: %v", eventID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to send broadcast"})
+		return
+	}
+
+	// Checked in means redeemed at the door
+	rows, err := tx.Query(ctx, `
+		INSERT INTO broadcast_recipients (broadcast_id, user_id, email)
+		SELECT DISTINCT ON (u.email) $1::int, u.id, u.email
+		FROM tickets t
+		JOIN ticket_types tt ON tt.id = t.ticket_type_id
+		JOIN users u ON u.id = t.user_id
+		WHERE tt.event_id = $2 AND t.status IN ('valid', 'redeemed')
+			AND ($3::int IS NULL OR t.ticket_type_id = $3)
+			AND ($4::boolean IS NULL OR (t.status = 'redeemed') = $4)
+		ORDER BY u.email
+		RETURNING id`,
+		broadcastID, eventID, req.TicketTypeID, req.CheckedIn)
+	if err != nil {
+		log.Printf("Error resolving recipients of broadcast %d: %v", broadcastID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to send broadcast"})
+		return
+	}
+	var recipientIDs []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			log.Printf("Error scanning recipient of broadcast %d: %v", broadcastID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to send broadcast"})
+			return
+		}
+		recipientIDs = append(recipientIDs, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		log.Printf("Error resolving recipients of broadcast %d: %v", broadcastID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to send broadcast"})
+		return
+	}
+	if len(recipientIDs) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No ticket holders match"})
+		return
+	}
+
+	for i, id := range recipientIDs {
+		if err := outbox.EnqueueAfter(ctx, tx, jobSendBroadcastEmail, broadcastEmailJob{RecipientID: id}, time.Duration(i)*broadcastInterval); err != nil {
+			log.Printf("Error queueing email to recipient %d of broadcast %d: %v", id, broadcastID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to send broadcast"})
+			return
+		}
+	}
+	if err := tx.Commit(ctx); err != nil {
+		log.Printf("Error committing broadcast %d: %v", broadcastID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to send broadcast"})
+		return
+	}
+
+	log.Printf("Broadcast %d for event %d queued by user %d to %d recipient(s)", broadcastID, eventID, userID, len(recipientIDs))
+	b, err := h.broadcast(ctx, eventID, broadcastID)
+	if err != nil {
+		log.Printf("Error loading broadcast %d: %v", broadcastID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load broadcast"})
+		return
+	}
+	c.JSON(http.StatusCreated, b)
+}
+
+// broadcast loads one of an event's broadcasts with its delivery report.
+func (h *Handler) broadcast(ctx context.Context, eventID, broadcastID int) (Broadcast, error) {
+	return scanBroadcast(h.DB.QueryRow(ctx, `
+		SELECT `+broadcastColumns+`
+		FROM broadcasts b
+		LEFT JOIN broadcast_recipients r ON r.broadcast_id = b.id
+		WHERE b.id = $1 AND b.event_id = $2
+		GROUP BY b.id`, broadcastID, eventID))
+}
+
+// GetBroadcasts lists an event's broadcasts, newest first, with their
+// delivery reports.
+func (h *Handler) GetBroadcasts(c *gin.Context) {
+	eventID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid event ID"})
+		return
+	}
+	if !h.authorizeEventOrganiser(c, eventID) {
+		return
+	}
+
+	rows, err := h.DB.Query(c.Request.Context(), `
+		SELECT `+broadcastColumns+`
+		FROM broadcasts b
+		LEFT JOIN broadcast_recipients r ON r.broadcast_id = b.id
+		WHERE b.event_id = $1
+		GROUP BY b.id
+		ORDER BY b.id DESC`, eventID)
+	if err != nil {
+		log.Printf("Error loading broadcasts of event %d: %v", eventID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load broadcasts"})
+		return
+	}
+	defer rows.Close()
+
+	broadcasts := []Broadcast{}
+	for rows.Next() {
+		b, err := scanBroadcast(rows)
+		if err != nil {
+			log.Printf("Error scanning broadcast: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load broadcasts"})
+			return
+		}
+		broadcasts = append(broadcasts, b)
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("Error loading broadcasts of event %d: %v", eventID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load broadcasts"})
+		return
+	}
+	c.JSON(http.StatusOK, broadcasts)
+}
+
+// GetBroadcast returns a broadcast's delivery report, with how delivery went
+// to each recipient.
+func (h *Handler) GetBroadcast(c *gin.Context) {
+	eventID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid event ID"})
+		return
+	}
+	broadcastID, err := strconv.Atoi(c.Param("broadcastId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid broadcast ID"})
+		return
+	}
+	if !h.authorizeEventOrganiser(c, eventID) {
+		return
+	}
+	ctx := c.Request.Context()
+
+	b, err := h.broadcast(ctx, eventID, broadcastID)
+	if err == pgx.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Broadcast not found"})
+		return
+	}
+	if err != nil {
+		log.Printf("Error loading broadcast %d: %v", broadcastID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load broadcast"})
+		return
+	}
+
+	rows, err := h.DB.Query(ctx, `
+		SELECT email, status, attempts, last_error, sent_at
+		FROM broadcast_recipients
+		WHERE broadcast_id = $1
+		ORDER BY email`, broadcastID)
+	if err != nil {
+		log.Printf("Error loading recipients of broadcast %d: %v", broadcastID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load broadcast"})
+		return
+	}
+	defer rows.Close()
+	b.Deliveries = []BroadcastRecipient{}
+	for rows.Next() {
+		var r BroadcastRecipient
+		if err := rows.Scan(&r.Email, &r.Status, &r.Attempts, &r.LastError, &r.SentAt); err != nil {
+			log.Printf("Error scanning recipient of broadcast %d: %v", broadcastID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load broadcast"})
+			return
+		}
+		b.Deliveries = append(b.Deliveries, r)
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("Error loading recipients of broadcast %d: %v", broadcastID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load broadcast"})
+		return
+	}
+	c.JSON(http.StatusOK, b)
+}
+
+// sendBroadcastEmail emails one recipient of a broadcast and records how it
+// went. It runs as an outbox job, so failures are recorded and returned to be
+// retried.
+func (h *Handler) sendBroadcastEmail(ctx context.Context, job broadcastEmailJob) error {
+	var email, status string
+	var eventID int
+	var data broadcastEmail
+	err := h.DB.QueryRow(ctx, `
+		SELECT r.email, r.status, b.subject, b.body, e.id, e.title, COALESCE(e.location, ''), e.start_time
+		FROM broadcast_recipients r
+		JOIN broadcasts b ON b.id = r.broadcast_id
+		JOIN events e ON e.id = b.event_id
+		WHERE r.id = $1`, job.RecipientID,
+	).Scan(&email, &status, &data.Subject, &data.Body, &eventID, &data.Event.Title, &data.Event.Location, &data.Event.StartTime)
+	if err == pgx.ErrNoRows {
+		return outbox.Permanent(fmt.Errorf("broadcast recipient %d not found", job.RecipientID))
+	}
+	if err != nil {
+		return fmt.Errorf("loading broadcast recipient %d: %w", job.RecipientID, err)
+	}
+	if status == recipientSent {
+		return nil
+	}
+
+	brand, err := h.eventBranding(ctx, eventID)
+	if err != nil {
+		return fmt.Errorf("loading email branding for event %d: %w", eventID, err)
+	}
+	content, err := mailer.Render("broadcast", brand, data)
+	if err != nil {
+		return outbox.Permanent(err)
+	}
+	sent, sendErr := h.sendMail(ctx, content.Message(email))
+
+	status, lastError := recipientSkipped, ""
+	switch {
+	case sendErr != nil:
+		status, lastError = recipientFailed, sendErr.Error()
+	case sent:
+		status = recipientSent
+	}
+	_, err = h.DB.Exec(ctx, `
+		UPDATE broadcast_recipients
+		SET status = $2, attempts = attempts + 1, last_error = NULLIF($3, ''),
+			sent_at = CASE WHEN $2 = 'sent' THEN now() END
+		WHERE id = $1`, job.RecipientID, status, lastError)
+	if err != nil {
+		log.Printf("Error recording delivery to broadcast recipient %d: %v", job.RecipientID, err)
+	}
+	if sendErr != nil {
+		return fmt.Errorf("sending broadcast email to %s: %w", email, sendErr)
+	}
+	return nil
+}
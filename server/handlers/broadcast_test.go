@@ -0,0 +1,128 @@
+package handlers_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	netmail "net/mail"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+
+	"github.com/tpgcig/carneauengine/server/handlers"
+	"github.com/tpgcig/carneauengine/server/mailer"
+	"github.com/tpgcig/carneauengine/server/outbox"
+)
+
+func TestBroadcast(t *testing.T) {
+	db := newTestDB(t)
+	ctx := context.Background()
+	f := newCheckoutFixture(t, db, 1)
+
+	// The buyer has a ticket not yet scanned, and has already let a friend in;
+	// another holder has been checked in, and a third's ticket was voided
+	var buyer, checkedIn string
+	mustQuery(t, db.QueryRow(ctx, "SELECT email FROM users WHERE id = $1", f.userID).Scan(&buyer))
+	holders := map[int]string{f.userID: "valid"}
+	for _, status := range []string{"redeemed", "voided"} {
+		var userID int
+		email := fmt.Sprintf("broadcast-%s@example.com", uuid.New())
+		mustQuery(t, db.QueryRow(ctx,
+			"INSERT INTO users (email, role, password_hash) VALUES ($1, 'guest', 'x') RETURNING id", email).Scan(&userID))
+		t.Cleanup(func() {
+			db.Exec(ctx, "DELETE FROM tickets WHERE user_id = $1", userID)
+			db.Exec(ctx, "DELETE FROM users WHERE id = $1", userID)
+		})
+		holders[userID] = status
+		if status == "redeemed" {
+			checkedIn = email
+		}
+	}
+	for userID, status := range holders {
+		_, err := db.Exec(ctx,
+			"INSERT INTO tickets (ticket_type_id, user_id, purchase_id, qr_code, status) VALUES ($1, $2, $3, $4, $5)",
+			f.ticketTypeID, userID, f.purchaseID, uuid.New().String(), status)
+		mustQuery(t, err)
+	}
+	_, err := db.Exec(ctx,
+		"INSERT INTO tickets (ticket_type_id, user_id, purchase_id, qr_code, status) VALUES ($1, $2, $3, $4, 'redeemed')",
+		f.ticketTypeID, f.userID, f.purchaseID, uuid.New().String())
+	mustQuery(t, err)
+	t.Cleanup(func() {
+		db.Exec(ctx, `
+			DELETE FROM outbox WHERE kind = 'send_broadcast_email' AND payload->>'recipient_id' IN (
+				SELECT r.id::text FROM broadcast_recipients r JOIN broadcasts b ON b.id = r.broadcast_id WHERE b.event_id = $1
+			)`, f.eventID)
+	})
+
+	fileMailer, err := mailer.NewFileMailer(t.TempDir(), netmail.Address{Address: "tickets@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &handlers.Handler{DB: db, Mailer: fileMailer}
+	worker := outbox.NewWorker(db)
+	h.RegisterJobs(worker)
+	s := checkoutServer{mail: fileMailer, worker: worker}
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	organiserID := newOrganiser(t, db, f.orgID)
+	organiser := r.Group("/", func(c *gin.Context) {
+		c.Set("userID", organiserID)
+		c.Set("userRole", "organizer")
+	})
+	organiser.POST("/api/events/:id/broadcasts", h.CreateBroadcast)
+	organiser.GET("/api/events/:id/broadcasts/:broadcastId", h.GetBroadcast)
+
+	send := func(req handlers.BroadcastRequest) (int, handlers.Broadcast) {
+		t.Helper()
+		body, _ := json.Marshal(req)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, fmt.Sprintf("/api/events/%d/broadcasts", f.eventID), bytes.NewReader(body)))
+		var b handlers.Broadcast
+		json.Unmarshal(w.Body.Bytes(), &b)
+		return w.Code, b
+	}
+
+	notIn := false
+	code, b := send(handlers.BroadcastRequest{Subject: "Doors at 8", Body: "Doors open an hour late.", CheckedIn: &notIn})
+	if code != http.StatusCreated || b.Report.Recipients != 1 || b.Report.Queued != 1 {
+		t.Fatalf("not checked in: expected 1 queued recipient, got %d %+v", code, b.Report)
+	}
+
+	code, b = send(handlers.BroadcastRequest{Subject: "Venue change", Body: "We've moved to the Town Hall."})
+	if code != http.StatusCreated || b.Report.Recipients != 2 {
+		t.Fatalf("everyone: expected 2 recipients, got %d %+v", code, b.Report)
+	}
+
+	// Make the throttled emails due, then deliver them
+	_, err = db.Exec(ctx, `
+		UPDATE outbox SET run_at = now()
+		WHERE kind = 'send_broadcast_email' AND status = 'pending' AND payload->>'recipient_id' IN (
+			SELECT r.id::text FROM broadcast_recipients r JOIN broadcasts b ON b.id = r.broadcast_id WHERE b.event_id = $1
+		)`, f.eventID)
+	mustQuery(t, err)
+	if got := len(s.emailsTo(t, buyer)); got != 2 {
+		t.Errorf("expected the buyer to get both broadcasts, got %d emails", got)
+	}
+	emails := s.emailsTo(t, checkedIn)
+	if len(emails) != 1 || emails[0].Header.Get("Subject") != "Webhook Test Event: Venue change" {
+		t.Errorf("expected the checked in holder to get just the venue change, got %d emails", len(emails))
+	}
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, fmt.Sprintf("/api/events/%d/broadcasts/%d", f.eventID, b.ID), nil))
+	var report handlers.Broadcast
+	json.Unmarshal(w.Body.Bytes(), &report)
+	if w.Code != http.StatusOK || report.Report.Sent != 2 || len(report.Deliveries) != 2 || report.Deliveries[0].SentAt == nil {
+		t.Errorf("report: expected 2 sent, got %d %s", w.Code, w.Body)
+	}
+
+	if code, _ := send(handlers.BroadcastRequest{Subject: "Hi", Body: "Hi", TicketTypeID: new(int)}); code != http.StatusBadRequest {
+		t.Errorf("another event's ticket type: expected 400, got %d", code)
+	}
+}
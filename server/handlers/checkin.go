@@ -0,0 +1,221 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+
+	"github.com/tpgcig/carneauengine/server/qrtoken"
+	"github.com/tpgcig/carneauengine/server/ticketstate"
+)
+
+type VerifyTicketRequest struct {
+	QR      string `json:"qr" binding:"required"`
+	EventID int    `json:"event_id" binding:"required"`
+	Gate    string `json:"gate"`
+}
+
+// TicketScan is when, where and by whom a ticket was let in.
+type TicketScan struct {
+	RedeemedAt time.Time `json:"redeemed_at"`
+	Gate       string    `json:"gate,omitempty"`
+	ScannedBy  string    `json:"scanned_by,omitempty"`
+}
+
+// ScannedTicket is what the door sees about a scanned ticket.
+type ScannedTicket struct {
+	ID          int         `json:"id"`
+	EventID     int         `json:"event_id"`
+	TicketType  string      `json:"ticket_type"`
+	HolderEmail string      `json:"holder_email,omitempty"`
+	Status      string      `json:"status"`
+	Scan        *TicketScan `json:"scan,omitempty"`
+}
+
+// errQRReplaced is returned by findScannedTicket for a genuine QR code that is
+// no longer its ticket's current one.
+var errQRReplaced = errors.New("QR code has been replaced")
+
+// findScannedTicket returns the ID of the ticket a scanned QR payload is for.
+// Signed payloads are verified first; legacy CARNEAU- codes are looked up as
+// they are. It returns pgx.ErrNoRows for unknown tickets.
+func (h *Handler) findScannedTicket(ctx context.Context, payload string) (int, error) {
+	payload = strings.TrimSpace(payload)
+	if !strings.HasPrefix(payload, qrtoken.Prefix+".") {
+		var id int
+		err := h.DB.QueryRow(ctx, "SELECT id FROM tickets WHERE qr_code = $1", payload).Scan(&id)
+		return id, err
+	}
+
+	claims, err := h.TicketKeys.Verify(payload)
+	if err != nil {
+		return 0, err
+	}
+	var current *string
+	err = h.DB.QueryRow(ctx, "SELECT qr_code FROM tickets WHERE id = $1", claims.TicketID).Scan(&current)
+	if err != nil {
+		return 0, err
+	}
+	if current == nil || *current != payload {
+		return 0, errQRReplaced
+	}
+	return claims.TicketID, nil
+}
+
+// loadScannedTicket returns a ticket as the door sees it.
+func (h *Handler) loadScannedTicket(ctx context.Context, ticketID int) (*ScannedTicket, error) {
+	t := &ScannedTicket{ID: ticketID}
+	var redeemedAt *time.Time
+	var gate, scannedBy *string
+	err := h.DB.QueryRow(ctx, `
+		SELECT tt.event_id, tt.name, holder.email, COALESCE(t.status, 'valid'),
+			t.redeemed_at, t.redeemed_gate, scanner.email
+		FROM tickets t
+		JOIN ticket_types tt ON tt.id = t.ticket_type_id
+		LEFT JOIN users holder ON holder.id = t.user_id
+		LEFT JOIN users scanner ON scanner.id = t.redeemed_by
+		WHERE t.id = $1`, ticketID,
+	).Scan(&t.EventID, &t.TicketType, &t.HolderEmail, &t.Status, &redeemedAt, &gate, &scannedBy)
+	if err != nil {
+		return nil, err
+	}
+	if redeemedAt != nil {
+		t.Scan = &TicketScan{RedeemedAt: *redeemedAt}
+		if gate != nil {
+			t.Scan.Gate = *gate
+		}
+		if scannedBy != nil {
+			t.Scan.ScannedBy = *scannedBy
+		}
+	}
+	return t, nil
+}
+
+// VerifyTicket checks in a scanned ticket at the door. The scanner must
+// belong to the organisation running the event being scanned, and the ticket
+// must be for that event. A valid ticket is redeemed, recording the time,
+// gate and scanner; scanning it again reports the original scan.
+func (h *Handler) VerifyTicket(c *gin.Context) {
+	var req VerifyTicketRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !h.authorizeEventOrganiser(c, req.EventID) {
+		return
+	}
+	ctx := c.Request.Context()
+	userID := c.GetInt("userID")
+
+	ticketID, err := h.findScannedTicket(ctx, req.QR)
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Ticket not found"})
+		return
+	case errors.Is(err, errQRReplaced):
+		c.JSON(http.StatusConflict, gin.H{"error": "This QR code has been replaced by a newer one"})
+		return
+	case errors.Is(err, qrtoken.ErrMalformed), errors.Is(err, qrtoken.ErrUnknownKey), errors.Is(err, qrtoken.ErrBadSignature):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ticket"})
+		return
+	case err != nil:
+		log.Printf("Error looking up scanned ticket: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to look up ticket"})
+		return
+	}
+
+	redeemed, err := h.redeemAtDoor(ctx, ticketID, req.EventID, userID, strings.TrimSpace(req.Gate))
+	if err != nil {
+		log.Printf("Error redeeming ticket %d: %v", ticketID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to redeem ticket"})
+		return
+	}
+
+	ticket, err := h.loadScannedTicket(ctx, ticketID)
+	if err != nil {
+		log.Printf("Error loading ticket %d: %v", ticketID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to look up ticket"})
+		return
+	}
+
+	switch {
+	case redeemed:
+		log.Printf("Ticket %d redeemed for event %d by user %d at gate %q", ticketID, req.EventID, userID, req.Gate)
+		c.JSON(http.StatusOK, gin.H{"status": "redeemed", "ticket": ticket})
+	case ticket.EventID != req.EventID:
+		c.JSON(http.StatusConflict, gin.H{"error": "Ticket is for a different event", "event_id": ticket.EventID})
+	case ticket.Status == "redeemed":
+		c.JSON(http.StatusConflict, gin.H{"error": "Ticket already used", "ticket": ticket})
+	default:
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("Ticket is %s", ticket.Status), "ticket": ticket})
+	}
+}
+
+// redeemAtDoor redeems a ticket scanned online, if it is valid and for the
+// event, and logs the scan. It reports whether the ticket was redeemed; of
+// any number of simultaneous scans, only the first finds it still valid.
+func (h *Handler) redeemAtDoor(ctx context.Context, ticketID, eventID, userID int, gate string) (bool, error) {
+	tx, err := h.DB.Begin(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback(ctx)
+
+	var ticketEventID int
+	var status string
+	err = tx.QueryRow(ctx, `
+		SELECT tt.event_id, COALESCE(t.status, 'valid')
+		FROM tickets t
+		JOIN ticket_types tt ON tt.id = t.ticket_type_id
+		WHERE t.id = $1
+		FOR UPDATE OF t`, ticketID,
+	).Scan(&ticketEventID, &status)
+	if err != nil {
+		return false, err
+	}
+	if ticketEventID != eventID || ticketstate.Status(status) != ticketstate.Valid {
+		return false, nil
+	}
+
+	if err := redeemTicket(ctx, tx, ticketID, time.Now(), gate, userID); err != nil {
+		return false, err
+	}
+	_, err = tx.Exec(ctx, `
+		INSERT INTO ticket_scans (ticket_id, scanned_by, scanned_at, gate, outcome)
+		SELECT id, redeemed_by, redeemed_at, redeemed_gate, 'redeemed' FROM tickets WHERE id = $1`, ticketID)
+	if err != nil {
+		return false, err
+	}
+	return true, tx.Commit(ctx)
+}
+
+// redeemTicket records the scan that let a ticket in, redeeming it if it is
+// still valid. Offline scans also use it to replace the recorded scan with an
+// earlier one.
+func redeemTicket(ctx context.Context, tx pgx.Tx, ticketID int, at time.Time, gate string, scannerID int) error {
+	var status string
+	if err := tx.QueryRow(ctx, "SELECT COALESCE(status, 'valid') FROM tickets WHERE id = $1", ticketID).Scan(&status); err != nil {
+		return err
+	}
+	if ticketstate.Status(status) != ticketstate.Redeemed {
+		reason := "checked in"
+		if gate != "" {
+			reason = fmt.Sprintf("checked in at %s", gate)
+		}
+		err := ticketstate.Transition(ctx, tx, []int{ticketID}, ticketstate.Change{To: ticketstate.Redeemed, ActorID: scannerID, Reason: reason})
+		if err != nil {
+			return err
+		}
+	}
+	_, err := tx.Exec(ctx,
+		"UPDATE tickets SET redeemed_at = $2, redeemed_gate = NULLIF($3, ''), redeemed_by = $4 WHERE id = $1",
+		ticketID, at, gate, scannerID)
+	return err
+}
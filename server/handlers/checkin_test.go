@@ -0,0 +1,146 @@
+package handlers_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/tpgcig/carneauengine/server/handlers"
+	"github.com/tpgcig/carneauengine/server/payment"
+	"github.com/tpgcig/carneauengine/server/qrtoken"
+	"github.com/tpgcig/carneauengine/server/ticketstate"
+)
+
+type verifyResponse struct {
+	Error  string                  `json:"error"`
+	Status string                  `json:"status"`
+	Ticket *handlers.ScannedTicket `json:"ticket"`
+}
+
+// newScannerRouter serves the check-in endpoint as scannerID would see it
+// after AuthMiddleware.
+func newScannerRouter(db *pgxpool.Pool, scannerID int) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	h := &handlers.Handler{DB: db, TicketSigner: testTicketSigner, TicketKeys: testTicketKeys}
+	r := gin.New()
+	r.POST("/api/tickets/verify", func(c *gin.Context) {
+		c.Set("userID", scannerID)
+		c.Set("userRole", "staff")
+	}, h.VerifyTicket)
+	return r
+}
+
+func scanTicket(t *testing.T, r *gin.Engine, qr string, eventID int, gate string) (int, verifyResponse) {
+	t.Helper()
+	body, _ := json.Marshal(handlers.VerifyTicketRequest{QR: qr, EventID: eventID, Gate: gate})
+	req := httptest.NewRequest(http.MethodPost, "/api/tickets/verify", bytes.NewReader(body))
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	var resp verifyResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	return w.Code, resp
+}
+
+// signFixtureTicket gives the fixture's first ticket a signed QR code and
+// returns it.
+func signFixtureTicket(t *testing.T, db *pgxpool.Pool, f checkoutFixture) (int, string) {
+	t.Helper()
+	ctx := context.Background()
+	var ticketID int
+	mustQuery(t, db.QueryRow(ctx, "SELECT MIN(id) FROM tickets WHERE purchase_id = $1", f.purchaseID).Scan(&ticketID))
+	qr, err := testTicketSigner.Sign(qrtoken.Claims{TicketID: ticketID, EventID: f.eventID, TicketTypeID: f.ticketTypeID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec(ctx, "UPDATE tickets SET qr_code = $1 WHERE id = $2", qr, ticketID)
+	mustQuery(t, err)
+	return ticketID, qr
+}
+
+func TestVerifyTicket_SecondScanReportsFirst(t *testing.T) {
+	db := newTestDB(t)
+	fake := payment.NewFakeGateway("http://unused", "", "test-secret")
+	f := newCheckoutFixture(t, db, 1)
+	payFixture(t, db, fake, f)
+	scannerID := newOrganiser(t, db, f.orgID)
+	t.Cleanup(func() { deleteFixtureTickets(db, f) }) // before the scanner, as tickets refer to who scanned them
+	r := newScannerRouter(db, scannerID)
+	ticketID, qr := signFixtureTicket(t, db, f)
+
+	code, resp := scanTicket(t, r, qr, f.eventID, "North")
+	if code != http.StatusOK {
+		t.Fatalf("first scan: expected 200, got %d (%s)", code, resp.Error)
+	}
+	if resp.Ticket == nil || resp.Ticket.ID != ticketID || resp.Ticket.Status != "redeemed" || resp.Ticket.Scan == nil {
+		t.Fatalf("first scan: expected ticket %d redeemed, got %+v", ticketID, resp.Ticket)
+	}
+	first := *resp.Ticket.Scan
+	if first.Gate != "North" || first.ScannedBy == "" {
+		t.Errorf("first scan: expected gate North and a scanner, got %+v", first)
+	}
+
+	code, resp = scanTicket(t, r, qr, f.eventID, "South")
+	if code != http.StatusConflict || resp.Error != "Ticket already used" {
+		t.Fatalf("second scan: expected 409 already used, got %d (%s)", code, resp.Error)
+	}
+	if resp.Ticket == nil || resp.Ticket.Scan == nil || *resp.Ticket.Scan != first {
+		t.Errorf("second scan: expected the first scan %+v, got %+v", first, resp.Ticket)
+	}
+
+	history, err := ticketstate.History(context.Background(), db, ticketID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 1 || history[0].To != ticketstate.Redeemed || history[0].ActorID == nil || *history[0].ActorID != scannerID {
+		t.Errorf("expected one redemption by the scanner in the history, got %+v", history)
+	}
+}
+
+// TestVerifyTicket_Rejects checks scans that must not let anyone in.
+func TestVerifyTicket_Rejects(t *testing.T) {
+	db := newTestDB(t)
+	ctx := context.Background()
+	fake := payment.NewFakeGateway("http://unused", "", "test-secret")
+	f := newCheckoutFixture(t, db, 1)
+	payFixture(t, db, fake, f)
+	ticketID, qr := signFixtureTicket(t, db, f)
+
+	var otherEventID int
+	mustQuery(t, db.QueryRow(ctx,
+		"INSERT INTO events (organisation_id, title, start_time, end_time) VALUES ($1, 'Other Event', now(), now()) RETURNING id",
+		f.orgID).Scan(&otherEventID))
+	t.Cleanup(func() { db.Exec(ctx, "DELETE FROM events WHERE id = $1", otherEventID) })
+
+	r := newScannerRouter(db, newOrganiser(t, db, f.orgID))
+	if code, resp := scanTicket(t, r, qr, otherEventID, ""); code != http.StatusConflict {
+		t.Errorf("other event: expected 409, got %d (%s)", code, resp.Error)
+	}
+	// Genuine, but not the QR code the ticket has now
+	replaced, err := testTicketSigner.Sign(qrtoken.Claims{TicketID: ticketID, EventID: f.eventID, TicketTypeID: f.ticketTypeID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code, _ := scanTicket(t, r, replaced, f.eventID, ""); code != http.StatusConflict {
+		t.Errorf("replaced QR: expected 409, got %d", code)
+	}
+	if code, _ := scanTicket(t, r, qr[:len(qr)-4]+"AAAA", f.eventID, ""); code != http.StatusBadRequest {
+		t.Errorf("forged QR: expected 400, got %d", code)
+	}
+
+	outsider := newScannerRouter(db, newOrganiser(t, db, 0))
+	if code, _ := scanTicket(t, outsider, qr, f.eventID, ""); code != http.StatusForbidden {
+		t.Errorf("outsider: expected 403, got %d", code)
+	}
+
+	var status string
+	mustQuery(t, db.QueryRow(ctx, "SELECT status FROM tickets WHERE qr_code = $1", qr).Scan(&status))
+	if status != "valid" {
+		t.Errorf("expected ticket still valid, got %s", status)
+	}
+}
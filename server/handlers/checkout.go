@@ -2,12 +2,16 @@ package handlers
 
 import (
 	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+
+	"github.com/tpgcig/carneauengine/server/money"
 )
 
 type CheckoutRequest struct {
@@ -28,7 +32,41 @@ type PurchasedTicketDetail struct {
 	QRCode    string `json:"qr_code"`
 	Status    string `json:"status"`
 	TicketTypeName string `json:"ticket_type_name"`
-	TicketTypePrice float64 `json:"ticket_type_price"`
+	TicketTypePrice money.Money `json:"ticket_type_price"`
+}
+
+// numericPrice is a price as queries build it into JSON, with the numeric
+// column left as it is. It goes through money.FromNumeric like every other
+// amount, rather than being rounded to cents in SQL.
+type numericPrice struct {
+	Amount   pgtype.Numeric `json:"amount"`
+	Currency string         `json:"currency"`
+}
+
+func (p numericPrice) money() (money.Money, error) {
+	return money.FromNumeric(p.Amount, p.Currency)
+}
+
+// unmarshalPurchasedTickets decodes the tickets of a purchase, as built by
+// JSON_AGG with ticket_type_price as a numericPrice.
+func unmarshalPurchasedTickets(data []byte) ([]PurchasedTicketDetail, error) {
+	var rows []struct {
+		PurchasedTicketDetail
+		Price numericPrice `json:"ticket_type_price"`
+	}
+	if err := json.Unmarshal(data, &rows); err != nil {
+		return nil, err
+	}
+	tickets := make([]PurchasedTicketDetail, len(rows))
+	for i, row := range rows {
+		tickets[i] = row.PurchasedTicketDetail
+		price, err := row.Price.money()
+		if err != nil {
+			return nil, fmt.Errorf("price of ticket %d: %w", row.ID, err)
+		}
+		tickets[i].TicketTypePrice = price
+	}
+	return tickets, nil
 }
 
 type PurchaseEventDetails struct {
@@ -43,7 +81,7 @@ type PurchaseEventDetails struct {
 
 type FullPurchaseDetails struct {
 	PurchaseID     int                     `json:"purchase_id"`
-	TotalAmount    float64                 `json:"total_amount"`
+	TotalAmount    money.Money             `json:"total_amount"`
 	PaymentStatus  string                  `json:"payment_status"`
 	PurchaserEmail string                  `json:"purchaser_email"`
 	Event          PurchaseEventDetails    `json:"event"`
@@ -56,6 +94,8 @@ func (h *Handler) GetPurchaseByStripeSessionID(c *gin.Context) {
 	stripeSessionID := c.Param("stripeSessionId")
 
 	var purchase FullPurchaseDetails
+	var totalAmount pgtype.Numeric
+	var currency string
 	var eventJSON []byte
 	var ticketsJSON []byte
 
@@ -63,7 +103,7 @@ func (h *Handler) GetPurchaseByStripeSessionID(c *gin.Context) {
 	// This query is complex as it gathers details from multiple tables and aggregates tickets
 	query := `
 		SELECT
-			p.id, p.total_amount, p.payment_status, p.created_at,
+			p.id, p.total_amount, p.currency, p.payment_status, p.created_at,
 			u.email AS purchaser_email,
 			JSON_BUILD_OBJECT(
 				'id', e.id,
@@ -80,7 +120,7 @@ func (h *Handler) GetPurchaseByStripeSessionID(c *gin.Context) {
 					'qr_code', t.qr_code,
 					'status', t.status,
 					'ticket_type_name', tt.name,
-					'ticket_type_price', tt.price
+					'ticket_type_price', JSON_BUILD_OBJECT('amount', tt.price, 'currency', p.currency)
 				)
 			) FILTER (WHERE t.id IS NOT NULL), '[]') AS tickets_details
 		FROM purchases p
@@ -94,7 +134,7 @@ func (h *Handler) GetPurchaseByStripeSessionID(c *gin.Context) {
 	`
 
 	err := h.DB.QueryRow(c.Request.Context(), query, stripeSessionID).Scan(
-		&purchase.PurchaseID, &purchase.TotalAmount, &purchase.PaymentStatus, &purchase.CreatedAt,
+		&purchase.PurchaseID, &totalAmount, &currency, &purchase.PaymentStatus, &purchase.CreatedAt,
 		&purchase.PurchaserEmail,
 		&eventJSON,
 		&ticketsJSON,
@@ -110,12 +150,19 @@ func (h *Handler) GetPurchaseByStripeSessionID(c *gin.Context) {
 		return
 	}
 
+	purchase.TotalAmount, err = money.FromNumeric(totalAmount, currency)
+	if err != nil {
+		log.Printf("Error converting total for purchase %d: %v", purchase.PurchaseID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve purchase details"})
+		return
+	}
+
 	if err := json.Unmarshal(eventJSON, &purchase.Event); err != nil {
 		log.Printf("Error unmarshalling event details: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to process event details"})
 		return
 	}
-	if err := json.Unmarshal(ticketsJSON, &purchase.Tickets); err != nil {
+	if purchase.Tickets, err = unmarshalPurchasedTickets(ticketsJSON); err != nil {
 		log.Printf("Error unmarshalling tickets details: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to process ticket details"})
 		return
@@ -0,0 +1,358 @@
+package handlers_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	netmail "net/mail"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/tpgcig/carneauengine/server/handlers"
+	"github.com/tpgcig/carneauengine/server/mailer"
+	"github.com/tpgcig/carneauengine/server/money"
+	"github.com/tpgcig/carneauengine/server/outbox"
+	"github.com/tpgcig/carneauengine/server/payment"
+	"github.com/tpgcig/carneauengine/server/reservation"
+)
+
+// checkoutServer serves checkout, the fake gateway's pay page and the webhook
+// its callback goes to.
+type checkoutServer struct {
+	*httptest.Server
+	h      *handlers.Handler
+	mail   *mailer.FileMailer // where the emails the outbox jobs send end up
+	worker *outbox.Worker
+}
+
+// failingGateway is a gateway that can't create checkout sessions.
+type failingGateway struct {
+	payment.Gateway
+}
+
+func (failingGateway) CreateSession(ctx context.Context, p payment.SessionParams) (*payment.Session, error) {
+	return nil, errors.New("stripe: api key expired")
+}
+
+func newCheckoutServer(t *testing.T, db *pgxpool.Pool, f checkoutFixture) checkoutServer {
+	t.Helper()
+	ctx := context.Background()
+	gin.SetMode(gin.TestMode)
+	t.Cleanup(func() {
+		db.Exec(ctx, "DELETE FROM outbox WHERE payload->>'purchase_id' IN (SELECT id::text FROM purchases WHERE event_id = $1) OR payload->>'reservation_id' IN (SELECT reservation_id FROM purchases WHERE event_id = $1)", f.eventID)
+		db.Exec(ctx, "DELETE FROM ticket_events WHERE ticket_id IN (SELECT t.id FROM tickets t JOIN purchases p ON p.id = t.purchase_id WHERE p.event_id = $1)", f.eventID)
+		db.Exec(ctx, "DELETE FROM tickets WHERE purchase_id IN (SELECT id FROM purchases WHERE event_id = $1)", f.eventID)
+		db.Exec(ctx, "DELETE FROM purchases WHERE event_id = $1", f.eventID)
+		db.Exec(ctx, "DELETE FROM stripe_events WHERE event_id LIKE 'evt_fake_%'")
+	})
+
+	r := gin.New()
+	srv := httptest.NewServer(r)
+	t.Cleanup(srv.Close)
+
+	fake := payment.NewFakeGateway(srv.URL+"/fake-pay", srv.URL+"/stripe-webhook", "test-secret")
+	fileMailer, err := mailer.NewFileMailer(t.TempDir(), netmail.Address{Address: "tickets@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &handlers.Handler{
+		DB:           db,
+		Reservations: reservation.NewMemoryReserver(15 * time.Minute),
+		Payments:     fake,
+		TicketSigner: testTicketSigner,
+		TicketKeys:   testTicketKeys,
+		Mailer:       fileMailer,
+	}
+	r.POST("/create-checkout-session", h.CreateCheckoutSession)
+	r.POST("/stripe-webhook", h.StripeWebhook)
+	r.DELETE("/api/reservations/:id", h.CancelReservation)
+	r.GET("/api/purchases/:stripeSessionId", h.GetPurchaseByStripeSessionID)
+	r.Any("/fake-pay/*path", gin.WrapH(http.StripPrefix("/fake-pay", fake)))
+
+	worker := outbox.NewWorker(db)
+	h.RegisterJobs(worker)
+	return checkoutServer{Server: srv, h: h, mail: fileMailer, worker: worker}
+}
+
+// emailsTo runs the due outbox jobs and returns the emails sent to address.
+func (s checkoutServer) emailsTo(t *testing.T, address string) []*netmail.Message {
+	t.Helper()
+	if _, err := s.worker.RunOnce(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	var found []*netmail.Message
+	for _, path := range s.mail.Sent() {
+		raw, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg, err := netmail.ReadMessage(bytes.NewReader(raw))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if to, _ := msg.Header.AddressList("To"); len(to) == 1 && to[0].Address == address {
+			found = append(found, msg)
+		}
+	}
+	return found
+}
+
+// checkout posts a checkout for email and returns the status and the pay
+// page's URL, or the error.
+func (s checkoutServer) checkout(t *testing.T, email string, items ...any) (int, string) {
+	t.Helper()
+	body, _ := json.Marshal(map[string]interface{}{"items": items, "email": email})
+	resp, err := http.Post(s.URL+"/create-checkout-session", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var checkout struct {
+		URL   string `json:"url"`
+		Error string `json:"error"`
+	}
+	json.NewDecoder(resp.Body).Decode(&checkout)
+	if resp.StatusCode != http.StatusOK {
+		return resp.StatusCode, checkout.Error
+	}
+	return resp.StatusCode, checkout.URL
+}
+
+// pay presses Pay on the fake gateway's page.
+func (s checkoutServer) pay(t *testing.T, payURL string) {
+	t.Helper()
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := client.PostForm(payURL, url.Values{"action": {"pay"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSeeOther {
+		t.Fatalf("pay: expected redirect, got %d", resp.StatusCode)
+	}
+}
+
+// TestCheckout_FakeGatewayEndToEnd buys tickets through CreateCheckoutSession,
+// pays on the fake gateway's page and checks its callback fulfils the order.
+func TestCheckout_FakeGatewayEndToEnd(t *testing.T) {
+	db := newTestDB(t)
+	ctx := context.Background()
+
+	f := newCheckoutFixture(t, db, 1)
+	email := fmt.Sprintf("fake-gateway-%s@example.com", uuid.New())
+	t.Cleanup(func() { db.Exec(ctx, "DELETE FROM users WHERE email = $1", email) })
+	s := newCheckoutServer(t, db, f)
+
+	code, payURL := s.checkout(t, email, map[string]int{"ticket_id": f.ticketTypeID, "quantity": 2})
+	if code != http.StatusOK {
+		t.Fatalf("create checkout session: expected 200, got %d (%s)", code, payURL)
+	}
+	s.pay(t, payURL)
+
+	var status string
+	var totalCents, tickets int
+	mustQuery(t, db.QueryRow(ctx, `
+		SELECT p.payment_status, (p.total_amount * 100)::int, COUNT(t.id)
+		FROM purchases p
+		JOIN users u ON u.id = p.user_id
+		LEFT JOIN tickets t ON t.purchase_id = p.id
+		WHERE u.email = $1
+		GROUP BY p.id`, email).Scan(&status, &totalCents, &tickets))
+
+	if status != "succeeded" {
+		t.Errorf("expected purchase succeeded, got %s", status)
+	}
+	if totalCents != 2000 {
+		t.Errorf("expected total of 2000 cents, got %d", totalCents)
+	}
+	if tickets != 2 {
+		t.Errorf("expected 2 tickets issued, got %d", tickets)
+	}
+
+	var sessionID string
+	mustQuery(t, db.QueryRow(ctx,
+		"SELECT p.stripe_payment_id FROM purchases p JOIN users u ON u.id = p.user_id WHERE u.email = $1", email).Scan(&sessionID))
+	resp, err := http.Get(s.URL + "/api/purchases/" + sessionID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var details handlers.FullPurchaseDetails
+	json.NewDecoder(resp.Body).Decode(&details)
+	resp.Body.Close()
+	if len(details.Tickets) != 2 || details.Tickets[0].TicketTypePrice != money.New(1000, "aud") {
+		t.Errorf("expected 2 tickets at 10.00 AUD, got %+v", details.Tickets)
+	}
+
+	emails := s.emailsTo(t, email)
+	if len(emails) != 1 {
+		t.Fatalf("expected 1 ticket email, got %d", len(emails))
+	}
+	subject, _ := new(mime.WordDecoder).DecodeHeader(emails[0].Header.Get("Subject"))
+	if subject != "Your Tickets for Webhook Test Event" {
+		t.Errorf("unexpected subject %q", subject)
+	}
+	if ct := emails[0].Header.Get("Content-Type"); !strings.HasPrefix(ct, "multipart/alternative") {
+		t.Errorf("expected text and HTML alternatives, got %q", ct)
+	}
+}
+
+// TestCheckout_CancelExpiresSession cancels a checkout from the cancel page and
+// checks the purchase is closed and the session can no longer be paid.
+func TestCheckout_CancelExpiresSession(t *testing.T) {
+	db := newTestDB(t)
+	ctx := context.Background()
+
+	f := newCheckoutFixture(t, db, 1)
+	email := fmt.Sprintf("fake-gateway-%s@example.com", uuid.New())
+	t.Cleanup(func() { db.Exec(ctx, "DELETE FROM users WHERE email = $1", email) })
+	s := newCheckoutServer(t, db, f)
+
+	code, payURL := s.checkout(t, email, map[string]int{"ticket_id": f.ticketTypeID, "quantity": 1})
+	if code != http.StatusOK {
+		t.Fatalf("create checkout session: expected 200, got %d (%s)", code, payURL)
+	}
+	var reservationID string
+	mustQuery(t, db.QueryRow(ctx,
+		"SELECT p.reservation_id FROM purchases p JOIN users u ON u.id = p.user_id WHERE u.email = $1", email).Scan(&reservationID))
+
+	cancel := func() int {
+		req, _ := http.NewRequest(http.MethodDelete, s.URL+"/api/reservations/"+reservationID, nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if code := cancel(); code != http.StatusOK {
+		t.Fatalf("cancel: expected 200, got %d", code)
+	}
+	if code := cancel(); code != http.StatusOK {
+		t.Errorf("cancelling again: expected 200, got %d", code)
+	}
+
+	var status string
+	mustQuery(t, db.QueryRow(ctx, "SELECT payment_status FROM purchases WHERE reservation_id = $1", reservationID).Scan(&status))
+	if status != "expired" {
+		t.Errorf("expected purchase expired, got %s", status)
+	}
+
+	resp, err := http.PostForm(payURL, url.Values{"action": {"pay"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("paying a cancelled checkout: expected 502, got %d", resp.StatusCode)
+	}
+}
+
+// TestCheckout_SessionFailureClosesPurchase checks a checkout the gateway
+// can't start gives its tickets back, and doesn't leave a pending purchase or
+// pass the gateway's error on.
+func TestCheckout_SessionFailureClosesPurchase(t *testing.T) {
+	db := newTestDB(t)
+	ctx := context.Background()
+
+	f := newCheckoutFixture(t, db, 1)
+	email := fmt.Sprintf("fake-gateway-%s@example.com", uuid.New())
+	t.Cleanup(func() { db.Exec(ctx, "DELETE FROM users WHERE email = $1", email) })
+	s := newCheckoutServer(t, db, f)
+	s.h.Payments = failingGateway{s.h.Payments}
+
+	code, msg := s.checkout(t, email, map[string]int{"ticket_id": f.ticketTypeID, "quantity": 2})
+	if code != http.StatusBadGateway || strings.Contains(msg, "stripe") {
+		t.Fatalf("expected 502 with a generic error, got %d (%s)", code, msg)
+	}
+	var status string
+	mustQuery(t, db.QueryRow(ctx,
+		"SELECT p.payment_status FROM purchases p JOIN users u ON u.id = p.user_id WHERE u.email = $1", email).Scan(&status))
+	if status != "failed" {
+		t.Errorf("expected purchase failed, got %s", status)
+	}
+	if held := s.h.Reservations.(*reservation.MemoryReserver).Held(f.ticketTypeID); held != 0 {
+		t.Errorf("expected the hold released, got %d held", held)
+	}
+}
+
+// TestCheckout_AttendeeAnswers checks the answers given for each ticket at
+// checkout are validated, and end up on the tickets issued.
+func TestCheckout_AttendeeAnswers(t *testing.T) {
+	db := newTestDB(t)
+	ctx := context.Background()
+
+	f := newCheckoutFixture(t, db, 1)
+	email := fmt.Sprintf("attendees-%s@example.com", uuid.New())
+	t.Cleanup(func() { db.Exec(ctx, "DELETE FROM users WHERE email = $1", email) })
+	var nameQ, dietQ, newsQ int
+	mustQuery(t, db.QueryRow(ctx,
+		"INSERT INTO registration_questions (event_id, label, kind, required) VALUES ($1, 'Badge name', 'text', true) RETURNING id",
+		f.eventID).Scan(&nameQ))
+	mustQuery(t, db.QueryRow(ctx,
+		"INSERT INTO registration_questions (event_id, ticket_type_id, label, kind, options) VALUES ($1, $2, 'Diet', 'select', '{None,Vegan}') RETURNING id",
+		f.eventID, f.ticketTypeID).Scan(&dietQ))
+	mustQuery(t, db.QueryRow(ctx,
+		"INSERT INTO registration_questions (event_id, label, kind) VALUES ($1, 'Newsletter', 'checkbox') RETURNING id",
+		f.eventID).Scan(&newsQ))
+	s := newCheckoutServer(t, db, f)
+
+	item := func(attendees ...handlers.AttendeeDetails) map[string]any {
+		return map[string]any{"ticket_id": f.ticketTypeID, "quantity": 2, "attendees": attendees}
+	}
+	ada := handlers.AttendeeDetails{Name: "Ada", Email: "ada@example.com", Answers: []handlers.AttendeeAnswer{
+		{QuestionID: nameQ, Value: "Ada L"}, {QuestionID: dietQ, Value: "Vegan"}, {QuestionID: newsQ, Value: true},
+	}}
+	bob := handlers.AttendeeDetails{Name: "Bob", Answers: []handlers.AttendeeAnswer{{QuestionID: nameQ, Value: "Bob"}}}
+
+	for name, it := range map[string]map[string]any{
+		"no attendees":     {"ticket_id": f.ticketTypeID, "quantity": 2},
+		"one attendee":     item(ada),
+		"missing required": item(ada, handlers.AttendeeDetails{Name: "Bob"}),
+		"unknown option": item(ada, handlers.AttendeeDetails{Answers: []handlers.AttendeeAnswer{
+			{QuestionID: nameQ, Value: "Bob"}, {QuestionID: dietQ, Value: "Steak"},
+		}}),
+	} {
+		if code, msg := s.checkout(t, email, it); code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d (%s)", name, code, msg)
+		}
+	}
+
+	code, payURL := s.checkout(t, email, item(ada, bob))
+	if code != http.StatusOK {
+		t.Fatalf("create checkout session: expected 200, got %d (%s)", code, payURL)
+	}
+	s.pay(t, payURL)
+
+	rows, err := db.Query(ctx, `
+		SELECT t.attendee_name, COALESCE(t.attendee_email, ''), string_agg(a.label || '=' || a.value, ',' ORDER BY a.question_id)
+		FROM tickets t
+		JOIN purchases p ON p.id = t.purchase_id
+		JOIN ticket_answers a ON a.ticket_id = t.id
+		WHERE p.event_id = $1
+		GROUP BY t.id
+		ORDER BY t.id`, f.eventID)
+	mustQuery(t, err)
+	var got []string
+	for rows.Next() {
+		var name, email, answers string
+		mustQuery(t, rows.Scan(&name, &email, &answers))
+		got = append(got, name+"|"+email+"|"+answers)
+	}
+	rows.Close()
+	want := []string{"Ada|ada@example.com|Badge name=Ada L,Diet=Vegan,Newsletter=true", "Bob||Badge name=Bob"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("expected tickets %q, got %q", want, got)
+	}
+}
@@ -1,15 +1,67 @@
 package handlers
 
 import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/go-redis/redis/v8"
+
+	"github.com/tpgcig/carneauengine/server/mailer"
+	"github.com/tpgcig/carneauengine/server/payment"
+	"github.com/tpgcig/carneauengine/server/qrtoken"
+	"github.com/tpgcig/carneauengine/server/reservation"
 )
 
-type Handler struct {
-	DB    *pgxpool.Pool
-	Redis *redis.Client
+const (
+	// reservationTTL is how long a buyer's hold lasts before the reaper gives it back.
+	reservationTTL = 15 * time.Minute
+	// reservationExtension is the single extra block of time a buyer can ask for
+	// while still filling in their details.
+	reservationExtension = 5 * time.Minute
+	// minSessionLifetime is the soonest Stripe lets a checkout session expire.
+	// It outlasts the hold, so a buyer can pay after their tickets have been
+	// given back. Such orders are fulfilled if tickets remain and held for
+	// review if not; that is preferred to blocking stock for every abandoned
+	// cart for the full 30 minutes.
+	minSessionLifetime = 30 * time.Minute
+	// reservationGrace keeps a reservation's record around after its deadline so
+	// the reaper can still see what to give back.
+	reservationGrace = time.Hour
+)
+
+// dbExecer is satisfied by both *pgxpool.Pool and pgx.Tx, for helpers that may
+// run inside or outside a transaction.
+type dbExecer interface {
+	Exec(ctx context.Context, sql string, arguments ...any) (pgconn.CommandTag, error)
 }
 
-func NewHandler(pool *pgxpool.Pool, rdb *redis.Client) *Handler {
-	return &Handler{DB: pool, Redis: rdb}
+// dbQueryer is dbExecer for helpers that also read.
+type dbQueryer interface {
+	dbExecer
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
 }
+
+type Handler struct {
+	DB           *pgxpool.Pool
+	Redis        *redis.Client
+	Reservations reservation.Reserver
+	Payments     payment.Gateway
+	TicketSigner *qrtoken.Signer  // signs the QR token of each ticket issued
+	TicketKeys   *qrtoken.Keyring // verifies QR tokens, including ones signed with retired keys
+	Mailer       mailer.Mailer    // nil if email isn't configured, in which case emails are skipped
+}
+
+func NewHandler(pool *pgxpool.Pool, rdb *redis.Client, payments payment.Gateway, signer *qrtoken.Signer, keys *qrtoken.Keyring, mail mailer.Mailer) *Handler {
+	return &Handler{
+		DB:           pool,
+		Redis:        rdb,
+		Reservations: reservation.NewRedisReserver(rdb, reservationTTL, reservationGrace),
+		Payments:     payments,
+		TicketSigner: signer,
+		TicketKeys:   keys,
+		Mailer:       mail,
+	}
+}
\ No newline at end of file
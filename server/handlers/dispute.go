@@ -0,0 +1,228 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+
+	"github.com/tpgcig/carneauengine/server/money"
+	"github.com/tpgcig/carneauengine/server/payment"
+	"github.com/tpgcig/carneauengine/server/ticketstate"
+)
+
+type DisputeSummary struct {
+	ID               int         `json:"id"`
+	PurchaseID       int         `json:"purchase_id"`
+	EventID          int         `json:"event_id"`
+	EventTitle       string      `json:"event_title"`
+	BuyerEmail       string      `json:"buyer_email"`
+	GatewayDisputeID string      `json:"gateway_dispute_id"`
+	Amount           money.Money `json:"amount"`
+	Reason           string      `json:"reason"`
+	Status           string      `json:"status"`
+	DisputedTickets  int         `json:"disputed_tickets"`
+	CreatedAt        time.Time   `json:"created_at"`
+	UpdatedAt        time.Time   `json:"updated_at"`
+	ClosedAt         *time.Time  `json:"closed_at,omitempty"`
+}
+
+// GetDisputes lists chargebacks on purchases for the events the authenticated
+// organiser runs. ?status=closed lists decided disputes and ?status=all every
+// dispute; by default only open ones are listed.
+func (h *Handler) GetDisputes(c *gin.Context) {
+	var filter string
+	switch c.DefaultQuery("status", "open") {
+	case "open":
+		filter = "AND d.closed_at IS NULL"
+	case "closed":
+		filter = "AND d.closed_at IS NOT NULL"
+	case "all":
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "status must be open, closed or all"})
+		return
+	}
+
+	rows, err := h.DB.Query(c.Request.Context(), `
+		SELECT d.id, d.purchase_id, e.id, e.title, u.email, d.gateway_dispute_id,
+			d.amount, d.currency, COALESCE(d.reason, ''), d.status,
+			(SELECT COUNT(*) FROM tickets t WHERE t.purchase_id = p.id AND t.status = 'disputed'),
+			d.created_at, d.updated_at, d.closed_at
+		FROM disputes d
+		JOIN purchases p ON p.id = d.purchase_id
+		JOIN users u ON u.id = p.user_id
+		JOIN events e ON e.id = p.event_id
+		JOIN organisation_members om ON om.organisation_id = e.organisation_id
+		WHERE om.user_id = $1 `+filter+`
+		ORDER BY d.created_at DESC`, c.GetInt("userID"))
+	if err != nil {
+		log.Printf("Error querying disputes: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load disputes"})
+		return
+	}
+	defer rows.Close()
+
+	disputes := []DisputeSummary{}
+	for rows.Next() {
+		var d DisputeSummary
+		var amount pgtype.Numeric
+		var currency string
+		if err := rows.Scan(&d.ID, &d.PurchaseID, &d.EventID, &d.EventTitle, &d.BuyerEmail, &d.GatewayDisputeID,
+			&amount, &currency, &d.Reason, &d.Status, &d.DisputedTickets, &d.CreatedAt, &d.UpdatedAt, &d.ClosedAt); err != nil {
+			log.Printf("Error scanning dispute: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load disputes"})
+			return
+		}
+		if d.Amount, err = money.FromNumeric(amount, currency); err != nil {
+			log.Printf("Error reading amount of dispute %d: %v", d.ID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load disputes"})
+			return
+		}
+		disputes = append(disputes, d)
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("Error iterating disputes: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load disputes"})
+		return
+	}
+
+	c.JSON(http.StatusOK, disputes)
+}
+
+// applyDispute records a charge.dispute.* webhook against the disputed
+// purchase and moves its tickets along with the dispute: an open dispute
+// makes every valid ticket disputed, so it won't get in at the door; winning
+// it makes them valid again, and losing it voids them and puts the places
+// back on sale, as the money has gone back to the buyer.
+// It writes the error response itself and returns false if it failed.
+func (h *Handler) applyDispute(c *gin.Context, event *payment.Event) bool {
+	ctx := c.Request.Context()
+	d := event.Dispute
+	if d == nil {
+		log.Printf("Webhook event %s (%s) carries no dispute", event.ID, event.Type)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Webhook event has no dispute"})
+		return false
+	}
+	log.Printf("Dispute %s on payment %s is %s", d.ID, d.PaymentID, d.Status)
+
+	tx, err := h.DB.Begin(ctx)
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start database transaction"})
+		return false
+	}
+	defer tx.Rollback(ctx)
+
+	recorded, err := recordStripeEvent(ctx, tx, event)
+	if err != nil {
+		log.Printf("Error recording Stripe event %s: %v", event.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record webhook event"})
+		return false
+	}
+	if !recorded {
+		log.Printf("Stripe event %s was already processed by another delivery", event.ID)
+		return true
+	}
+
+	var purchaseID int
+	err = tx.QueryRow(ctx,
+		"SELECT id FROM purchases WHERE payment_id = $1 FOR UPDATE",
+		d.PaymentID,
+	).Scan(&purchaseID)
+	if err == pgx.ErrNoRows {
+		log.Printf("No purchase for disputed payment %s, ignoring event %s", d.PaymentID, event.ID)
+		return commitOrFail(c, tx)
+	}
+	if err != nil {
+		log.Printf("Error loading purchase for payment %s: %v", d.PaymentID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load purchase"})
+		return false
+	}
+
+	// Events can arrive out of order, so a closed dispute stays closed
+	var closedAt *time.Time
+	if d.Status.Closed() {
+		now := time.Now()
+		closedAt = &now
+	}
+	var disputeID int
+	err = tx.QueryRow(ctx, `
+		INSERT INTO disputes (purchase_id, gateway_dispute_id, amount, currency, reason, status, closed_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (gateway_dispute_id) DO UPDATE
+		SET amount = EXCLUDED.amount, reason = EXCLUDED.reason, status = EXCLUDED.status,
+			closed_at = EXCLUDED.closed_at, updated_at = now()
+		WHERE disputes.closed_at IS NULL
+		RETURNING id`,
+		purchaseID, d.ID, d.Amount.Numeric(), d.Amount.Currency, d.Reason, string(d.Status), closedAt,
+	).Scan(&disputeID)
+	if err == pgx.ErrNoRows {
+		log.Printf("Dispute %s is already closed, ignoring event %s", d.ID, event.ID)
+		return commitOrFail(c, tx)
+	}
+	if err != nil {
+		log.Printf("Error recording dispute %s: %v", d.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record dispute"})
+		return false
+	}
+
+	reason := fmt.Sprintf("dispute %s %s", d.ID, d.Status)
+	switch d.Status {
+	case payment.DisputeWon, payment.DisputeWarningClosed:
+		err = transitionPurchaseTickets(ctx, tx, purchaseID, ticketstate.Disputed, ticketstate.Change{To: ticketstate.Valid, Reason: reason})
+	case payment.DisputeLost:
+		err = voidLostDisputeTickets(ctx, tx, purchaseID, reason)
+	default:
+		err = transitionPurchaseTickets(ctx, tx, purchaseID, ticketstate.Valid, ticketstate.Change{To: ticketstate.Disputed, Reason: reason})
+	}
+	if err != nil {
+		log.Printf("Error updating tickets for dispute %s on purchase %d: %v", d.ID, purchaseID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update tickets"})
+		return false
+	}
+
+	log.Printf("Recorded dispute %d (%s) on purchase %d as %s", disputeID, d.ID, purchaseID, d.Status)
+	return commitOrFail(c, tx)
+}
+
+// transitionPurchaseTickets moves every ticket of a purchase that is in one
+// status on to another.
+func transitionPurchaseTickets(ctx context.Context, tx pgx.Tx, purchaseID int, from ticketstate.Status, change ticketstate.Change) error {
+	ids, err := ticketstate.PurchaseTickets(ctx, tx, purchaseID, from)
+	if err != nil {
+		return err
+	}
+	return ticketstate.Transition(ctx, tx, ids, change)
+}
+
+// voidLostDisputeTickets voids a purchase's tickets once its dispute is lost
+// and puts their places back on sale. The closing event can arrive before the
+// one that opened the dispute, so tickets still valid are voided too.
+func voidLostDisputeTickets(ctx context.Context, tx pgx.Tx, purchaseID int, reason string) error {
+	var ids []int
+	for _, status := range []ticketstate.Status{ticketstate.Valid, ticketstate.Disputed} {
+		found, err := ticketstate.PurchaseTickets(ctx, tx, purchaseID, status)
+		if err != nil {
+			return err
+		}
+		ids = append(ids, found...)
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	_, err := tx.Exec(ctx, `
+		UPDATE ticket_types tt
+		SET sold_quantity = tt.sold_quantity - v.n
+		FROM (SELECT ticket_type_id, COUNT(*) AS n FROM tickets WHERE id = ANY($1) GROUP BY ticket_type_id) v
+		WHERE tt.id = v.ticket_type_id`, ids)
+	if err != nil {
+		return err
+	}
+	return ticketstate.Transition(ctx, tx, ids, ticketstate.Change{To: ticketstate.Voided, Reason: reason})
+}
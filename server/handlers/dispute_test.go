@@ -0,0 +1,120 @@
+package handlers_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/tpgcig/carneauengine/server/handlers"
+	"github.com/tpgcig/carneauengine/server/payment"
+)
+
+func TestStripeWebhook_Dispute(t *testing.T) {
+	for _, tc := range []struct {
+		outcome payment.DisputeStatus
+		want    refundState
+	}{
+		{payment.DisputeWon, refundState{"succeeded", 2, 0, 2, 0}},
+		{payment.DisputeLost, refundState{"succeeded", 0, 0, 0, 0}},
+	} {
+		t.Run(string(tc.outcome), func(t *testing.T) {
+			db := newTestDB(t)
+			ctx := context.Background()
+			fake := payment.NewFakeGateway("http://unused", "", "test-secret")
+			f := newCheckoutFixture(t, db, 2)
+			payFixture(t, db, fake, f)
+
+			r := newOrganiserRouter(db, fake, newOrganiser(t, db, f.orgID))
+			srv := httptest.NewServer(r)
+			t.Cleanup(srv.Close)
+			fake.WebhookURL = srv.URL + "/stripe-webhook"
+			t.Cleanup(func() { db.Exec(ctx, "DELETE FROM stripe_events WHERE event_id LIKE 'evt_fake_%'") })
+
+			var paymentID string
+			mustQuery(t, db.QueryRow(ctx, "SELECT payment_id FROM purchases WHERE id = $1", f.purchaseID).Scan(&paymentID))
+			d, err := fake.OpenDispute(ctx, paymentID, "fraudulent")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var disputed int
+			mustQuery(t, db.QueryRow(ctx, "SELECT COUNT(*) FROM tickets WHERE purchase_id = $1 AND status = 'disputed'", f.purchaseID).Scan(&disputed))
+			if disputed != 2 {
+				t.Errorf("expected 2 disputed tickets, got %d", disputed)
+			}
+			if open := listDisputes(t, r, "open"); len(open) != 1 || open[0].PurchaseID != f.purchaseID || open[0].DisputedTickets != 2 {
+				t.Errorf("expected the dispute listed as open, got %+v", open)
+			}
+
+			if err := fake.UpdateDispute(ctx, d.ID, tc.outcome); err != nil {
+				t.Fatal(err)
+			}
+			if got := loadRefundState(t, db, f); got != tc.want {
+				t.Errorf("after dispute %s: expected %+v, got %+v", tc.outcome, tc.want, got)
+			}
+			if open := listDisputes(t, r, "open"); len(open) != 0 {
+				t.Errorf("expected no open disputes, got %+v", open)
+			}
+
+			// A late update must not reopen it
+			if err := fake.UpdateDispute(ctx, d.ID, payment.DisputeUnderReview); err != nil {
+				t.Fatal(err)
+			}
+			if got := loadRefundState(t, db, f); got != tc.want {
+				t.Errorf("after late update: expected %+v, got %+v", tc.want, got)
+			}
+		})
+	}
+}
+
+// TestStripeWebhook_DisputeLostFirst delivers a lost dispute's closing event
+// before the one that opened it, as Stripe may, and checks the tickets are
+// still voided and put back on sale.
+func TestStripeWebhook_DisputeLostFirst(t *testing.T) {
+	db := newTestDB(t)
+	ctx := context.Background()
+	fake := payment.NewFakeGateway("http://unused", "", "test-secret")
+	f := newCheckoutFixture(t, db, 2)
+	payFixture(t, db, fake, f)
+
+	var paymentID string
+	mustQuery(t, db.QueryRow(ctx, "SELECT payment_id FROM purchases WHERE id = $1", f.purchaseID).Scan(&paymentID))
+	d, err := fake.OpenDispute(ctx, paymentID, "fraudulent") // delivered nowhere
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(newOrganiserRouter(db, fake, newOrganiser(t, db, f.orgID)))
+	t.Cleanup(srv.Close)
+	fake.WebhookURL = srv.URL + "/stripe-webhook"
+	t.Cleanup(func() { db.Exec(ctx, "DELETE FROM stripe_events WHERE event_id LIKE 'evt_fake_%'") })
+
+	if err := fake.UpdateDispute(ctx, d.ID, payment.DisputeLost); err != nil {
+		t.Fatal(err)
+	}
+	want := refundState{"succeeded", 0, 0, 0, 0}
+	if got := loadRefundState(t, db, f); got != want {
+		t.Errorf("after lost: expected %+v, got %+v", want, got)
+	}
+	var voided int
+	mustQuery(t, db.QueryRow(ctx, "SELECT COUNT(*) FROM tickets WHERE purchase_id = $1 AND status = 'voided'", f.purchaseID).Scan(&voided))
+	if voided != 2 {
+		t.Errorf("expected 2 voided tickets, got %d", voided)
+	}
+}
+
+func listDisputes(t *testing.T, r http.Handler, status string) []handlers.DisputeSummary {
+	t.Helper()
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/disputes?status="+status, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("list disputes: expected 200, got %d", w.Code)
+	}
+	var disputes []handlers.DisputeSummary
+	if err := json.Unmarshal(w.Body.Bytes(), &disputes); err != nil {
+		t.Fatal(err)
+	}
+	return disputes
+}
@@ -0,0 +1,120 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"html/template"
+	"log"
+	"time"
+
+	"github.com/skip2/go-qrcode"
+
+	"github.com/tpgcig/carneauengine/server/mailer"
+	"github.com/tpgcig/carneauengine/server/outbox"
+)
+
+// sendMail sends msg through the handler's mailer. It reports false, without
+// an error, if no mailer is configured.
+func (h *Handler) sendMail(ctx context.Context, msg *mailer.Message) (bool, error) {
+	if h.Mailer == nil {
+		log.Printf("No mailer configured. Skipping email %q to %s.", msg.Subject, msg.To)
+		return false, nil
+	}
+	return true, h.Mailer.Send(ctx, msg)
+}
+
+// ticketEmail is the data of the ticket_confirmation template.
+type ticketEmail struct {
+	Recipient   string
+	Transferred bool // the tickets were transferred to Recipient rather than bought
+	Event       emailEvent
+	Tickets     []emailTicket
+}
+
+type emailEvent struct {
+	Title     string
+	Location  string
+	StartTime time.Time
+}
+
+type emailTicket struct {
+	TypeName string
+	QR       string
+	ImageSrc template.URL // the QR code image, if it could be drawn
+}
+
+// qrImages draws each ticket's QR code as an inline image and points its
+// ImageSrc at it. A ticket whose code can't be drawn is left without an image.
+func qrImages(tickets []emailTicket) []mailer.Inline {
+	var images []mailer.Inline
+	for i := range tickets {
+		png, err := qrcode.Encode(tickets[i].QR, qrcode.Medium, 256)
+		if err != nil {
+			log.Printf("Error generating QR code for ticket %s: %v", tickets[i].QR, err)
+			continue
+		}
+		cid := fmt.Sprintf("qrcode_%d", i)
+		tickets[i].ImageSrc = template.URL("cid:" + cid)
+		images = append(images, mailer.Inline{ContentID: cid, ContentType: "image/png", Data: png})
+	}
+	return images
+}
+
+// sendTicketEmail emails the buyer their tickets and QR codes for a fulfilled
+// purchase. Given ticketIDs, it sends just those instead, to whoever they were
+// transferred to. It runs as an outbox job, so failures are returned to be
+// retried.
+func (h *Handler) sendTicketEmail(ctx context.Context, purchaseID int, customerEmail string, ticketIDs []int) error {
+	data := ticketEmail{Recipient: customerEmail, Transferred: len(ticketIDs) > 0}
+	var eventID int
+	rows, err := h.DB.Query(ctx, `
+		SELECT t.qr_code, tt.name, e.id, e.title, COALESCE(e.location, ''), e.start_time
+		FROM tickets t
+		JOIN ticket_types tt ON t.ticket_type_id = tt.id
+		JOIN events e ON tt.event_id = e.id
+		JOIN purchases p ON p.id = t.purchase_id
+		WHERE t.purchase_id = $1 AND t.status = 'valid'
+			AND (t.id = ANY($2::int[]) OR (cardinality($2::int[]) = 0 AND t.user_id = p.user_id))
+		ORDER BY t.id`,
+		purchaseID, append([]int{}, ticketIDs...)) // never nil, which would be NULL
+	if err != nil {
+		return fmt.Errorf("querying tickets for email: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var et emailTicket
+		if err := rows.Scan(&et.QR, &et.TypeName, &eventID, &data.Event.Title, &data.Event.Location, &data.Event.StartTime); err != nil {
+			return fmt.Errorf("scanning ticket for email: %w", err)
+		}
+		data.Tickets = append(data.Tickets, et)
+	}
+	if err = rows.Err(); err != nil {
+		return fmt.Errorf("iterating ticket rows for email: %w", err)
+	}
+
+	if len(data.Tickets) == 0 {
+		log.Printf("No tickets found for email confirmation for purchase %d", purchaseID)
+		return nil
+	}
+
+	brand, err := h.eventBranding(ctx, eventID)
+	if err != nil {
+		return fmt.Errorf("loading email branding for event %d: %w", eventID, err)
+	}
+	images := qrImages(data.Tickets)
+	content, err := mailer.Render("ticket_confirmation", brand, data)
+	if err != nil {
+		return outbox.Permanent(err)
+	}
+	msg := content.Message(customerEmail)
+	msg.Inline = images
+
+	sent, err := h.sendMail(ctx, msg)
+	if err != nil {
+		return fmt.Errorf("sending ticket confirmation email to %s: %w", customerEmail, err)
+	}
+	if sent {
+		log.Printf("Ticket confirmation email sent to %s for purchase %d", customerEmail, purchaseID)
+	}
+	return nil
+}
@@ -10,6 +10,8 @@ import (
 
 	"github.com/gin-gonic/gin"
 	redis "github.com/go-redis/redis/v8"
+
+	"github.com/tpgcig/carneauengine/server/money"
 )
 
 type SummaryEvent struct {
@@ -36,7 +38,7 @@ SELECT
             JSON_BUILD_OBJECT(
                 'id', t.id,
                 'name', t.name,
-                'price', t.price,
+                'price', JSON_BUILD_OBJECT('amount', t.price, 'currency', e.currency),
                 'total_quantity', t.total_quantity
             )
         ) FILTER (WHERE t.id IS NOT NULL),
@@ -113,11 +115,33 @@ func (h *Handler) GetSummarisedEvents(c *gin.Context) {
 type TicketType struct {
 	ID	int	`json:"id"`
 	Name	string	`json:"name"`
-	Price	float32	`json:"price"`
+	Price	money.Money	`json:"price"`
 	TotalQuantity	int	`json:"total_quantity"`
 
 }
 
+// unmarshalTicketTypes decodes an event's ticket types, as built by JSON_AGG
+// with price as a numericPrice.
+func unmarshalTicketTypes(data []byte) ([]TicketType, error) {
+	var rows []struct {
+		TicketType
+		Price numericPrice `json:"price"`
+	}
+	if err := json.Unmarshal(data, &rows); err != nil {
+		return nil, err
+	}
+	ticketTypes := make([]TicketType, len(rows))
+	for i, row := range rows {
+		ticketTypes[i] = row.TicketType
+		price, err := row.Price.money()
+		if err != nil {
+			return nil, fmt.Errorf("price of ticket type %d: %w", row.ID, err)
+		}
+		ticketTypes[i].Price = price
+	}
+	return ticketTypes, nil
+}
+
 type Event struct {
 	ID 		int 	`json:"id"`
 	OrganisationName  string 	`json:"organisation_name"`
@@ -167,8 +191,9 @@ func (h *Handler) GetEvent(c *gin.Context) {
 		return
 	}
 
-	if err := json.Unmarshal(ticketTypesJSON, &e.TicketTypes); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	if e.TicketTypes, err = unmarshalTicketTypes(ticketTypesJSON); err != nil {
+		log.Printf("Error reading ticket types of event %s: %v", id, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve event"})
 		return
 	}
 
@@ -0,0 +1,309 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+
+	"github.com/tpgcig/carneauengine/server/mailer"
+	"github.com/tpgcig/carneauengine/server/money"
+	"github.com/tpgcig/carneauengine/server/outbox"
+)
+
+// Guests can't log in, so they find their tickets through a link emailed to
+// them. Following it exchanges its single-use token for a short-lived JWT with
+// the ticket holder role, which can see the holder's tickets and nothing more.
+
+const (
+	// lookupLinkTTL is how long a "find my tickets" link works for.
+	lookupLinkTTL = 30 * time.Minute
+	// lookupSessionTTL is how long the JWT a link is exchanged for lasts.
+	lookupSessionTTL = time.Hour
+	// lookupInterval is how often one email address can be sent a link.
+	lookupInterval = time.Minute
+	// lookupURL is the page the link opens; the token goes on the end.
+	lookupURL = "http://localhost:3000/my-tickets?token="
+
+	// ticketHolderRole is the role of JWTs issued for lookup links.
+	ticketHolderRole = "ticket_holder"
+)
+
+type TicketLookupRequest struct {
+	Email string `json:"email" binding:"required,email"`
+}
+
+// lookupEmailJob names the lookup token to email a link for. The link's token
+// is only made when the email is sent, so it's never stored in the outbox.
+type lookupEmailJob struct {
+	TokenID int    `json:"token_id"`
+	Email   string `json:"email"`
+}
+
+// lookupEmail is the data of the ticket_lookup template.
+type lookupEmail struct {
+	Link      string
+	ExpiresAt time.Time
+}
+
+// RequestTicketLookup emails a link to the tickets held by an email address.
+// It answers the same whether or not there are any, so it can't be used to
+// find out who has bought tickets.
+func (h *Handler) RequestTicketLookup(c *gin.Context) {
+	var req TicketLookupRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	email := strings.TrimSpace(req.Email)
+	ctx := c.Request.Context()
+
+	tx, err := h.DB.Begin(ctx)
+	if err != nil {
+		log.Printf("Error beginning lookup transaction: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to send link"})
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	// Only holders of tickets get a link, and no more than one a minute
+	var tokenID int
+	err = tx.QueryRow(ctx, `
+		INSERT INTO ticket_lookup_tokens (user_id, expires_at)
+		SELECT u.id, now() + make_interval(secs => $2)
+		FROM users u
+		WHERE u.email = $1
+			AND EXISTS (SELECT 1 FROM tickets t WHERE t.user_id = u.id AND t.status <> 'transferred')
+			AND NOT EXISTS (
+				SELECT 1 FROM ticket_lookup_tokens lt
+				WHERE lt.user_id = u.id AND lt.created_at > now() - make_interval(secs => $3)
+			)
+		RETURNING id`,
+		email, lookupLinkTTL.Seconds(), lookupInterval.Seconds(),
+	).Scan(&tokenID)
+	switch {
+	case err == pgx.ErrNoRows:
+		log.Printf("Ticket lookup for %s: no link sent", email)
+	case err != nil:
+		log.Printf("Error creating lookup token for %s: %v", email, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to send link"})
+		return
+	default:
+		err = outbox.Enqueue(ctx, tx, jobSendLookupEmail, lookupEmailJob{TokenID: tokenID, Email: email})
+		if err == nil {
+			err = tx.Commit(ctx)
+		}
+		if err != nil {
+			log.Printf("Error queueing lookup email to %s: %v", email, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to send link"})
+			return
+		}
+		log.Printf("Ticket lookup link %d queued for %s", tokenID, email)
+	}
+	c.JSON(http.StatusAccepted, gin.H{"message": "If there are tickets for that email address, a link to them is on its way."})
+}
+
+// sendLookupEmail emails a "find my tickets" link. It runs as an outbox job.
+// Links used or expired by the time it runs are skipped. The link's token is
+// made here, and replaces any an earlier run of the job emailed.
+func (h *Handler) sendLookupEmail(ctx context.Context, job lookupEmailJob) error {
+	token, err := newLinkToken()
+	if err != nil {
+		return fmt.Errorf("generating lookup token: %w", err)
+	}
+	var expiresAt time.Time
+	var usable bool
+	err = h.DB.QueryRow(ctx, `
+		UPDATE ticket_lookup_tokens
+		SET token_hash = CASE WHEN used_at IS NULL AND expires_at > now() THEN $2 ELSE token_hash END
+		WHERE id = $1
+		RETURNING expires_at, used_at IS NULL AND expires_at > now()`,
+		job.TokenID, hashLinkToken(token),
+	).Scan(&expiresAt, &usable)
+	if err == pgx.ErrNoRows {
+		return outbox.Permanent(fmt.Errorf("lookup token %d not found", job.TokenID))
+	}
+	if err != nil {
+		return fmt.Errorf("loading lookup token %d: %w", job.TokenID, err)
+	}
+	if !usable {
+		log.Printf("Lookup link %d is used or expired; not emailing %s", job.TokenID, job.Email)
+		return nil
+	}
+
+	// Tickets can be for several organisations' events, so the link is unbranded
+	content, err := mailer.Render("ticket_lookup", mailer.Branding{}, lookupEmail{Link: lookupURL + token, ExpiresAt: expiresAt})
+	if err != nil {
+		return outbox.Permanent(err)
+	}
+	sent, err := h.sendMail(ctx, content.Message(job.Email))
+	if err != nil {
+		return fmt.Errorf("sending lookup email to %s: %w", job.Email, err)
+	}
+	if sent {
+		log.Printf("Lookup email sent to %s", job.Email)
+	}
+	return nil
+}
+
+// RedeemTicketLookup exchanges a lookup link's token, once, for a JWT that
+// can list the holder's tickets.
+func (h *Handler) RedeemTicketLookup(c *gin.Context) {
+	var userID int
+	var email string
+	err := h.DB.QueryRow(c.Request.Context(), `
+		UPDATE ticket_lookup_tokens lt
+		SET used_at = now()
+		FROM users u
+		WHERE u.id = lt.user_id AND lt.token_hash = $1 AND lt.used_at IS NULL AND lt.expires_at > now()
+		RETURNING u.id, u.email`, hashLinkToken(c.Param("token")),
+	).Scan(&userID, &email)
+	if err == pgx.ErrNoRows {
+		c.JSON(http.StatusGone, gin.H{"error": "This link has expired or was already used"})
+		return
+	}
+	if err != nil {
+		log.Printf("Error redeeming lookup token: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to open link"})
+		return
+	}
+
+	token, expiresAt, err := signToken(userID, email, ticketHolderRole, lookupSessionTTL)
+	if err != nil {
+		log.Printf("Error signing ticket holder token for user %d: %v", userID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+		return
+	}
+	log.Printf("Lookup link redeemed by user %d", userID)
+	c.JSON(http.StatusOK, gin.H{"token": token, "expires_at": expiresAt})
+}
+
+// GetMyTickets lists the authenticated user's purchases, in the shape of
+// GetPurchaseByStripeSessionID, with the tickets they hold. Purchases they
+// hold a transferred ticket from are included; tickets they transferred away
+// are not.
+func (h *Handler) GetMyTickets(c *gin.Context) {
+	userID := c.GetInt("userID")
+	rows, err := h.DB.Query(c.Request.Context(), `
+		SELECT
+			p.id, p.total_amount, p.currency, p.payment_status, p.created_at,
+			u.email AS purchaser_email,
+			JSON_BUILD_OBJECT(
+				'id', e.id,
+				'title', e.title,
+				'description', e.description,
+				'location', e.location,
+				'start_time', e.start_time,
+				'end_time', e.end_time,
+				'image_urls', COALESCE((SELECT ARRAY_AGG(ei.url) FROM event_images ei WHERE ei.event_id = e.id), '{}')
+			) AS event_details,
+			(SELECT JSON_AGG(
+				JSON_BUILD_OBJECT(
+					'id', t.id,
+					'qr_code', t.qr_code,
+					'status', t.status,
+					'ticket_type_name', tt.name,
+					'ticket_type_price', JSON_BUILD_OBJECT('amount', tt.price, 'currency', p.currency)
+				) ORDER BY t.id)
+			FROM tickets t
+			JOIN ticket_types tt ON t.ticket_type_id = tt.id
+			WHERE t.purchase_id = p.id AND t.user_id = $1 AND t.status <> 'transferred'
+			) AS tickets_details
+		FROM purchases p
+		JOIN users u ON p.user_id = u.id
+		JOIN events e ON p.event_id = e.id
+		WHERE EXISTS (SELECT 1 FROM tickets t WHERE t.purchase_id = p.id AND t.user_id = $1 AND t.status <> 'transferred')
+		ORDER BY e.start_time DESC, p.id`, userID)
+	if err != nil {
+		log.Printf("Error querying tickets of user %d: %v", userID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve tickets"})
+		return
+	}
+	defer rows.Close()
+
+	purchases := []FullPurchaseDetails{}
+	for rows.Next() {
+		var purchase FullPurchaseDetails
+		var totalAmount pgtype.Numeric
+		var currency string
+		var eventJSON, ticketsJSON []byte
+		err := rows.Scan(
+			&purchase.PurchaseID, &totalAmount, &currency, &purchase.PaymentStatus, &purchase.CreatedAt,
+			&purchase.PurchaserEmail, &eventJSON, &ticketsJSON,
+		)
+		if err == nil {
+			purchase.TotalAmount, err = money.FromNumeric(totalAmount, currency)
+		}
+		if err == nil {
+			err = json.Unmarshal(eventJSON, &purchase.Event)
+		}
+		if err == nil {
+			purchase.Tickets, err = unmarshalPurchasedTickets(ticketsJSON)
+		}
+		if err != nil {
+			log.Printf("Error reading purchase %d for user %d: %v", purchase.PurchaseID, userID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve tickets"})
+			return
+		}
+		purchases = append(purchases, purchase)
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("Error iterating tickets of user %d: %v", userID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve tickets"})
+		return
+	}
+	c.JSON(http.StatusOK, purchases)
+}
+
+// ResendMyTickets emails the authenticated user the valid tickets they hold
+// from a purchase again.
+func (h *Handler) ResendMyTickets(c *gin.Context) {
+	purchaseID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid purchase ID"})
+		return
+	}
+	userID := c.GetInt("userID")
+	ctx := c.Request.Context()
+
+	var buyer bool
+	var ticketIDs []int
+	err = h.DB.QueryRow(ctx, `
+		SELECT p.user_id = $2, COALESCE(ARRAY_AGG(t.id ORDER BY t.id) FILTER (WHERE t.id IS NOT NULL), '{}')
+		FROM purchases p
+		LEFT JOIN tickets t ON t.purchase_id = p.id AND t.user_id = $2 AND t.status = 'valid'
+		WHERE p.id = $1
+		GROUP BY p.id`, purchaseID, userID,
+	).Scan(&buyer, &ticketIDs)
+	if err != nil && err != pgx.ErrNoRows {
+		log.Printf("Error loading purchase %d for resend: %v", purchaseID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to resend tickets"})
+		return
+	}
+	if len(ticketIDs) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "You hold no valid tickets from this purchase"})
+		return
+	}
+
+	// The buyer gets the confirmation again; anyone else, the tickets
+	// transferred to them
+	job := ticketEmailJob{PurchaseID: purchaseID, Email: c.GetString("userEmail")}
+	if !buyer {
+		job.TicketIDs = ticketIDs
+	}
+	if err := outbox.Enqueue(ctx, h.DB, jobSendTicketEmail, job); err != nil {
+		log.Printf("Error queueing resend of purchase %d: %v", purchaseID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to resend tickets"})
+		return
+	}
+	log.Printf("Tickets from purchase %d resent to user %d", purchaseID, userID)
+	c.JSON(http.StatusAccepted, gin.H{"message": "Your tickets are on their way."})
+}
@@ -0,0 +1,133 @@
+package handlers_test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	netmail "net/mail"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+
+	"github.com/tpgcig/carneauengine/server/handlers"
+	"github.com/tpgcig/carneauengine/server/mailer"
+	"github.com/tpgcig/carneauengine/server/outbox"
+)
+
+// emailedLinkToken returns the token of the link in an email's text part.
+func emailedLinkToken(t *testing.T, msg *netmail.Message) string {
+	t.Helper()
+	_, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		p, err := r.NextPart() // decodes quoted-printable
+		if err != nil {
+			t.Fatalf("no text part with a link: %v", err)
+		}
+		if !strings.HasPrefix(p.Header.Get("Content-Type"), "text/plain") {
+			continue
+		}
+		body, err := io.ReadAll(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, field := range strings.Fields(string(body)) {
+			if u, err := url.Parse(field); err == nil && u.Query().Get("token") != "" {
+				return u.Query().Get("token")
+			}
+		}
+	}
+}
+
+func TestTicketLookup(t *testing.T) {
+	db := newTestDB(t)
+	ctx := context.Background()
+	f := newCheckoutFixture(t, db, 1)
+	qr := uuid.New().String()
+	_, err := db.Exec(ctx,
+		"INSERT INTO tickets (ticket_type_id, user_id, purchase_id, qr_code, status) VALUES ($1, $2, $3, $4, 'valid')",
+		f.ticketTypeID, f.userID, f.purchaseID, qr)
+	mustQuery(t, err)
+	var email string
+	mustQuery(t, db.QueryRow(ctx, "SELECT email FROM users WHERE id = $1", f.userID).Scan(&email))
+	t.Cleanup(func() {
+		db.Exec(ctx, "DELETE FROM outbox WHERE kind = 'send_lookup_email' AND payload->>'email' = $1", email)
+	})
+
+	fileMailer, err := mailer.NewFileMailer(t.TempDir(), netmail.Address{Address: "tickets@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &handlers.Handler{DB: db, Mailer: fileMailer}
+	worker := outbox.NewWorker(db)
+	h.RegisterJobs(worker)
+	s := checkoutServer{mail: fileMailer, worker: worker}
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/api/tickets/lookup", h.RequestTicketLookup)
+	r.POST("/api/tickets/lookup/:token", h.RedeemTicketLookup)
+	protected := r.Group("/", handlers.AuthMiddleware())
+	protected.GET("/api/my-tickets", h.GetMyTickets)
+	protected.GET("/api/disputes", handlers.RequireRole("organizer"), h.GetDisputes)
+
+	// Asking twice in a row, or for an address with no tickets, sends nothing more
+	for _, address := range []string{email, email, "nobody-" + uuid.New().String() + "@example.com"} {
+		if w := postJSON(r, "/api/tickets/lookup", handlers.TicketLookupRequest{Email: address}); w.Code != http.StatusAccepted {
+			t.Fatalf("lookup for %s: expected 202, got %d: %s", address, w.Code, w.Body)
+		}
+	}
+	emails := s.emailsTo(t, email)
+	if len(emails) != 1 {
+		t.Fatalf("expected 1 lookup email, got %d", len(emails))
+	}
+	var payload string
+	mustQuery(t, db.QueryRow(ctx,
+		"SELECT payload::text FROM outbox WHERE kind = 'send_lookup_email' AND payload->>'email' = $1", email).Scan(&payload))
+	token := emailedLinkToken(t, emails[0])
+	if strings.Contains(payload, token) {
+		t.Error("expected the link's token to be kept out of the outbox")
+	}
+
+	w := postJSON(r, "/api/tickets/lookup/"+token, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("redeem: expected 200, got %d: %s", w.Code, w.Body)
+	}
+	var session struct {
+		Token string `json:"token"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &session)
+	if w := postJSON(r, "/api/tickets/lookup/"+token, nil); w.Code != http.StatusGone {
+		t.Errorf("second redeem: expected 410, got %d", w.Code)
+	}
+
+	get := func(path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("Authorization", "Bearer "+session.Token)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	w = get("/api/my-tickets")
+	var purchases []handlers.FullPurchaseDetails
+	json.Unmarshal(w.Body.Bytes(), &purchases)
+	if w.Code != http.StatusOK || len(purchases) != 1 || len(purchases[0].Tickets) != 1 || purchases[0].Tickets[0].QRCode != qr {
+		t.Fatalf("my tickets: expected the one ticket, got %d %s", w.Code, w.Body)
+	}
+	if purchases[0].PurchaseID != f.purchaseID || purchases[0].Event.ID != f.eventID {
+		t.Errorf("my tickets: expected purchase %d for event %d, got %+v", f.purchaseID, f.eventID, purchases[0])
+	}
+	if w := get("/api/disputes"); w.Code != http.StatusForbidden {
+		t.Errorf("organiser route with a lookup token: expected 403, got %d", w.Code)
+	}
+}
@@ -0,0 +1,68 @@
+package handlers
+
+import (
+	"context"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// organisesEvent reports whether a user belongs to the organisation running an event.
+func (h *Handler) organisesEvent(ctx context.Context, userID, eventID int) (bool, error) {
+	var ok bool
+	err := h.DB.QueryRow(ctx, `
+		SELECT EXISTS (
+			SELECT 1
+			FROM events e
+			JOIN organisation_members om ON om.organisation_id = e.organisation_id
+			WHERE e.id = $1 AND om.user_id = $2
+		)`, eventID, userID,
+	).Scan(&ok)
+	return ok, err
+}
+
+// authorizeEventOrganiser checks that the authenticated user organises an
+// event. It writes the error response itself and returns false if not.
+func (h *Handler) authorizeEventOrganiser(c *gin.Context, eventID int) bool {
+	ok, err := h.organisesEvent(c.Request.Context(), c.GetInt("userID"), eventID)
+	if err != nil {
+		log.Printf("Error checking organiser of event %d: %v", eventID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check event access"})
+		return false
+	}
+	if !ok {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You do not organise this event"})
+		return false
+	}
+	return true
+}
+
+// authorizeOrganisationMember checks that the authenticated user is a member
+// of an organisation. It writes the error response itself and returns false if
+// not.
+func (h *Handler) authorizeOrganisationMember(c *gin.Context, orgID int) bool {
+	var ok bool
+	err := h.DB.QueryRow(c.Request.Context(),
+		"SELECT EXISTS (SELECT 1 FROM organisation_members WHERE organisation_id = $1 AND user_id = $2)",
+		orgID, c.GetInt("userID"),
+	).Scan(&ok)
+	if err != nil {
+		log.Printf("Error checking membership of organisation %d: %v", orgID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check organisation access"})
+		return false
+	}
+	if !ok {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You are not a member of this organisation"})
+		return false
+	}
+	return true
+}
+
+// purchaseEventID returns the event a purchase is for. It returns pgx.ErrNoRows
+// for unknown purchases.
+func (h *Handler) purchaseEventID(ctx context.Context, purchaseID int) (int, error) {
+	var eventID int
+	err := h.DB.QueryRow(ctx, "SELECT event_id FROM purchases WHERE id = $1", purchaseID).Scan(&eventID)
+	return eventID, err
+}
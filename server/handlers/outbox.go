@@ -0,0 +1,149 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/tpgcig/carneauengine/server/outbox"
+)
+
+// Outbox job kinds handled by RegisterJobs.
+const (
+	jobCommitReservation  = "commit_reservation"
+	jobReleaseReservation = "release_reservation"
+	jobSendTicketEmail    = "send_ticket_email"
+	jobSendTransferEmail  = "send_transfer_email"
+	jobSendReminderEmail  = "send_reminder_email"
+	jobSendLookupEmail    = "send_lookup_email"
+	jobSendBroadcastEmail = "send_broadcast_email"
+)
+
+type reservationJob struct {
+	ReservationID string `json:"reservation_id"`
+}
+
+type ticketEmailJob struct {
+	PurchaseID int    `json:"purchase_id"`
+	Email      string `json:"email"`
+	TicketIDs  []int  `json:"ticket_ids,omitempty"` // just these, e.g. one transferred to Email
+}
+
+// RegisterJobs registers the handlers for the outbox jobs the webhook queues.
+func (h *Handler) RegisterJobs(w *outbox.Worker) {
+	w.Handle(jobCommitReservation, func(ctx context.Context, payload json.RawMessage) error {
+		var job reservationJob
+		if err := json.Unmarshal(payload, &job); err != nil {
+			return outbox.Permanent(err)
+		}
+		return h.Reservations.Commit(ctx, job.ReservationID)
+	})
+	w.Handle(jobReleaseReservation, func(ctx context.Context, payload json.RawMessage) error {
+		var job reservationJob
+		if err := json.Unmarshal(payload, &job); err != nil {
+			return outbox.Permanent(err)
+		}
+		return h.Reservations.Release(ctx, job.ReservationID)
+	})
+	w.Handle(jobSendTicketEmail, func(ctx context.Context, payload json.RawMessage) error {
+		var job ticketEmailJob
+		if err := json.Unmarshal(payload, &job); err != nil {
+			return outbox.Permanent(err)
+		}
+		return h.sendTicketEmail(ctx, job.PurchaseID, job.Email, job.TicketIDs)
+	})
+	w.Handle(jobSendTransferEmail, func(ctx context.Context, payload json.RawMessage) error {
+		var job transferEmailJob
+		if err := json.Unmarshal(payload, &job); err != nil {
+			return outbox.Permanent(err)
+		}
+		return h.sendTransferEmail(ctx, job)
+	})
+	w.Handle(jobSendReminderEmail, func(ctx context.Context, payload json.RawMessage) error {
+		var job reminderJob
+		if err := json.Unmarshal(payload, &job); err != nil {
+			return outbox.Permanent(err)
+		}
+		return h.sendReminderEmail(ctx, job)
+	})
+	w.Handle(jobSendLookupEmail, func(ctx context.Context, payload json.RawMessage) error {
+		var job lookupEmailJob
+		if err := json.Unmarshal(payload, &job); err != nil {
+			return outbox.Permanent(err)
+		}
+		return h.sendLookupEmail(ctx, job)
+	})
+	w.Handle(jobSendBroadcastEmail, func(ctx context.Context, payload json.RawMessage) error {
+		var job broadcastEmailJob
+		if err := json.Unmarshal(payload, &job); err != nil {
+			return outbox.Permanent(err)
+		}
+		return h.sendBroadcastEmail(ctx, job)
+	})
+}
+
+// enqueueReservationJob queues a commit or release of a reservation's Redis
+// holds, if the purchase had any.
+func enqueueReservationJob(ctx context.Context, db outbox.Execer, kind, reservationID string) error {
+	if reservationID == "" {
+		return nil
+	}
+	return outbox.Enqueue(ctx, db, kind, reservationJob{ReservationID: reservationID})
+}
+
+// GetOutboxJobs lists outbox jobs for admins, newest first. ?status= narrows
+// it to one status, e.g. dead, and ?limit= caps it (default 100).
+func (h *Handler) GetOutboxJobs(c *gin.Context) {
+	status := c.Query("status")
+	switch status {
+	case "", outbox.StatusPending, outbox.StatusRunning, outbox.StatusDone, outbox.StatusDead:
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Unknown job status %q", status)})
+		return
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	if err != nil || limit <= 0 || limit > 1000 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be between 1 and 1000"})
+		return
+	}
+
+	jobs, err := outbox.List(c.Request.Context(), h.DB, status, limit)
+	if err != nil {
+		log.Printf("Error listing outbox jobs: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load jobs"})
+		return
+	}
+	c.JSON(http.StatusOK, jobs)
+}
+
+// RetryOutboxJob queues an outbox job, usually a dead one, to run again now.
+func (h *Handler) RetryOutboxJob(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid job ID"})
+		return
+	}
+
+	job, err := outbox.Retry(c.Request.Context(), h.DB, id)
+	if errors.Is(err, outbox.ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Job not found"})
+		return
+	}
+	if errors.Is(err, outbox.ErrRunning) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Job is running"})
+		return
+	}
+	if err != nil {
+		log.Printf("Error retrying outbox job %d: %v", id, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retry job"})
+		return
+	}
+	log.Printf("Outbox job %d (%s) queued for retry by user %d", id, job.Kind, c.GetInt("userID"))
+	c.JSON(http.StatusOK, job)
+}
@@ -0,0 +1,18 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GetTicketKeys publishes the public keys ticket QR tokens are signed with, by
+// key ID, so scanners can check tickets while offline. current is the key new
+// tickets are signed with; the others are retired but still trusted.
+func (h *Handler) GetTicketKeys(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"algorithm": "Ed25519",
+		"current":   h.TicketSigner.KeyID(),
+		"keys":      h.TicketKeys.PublicKeys(),
+	})
+}
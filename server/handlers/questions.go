@@ -0,0 +1,407 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/mail"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+)
+
+// Kinds of registration question.
+const (
+	questionText     = "text"
+	questionSelect   = "select"
+	questionCheckbox = "checkbox"
+)
+
+const (
+	maxAnswerLength       = 1000
+	maxAttendeeNameLength = 200
+)
+
+// RegistrationQuestion is asked of each attendee at checkout, for every
+// ticket type of its event or, if TicketTypeID is set, for one.
+type RegistrationQuestion struct {
+	ID           int      `json:"id"`
+	EventID      int      `json:"event_id"`
+	TicketTypeID *int     `json:"ticket_type_id"`
+	Label        string   `json:"label"`
+	Kind         string   `json:"kind"`
+	Options      []string `json:"options"` // the choices of a select question
+	Required     bool     `json:"required"`
+	Position     int      `json:"position"`
+}
+
+// appliesTo reports whether the question is asked of ticket type ticketTypeID.
+func (q RegistrationQuestion) appliesTo(ticketTypeID int) bool {
+	return q.TicketTypeID == nil || *q.TicketTypeID == ticketTypeID
+}
+
+type CreateQuestionRequest struct {
+	TicketTypeID *int     `json:"ticket_type_id"`
+	Label        string   `json:"label" binding:"required"`
+	Kind         string   `json:"kind" binding:"required,oneof=text select checkbox"`
+	Options      []string `json:"options"`
+	Required     bool     `json:"required"`
+	Position     int      `json:"position"`
+}
+
+// AttendeeDetails is who one ticket of a checkout is for, and their answers.
+type AttendeeDetails struct {
+	Name    string           `json:"name"`
+	Email   string           `json:"email"`
+	Answers []AttendeeAnswer `json:"answers"`
+}
+
+// AttendeeAnswer answers one question. Value is a string for text and select
+// questions and a bool for checkboxes.
+type AttendeeAnswer struct {
+	QuestionID int `json:"question_id"`
+	Value      any `json:"value"`
+}
+
+// attendee is AttendeeDetails once validated, as kept on purchase_items until
+// the tickets are issued. Answers are by question ID, with checkboxes as
+// "true" or "false".
+type attendee struct {
+	Name    string         `json:"name,omitempty"`
+	Email   string         `json:"email,omitempty"`
+	Answers map[int]string `json:"answers,omitempty"`
+}
+
+// eventQuestions loads an event's registration questions in the order they
+// are asked.
+func (h *Handler) eventQuestions(ctx context.Context, eventID int) ([]RegistrationQuestion, error) {
+	rows, err := h.DB.Query(ctx, `
+		SELECT id, event_id, ticket_type_id, label, kind, options, required, position
+		FROM registration_questions
+		WHERE event_id = $1
+		ORDER BY position, id`, eventID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	questions := []RegistrationQuestion{}
+	for rows.Next() {
+		var q RegistrationQuestion
+		if err := rows.Scan(&q.ID, &q.EventID, &q.TicketTypeID, &q.Label, &q.Kind, &q.Options, &q.Required, &q.Position); err != nil {
+			return nil, err
+		}
+		questions = append(questions, q)
+	}
+	return questions, rows.Err()
+}
+
+// validateAttendees checks the attendees given for quantity tickets of
+// ticketTypeID against the event's questions. Attendees can be left out if
+// none of the questions that apply are required; otherwise there must be one
+// per ticket. The error is fit to show the buyer.
+func validateAttendees(questions []RegistrationQuestion, ticketTypeID, quantity int, details []AttendeeDetails) ([]attendee, error) {
+	var asked []RegistrationQuestion
+	required := false
+	for _, q := range questions {
+		if q.appliesTo(ticketTypeID) {
+			asked = append(asked, q)
+			required = required || q.Required
+		}
+	}
+	if len(details) == 0 {
+		if required {
+			return nil, fmt.Errorf("attendee details are needed for each ticket")
+		}
+		return nil, nil
+	}
+	if len(details) != quantity {
+		return nil, fmt.Errorf("expected attendee details for %d tickets, got %d", quantity, len(details))
+	}
+
+	attendees := make([]attendee, len(details))
+	for i, d := range details {
+		a, err := validateAttendee(asked, d)
+		if err != nil {
+			return nil, fmt.Errorf("ticket %d: %w", i+1, err)
+		}
+		attendees[i] = a
+	}
+	return attendees, nil
+}
+
+func validateAttendee(asked []RegistrationQuestion, d AttendeeDetails) (attendee, error) {
+	a := attendee{Name: strings.TrimSpace(d.Name), Email: strings.TrimSpace(d.Email), Answers: map[int]string{}}
+	if utf8.RuneCountInString(a.Name) > maxAttendeeNameLength {
+		return a, fmt.Errorf("name is longer than %d characters", maxAttendeeNameLength)
+	}
+	if a.Email != "" {
+		if _, err := mail.ParseAddress(a.Email); err != nil {
+			return a, fmt.Errorf("%q is not a valid email address", a.Email)
+		}
+	}
+
+	byID := make(map[int]RegistrationQuestion, len(asked))
+	for _, q := range asked {
+		byID[q.ID] = q
+	}
+	for _, ans := range d.Answers {
+		q, ok := byID[ans.QuestionID]
+		if !ok {
+			return a, fmt.Errorf("question %d isn't asked for this ticket", ans.QuestionID)
+		}
+		if _, dup := a.Answers[q.ID]; dup {
+			return a, fmt.Errorf("%q is answered twice", q.Label)
+		}
+		value, err := answerValue(q, ans.Value)
+		if err != nil {
+			return a, err
+		}
+		if value != "" {
+			a.Answers[q.ID] = value
+		}
+	}
+	for _, q := range asked {
+		if !q.Required {
+			continue
+		}
+		if value, ok := a.Answers[q.ID]; !ok || q.Kind == questionCheckbox && value != "true" {
+			return a, fmt.Errorf("%q is required", q.Label)
+		}
+	}
+	return a, nil
+}
+
+// answerValue checks an answer to q and returns it as stored; "" means
+// unanswered.
+func answerValue(q RegistrationQuestion, value any) (string, error) {
+	switch q.Kind {
+	case questionCheckbox:
+		checked, ok := value.(bool)
+		if !ok && value != nil {
+			return "", fmt.Errorf("%q must be true or false", q.Label)
+		}
+		return strconv.FormatBool(checked), nil
+	case questionSelect:
+		s, ok := value.(string)
+		if !ok && value != nil {
+			return "", fmt.Errorf("%q must be one of its options", q.Label)
+		}
+		if s == "" {
+			return "", nil
+		}
+		for _, opt := range q.Options {
+			if s == opt {
+				return s, nil
+			}
+		}
+		return "", fmt.Errorf("%q must be one of its options", q.Label)
+	default:
+		s, ok := value.(string)
+		if !ok && value != nil {
+			return "", fmt.Errorf("%q must be text", q.Label)
+		}
+		s = strings.TrimSpace(s)
+		if utf8.RuneCountInString(s) > maxAnswerLength {
+			return "", fmt.Errorf("%q is longer than %d characters", q.Label, maxAnswerLength)
+		}
+		return s, nil
+	}
+}
+
+// GetRegistrationQuestions lists an event's questions, for the checkout form.
+func (h *Handler) GetRegistrationQuestions(c *gin.Context) {
+	eventID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid event ID"})
+		return
+	}
+	questions, err := h.eventQuestions(c.Request.Context(), eventID)
+	if err != nil {
+		log.Printf("Error loading questions of event %d: %v", eventID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load questions"})
+		return
+	}
+	c.JSON(http.StatusOK, questions)
+}
+
+// CreateRegistrationQuestion adds a question to an event's checkout. Select
+// questions need options to choose from; other kinds take none.
+func (h *Handler) CreateRegistrationQuestion(c *gin.Context) {
+	eventID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid event ID"})
+		return
+	}
+	var req CreateQuestionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	req.Label = strings.TrimSpace(req.Label)
+	options := make([]string, 0, len(req.Options))
+	for _, opt := range req.Options {
+		if opt = strings.TrimSpace(opt); opt != "" {
+			options = append(options, opt)
+		}
+	}
+	switch {
+	case req.Label == "":
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Questions need a label"})
+		return
+	case req.Kind == questionSelect && len(options) == 0:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Select questions need options"})
+		return
+	case req.Kind != questionSelect && len(options) > 0:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Only select questions have options"})
+		return
+	}
+	if !h.authorizeEventOrganiser(c, eventID) {
+		return
+	}
+	ctx := c.Request.Context()
+
+	if req.TicketTypeID != nil {
+		var typeEventID int
+		err := h.DB.QueryRow(ctx, "SELECT event_id FROM ticket_types WHERE id = $1", *req.TicketTypeID).Scan(&typeEventID)
+		if err != nil && err != pgx.ErrNoRows {
+			log.Printf("Error loading ticket type %d: %v", *req.TicketTypeID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create question"})
+			return
+		}
+		if err == pgx.ErrNoRows || typeEventID != eventID {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Ticket type is not part of this event"})
+			return
+		}
+	}
+
+	q := RegistrationQuestion{
+		EventID:      eventID,
+		TicketTypeID: req.TicketTypeID,
+		Label:        req.Label,
+		Kind:         req.Kind,
+		Options:      options,
+		Required:     req.Required,
+		Position:     req.Position,
+	}
+	err = h.DB.QueryRow(ctx, `
+		INSERT INTO registration_questions (event_id, ticket_type_id, label, kind, options, required, position)
+		VALUES ($1, $2, $3, $4, $5::text[], $6, $7)
+		RETURNING id`,
+		q.EventID, q.TicketTypeID, q.Label, q.Kind, q.Options, q.Required, q.Position,
+	).Scan(&q.ID)
+	if err != nil {
+		log.Printf("Error creating question for event %d: %v", eventID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create question"})
+		return
+	}
+	log.Printf("Question %d added to event %d by user %d", q.ID, eventID, c.GetInt("userID"))
+	c.JSON(http.StatusCreated, q)
+}
+
+// DeleteRegistrationQuestion stops a question being asked. Answers already
+// given keep the question's label.
+func (h *Handler) DeleteRegistrationQuestion(c *gin.Context) {
+	eventID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid event ID"})
+		return
+	}
+	questionID, err := strconv.Atoi(c.Param("questionId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid question ID"})
+		return
+	}
+	if !h.authorizeEventOrganiser(c, eventID) {
+		return
+	}
+
+	tag, err := h.DB.Exec(c.Request.Context(), "DELETE FROM registration_questions WHERE id = $1 AND event_id = $2", questionID, eventID)
+	if err != nil {
+		log.Printf("Error deleting question %d: %v", questionID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete question"})
+		return
+	}
+	if tag.RowsAffected() == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Question not found"})
+		return
+	}
+	log.Printf("Question %d removed from event %d by user %d", questionID, eventID, c.GetInt("userID"))
+	c.Status(http.StatusNoContent)
+}
+
+type Attendee struct {
+	TicketID       int                    `json:"ticket_id"`
+	TicketType     string                 `json:"ticket_type"`
+	Status         string                 `json:"status"`
+	PurchaserEmail string                 `json:"purchaser_email"`
+	Name           *string                `json:"name"`
+	Email          *string                `json:"email"`
+	Answers        []AttendeeAnswerRecord `json:"answers"`
+}
+
+type AttendeeAnswerRecord struct {
+	QuestionID *int   `json:"question_id"` // nil once the question has been deleted
+	Label      string `json:"label"`
+	Value      string `json:"value"`
+}
+
+// GetEventAttendees lists an event's issued tickets with who they are for and
+// the answers given at checkout.
+func (h *Handler) GetEventAttendees(c *gin.Context) {
+	eventID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid event ID"})
+		return
+	}
+	if !h.authorizeEventOrganiser(c, eventID) {
+		return
+	}
+
+	rows, err := h.DB.Query(c.Request.Context(), `
+		SELECT t.id, tt.name, COALESCE(t.status, 'valid'), COALESCE(u.email, ''), t.attendee_name, t.attendee_email,
+			COALESCE(jsonb_agg(jsonb_build_object('question_id', a.question_id, 'label', a.label, 'value', a.value) ORDER BY a.id)
+				FILTER (WHERE a.id IS NOT NULL), '[]'::jsonb)
+		FROM tickets t
+		JOIN ticket_types tt ON tt.id = t.ticket_type_id
+		LEFT JOIN purchases p ON p.id = t.purchase_id
+		LEFT JOIN users u ON u.id = p.user_id
+		LEFT JOIN ticket_answers a ON a.ticket_id = t.id
+		WHERE tt.event_id = $1
+		GROUP BY t.id, tt.name, u.email
+		ORDER BY t.id`, eventID)
+	if err != nil {
+		log.Printf("Error loading attendees of event %d: %v", eventID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load attendees"})
+		return
+	}
+	defer rows.Close()
+
+	attendees := []Attendee{}
+	for rows.Next() {
+		var a Attendee
+		var answers []byte
+		if err := rows.Scan(&a.TicketID, &a.TicketType, &a.Status, &a.PurchaserEmail, &a.Name, &a.Email, &answers); err != nil {
+			log.Printf("Error scanning attendee: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load attendees"})
+			return
+		}
+		if err := json.Unmarshal(answers, &a.Answers); err != nil {
+			log.Printf("Error decoding answers of ticket %d: %v", a.TicketID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load attendees"})
+			return
+		}
+		attendees = append(attendees, a)
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("Error loading attendees of event %d: %v", eventID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load attendees"})
+		return
+	}
+	c.JSON(http.StatusOK, attendees)
+}
@@ -0,0 +1,134 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgtype"
+
+	"github.com/tpgcig/carneauengine/server/money"
+	"github.com/tpgcig/carneauengine/server/payment"
+)
+
+// ReconciliationIssue is a purchase whose status disagrees with the payment
+// gateway's record of its checkout session.
+type ReconciliationIssue struct {
+	PurchaseID    int         `json:"purchase_id"`
+	SessionID     string      `json:"session_id"`
+	PaymentStatus string      `json:"payment_status"`
+	SessionStatus string      `json:"session_status"`
+	Expected      money.Money `json:"expected"`
+	Paid          money.Money `json:"paid"`
+	Reason        string      `json:"reason"`
+}
+
+// ReconcilePurchases checks every purchase created since the given time
+// against the payment gateway and returns the ones that disagree, e.g. paid
+// sessions whose webhook never arrived, or purchases held for review.
+func (h *Handler) ReconcilePurchases(ctx context.Context, since time.Time) ([]ReconciliationIssue, error) {
+	rows, err := h.DB.Query(ctx, `
+		SELECT id, stripe_payment_id, payment_status, total_amount, currency, COALESCE(review_reason, '')
+		FROM purchases
+		WHERE stripe_payment_id IS NOT NULL AND created_at >= $1
+		ORDER BY id`, since)
+	if err != nil {
+		return nil, err
+	}
+
+	type purchaseRecord struct {
+		id           int
+		sessionID    string
+		status       string
+		reviewReason string
+		expected     money.Money
+	}
+	var purchases []purchaseRecord
+	for rows.Next() {
+		var p purchaseRecord
+		var total pgtype.Numeric
+		var currency string
+		if err := rows.Scan(&p.id, &p.sessionID, &p.status, &total, &currency, &p.reviewReason); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if p.expected, err = money.FromNumeric(total, currency); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("purchase %d: %w", p.id, err)
+		}
+		purchases = append(purchases, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var issues []ReconciliationIssue
+	for _, p := range purchases {
+		s, err := h.Payments.GetSession(ctx, p.sessionID)
+		if err != nil {
+			// Report it and carry on, so one bad session doesn't hide the rest
+			issues = append(issues, ReconciliationIssue{
+				PurchaseID:    p.id,
+				SessionID:     p.sessionID,
+				PaymentStatus: p.status,
+				SessionStatus: "unknown",
+				Expected:      p.expected,
+				Reason:        fmt.Sprintf("could not fetch session: %v", err),
+			})
+			continue
+		}
+		if reason := reconcileReason(p.status, p.reviewReason, p.expected, s); reason != "" {
+			issues = append(issues, ReconciliationIssue{
+				PurchaseID:    p.id,
+				SessionID:     p.sessionID,
+				PaymentStatus: p.status,
+				SessionStatus: sessionState(s),
+				Expected:      p.expected,
+				Paid:          s.AmountTotal,
+				Reason:        reason,
+			})
+		}
+	}
+	return issues, nil
+}
+
+// sessionState describes a session in one word for reports.
+func sessionState(s *payment.Session) string {
+	if s.Status == payment.SessionComplete && !s.Paid {
+		return "complete_unpaid"
+	}
+	return string(s.Status)
+}
+
+// reconcileReason explains why a purchase's status disagrees with its session,
+// or returns "" if they agree.
+func reconcileReason(status, reviewReason string, expected money.Money, s *payment.Session) string {
+	switch {
+	case status == "needs_review":
+		return "held for review: " + reviewReason
+	case s.Status == payment.SessionOpen:
+		if status != "pending" {
+			return "session is still open"
+		}
+	case s.Status == payment.SessionExpired:
+		if status != "expired" && status != "failed" {
+			return "session expired without payment"
+		}
+	case s.Paid:
+		if status == "pending" || status == "processing" {
+			return "session was paid but the purchase was never fulfilled"
+		}
+		if status == "expired" || status == "failed" {
+			return "session was paid but the purchase was closed"
+		}
+		if s.AmountTotal != expected {
+			return "paid amount differs from the purchase total"
+		}
+	default: // complete, payment not cleared or failed
+		if status != "processing" && status != "failed" {
+			return "session payment has not cleared"
+		}
+	}
+	return ""
+}
@@ -0,0 +1,66 @@
+package handlers_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/tpgcig/carneauengine/server/handlers"
+	"github.com/tpgcig/carneauengine/server/money"
+	"github.com/tpgcig/carneauengine/server/payment"
+)
+
+// TestReconcilePurchases_PaidButNeverFulfilled pays a session whose webhook is
+// lost and checks reconciliation reports the still-pending purchase.
+func TestReconcilePurchases_PaidButNeverFulfilled(t *testing.T) {
+	db := newTestDB(t)
+	ctx := context.Background()
+
+	// A webhook endpoint that acknowledges callbacks and drops them
+	lost := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	t.Cleanup(lost.Close)
+	fake := payment.NewFakeGateway("http://unused", lost.URL, "test-secret")
+	h := &handlers.Handler{DB: db, Payments: fake}
+
+	paid := newCheckoutFixture(t, db, 1)
+	open := newCheckoutFixture(t, db, 1)
+	for _, f := range []checkoutFixture{paid, open} {
+		s, err := fake.CreateSession(ctx, payment.SessionParams{
+			LineItems: []payment.LineItem{{Name: "GA", UnitPrice: money.New(1000, "aud"), Quantity: 1}},
+			Metadata:  map[string]string{},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.Exec(ctx, "UPDATE purchases SET stripe_payment_id = $1 WHERE id = $2", s.ID, f.purchaseID)
+		mustQuery(t, err)
+		if f == paid {
+			if err := fake.Complete(ctx, s.ID); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	issues, err := h.ReconcilePurchases(ctx, time.Now().Add(-time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var found bool
+	for _, issue := range issues {
+		switch issue.PurchaseID {
+		case paid.purchaseID:
+			found = true
+			if issue.PaymentStatus != "pending" || issue.SessionStatus != "complete" {
+				t.Errorf("expected pending purchase with complete session, got %+v", issue)
+			}
+		case open.purchaseID:
+			t.Errorf("expected the unpaid open session to agree, got %+v", issue)
+		}
+	}
+	if !found {
+		t.Errorf("expected purchase %d to be reported, got %+v", paid.purchaseID, issues)
+	}
+}
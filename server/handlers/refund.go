@@ -0,0 +1,651 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+
+	"github.com/tpgcig/carneauengine/server/money"
+	"github.com/tpgcig/carneauengine/server/payment"
+	"github.com/tpgcig/carneauengine/server/ticketstate"
+)
+
+type RefundRequest struct {
+	TicketIDs []int  `json:"ticket_ids"` // empty refunds every ticket still valid
+	Reason    string `json:"reason"`
+}
+
+type RefundResponse struct {
+	ID              int         `json:"id"`
+	PurchaseID      int         `json:"purchase_id"`
+	GatewayRefundID string      `json:"gateway_refund_id"`
+	Amount          money.Money `json:"amount"`
+	TicketIDs       []int       `json:"ticket_ids"`
+	PaymentStatus   string      `json:"payment_status"`
+}
+
+// refundableTicket is a valid ticket on a purchase and what was paid for it.
+type refundableTicket struct {
+	ID           int
+	TicketTypeID int
+	Price        money.Money
+}
+
+// staleRefundAge is how long a refund can stay pending before the request that
+// started it is taken to have died, and RecoverStaleRefunds finishes it.
+const staleRefundAge = 5 * time.Minute
+
+// errRefundRecorded is returned by applyRefund for a refund that is no longer
+// pending, because another request recorded it first.
+var errRefundRecorded = errors.New("refund already recorded")
+
+// pendingRefund is a refund recorded before the gateway is asked for it.
+type pendingRefund struct {
+	ID             int
+	PurchaseID     int
+	PaymentID      string
+	Status         string      // the purchase's status when the refund was asked for
+	Amount         money.Money // zero for whatever is left of the payment
+	TicketIDs      []int
+	IdempotencyKey string
+}
+
+// CreateRefund refunds a whole purchase, or just some of its tickets, through
+// the payment gateway. Only organisers of the purchase's event may do this.
+// Refunded tickets are marked refunded and go back on sale. Purchases held for review
+// can be refunded too, as a whole.
+//
+// Nothing is locked while the gateway is called. The refund is first recorded
+// as pending, which stops any other refund of the purchase starting, and is
+// only applied to the purchase and its tickets once the gateway has taken it.
+func (h *Handler) CreateRefund(c *gin.Context) {
+	ctx := c.Request.Context()
+	purchaseID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid purchase ID"})
+		return
+	}
+
+	var req RefundRequest
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	eventID, err := h.purchaseEventID(ctx, purchaseID)
+	if err == pgx.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Purchase not found"})
+		return
+	}
+	if err != nil {
+		log.Printf("Error loading purchase %d: %v", purchaseID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load purchase"})
+		return
+	}
+	if !h.authorizeEventOrganiser(c, eventID) {
+		return
+	}
+
+	pending, ok := h.recordPendingRefund(c, purchaseID, req)
+	if !ok {
+		return
+	}
+
+	refund, err := h.Payments.Refund(ctx, payment.RefundParams{
+		PaymentID:      pending.PaymentID,
+		Amount:         pending.Amount,
+		IdempotencyKey: pending.IdempotencyKey,
+	})
+	if err != nil {
+		log.Printf("Refund of %s on purchase %d failed: %v", pending.Amount, purchaseID, err)
+		if _, err := h.DB.Exec(ctx, "UPDATE refunds SET status = 'failed' WHERE id = $1 AND status = 'pending'", pending.ID); err != nil {
+			log.Printf("Error marking refund %d failed: %v", pending.ID, err)
+		}
+		c.JSON(http.StatusBadGateway, gin.H{"error": "The payment provider did not accept the refund"})
+		return
+	}
+
+	resp, err := h.applyRefund(ctx, pending, refund, c.GetInt("userID"), req.Reason)
+	if errors.Is(err, errRefundRecorded) {
+		c.JSON(http.StatusConflict, gin.H{"error": "This refund has already been recorded"})
+		return
+	}
+	if err != nil {
+		log.Printf("Error recording refund %s on purchase %d: %v", refund.ID, purchaseID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Refund was issued but could not be recorded"})
+		return
+	}
+	log.Printf("Refunded %s for tickets %v on purchase %d (%s)", resp.Amount, resp.TicketIDs, purchaseID, refund.ID)
+	c.JSON(http.StatusCreated, resp)
+}
+
+// recordPendingRefund works out what a refund request covers and records it
+// as a pending refund. If the same refund was left pending by an earlier
+// request that failed part way, that one is picked up again instead. It writes
+// the error response itself and returns false if it failed.
+func (h *Handler) recordPendingRefund(c *gin.Context, purchaseID int, req RefundRequest) (*pendingRefund, bool) {
+	ctx := c.Request.Context()
+	tx, err := h.DB.Begin(ctx)
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start database transaction"})
+		return nil, false
+	}
+	defer tx.Rollback(ctx)
+
+	p := &pendingRefund{PurchaseID: purchaseID}
+	var currency string
+	err = tx.QueryRow(ctx,
+		"SELECT payment_status, COALESCE(payment_id, ''), currency FROM purchases WHERE id = $1 FOR UPDATE",
+		purchaseID,
+	).Scan(&p.Status, &p.PaymentID, &currency)
+	if err != nil {
+		log.Printf("Error locking purchase %d: %v", purchaseID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load purchase"})
+		return nil, false
+	}
+	if (p.Status != "succeeded" && p.Status != "partially_refunded" && p.Status != "needs_review") || p.PaymentID == "" {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("A %s purchase cannot be refunded", p.Status)})
+		return nil, false
+	}
+
+	// A purchase held for review has no tickets, so it is refunded whole. Zero
+	// asks the gateway for whatever is left, and it reports how much that was.
+	p.Amount = money.New(0, currency)
+	if p.Status == "needs_review" {
+		if len(req.TicketIDs) > 0 {
+			c.JSON(http.StatusConflict, gin.H{"error": "This purchase has no tickets; it can only be refunded whole"})
+			return nil, false
+		}
+	} else {
+		valid, err := refundableTickets(ctx, tx, purchaseID)
+		if err != nil {
+			log.Printf("Error loading tickets for purchase %d: %v", purchaseID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load tickets"})
+			return nil, false
+		}
+
+		tickets := valid
+		if len(req.TicketIDs) > 0 {
+			byID := make(map[int]refundableTicket, len(valid))
+			for _, t := range valid {
+				byID[t.ID] = t
+			}
+			tickets = nil
+			seen := make(map[int]bool)
+			for _, id := range req.TicketIDs {
+				t, ok := byID[id]
+				if !ok {
+					c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("Ticket %d is not a valid ticket on this purchase", id)})
+					return nil, false
+				}
+				if !seen[id] {
+					seen[id] = true
+					tickets = append(tickets, t)
+				}
+			}
+		}
+		if len(tickets) == 0 {
+			c.JSON(http.StatusConflict, gin.H{"error": "Nothing left to refund on this purchase"})
+			return nil, false
+		}
+
+		p.Amount = tickets[0].Price
+		p.TicketIDs = []int{tickets[0].ID}
+		for _, t := range tickets[1:] {
+			if p.Amount, err = p.Amount.Add(t.Price); err != nil {
+				log.Printf("Error totalling refund for purchase %d: %v", purchaseID, err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to total refund"})
+				return nil, false
+			}
+			p.TicketIDs = append(p.TicketIDs, t.ID)
+		}
+		sort.Ints(p.TicketIDs)
+	}
+
+	// The key makes retrying the same refund safe if we fail after the gateway
+	// has taken it
+	p.IdempotencyKey = fmt.Sprintf("purchase-%d-refund-%s", purchaseID, joinInts(p.TicketIDs))
+	if len(p.TicketIDs) == 0 {
+		p.IdempotencyKey = fmt.Sprintf("purchase-%d-refund-all", purchaseID)
+	}
+
+	var existingKey string
+	err = tx.QueryRow(ctx,
+		"SELECT id, COALESCE(idempotency_key, '') FROM refunds WHERE purchase_id = $1 AND status = 'pending'",
+		purchaseID,
+	).Scan(&p.ID, &existingKey)
+	switch {
+	case err == pgx.ErrNoRows:
+		err = tx.QueryRow(ctx, `
+			INSERT INTO refunds (purchase_id, amount, currency, source, reason, created_by, status, idempotency_key, ticket_ids)
+			VALUES ($1, $2, $3, 'organiser', $4, $5, 'pending', $6, $7) RETURNING id`,
+			purchaseID, p.Amount.Numeric(), p.Amount.Currency, req.Reason, c.GetInt("userID"), p.IdempotencyKey, p.TicketIDs,
+		).Scan(&p.ID)
+		if err != nil {
+			log.Printf("Error recording refund on purchase %d: %v", purchaseID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record refund"})
+			return nil, false
+		}
+	case err != nil:
+		log.Printf("Error loading pending refunds of purchase %d: %v", purchaseID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record refund"})
+		return nil, false
+	case existingKey != p.IdempotencyKey:
+		c.JSON(http.StatusConflict, gin.H{"error": "Another refund on this purchase is still in progress"})
+		return nil, false
+	default:
+		log.Printf("Retrying pending refund %d on purchase %d", p.ID, purchaseID)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		log.Printf("Error committing transaction: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record refund"})
+		return nil, false
+	}
+	return p, true
+}
+
+// applyRefund records what the gateway refunded against a pending refund, and
+// marks its tickets refunded on behalf of actorID. It returns
+// errRefundRecorded if the refund is no longer pending.
+func (h *Handler) applyRefund(ctx context.Context, p *pendingRefund, refund *payment.Refund, actorID int, reason string) (RefundResponse, error) {
+	tx, err := h.DB.Begin(ctx)
+	if err != nil {
+		return RefundResponse{}, err
+	}
+	defer tx.Rollback(ctx)
+
+	// Lock the purchase so a charge.refunded webhook waits for this refund
+	if _, err := tx.Exec(ctx, "SELECT 1 FROM purchases WHERE id = $1 FOR UPDATE", p.PurchaseID); err != nil {
+		return RefundResponse{}, fmt.Errorf("locking purchase: %w", err)
+	}
+
+	amount := p.Amount
+	if amount.Amount == 0 {
+		amount = refund.Amount
+	}
+	tag, err := tx.Exec(ctx,
+		"UPDATE refunds SET status = 'succeeded', gateway_refund_id = $1, amount = $2 WHERE id = $3 AND status = 'pending'",
+		refund.ID, amount.Numeric(), p.ID)
+	if err != nil {
+		return RefundResponse{}, fmt.Errorf("updating refund %d: %w", p.ID, err)
+	}
+	if tag.RowsAffected() == 0 {
+		return RefundResponse{}, errRefundRecorded
+	}
+
+	// A ticket may have changed hands or been voided since the refund was
+	// asked for; the money is back either way, so only the rest are marked
+	ticketIDs := p.TicketIDs
+	if len(ticketIDs) > 0 {
+		valid, err := refundableTickets(ctx, tx, p.PurchaseID)
+		if err != nil {
+			return RefundResponse{}, fmt.Errorf("loading tickets: %w", err)
+		}
+		stillValid := make(map[int]bool, len(valid))
+		for _, t := range valid {
+			stillValid[t.ID] = true
+		}
+		ticketIDs = nil
+		for _, id := range p.TicketIDs {
+			if stillValid[id] {
+				ticketIDs = append(ticketIDs, id)
+			} else {
+				log.Printf("Ticket %d on purchase %d is no longer valid, leaving it out of refund %d", id, p.PurchaseID, p.ID)
+			}
+		}
+	}
+	if err := refundTickets(ctx, tx, p.ID, ticketIDs, actorID, reason); err != nil {
+		return RefundResponse{}, fmt.Errorf("marking tickets refunded: %w", err)
+	}
+
+	status := p.Status
+	if status == "needs_review" {
+		// The whole payment went back, even if it was short of the order total
+		status = "refunded"
+		_, err = tx.Exec(ctx, "UPDATE purchases SET payment_status = $1, updated_at = now() WHERE id = $2", status, p.PurchaseID)
+	} else {
+		status, err = updateRefundStatus(ctx, tx, p.PurchaseID)
+	}
+	if err != nil {
+		return RefundResponse{}, fmt.Errorf("updating refund status: %w", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return RefundResponse{}, err
+	}
+	return RefundResponse{
+		ID:              p.ID,
+		PurchaseID:      p.PurchaseID,
+		GatewayRefundID: refund.ID,
+		Amount:          amount,
+		TicketIDs:       ticketIDs,
+		PaymentStatus:   status,
+	}, nil
+}
+
+// RunRefundRecovery finishes stale pending refunds every interval until ctx
+// is done.
+func (h *Handler) RunRefundRecovery(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			n, err := h.RecoverStaleRefunds(ctx)
+			if err != nil {
+				log.Printf("Error recovering pending refunds: %v", err)
+				continue
+			}
+			if n > 0 {
+				log.Printf("Recovered %d pending refund(s)", n)
+			}
+		}
+	}
+}
+
+// RecoverStaleRefunds finishes refunds left pending for staleRefundAge by a
+// CreateRefund that died part way, and returns how many it finished. Until
+// then they block other refunds of the purchase and its charge.refunded
+// webhooks. Each is asked of the gateway again with its idempotency key, which
+// returns the refund already made if there was one, and applied as CreateRefund
+// would have. Refunds the gateway won't take are marked failed.
+func (h *Handler) RecoverStaleRefunds(ctx context.Context) (int, error) {
+	rows, err := h.DB.Query(ctx, `
+		SELECT r.id, r.purchase_id, COALESCE(p.payment_id, ''), p.payment_status, r.amount, r.currency,
+			COALESCE(r.ticket_ids, '{}'), COALESCE(r.idempotency_key, ''), COALESCE(r.created_by, 0), COALESCE(r.reason, '')
+		FROM refunds r
+		JOIN purchases p ON p.id = r.purchase_id
+		WHERE r.status = 'pending' AND r.created_at < now() - make_interval(secs => $1)
+		ORDER BY r.id`, staleRefundAge.Seconds())
+	if err != nil {
+		return 0, fmt.Errorf("loading pending refunds: %w", err)
+	}
+	type staleRefund struct {
+		pendingRefund
+		ActorID int
+		Reason  string
+	}
+	var stale []staleRefund
+	for rows.Next() {
+		var r staleRefund
+		var amount pgtype.Numeric
+		var currency string
+		err := rows.Scan(&r.ID, &r.PurchaseID, &r.PaymentID, &r.Status, &amount, &currency,
+			&r.TicketIDs, &r.IdempotencyKey, &r.ActorID, &r.Reason)
+		if err == nil {
+			r.Amount, err = money.FromNumeric(amount, currency)
+		}
+		if err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("reading pending refund: %w", err)
+		}
+		stale = append(stale, r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("iterating pending refunds: %w", err)
+	}
+
+	recovered := 0
+	for _, r := range stale {
+		var refund *payment.Refund
+		err := errors.New("no idempotency key to retry it safely with")
+		if r.IdempotencyKey != "" {
+			refund, err = h.Payments.Refund(ctx, payment.RefundParams{
+				PaymentID:      r.PaymentID,
+				Amount:         r.Amount,
+				IdempotencyKey: r.IdempotencyKey,
+			})
+		}
+		if err != nil {
+			log.Printf("Pending refund %d on purchase %d could not be retried, marking it failed: %v", r.ID, r.PurchaseID, err)
+			if _, err := h.DB.Exec(ctx, "UPDATE refunds SET status = 'failed' WHERE id = $1 AND status = 'pending'", r.ID); err != nil {
+				return recovered, fmt.Errorf("marking refund %d failed: %w", r.ID, err)
+			}
+			continue
+		}
+
+		resp, err := h.applyRefund(ctx, &r.pendingRefund, refund, r.ActorID, r.Reason)
+		if errors.Is(err, errRefundRecorded) {
+			continue
+		}
+		if err != nil {
+			return recovered, fmt.Errorf("recording refund %d: %w", r.ID, err)
+		}
+		log.Printf("Recovered refund %d of %s for tickets %v on purchase %d (%s)", r.ID, resp.Amount, resp.TicketIDs, r.PurchaseID, refund.ID)
+		recovered++
+	}
+	return recovered, nil
+}
+
+// applyChargeRefund records refunds reported by the gateway's charge.refunded
+// webhook. Refunds made through CreateRefund are already recorded by the time
+// it arrives, so only the part of the charge's refunded total we don't know
+// about yet, e.g. a refund made in the Stripe dashboard, is recorded. A
+// dashboard refund of the whole charge refunds every remaining ticket; a partial
+// one can't say which tickets it covers, so they are left for the organiser.
+// It writes the error response itself and returns false if it failed.
+func (h *Handler) applyChargeRefund(c *gin.Context, event *payment.Event) bool {
+	ctx := c.Request.Context()
+	ch := event.Charge
+	if ch == nil {
+		log.Printf("Webhook event %s (%s) carries no charge", event.ID, event.Type)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Webhook event has no charge"})
+		return false
+	}
+	log.Printf("Charge %s refunded, %s refunded in total", ch.ID, ch.AmountRefunded)
+
+	tx, err := h.DB.Begin(ctx)
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start database transaction"})
+		return false
+	}
+	defer tx.Rollback(ctx)
+
+	recorded, err := recordStripeEvent(ctx, tx, event)
+	if err != nil {
+		log.Printf("Error recording Stripe event %s: %v", event.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record webhook event"})
+		return false
+	}
+	if !recorded {
+		log.Printf("Stripe event %s was already processed by another delivery", event.ID)
+		return true
+	}
+
+	var purchaseID int
+	var total, refunded pgtype.Numeric
+	var currency string
+	var pending bool
+	err = tx.QueryRow(ctx, `
+		SELECT p.id, p.total_amount, p.currency,
+			(SELECT COALESCE(SUM(r.amount), 0) FROM refunds r WHERE r.purchase_id = p.id AND r.status = 'succeeded'),
+			EXISTS (SELECT 1 FROM refunds r WHERE r.purchase_id = p.id AND r.status = 'pending')
+		FROM purchases p
+		WHERE p.payment_id = $1
+		FOR UPDATE OF p`, ch.PaymentID,
+	).Scan(&purchaseID, &total, &currency, &refunded, &pending)
+	if err == pgx.ErrNoRows {
+		log.Printf("No purchase for refunded payment %s, ignoring event %s", ch.PaymentID, event.ID)
+		return commitOrFail(c, tx)
+	}
+	if err != nil {
+		log.Printf("Error loading purchase for payment %s: %v", ch.PaymentID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load purchase"})
+		return false
+	}
+
+	if pending {
+		// CreateRefund, or RecoverStaleRefunds if it died, hasn't recorded what
+		// the gateway refunded yet, so this can't tell what's new. Fail, and let
+		// the gateway deliver it again.
+		log.Printf("Purchase %d has a refund in progress, deferring event %s", purchaseID, event.ID)
+		c.JSON(http.StatusConflict, gin.H{"error": "A refund on this purchase is still being recorded"})
+		return false
+	}
+
+	known, err := money.FromNumeric(refunded, currency)
+	if err != nil {
+		log.Printf("Error reading refunds of purchase %d: %v", purchaseID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read refunds"})
+		return false
+	}
+	unrecorded := ch.AmountRefunded.Amount - known.Amount
+	if unrecorded <= 0 {
+		log.Printf("Refunds on purchase %d are already recorded", purchaseID)
+		return commitOrFail(c, tx)
+	}
+	amount := money.New(unrecorded, currency)
+
+	var refundID int
+	err = tx.QueryRow(ctx, `
+		INSERT INTO refunds (purchase_id, amount, currency, source, reason)
+		VALUES ($1, $2, $3, 'provider', 'Refunded through the payment provider') RETURNING id`,
+		purchaseID, amount.Numeric(), amount.Currency,
+	).Scan(&refundID)
+	if err != nil {
+		log.Printf("Error recording refund on purchase %d: %v", purchaseID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record refund"})
+		return false
+	}
+
+	if ch.AmountRefunded.Amount >= ch.Amount.Amount {
+		tickets, err := refundableTickets(ctx, tx, purchaseID)
+		if err != nil {
+			log.Printf("Error loading tickets for purchase %d: %v", purchaseID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load tickets"})
+			return false
+		}
+		var ticketIDs []int
+		for _, t := range tickets {
+			ticketIDs = append(ticketIDs, t.ID)
+		}
+		if err := refundTickets(ctx, tx, refundID, ticketIDs, 0, "refunded through the payment provider"); err != nil {
+			log.Printf("Error marking tickets refunded on purchase %d: %v", purchaseID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update tickets"})
+			return false
+		}
+	} else {
+		log.Printf("Partial refund of %s on purchase %d made outside the app; tickets left as they are", amount, purchaseID)
+	}
+
+	if _, err := updateRefundStatus(ctx, tx, purchaseID); err != nil {
+		log.Printf("Error updating refund status of purchase %d: %v", purchaseID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update purchase status"})
+		return false
+	}
+	log.Printf("Recorded refund of %s on purchase %d from event %s", amount, purchaseID, event.ID)
+	return commitOrFail(c, tx)
+}
+
+// refundableTickets returns a purchase's valid tickets with the price paid for
+// each, locking them.
+func refundableTickets(ctx context.Context, tx pgx.Tx, purchaseID int) ([]refundableTicket, error) {
+	rows, err := tx.Query(ctx, `
+		SELECT t.id, t.ticket_type_id,
+			(SELECT pi.unit_price FROM purchase_items pi WHERE pi.purchase_id = t.purchase_id AND pi.ticket_type_id = t.ticket_type_id LIMIT 1),
+			p.currency
+		FROM tickets t
+		JOIN purchases p ON p.id = t.purchase_id
+		WHERE t.purchase_id = $1 AND t.status = 'valid'
+		ORDER BY t.id
+		FOR UPDATE OF t`, purchaseID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tickets []refundableTicket
+	for rows.Next() {
+		var t refundableTicket
+		var price pgtype.Numeric
+		var currency string
+		if err := rows.Scan(&t.ID, &t.TicketTypeID, &price, &currency); err != nil {
+			return nil, err
+		}
+		if t.Price, err = money.FromNumeric(price, currency); err != nil {
+			return nil, fmt.Errorf("ticket %d: %w", t.ID, err)
+		}
+		tickets = append(tickets, t)
+	}
+	return tickets, rows.Err()
+}
+
+// refundTickets marks the tickets a refund covers refunded and puts their
+// places back on sale.
+func refundTickets(ctx context.Context, tx pgx.Tx, refundID int, ticketIDs []int, actorID int, reason string) error {
+	if len(ticketIDs) == 0 {
+		return nil
+	}
+	_, err := tx.Exec(ctx, `
+		UPDATE ticket_types tt
+		SET sold_quantity = tt.sold_quantity - v.n
+		FROM (SELECT ticket_type_id, COUNT(*) AS n FROM tickets WHERE id = ANY($1) AND status = 'valid' GROUP BY ticket_type_id) v
+		WHERE tt.id = v.ticket_type_id`, ticketIDs)
+	if err != nil {
+		return err
+	}
+	err = ticketstate.Transition(ctx, tx, ticketIDs, ticketstate.Change{
+		To:      ticketstate.Refunded,
+		ActorID: actorID,
+		Reason:  fmt.Sprintf("refund %d: %s", refundID, reason),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx, "UPDATE tickets SET refund_id = $1 WHERE id = ANY($2)", refundID, ticketIDs)
+	return err
+}
+
+// updateRefundStatus marks a purchase refunded once its whole total has been
+// refunded, or partially refunded before that, and returns the new status.
+func updateRefundStatus(ctx context.Context, tx pgx.Tx, purchaseID int) (string, error) {
+	var status string
+	err := tx.QueryRow(ctx, `
+		UPDATE purchases
+		SET payment_status = CASE
+				WHEN (SELECT COALESCE(SUM(amount), 0) FROM refunds WHERE purchase_id = $1 AND status = 'succeeded') >= total_amount THEN 'refunded'
+				ELSE 'partially_refunded'
+			END,
+			updated_at = now()
+		WHERE id = $1
+		RETURNING payment_status`, purchaseID,
+	).Scan(&status)
+	return status, err
+}
+
+// commitOrFail commits a webhook's transaction. It writes the error response
+// itself and returns false if the commit failed.
+func commitOrFail(c *gin.Context, tx pgx.Tx) bool {
+	if err := tx.Commit(c.Request.Context()); err != nil {
+		log.Printf("Error committing transaction: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit database transaction"})
+		return false
+	}
+	return true
+}
+
+func joinInts(ids []int) string {
+	parts := make([]string, len(ids))
+	for i, id := range ids {
+		parts[i] = strconv.Itoa(id)
+	}
+	return strings.Join(parts, ",")
+}
@@ -0,0 +1,313 @@
+package handlers_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/tpgcig/carneauengine/server/handlers"
+	"github.com/tpgcig/carneauengine/server/money"
+	"github.com/tpgcig/carneauengine/server/payment"
+	"github.com/tpgcig/carneauengine/server/reservation"
+)
+
+// newOrganiser creates an organizer user belonging to orgID.
+func newOrganiser(t *testing.T, db *pgxpool.Pool, orgID int) int {
+	t.Helper()
+	ctx := context.Background()
+	var userID int
+	mustQuery(t, db.QueryRow(ctx,
+		"INSERT INTO users (email, role, password_hash) VALUES ($1, 'organizer', 'x') RETURNING id",
+		fmt.Sprintf("organiser-%s@example.com", uuid.New())).Scan(&userID))
+	if orgID != 0 {
+		_, err := db.Exec(ctx, "INSERT INTO organisation_members (user_id, organisation_id) VALUES ($1, $2)", userID, orgID)
+		mustQuery(t, err)
+	}
+	t.Cleanup(func() {
+		db.Exec(ctx, "DELETE FROM organisation_members WHERE user_id = $1", userID)
+		db.Exec(ctx, "DELETE FROM users WHERE id = $1", userID)
+	})
+	return userID
+}
+
+// payFixture pays for the fixture's purchase on the fake gateway and issues
+// its tickets, as fulfilment would have.
+func payFixture(t *testing.T, db *pgxpool.Pool, fake *payment.FakeGateway, f checkoutFixture) {
+	t.Helper()
+	ctx := context.Background()
+
+	s, err := fake.CreateSession(ctx, payment.SessionParams{
+		LineItems: []payment.LineItem{{Name: "GA", UnitPrice: money.New(1000, "aud"), Quantity: f.quantity}},
+		Metadata:  map[string]string{"purchase_id": fmt.Sprint(f.purchaseID)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake.WebhookURL = droppingWebhook(t)
+	if err := fake.Complete(ctx, s.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = db.Exec(ctx,
+		"UPDATE purchases SET payment_status = 'succeeded', stripe_payment_id = $1, payment_id = $2 WHERE id = $3",
+		s.ID, s.PaymentID, f.purchaseID)
+	mustQuery(t, err)
+	for i := 0; i < f.quantity; i++ {
+		_, err = db.Exec(ctx,
+			"INSERT INTO tickets (ticket_type_id, user_id, purchase_id, qr_code, status) VALUES ($1, $2, $3, $4, 'valid')",
+			f.ticketTypeID, f.userID, f.purchaseID, uuid.New().String())
+		mustQuery(t, err)
+	}
+	_, err = db.Exec(ctx, "UPDATE ticket_types SET sold_quantity = $1 WHERE id = $2", f.quantity, f.ticketTypeID)
+	mustQuery(t, err)
+}
+
+// droppingWebhook is a webhook endpoint that acknowledges callbacks and ignores them.
+func droppingWebhook(t *testing.T) string {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	t.Cleanup(srv.Close)
+	return srv.URL
+}
+
+// newOrganiserRouter serves the organiser endpoints as organiserID would see
+// them after AuthMiddleware, and the webhook.
+func newOrganiserRouter(db *pgxpool.Pool, fake *payment.FakeGateway, organiserID int) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	h := &handlers.Handler{DB: db, Reservations: reservation.NewMemoryReserver(15 * time.Minute), Payments: fake}
+	r := gin.New()
+	r.POST("/stripe-webhook", h.StripeWebhook)
+	organiser := r.Group("/", func(c *gin.Context) {
+		c.Set("userID", organiserID)
+		c.Set("userRole", "organizer")
+	})
+	organiser.POST("/api/purchases/:id/refunds", h.CreateRefund)
+	organiser.GET("/api/disputes", h.GetDisputes)
+	return r
+}
+
+func requestRefund(t *testing.T, r *gin.Engine, purchaseID int, ticketIDs []int) (int, handlers.RefundResponse) {
+	t.Helper()
+	body, _ := json.Marshal(handlers.RefundRequest{TicketIDs: ticketIDs, Reason: "test"})
+	req := httptest.NewRequest(http.MethodPost, fmt.Sprintf("/api/purchases/%d/refunds", purchaseID), bytes.NewReader(body))
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	var resp handlers.RefundResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	return w.Code, resp
+}
+
+type refundState struct {
+	status        string
+	validCount    int
+	refundedCount int
+	sold          int
+	refunds       int
+}
+
+func loadRefundState(t *testing.T, db *pgxpool.Pool, f checkoutFixture) refundState {
+	t.Helper()
+	ctx := context.Background()
+	var s refundState
+	mustQuery(t, db.QueryRow(ctx, "SELECT payment_status FROM purchases WHERE id = $1", f.purchaseID).Scan(&s.status))
+	mustQuery(t, db.QueryRow(ctx, "SELECT COUNT(*) FILTER (WHERE status = 'valid'), COUNT(*) FILTER (WHERE status = 'refunded') FROM tickets WHERE purchase_id = $1", f.purchaseID).Scan(&s.validCount, &s.refundedCount))
+	mustQuery(t, db.QueryRow(ctx, "SELECT sold_quantity FROM ticket_types WHERE id = $1", f.ticketTypeID).Scan(&s.sold))
+	mustQuery(t, db.QueryRow(ctx, "SELECT COUNT(*) FROM refunds WHERE purchase_id = $1", f.purchaseID).Scan(&s.refunds))
+	return s
+}
+
+// TestCreateRefund_PerTicketThenRest refunds one ticket, then the rest, and
+// checks tickets, inventory and purchase status after each.
+func TestCreateRefund_PerTicketThenRest(t *testing.T) {
+	db := newTestDB(t)
+	fake := payment.NewFakeGateway("http://unused", "", "test-secret")
+	f := newCheckoutFixture(t, db, 2)
+	payFixture(t, db, fake, f)
+	r := newOrganiserRouter(db, fake, newOrganiser(t, db, f.orgID))
+
+	var first int
+	mustQuery(t, db.QueryRow(context.Background(), "SELECT MIN(id) FROM tickets WHERE purchase_id = $1", f.purchaseID).Scan(&first))
+
+	code, resp := requestRefund(t, r, f.purchaseID, []int{first})
+	if code != http.StatusCreated {
+		t.Fatalf("first refund: expected 201, got %d", code)
+	}
+	if resp.Amount != money.New(1000, "aud") || resp.PaymentStatus != "partially_refunded" {
+		t.Errorf("first refund: expected 10.00 AUD partially_refunded, got %s %s", resp.Amount, resp.PaymentStatus)
+	}
+	if got := loadRefundState(t, db, f); got != (refundState{"partially_refunded", 1, 1, 1, 1}) {
+		t.Errorf("after first refund: got %+v", got)
+	}
+
+	if code, _ := requestRefund(t, r, f.purchaseID, []int{first}); code != http.StatusConflict {
+		t.Errorf("refunding a refunded ticket: expected 409, got %d", code)
+	}
+
+	code, resp = requestRefund(t, r, f.purchaseID, nil)
+	if code != http.StatusCreated {
+		t.Fatalf("second refund: expected 201, got %d", code)
+	}
+	if resp.PaymentStatus != "refunded" {
+		t.Errorf("second refund: expected refunded, got %s", resp.PaymentStatus)
+	}
+	if got := loadRefundState(t, db, f); got != (refundState{"refunded", 0, 2, 0, 2}) {
+		t.Errorf("after second refund: got %+v", got)
+	}
+}
+
+// TestCreateRefund_ResumesPendingRefund leaves a refund pending, as if the
+// server had stopped after recording it, and checks only the same refund can
+// be asked for until it is finished.
+func TestCreateRefund_ResumesPendingRefund(t *testing.T) {
+	db := newTestDB(t)
+	ctx := context.Background()
+	fake := payment.NewFakeGateway("http://unused", "", "test-secret")
+	f := newCheckoutFixture(t, db, 2)
+	payFixture(t, db, fake, f)
+	r := newOrganiserRouter(db, fake, newOrganiser(t, db, f.orgID))
+
+	var first, second int
+	mustQuery(t, db.QueryRow(ctx, "SELECT MIN(id), MAX(id) FROM tickets WHERE purchase_id = $1", f.purchaseID).Scan(&first, &second))
+	_, err := db.Exec(ctx, `
+		INSERT INTO refunds (purchase_id, amount, currency, source, status, idempotency_key)
+		VALUES ($1, 10.00, 'aud', 'organiser', 'pending', $2)`,
+		f.purchaseID, fmt.Sprintf("purchase-%d-refund-%d", f.purchaseID, first))
+	mustQuery(t, err)
+
+	if code, _ := requestRefund(t, r, f.purchaseID, []int{second}); code != http.StatusConflict {
+		t.Errorf("another refund while one is pending: expected 409, got %d", code)
+	}
+	code, resp := requestRefund(t, r, f.purchaseID, []int{first})
+	if code != http.StatusCreated {
+		t.Fatalf("retrying the pending refund: expected 201, got %d", code)
+	}
+	if resp.GatewayRefundID == "" || len(resp.TicketIDs) != 1 || resp.TicketIDs[0] != first {
+		t.Errorf("expected ticket %d refunded through the gateway, got %+v", first, resp)
+	}
+	if got := loadRefundState(t, db, f); got != (refundState{"partially_refunded", 1, 1, 1, 1}) {
+		t.Errorf("after retry: got %+v", got)
+	}
+}
+
+// TestRecoverStaleRefunds leaves a refund pending long enough that the request
+// is taken to have died, and checks the recovery run finishes it.
+func TestRecoverStaleRefunds(t *testing.T) {
+	db := newTestDB(t)
+	ctx := context.Background()
+	fake := payment.NewFakeGateway("http://unused", "", "test-secret")
+	f := newCheckoutFixture(t, db, 2)
+	payFixture(t, db, fake, f)
+	h := &handlers.Handler{DB: db, Payments: fake}
+
+	var first int
+	mustQuery(t, db.QueryRow(ctx, "SELECT MIN(id) FROM tickets WHERE purchase_id = $1", f.purchaseID).Scan(&first))
+	var refundID int
+	mustQuery(t, db.QueryRow(ctx, `
+		INSERT INTO refunds (purchase_id, amount, currency, source, status, idempotency_key, ticket_ids, created_at)
+		VALUES ($1, 10.00, 'aud', 'organiser', 'pending', $2, $3, now() - interval '10 minutes') RETURNING id`,
+		f.purchaseID, fmt.Sprintf("purchase-%d-refund-%d", f.purchaseID, first), []int{first},
+	).Scan(&refundID))
+
+	n, err := h.RecoverStaleRefunds(ctx)
+	if err != nil {
+		t.Fatalf("RecoverStaleRefunds: %v", err)
+	}
+	if n != 1 {
+		t.Errorf("expected 1 refund recovered, got %d", n)
+	}
+	var status, gatewayID string
+	mustQuery(t, db.QueryRow(ctx, "SELECT status, COALESCE(gateway_refund_id, '') FROM refunds WHERE id = $1", refundID).Scan(&status, &gatewayID))
+	if status != "succeeded" || gatewayID == "" {
+		t.Errorf("expected the refund succeeded through the gateway, got %s %q", status, gatewayID)
+	}
+	if got := loadRefundState(t, db, f); got != (refundState{"partially_refunded", 1, 1, 1, 1}) {
+		t.Errorf("after recovery: got %+v", got)
+	}
+
+	if n, err := h.RecoverStaleRefunds(ctx); err != nil || n != 0 {
+		t.Errorf("second run: expected nothing recovered, got %d, %v", n, err)
+	}
+}
+
+// TestCreateRefund_OtherOrganisation checks organisers can't refund purchases
+// for events they don't run.
+func TestCreateRefund_OtherOrganisation(t *testing.T) {
+	db := newTestDB(t)
+	fake := payment.NewFakeGateway("http://unused", "", "test-secret")
+	f := newCheckoutFixture(t, db, 1)
+	payFixture(t, db, fake, f)
+	r := newOrganiserRouter(db, fake, newOrganiser(t, db, 0))
+
+	if code, _ := requestRefund(t, r, f.purchaseID, nil); code != http.StatusForbidden {
+		t.Fatalf("expected 403, got %d", code)
+	}
+	if got := loadRefundState(t, db, f); got.status != "succeeded" || got.refunds != 0 {
+		t.Errorf("expected purchase untouched, got %+v", got)
+	}
+}
+
+// TestCreateRefund_HeldPurchase refunds a paid purchase that was held for
+// review without issuing tickets.
+func TestCreateRefund_HeldPurchase(t *testing.T) {
+	db := newTestDB(t)
+	ctx := context.Background()
+	fake := payment.NewFakeGateway("http://unused", "", "test-secret")
+	f := newCheckoutFixture(t, db, 2)
+	payFixture(t, db, fake, f)
+	_, err := db.Exec(ctx, "DELETE FROM tickets WHERE purchase_id = $1", f.purchaseID)
+	mustQuery(t, err)
+	_, err = db.Exec(ctx, "UPDATE ticket_types SET sold_quantity = 0 WHERE id = $1", f.ticketTypeID)
+	mustQuery(t, err)
+	_, err = db.Exec(ctx, "UPDATE purchases SET payment_status = 'needs_review', review_reason = 'sold out' WHERE id = $1", f.purchaseID)
+	mustQuery(t, err)
+	r := newOrganiserRouter(db, fake, newOrganiser(t, db, f.orgID))
+
+	if code, _ := requestRefund(t, r, f.purchaseID, []int{1}); code != http.StatusConflict {
+		t.Errorf("refunding tickets of a held purchase: expected 409, got %d", code)
+	}
+	code, resp := requestRefund(t, r, f.purchaseID, nil)
+	if code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d", code)
+	}
+	if resp.Amount != money.New(2000, "aud") || resp.PaymentStatus != "refunded" {
+		t.Errorf("expected 20.00 AUD refunded, got %s %s", resp.Amount, resp.PaymentStatus)
+	}
+}
+
+// TestStripeWebhook_DashboardRefund refunds a whole payment outside the app
+// and checks the charge.refunded webhook voids the tickets.
+func TestStripeWebhook_DashboardRefund(t *testing.T) {
+	db := newTestDB(t)
+	fake := payment.NewFakeGateway("http://unused", "", "test-secret")
+	f := newCheckoutFixture(t, db, 2)
+	payFixture(t, db, fake, f)
+
+	srv := httptest.NewServer(newOrganiserRouter(db, fake, 0))
+	t.Cleanup(srv.Close)
+	fake.WebhookURL = srv.URL + "/stripe-webhook"
+	t.Cleanup(func() { db.Exec(context.Background(), "DELETE FROM stripe_events WHERE event_id LIKE 'evt_fake_%'") })
+
+	var paymentID string
+	mustQuery(t, db.QueryRow(context.Background(), "SELECT payment_id FROM purchases WHERE id = $1", f.purchaseID).Scan(&paymentID))
+	if _, err := fake.Refund(context.Background(), payment.RefundParams{PaymentID: paymentID}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The gateway confirms refunds asynchronously
+	deadline := time.Now().Add(5 * time.Second)
+	for loadRefundState(t, db, f).status != "refunded" && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if got := loadRefundState(t, db, f); got != (refundState{"refunded", 0, 2, 0, 1}) {
+		t.Errorf("expected dashboard refund applied, got %+v", got)
+	}
+}
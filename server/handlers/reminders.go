@@ -0,0 +1,267 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+
+	"github.com/tpgcig/carneauengine/server/mailer"
+	"github.com/tpgcig/carneauengine/server/outbox"
+)
+
+// Reminders are sent events.reminder_offsets minutes before an event starts,
+// 24 and 2 hours by default. Each ticket is recorded in ticket_reminders as its
+// reminder is queued, in the same transaction as the outbox job that sends it,
+// so a reminder goes out once however often the scheduler runs or restarts.
+
+type reminderJob struct {
+	EventID       int   `json:"event_id"`
+	UserID        int   `json:"user_id"`
+	OffsetMinutes int   `json:"offset_minutes"`
+	TicketIDs     []int `json:"ticket_ids"`
+}
+
+// reminderEmail is the data of the event_reminder template.
+type reminderEmail struct {
+	Recipient string
+	StartsIn  string // e.g. "24 hours"
+	MapURL    string
+	Event     emailEvent
+	Tickets   []emailTicket
+}
+
+// RunReminders queues due reminders every interval until ctx is done.
+func (h *Handler) RunReminders(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			n, err := h.ScheduleReminders(ctx)
+			if err != nil {
+				log.Printf("Error scheduling event reminders: %v", err)
+				continue
+			}
+			if n > 0 {
+				log.Printf("Queued %d event reminder email(s)", n)
+			}
+		}
+	}
+}
+
+// ScheduleReminders queues a reminder email to each holder of valid tickets
+// for events whose reminder time has come, and returns how many it queued.
+// A ticket only gets the reminders whose time came after it was issued, so one
+// bought 5 hours before the event gets just the 2 hour one. If the scheduler
+// was down through more than one, only the nearest is sent.
+func (h *Handler) ScheduleReminders(ctx context.Context) (int, error) {
+	tx, err := h.DB.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	rows, err := tx.Query(ctx, `
+		WITH due AS (
+			SELECT t.id AS ticket_id, (
+				SELECT min(o) FROM unnest(e.reminder_offsets) AS o
+				WHERE now() >= e.start_time - make_interval(mins => o)
+					AND t.created_at < e.start_time - make_interval(mins => o)
+			) AS offset_minutes
+			FROM events e
+			JOIN ticket_types tt ON tt.event_id = e.id
+			JOIN tickets t ON t.ticket_type_id = tt.id
+			WHERE e.reminders_enabled AND now() < e.start_time AND t.status = 'valid' AND t.user_id IS NOT NULL
+		), queued AS (
+			INSERT INTO ticket_reminders (ticket_id, offset_minutes)
+			SELECT due.ticket_id, due.offset_minutes
+			FROM due
+			WHERE due.offset_minutes IS NOT NULL
+				AND NOT EXISTS (
+					SELECT 1 FROM ticket_reminders r WHERE r.ticket_id = due.ticket_id AND r.offset_minutes = due.offset_minutes
+				)
+			ON CONFLICT DO NOTHING
+			RETURNING ticket_id, offset_minutes
+		)
+		SELECT tt.event_id, t.user_id, q.offset_minutes, array_agg(q.ticket_id ORDER BY q.ticket_id)
+		FROM queued q
+		JOIN tickets t ON t.id = q.ticket_id
+		JOIN ticket_types tt ON tt.id = t.ticket_type_id
+		GROUP BY tt.event_id, t.user_id, q.offset_minutes`)
+	if err != nil {
+		return 0, fmt.Errorf("recording due reminders: %w", err)
+	}
+	var jobs []reminderJob
+	for rows.Next() {
+		var job reminderJob
+		if err := rows.Scan(&job.EventID, &job.UserID, &job.OffsetMinutes, &job.TicketIDs); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("scanning due reminder: %w", err)
+		}
+		jobs = append(jobs, job)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("iterating due reminders: %w", err)
+	}
+
+	for _, job := range jobs {
+		if err := outbox.Enqueue(ctx, tx, jobSendReminderEmail, job); err != nil {
+			return 0, fmt.Errorf("queueing reminder for event %d to user %d: %w", job.EventID, job.UserID, err)
+		}
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return 0, err
+	}
+	return len(jobs), nil
+}
+
+// sendReminderEmail emails a ticket holder a reminder with their tickets for
+// an event. It runs as an outbox job. Tickets no longer valid are left out, and
+// nothing is sent once the event has started.
+func (h *Handler) sendReminderEmail(ctx context.Context, job reminderJob) error {
+	var email string
+	err := h.DB.QueryRow(ctx, "SELECT email FROM users WHERE id = $1", job.UserID).Scan(&email)
+	if err == pgx.ErrNoRows {
+		return outbox.Permanent(fmt.Errorf("user %d not found", job.UserID))
+	}
+	if err != nil {
+		return fmt.Errorf("loading user %d: %w", job.UserID, err)
+	}
+
+	data := reminderEmail{Recipient: email}
+	var minutesLeft int
+	rows, err := h.DB.Query(ctx, `
+		SELECT t.qr_code, tt.name, e.title, COALESCE(e.location, ''), e.start_time,
+			round(EXTRACT(EPOCH FROM e.start_time - LOCALTIMESTAMP) / 60)::int
+		FROM tickets t
+		JOIN ticket_types tt ON t.ticket_type_id = tt.id
+		JOIN events e ON tt.event_id = e.id
+		WHERE t.id = ANY($1::int[]) AND t.user_id = $2 AND e.id = $3 AND t.status = 'valid'
+		ORDER BY t.id`,
+		append([]int{}, job.TicketIDs...), job.UserID, job.EventID)
+	if err != nil {
+		return fmt.Errorf("querying tickets for reminder: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var et emailTicket
+		if err := rows.Scan(&et.QR, &et.TypeName, &data.Event.Title, &data.Event.Location, &data.Event.StartTime, &minutesLeft); err != nil {
+			return fmt.Errorf("scanning ticket for reminder: %w", err)
+		}
+		data.Tickets = append(data.Tickets, et)
+	}
+	if err = rows.Err(); err != nil {
+		return fmt.Errorf("iterating ticket rows for reminder: %w", err)
+	}
+
+	if len(data.Tickets) == 0 {
+		log.Printf("No valid tickets left for the reminder for event %d to %s", job.EventID, email)
+		return nil
+	}
+	if minutesLeft <= 0 {
+		log.Printf("Event %d has started; not sending its reminder to %s", job.EventID, email)
+		return nil
+	}
+	data.StartsIn = startsIn(minutesLeft)
+	if data.Event.Location != "" {
+		data.MapURL = "https://www.google.com/maps/search/?api=1&query=" + url.QueryEscape(data.Event.Location)
+	}
+
+	brand, err := h.eventBranding(ctx, job.EventID)
+	if err != nil {
+		return fmt.Errorf("loading email branding for event %d: %w", job.EventID, err)
+	}
+	images := qrImages(data.Tickets)
+	content, err := mailer.Render("event_reminder", brand, data)
+	if err != nil {
+		return outbox.Permanent(err)
+	}
+	msg := content.Message(email)
+	msg.Inline = images
+
+	sent, err := h.sendMail(ctx, msg)
+	if err != nil {
+		return fmt.Errorf("sending reminder email to %s: %w", email, err)
+	}
+	if sent {
+		log.Printf("Reminder email sent to %s for event %d (%d minutes before)", email, job.EventID, job.OffsetMinutes)
+	}
+	return nil
+}
+
+// startsIn says how long minutes is, roughly, for a reminder.
+func startsIn(minutes int) string {
+	n, unit := minutes, "minute"
+	switch {
+	case minutes >= 48*60:
+		n, unit = (minutes+12*60)/(24*60), "day"
+	case minutes >= 90:
+		n, unit = (minutes+30)/60, "hour"
+	}
+	if n == 1 {
+		return "1 " + unit
+	}
+	return fmt.Sprintf("%d %ss", n, unit)
+}
+
+type ReminderPolicyRequest struct {
+	Enabled       *bool `json:"enabled"`
+	OffsetMinutes []int `json:"offset_minutes" binding:"omitempty,max=5,dive,min=1,max=43200"`
+}
+
+// UpdateReminderPolicy sets whether an event's ticket holders get reminders,
+// and how many minutes before the event starts they go out.
+func (h *Handler) UpdateReminderPolicy(c *gin.Context) {
+	eventID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid event ID"})
+		return
+	}
+	var req ReminderPolicyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !h.authorizeEventOrganiser(c, eventID) {
+		return
+	}
+
+	// Kept longest first, without repeats
+	offsets := req.OffsetMinutes
+	if offsets != nil {
+		offsets = slices.Clone(offsets)
+		slices.Sort(offsets)
+		offsets = slices.Compact(offsets)
+		slices.Reverse(offsets)
+	}
+
+	var enabled bool
+	err = h.DB.QueryRow(c.Request.Context(), `
+		UPDATE events
+		SET reminders_enabled = COALESCE($2, reminders_enabled),
+			reminder_offsets = COALESCE($3::int[], reminder_offsets),
+			updated_at = now()
+		WHERE id = $1
+		RETURNING reminders_enabled, reminder_offsets`,
+		eventID, req.Enabled, offsets,
+	).Scan(&enabled, &offsets)
+	if err != nil {
+		log.Printf("Error updating reminder policy of event %d: %v", eventID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update reminder policy"})
+		return
+	}
+	log.Printf("Reminder policy of event %d set by user %d: enabled=%t, offsets %v minutes", eventID, c.GetInt("userID"), enabled, offsets)
+	c.JSON(http.StatusOK, gin.H{"event_id": eventID, "enabled": enabled, "offset_minutes": offsets})
+}
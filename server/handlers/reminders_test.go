@@ -0,0 +1,122 @@
+package handlers_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	netmail "net/mail"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+
+	"github.com/tpgcig/carneauengine/server/handlers"
+	"github.com/tpgcig/carneauengine/server/mailer"
+	"github.com/tpgcig/carneauengine/server/outbox"
+)
+
+func TestEventReminders(t *testing.T) {
+	db := newTestDB(t)
+	ctx := context.Background()
+	f := newCheckoutFixture(t, db, 2)
+	t.Cleanup(func() {
+		db.Exec(ctx, "DELETE FROM outbox WHERE kind = 'send_reminder_email' AND payload->>'event_id' = $1", fmt.Sprint(f.eventID))
+	})
+
+	_, err := db.Exec(ctx, "UPDATE events SET start_time = now() + interval '3 hours', location = 'Town Hall' WHERE id = $1", f.eventID)
+	mustQuery(t, err)
+	// Bought before the 24 hour mark, while the scheduler wasn't running
+	for _, status := range []string{"valid", "valid", "voided"} {
+		_, err := db.Exec(ctx,
+			"INSERT INTO tickets (ticket_type_id, user_id, purchase_id, qr_code, status, created_at) VALUES ($1, $2, $3, $4, $5, now() - interval '2 days')",
+			f.ticketTypeID, f.userID, f.purchaseID, uuid.New().String(), status)
+		mustQuery(t, err)
+	}
+	// Bought after it, so not reminded until the 2 hour mark
+	_, err = db.Exec(ctx,
+		"INSERT INTO tickets (ticket_type_id, user_id, purchase_id, qr_code, status) VALUES ($1, $2, $3, $4, 'valid')",
+		f.ticketTypeID, f.userID, f.purchaseID, uuid.New().String())
+	mustQuery(t, err)
+
+	fileMailer, err := mailer.NewFileMailer(t.TempDir(), netmail.Address{Address: "tickets@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &handlers.Handler{DB: db, Mailer: fileMailer}
+	worker := outbox.NewWorker(db)
+	h.RegisterJobs(worker)
+	s := checkoutServer{mail: fileMailer, worker: worker}
+
+	queued := func() (jobs int, offset string) {
+		t.Helper()
+		mustQuery(t, db.QueryRow(ctx, `
+			SELECT count(*), COALESCE(max(payload->>'offset_minutes'), '')
+			FROM outbox WHERE kind = 'send_reminder_email' AND payload->>'event_id' = $1`,
+			fmt.Sprint(f.eventID)).Scan(&jobs, &offset))
+		return jobs, offset
+	}
+
+	// 3 hours out, only the 24 hour reminder is due, and only once
+	for i := 0; i < 2; i++ {
+		if _, err := h.ScheduleReminders(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if jobs, offset := queued(); jobs != 1 || offset != "1440" {
+		t.Fatalf("expected one 24 hour reminder queued, got %d (offset %s)", jobs, offset)
+	}
+	var email string
+	mustQuery(t, db.QueryRow(ctx, "SELECT email FROM users WHERE id = $1", f.userID).Scan(&email))
+	emails := s.emailsTo(t, email)
+	if len(emails) != 1 {
+		t.Fatalf("expected 1 reminder email, got %d", len(emails))
+	}
+	if got := emails[0].Header.Get("Subject"); got != "Reminder: Webhook Test Event starts in 3 hours" {
+		t.Errorf("unexpected subject %q", got)
+	}
+	var recorded int
+	mustQuery(t, db.QueryRow(ctx,
+		"SELECT count(*) FROM ticket_reminders WHERE ticket_id IN (SELECT id FROM tickets WHERE purchase_id = $1)",
+		f.purchaseID).Scan(&recorded))
+	if recorded != 2 {
+		t.Errorf("expected the 2 valid tickets recorded as reminded, got %d", recorded)
+	}
+
+	// Turned off, the 2 hour reminder never goes
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	organiserID := newOrganiser(t, db, f.orgID)
+	r.PUT("/api/events/:id/reminders", func(c *gin.Context) { c.Set("userID", organiserID) }, h.UpdateReminderPolicy)
+	put := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPut, fmt.Sprintf("/api/events/%d/reminders", f.eventID), bytes.NewBufferString(body))
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	w := put(`{"offset_minutes": [60, 240, 60]}`)
+	var policy struct {
+		Enabled bool  `json:"enabled"`
+		Offsets []int `json:"offset_minutes"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &policy)
+	if w.Code != http.StatusOK || !policy.Enabled || fmt.Sprint(policy.Offsets) != "[240 60]" {
+		t.Fatalf("set offsets: got %d %s", w.Code, w.Body)
+	}
+	if w := put(`{"offset_minutes": [0]}`); w.Code != http.StatusBadRequest {
+		t.Errorf("zero offset: expected 400, got %d", w.Code)
+	}
+	if w := put(`{"enabled": false}`); w.Code != http.StatusOK {
+		t.Fatalf("disable: got %d %s", w.Code, w.Body)
+	}
+	_, err = db.Exec(ctx, "UPDATE events SET start_time = now() + interval '30 minutes' WHERE id = $1", f.eventID)
+	mustQuery(t, err)
+	if _, err := h.ScheduleReminders(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if jobs, _ := queued(); jobs != 1 {
+		t.Errorf("expected no reminders queued while disabled, got %d jobs", jobs)
+	}
+}
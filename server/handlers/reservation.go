@@ -0,0 +1,171 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+
+	"github.com/tpgcig/carneauengine/server/payment"
+	"github.com/tpgcig/carneauengine/server/reservation"
+)
+
+type ReservationItem struct {
+	TicketTypeID int `json:"ticket_type_id"`
+	Quantity     int `json:"quantity"`
+}
+
+type ReservationStatus struct {
+	ReservationID    string            `json:"reservation_id"`
+	Items            []ReservationItem `json:"items"`
+	RemainingSeconds int               `json:"remaining_seconds"`
+	ExpiresAt        time.Time         `json:"expires_at"`
+	Extended         bool              `json:"extended"`
+}
+
+func newReservationStatus(res *reservation.Reservation, now time.Time) ReservationStatus {
+	status := ReservationStatus{
+		ReservationID:    res.ID,
+		RemainingSeconds: int(res.ExpiresAt.Sub(now).Seconds()),
+		ExpiresAt:        res.ExpiresAt,
+		Extended:         res.Extended,
+	}
+	for ticketTypeID, quantity := range res.Items {
+		status.Items = append(status.Items, ReservationItem{TicketTypeID: ticketTypeID, Quantity: quantity})
+	}
+	sort.Slice(status.Items, func(i, j int) bool {
+		return status.Items[i].TicketTypeID < status.Items[j].TicketTypeID
+	})
+	return status
+}
+
+// GetReservation reports what a checkout hold covers and how long it has left,
+// so the cart can show a countdown. Holds that have run out return 410 until the
+// reaper clears them, and 404 after that.
+func (h *Handler) GetReservation(c *gin.Context) {
+	reservationID := c.Param("id")
+
+	res, err := h.Reservations.Get(c.Request.Context(), reservationID)
+	if errors.Is(err, reservation.ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Reservation not found"})
+		return
+	}
+	if err != nil {
+		log.Printf("Error retrieving reservation %s: %v", reservationID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve reservation"})
+		return
+	}
+
+	now := time.Now()
+	if res.Expired(now) {
+		c.JSON(http.StatusGone, gin.H{"error": "Reservation has expired", "expires_at": res.ExpiresAt})
+		return
+	}
+
+	c.JSON(http.StatusOK, newReservationStatus(res, now))
+}
+
+// CancelReservation gives a buyer's held tickets back straight away, e.g. when
+// they come back from Stripe's cancel page, instead of blocking other buyers
+// until the hold runs out. The checkout session is expired first, so the buyer
+// can't go back and pay for tickets that have been given back.
+func (h *Handler) CancelReservation(c *gin.Context) {
+	reservationID := c.Param("id")
+	ctx := c.Request.Context()
+
+	// A failed checkout may have held tickets without recording a purchase,
+	// in which case there is only the hold to release
+	var purchaseID int
+	var sessionID, status string
+	err := h.DB.QueryRow(ctx,
+		"SELECT id, COALESCE(stripe_payment_id, ''), payment_status FROM purchases WHERE reservation_id = $1",
+		reservationID,
+	).Scan(&purchaseID, &sessionID, &status)
+	if err != nil && err != pgx.ErrNoRows {
+		log.Printf("Error loading purchase for reservation %s: %v", reservationID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to cancel reservation"})
+		return
+	}
+
+	switch status {
+	case "", "expired", "failed":
+	case "pending":
+		if sessionID != "" {
+			if _, err := h.Payments.ExpireSession(ctx, sessionID); err != nil {
+				// The session may have closed on its own since; only carry on if
+				// it can no longer be paid
+				s, getErr := h.Payments.GetSession(ctx, sessionID)
+				if getErr != nil || s.Status == payment.SessionOpen {
+					log.Printf("Error expiring session %s for reservation %s: %v", sessionID, reservationID, err)
+					c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to cancel checkout"})
+					return
+				}
+				if s.Status == payment.SessionComplete {
+					c.JSON(http.StatusConflict, gin.H{"error": "Checkout has already been paid"})
+					return
+				}
+			}
+		}
+		// The webhook may have closed the purchase in the meantime, either way
+		err := h.DB.QueryRow(ctx, `
+			WITH expired AS (
+				UPDATE purchases SET payment_status = 'expired', updated_at = now()
+				WHERE id = $1 AND payment_status = 'pending'
+				RETURNING payment_status
+			)
+			SELECT COALESCE((SELECT payment_status FROM expired), (SELECT payment_status FROM purchases WHERE id = $1))`,
+			purchaseID,
+		).Scan(&status)
+		if err != nil {
+			log.Printf("Error expiring purchase %d: %v", purchaseID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to cancel reservation"})
+			return
+		}
+		if status != "expired" && status != "failed" {
+			c.JSON(http.StatusConflict, gin.H{"error": "Checkout has already been paid"})
+			return
+		}
+	default:
+		c.JSON(http.StatusConflict, gin.H{"error": "Checkout has already been paid"})
+		return
+	}
+
+	if err := h.Reservations.Release(ctx, reservationID); err != nil {
+		log.Printf("Error cancelling reservation %s: %v", reservationID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to cancel reservation"})
+		return
+	}
+	log.Printf("Released Redis holds for cancelled reservation ID: %s", reservationID)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Reservation cancelled"})
+}
+
+// ExtendReservation gives a buyer who is still filling in their details one
+// extra block of reservationExtension on their hold. The checkout session was
+// created to outlast the extended deadline, so it stays payable.
+func (h *Handler) ExtendReservation(c *gin.Context) {
+	reservationID := c.Param("id")
+
+	res, err := h.Reservations.Extend(c.Request.Context(), reservationID, reservationExtension)
+	switch {
+	case errors.Is(err, reservation.ErrNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Reservation not found"})
+		return
+	case errors.Is(err, reservation.ErrExpired):
+		c.JSON(http.StatusGone, gin.H{"error": "Reservation has expired"})
+		return
+	case errors.Is(err, reservation.ErrAlreadyExtended):
+		c.JSON(http.StatusConflict, gin.H{"error": "Reservation has already been extended"})
+		return
+	case err != nil:
+		log.Printf("Error extending reservation %s: %v", reservationID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to extend reservation"})
+		return
+	}
+
+	c.JSON(http.StatusOK, newReservationStatus(res, time.Now()))
+}
@@ -2,191 +2,116 @@ package handlers_test
 
 import (
 	"context"
-	"fmt"
-	"strconv"
-	"sync"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
 	"testing"
+	"time"
 
-	redis "github.com/go-redis/redis/v8"
-	"github.com/google/uuid"
-)
-
-// luaReserve is the same script used in CreateCheckoutSession.
-// Keeping it here as a copy ensures this test catches any divergence.
-const luaReserve = `
-local reservationId = ARGV[#ARGV - 1]
-local reservationTTL = tonumber(ARGV[#ARGV])
-local numTickets = (#KEYS)
-local reservedItems = {}
-local fullReservationKey = "reservation:" .. reservationId
-
-local function rollback()
-	for i = 1, #reservedItems, 2 do
-		local ttId = reservedItems[i]
-		local qty = reservedItems[i+1]
-		redis.call('HINCRBY', "ticket_holds:" .. ttId, "held_quantity", -qty)
-	end
-	redis.call('DEL', fullReservationKey)
-	return 0
-end
-
-for i = 1, numTickets do
-	local ticketHoldKey = KEYS[i]
-	local totalQty = tonumber(ARGV[(i-1)*3 + 1])
-	local soldQty = tonumber(ARGV[(i-1)*3 + 2])
-	local requestedQty = tonumber(ARGV[(i-1)*3 + 3])
-	local ticketTypeId = string.match(ticketHoldKey, "ticket_holds:(%d+)")
-
-	local currentHeldQty = tonumber(redis.call('HGET', ticketHoldKey, 'held_quantity') or '0')
-	local availableForSale = totalQty - soldQty - currentHeldQty
+	"github.com/gin-gonic/gin"
 
-	if availableForSale < requestedQty then
-		return rollback()
-	end
-
-	redis.call('HINCRBY', ticketHoldKey, "held_quantity", requestedQty)
-	table.insert(reservedItems, ticketTypeId)
-	table.insert(reservedItems, requestedQty)
-	redis.call('HSET', fullReservationKey, ticketTypeId, requestedQty)
-end
-
-redis.call('EXPIRE', fullReservationKey, reservationTTL)
-return 1
-`
+	"github.com/tpgcig/carneauengine/server/handlers"
+	"github.com/tpgcig/carneauengine/server/reservation"
+)
 
-func newTestRedis(t *testing.T) *redis.Client {
-	t.Helper()
-	rdb := redis.NewClient(&redis.Options{Addr: "localhost:6379", DB: 1}) // DB 1 = test isolation
-	if err := rdb.Ping(context.Background()).Err(); err != nil {
-		t.Skipf("Redis not reachable at localhost:6379 — skipping: %v", err)
-	}
-	return rdb
+func newReservationRouter(h *handlers.Handler) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/api/reservations/:id", h.GetReservation)
+	r.POST("/api/reservations/:id/extend", h.ExtendReservation)
+	return r
 }
 
-// TestNoOversell_ConcurrentReservations is the core correctness test.
-// It simulates N buyers simultaneously trying to claim tickets for an event
-// that only has `totalTickets` available. After all goroutines finish it
-// asserts that held_quantity never exceeded the supply.
-func TestNoOversell_ConcurrentReservations(t *testing.T) {
-	const (
-		ticketTypeID = 9999   // synthetic ID, won't exist in dev DB
-		totalTickets = 5      // intentionally scarce
-		soldTickets  = 0
-		buyers       = 50    // concurrent buyers — far more than available tickets
-	)
+func getReservation(r *gin.Engine, id string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/reservations/"+id, nil))
+	return w
+}
 
+func TestGetReservation(t *testing.T) {
 	ctx := context.Background()
-	rdb := newTestRedis(t)
-	defer rdb.Close()
-
-	holdKey := fmt.Sprintf("ticket_holds:%d", ticketTypeID)
-
-	// Clean state before test
-	rdb.Del(ctx, holdKey)
-
-	var (
-		wg        sync.WaitGroup
-		mu        sync.Mutex
-		succeeded int
-		rejected  int
-	)
-
-	for i := 0; i < buyers; i++ {
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-
-			reservationID := uuid.New().String()
-			keys := []string{holdKey}
-			args := []interface{}{
-				strconv.Itoa(totalTickets),
-				strconv.Itoa(soldTickets),
-				"1",           // each buyer wants 1 ticket
-				reservationID,
-				"900",         // TTL in seconds
-			}
-
-			val, err := rdb.Eval(ctx, luaReserve, keys, args...).Result()
-			if err != nil {
-				t.Errorf("Lua script error: %v", err)
-				return
-			}
-
-			mu.Lock()
-			if val.(int64) == 1 {
-				succeeded++
-			} else {
-				rejected++
-			}
-			mu.Unlock()
-		}()
-	}
+	reserver := reservation.NewMemoryReserver(10 * time.Minute)
+	r := newReservationRouter(&handlers.Handler{Reservations: reserver})
 
-	wg.Wait()
-
-	// Assert correctness
-	heldStr, err := rdb.HGet(ctx, holdKey, "held_quantity").Result()
+	err := reserver.Reserve(ctx, "live", []reservation.Request{
+		{TicketTypeID: 2, Quantity: 1, TotalQuantity: 10},
+		{TicketTypeID: 1, Quantity: 3, TotalQuantity: 10},
+	})
 	if err != nil {
-		t.Fatalf("Could not read held_quantity from Redis: %v", err)
+		t.Fatal(err)
 	}
-	held, _ := strconv.Atoi(heldStr)
-
-	t.Logf("buyers=%d  succeeded=%d  rejected=%d  held_quantity=%d  totalTickets=%d",
-		buyers, succeeded, rejected, held, totalTickets)
 
-	if held > totalTickets {
-		t.Errorf("OVERSOLD: held_quantity=%d exceeded totalTickets=%d", held, totalTickets)
+	w := getReservation(r, "live")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+	var status handlers.ReservationStatus
+	if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+		t.Fatal(err)
 	}
-	if succeeded != totalTickets {
-		t.Errorf("expected exactly %d successes, got %d", totalTickets, succeeded)
+	if status.RemainingSeconds <= 9*60 || status.RemainingSeconds > 10*60 {
+		t.Errorf("expected about 600 seconds left, got %d", status.RemainingSeconds)
 	}
-	if succeeded+rejected != buyers {
-		t.Errorf("successes+rejections should equal buyers: %d+%d != %d", succeeded, rejected, buyers)
+	want := []handlers.ReservationItem{{TicketTypeID: 1, Quantity: 3}, {TicketTypeID: 2, Quantity: 1}}
+	if len(status.Items) != 2 || status.Items[0] != want[0] || status.Items[1] != want[1] {
+		t.Errorf("expected items %v, got %v", want, status.Items)
 	}
 
-	// Cleanup
-	rdb.Del(ctx, holdKey)
-}
+	if w := getReservation(r, "unknown"); w.Code != http.StatusNotFound {
+		t.Errorf("unknown reservation: expected 404, got %d", w.Code)
+	}
 
-// TestReservation_RollbackOnPartialFailure verifies that if a multi-ticket
-// reservation can't be fully satisfied, no partial hold is left behind.
-func TestReservation_RollbackOnPartialFailure(t *testing.T) {
-	const (
-		typeA = 9991
-		typeB = 9992
-	)
+	// Past its deadline but not yet reaped
+	reserver.Now = func() time.Time { return time.Now().Add(-time.Hour) }
+	err = reserver.Reserve(ctx, "lapsed", []reservation.Request{{TicketTypeID: 1, Quantity: 1, TotalQuantity: 10}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := getReservation(r, "lapsed"); w.Code != http.StatusGone {
+		t.Errorf("expired reservation: expected 410, got %d: %s", w.Code, w.Body)
+	}
+}
 
+func TestExtendReservation(t *testing.T) {
 	ctx := context.Background()
-	rdb := newTestRedis(t)
-	defer rdb.Close()
-
-	keyA := fmt.Sprintf("ticket_holds:%d", typeA)
-	keyB := fmt.Sprintf("ticket_holds:%d", typeB)
-	rdb.Del(ctx, keyA, keyB)
-
-	// typeA has 5 available, typeB has 0 available
-	// Reservation should fail and typeA should NOT be held
-	keys := []string{keyA, keyB}
-	args := []interface{}{
-		"5", "0", "1", // typeA: total=5, sold=0, want=1
-		"0", "0", "1", // typeB: total=0, sold=0, want=1  — will fail
-		uuid.New().String(),
-		"900",
+	reserver := reservation.NewMemoryReserver(10 * time.Minute)
+	r := newReservationRouter(&handlers.Handler{Reservations: reserver})
+	extend := func(id string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/reservations/"+id+"/extend", nil))
+		return w
 	}
 
-	val, err := rdb.Eval(ctx, luaReserve, keys, args...).Result()
+	err := reserver.Reserve(ctx, "live", []reservation.Request{{TicketTypeID: 1, Quantity: 1, TotalQuantity: 10}})
 	if err != nil {
-		t.Fatalf("Lua script error: %v", err)
+		t.Fatal(err)
+	}
+	w := extend("live")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+	var status handlers.ReservationStatus
+	if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+		t.Fatal(err)
 	}
-	if val.(int64) != 0 {
-		t.Error("expected script to return 0 (failure) when one ticket type is unavailable")
+	if !status.Extended || status.RemainingSeconds <= 14*60 || status.RemainingSeconds > 15*60 {
+		t.Errorf("expected an extended hold with about 900 seconds left, got %+v", status)
 	}
 
-	// typeA hold must be zero — rollback should have cleaned it up
-	heldA, _ := rdb.HGet(ctx, keyA, "held_quantity").Result()
-	if heldA != "" && heldA != "0" {
-		t.Errorf("partial hold was NOT rolled back: ticket_holds:%d held_quantity=%s", typeA, heldA)
+	if w := extend("live"); w.Code != http.StatusConflict {
+		t.Errorf("second extension: expected 409, got %d: %s", w.Code, w.Body)
+	}
+	if w := extend("unknown"); w.Code != http.StatusNotFound {
+		t.Errorf("unknown reservation: expected 404, got %d", w.Code)
 	}
 
-	rdb.Del(ctx, keyA, keyB)
+	reserver.Now = func() time.Time { return time.Now().Add(-time.Hour) }
+	err = reserver.Reserve(ctx, "lapsed", []reservation.Request{{TicketTypeID: 1, Quantity: 1, TotalQuantity: 10}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reserver.Now = time.Now
+	if w := extend("lapsed"); w.Code != http.StatusGone {
+		t.Errorf("expired reservation: expected 410, got %d: %s", w.Code, w.Body)
+	}
 }
@@ -0,0 +1,312 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+
+	"github.com/tpgcig/carneauengine/server/qrtoken"
+)
+
+// ScanManifest is what an offline scanner needs to check tickets for one
+// event: a digest (qrtoken.Digest) of every valid ticket's QR payload.
+type ScanManifest struct {
+	EventID     int                  `json:"event_id"`
+	GeneratedAt time.Time            `json:"generated_at"`
+	TicketTypes []ManifestTicketType `json:"ticket_types"`
+	Tickets     []ManifestTicket     `json:"tickets"`
+}
+
+type ManifestTicketType struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+// ManifestTicket is kept to short keys, as manifests for big events are
+// downloaded over poor connections.
+type ManifestTicket struct {
+	Digest       string `json:"d"`
+	TicketTypeID int    `json:"t"`
+}
+
+// GetScanManifest returns the scan manifest for an event. The body is signed
+// with the ticket signing key: the signature of its exact bytes (see
+// qrtoken.Signer.SignMessage) is in the X-Manifest-Signature header and the
+// key's ID, as published at /api/ticket-keys, in X-Manifest-Key-Id.
+func (h *Handler) GetScanManifest(c *gin.Context) {
+	eventID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid event ID"})
+		return
+	}
+	if !h.authorizeEventOrganiser(c, eventID) {
+		return
+	}
+	ctx := c.Request.Context()
+
+	manifest := ScanManifest{
+		EventID:     eventID,
+		GeneratedAt: time.Now().UTC(),
+		TicketTypes: []ManifestTicketType{},
+		Tickets:     []ManifestTicket{},
+	}
+	rows, err := h.DB.Query(ctx, "SELECT id, name FROM ticket_types WHERE event_id = $1 ORDER BY id", eventID)
+	if err != nil {
+		log.Printf("Error loading ticket types for manifest of event %d: %v", eventID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to build manifest"})
+		return
+	}
+	for rows.Next() {
+		var tt ManifestTicketType
+		if err := rows.Scan(&tt.ID, &tt.Name); err != nil {
+			rows.Close()
+			log.Printf("Error scanning ticket type for manifest: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to build manifest"})
+			return
+		}
+		manifest.TicketTypes = append(manifest.TicketTypes, tt)
+	}
+	rows.Close()
+
+	rows, err = h.DB.Query(ctx, `
+		SELECT t.qr_code, t.ticket_type_id
+		FROM tickets t
+		JOIN ticket_types tt ON tt.id = t.ticket_type_id
+		WHERE tt.event_id = $1 AND t.status = 'valid' AND t.qr_code IS NOT NULL
+		ORDER BY t.id`, eventID)
+	if err != nil {
+		log.Printf("Error loading tickets for manifest of event %d: %v", eventID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to build manifest"})
+		return
+	}
+	for rows.Next() {
+		var qr string
+		var mt ManifestTicket
+		if err := rows.Scan(&qr, &mt.TicketTypeID); err != nil {
+			rows.Close()
+			log.Printf("Error scanning ticket for manifest: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to build manifest"})
+			return
+		}
+		mt.Digest = qrtoken.Digest(qr)
+		manifest.Tickets = append(manifest.Tickets, mt)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		log.Printf("Error loading tickets for manifest of event %d: %v", eventID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to build manifest"})
+		return
+	}
+
+	body, err := json.Marshal(manifest)
+	if err != nil {
+		log.Printf("Error encoding manifest of event %d: %v", eventID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to build manifest"})
+		return
+	}
+	c.Header("X-Manifest-Key-Id", h.TicketSigner.KeyID())
+	c.Header("X-Manifest-Signature", h.TicketSigner.SignMessage(body))
+	c.Data(http.StatusOK, "application/json; charset=utf-8", body)
+}
+
+// OfflineScan is one scan made by a scanner while offline.
+type OfflineScan struct {
+	ScanID    string    `json:"scan_id" binding:"required"` // made up by the device, so its re-uploads are recognised
+	QR        string    `json:"qr" binding:"required"`
+	ScannedAt time.Time `json:"scanned_at" binding:"required"`
+	Gate      string    `json:"gate"`
+}
+
+type ScanBatchRequest struct {
+	DeviceID string        `json:"device_id" binding:"required"` // scan IDs are only unique per device
+	Scans    []OfflineScan `json:"scans" binding:"required,max=1000,dive"`
+}
+
+// Outcomes of a synced scan.
+const (
+	scanRedeemed  = "redeemed"  // the first scan of the ticket, which let it in
+	scanDuplicate = "duplicate" // the ticket had already been scanned
+	scanRejected  = "rejected"  // not a ticket for this event that could be let in
+)
+
+type ScanResult struct {
+	ScanID    string      `json:"scan_id"`
+	TicketID  int         `json:"ticket_id,omitempty"`
+	Outcome   string      `json:"outcome"`
+	Reason    string      `json:"reason,omitempty"`
+	FirstScan *TicketScan `json:"first_scan,omitempty"`
+}
+
+// SyncScans merges a batch of scans made offline into the event's check-ins.
+// The earliest scan of a ticket wins, whichever order scans are uploaded in:
+// an uploaded scan older than the one recorded takes its place, and the
+// recorded one is flagged as a duplicate. Ties go to the scan recorded first.
+// Uploading a scan again returns its recorded outcome.
+func (h *Handler) SyncScans(c *gin.Context) {
+	eventID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid event ID"})
+		return
+	}
+	var req ScanBatchRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !h.authorizeEventOrganiser(c, eventID) {
+		return
+	}
+	ctx := c.Request.Context()
+	userID := c.GetInt("userID")
+
+	// Merging in scan order keeps the outcome the same however the batch is sorted
+	order := make([]int, len(req.Scans))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return req.Scans[order[a]].ScannedAt.Before(req.Scans[order[b]].ScannedAt)
+	})
+
+	results := make([]ScanResult, len(req.Scans))
+	counts := map[string]int{}
+	for _, i := range order {
+		scan := req.Scans[i]
+		res, err := h.mergeScan(ctx, eventID, userID, req.DeviceID, scan)
+		if err != nil {
+			log.Printf("Error syncing scan %s for event %d: %v", scan.ScanID, eventID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to sync scans", "scan_id": scan.ScanID})
+			return
+		}
+		results[i] = res
+		counts[res.Outcome]++
+	}
+
+	log.Printf("Synced %d offline scans for event %d from device %q by user %d: %d redeemed, %d duplicate, %d rejected",
+		len(req.Scans), eventID, req.DeviceID, userID, counts[scanRedeemed], counts[scanDuplicate], counts[scanRejected])
+	c.JSON(http.StatusOK, gin.H{"results": results})
+}
+
+// mergeScan records one offline scan against its ticket.
+func (h *Handler) mergeScan(ctx context.Context, eventID, userID int, deviceID string, scan OfflineScan) (ScanResult, error) {
+	res := ScanResult{ScanID: scan.ScanID}
+	scannedAt := scan.ScannedAt
+	if scannedAt.After(time.Now()) {
+		// A device clock running fast mustn't let its scans beat real ones
+		scannedAt = time.Now()
+	}
+
+	ticketID, err := h.findScannedTicket(ctx, scan.QR)
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+		res.Outcome, res.Reason = scanRejected, "Ticket not found"
+		return res, nil
+	case errors.Is(err, errQRReplaced):
+		res.Outcome, res.Reason = scanRejected, "QR code has been replaced"
+		return res, nil
+	case errors.Is(err, qrtoken.ErrMalformed), errors.Is(err, qrtoken.ErrUnknownKey), errors.Is(err, qrtoken.ErrBadSignature):
+		res.Outcome, res.Reason = scanRejected, "Invalid ticket"
+		return res, nil
+	case err != nil:
+		return res, err
+	}
+	res.TicketID = ticketID
+
+	tx, err := h.DB.Begin(ctx)
+	if err != nil {
+		return res, err
+	}
+	defer tx.Rollback(ctx)
+
+	var ticketEventID int
+	var status string
+	var redeemedAt *time.Time
+	err = tx.QueryRow(ctx, `
+		SELECT tt.event_id, COALESCE(t.status, 'valid'), t.redeemed_at
+		FROM tickets t
+		JOIN ticket_types tt ON tt.id = t.ticket_type_id
+		WHERE t.id = $1
+		FOR UPDATE OF t`, ticketID,
+	).Scan(&ticketEventID, &status, &redeemedAt)
+	if err != nil {
+		return res, err
+	}
+
+	if ticketEventID != eventID {
+		res.Outcome, res.Reason = scanRejected, "Ticket is for a different event"
+		return res, nil
+	}
+
+	// Another device may have made up the same scan ID, so only this device's
+	// scans count as re-uploads, and only of the same ticket
+	var synced string
+	var syncedTicketID int
+	err = tx.QueryRow(ctx,
+		"SELECT outcome, ticket_id FROM ticket_scans WHERE device_id = $1 AND scan_id = $2",
+		deviceID, scan.ScanID,
+	).Scan(&synced, &syncedTicketID)
+	if err == nil {
+		if syncedTicketID != ticketID {
+			res.Outcome, res.Reason = scanRejected, "Scan ID was already used for another ticket"
+			return res, nil
+		}
+		res.Outcome = synced
+		return h.withFirstScan(ctx, res)
+	}
+	if err != pgx.ErrNoRows {
+		return res, err
+	}
+
+	switch {
+	case status == "valid", status == "redeemed" && redeemedAt != nil && scannedAt.Before(*redeemedAt):
+		// Either the first scan, or earlier than the one that was taken as first
+		_, err = tx.Exec(ctx, "UPDATE ticket_scans SET outcome = 'duplicate' WHERE ticket_id = $1 AND outcome = 'redeemed'", ticketID)
+		if err != nil {
+			return res, err
+		}
+		if err := redeemTicket(ctx, tx, ticketID, scannedAt, strings.TrimSpace(scan.Gate), userID); err != nil {
+			return res, err
+		}
+		res.Outcome = scanRedeemed
+	case status == "redeemed":
+		res.Outcome = scanDuplicate
+	default:
+		res.Outcome, res.Reason = scanRejected, fmt.Sprintf("Ticket is %s", status)
+		return res, nil
+	}
+
+	_, err = tx.Exec(ctx, `
+		INSERT INTO ticket_scans (ticket_id, scan_id, device_id, scanned_by, scanned_at, gate, outcome)
+		VALUES ($1, $2, $3, $4, $5, NULLIF($6, ''), $7)`,
+		ticketID, scan.ScanID, deviceID, userID, scannedAt, strings.TrimSpace(scan.Gate), res.Outcome)
+	if err != nil {
+		return res, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return res, err
+	}
+	return h.withFirstScan(ctx, res)
+}
+
+// withFirstScan adds the scan that let a duplicate's ticket in to its result.
+func (h *Handler) withFirstScan(ctx context.Context, res ScanResult) (ScanResult, error) {
+	if res.Outcome != scanDuplicate {
+		return res, nil
+	}
+	ticket, err := h.loadScannedTicket(ctx, res.TicketID)
+	if err != nil {
+		return res, err
+	}
+	res.FirstScan = ticket.Scan
+	return res, nil
+}
@@ -0,0 +1,205 @@
+package handlers_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/tpgcig/carneauengine/server/handlers"
+	"github.com/tpgcig/carneauengine/server/payment"
+	"github.com/tpgcig/carneauengine/server/qrtoken"
+)
+
+// newOfflineScannerRouter serves the offline scanning endpoints as scannerID
+// would see them after AuthMiddleware, at the same paths as main.go.
+func newOfflineScannerRouter(db *pgxpool.Pool, scannerID int) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	h := &handlers.Handler{DB: db, TicketSigner: testTicketSigner, TicketKeys: testTicketKeys}
+	r := gin.New()
+	scanner := r.Group("/", func(c *gin.Context) {
+		c.Set("userID", scannerID)
+		c.Set("userRole", "staff")
+	})
+	scanner.GET("/api/events/:id/scan-manifest", h.GetScanManifest)
+	scanner.POST("/api/events/:id/scans\\:batch", h.SyncScans)
+	unescapeRoutes(r)
+	return r
+}
+
+// unescapeRoutes turns escaped colons in r's routes into literal ones, as
+// Run does before serving. Gin does this nowhere else, so without it
+// ServeHTTP never matches /scans:batch. Run returns as soon as it fails to
+// listen, which it does on a port that can't exist.
+func unescapeRoutes(r *gin.Engine) {
+	if err := r.Run("localhost:-1"); err == nil {
+		panic("gin: Run on an invalid address succeeded")
+	}
+}
+
+func syncScans(t *testing.T, r *gin.Engine, eventID int, scans ...handlers.OfflineScan) []handlers.ScanResult {
+	t.Helper()
+	return syncDeviceScans(t, r, eventID, "gate-tablet", scans...)
+}
+
+func syncDeviceScans(t *testing.T, r *gin.Engine, eventID int, deviceID string, scans ...handlers.OfflineScan) []handlers.ScanResult {
+	t.Helper()
+	body, _ := json.Marshal(handlers.ScanBatchRequest{DeviceID: deviceID, Scans: scans})
+	req := httptest.NewRequest(http.MethodPost, fmt.Sprintf("/api/events/%d/scans:batch", eventID), bytes.NewReader(body))
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("sync: expected 200, got %d: %s", w.Code, w.Body)
+	}
+	var resp struct {
+		Results []handlers.ScanResult `json:"results"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	return resp.Results
+}
+
+func TestGetScanManifest(t *testing.T) {
+	db := newTestDB(t)
+	fake := payment.NewFakeGateway("http://unused", "", "test-secret")
+	f := newCheckoutFixture(t, db, 2)
+	payFixture(t, db, fake, f)
+	ticketID, qr := signFixtureTicket(t, db, f)
+	_, err := db.Exec(context.Background(), "UPDATE tickets SET status = 'redeemed' WHERE purchase_id = $1 AND id <> $2", f.purchaseID, ticketID)
+	mustQuery(t, err)
+	r := newOfflineScannerRouter(db, newOrganiser(t, db, f.orgID))
+
+	req := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/api/events/%d/scan-manifest", f.eventID), nil)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+	err = testTicketKeys.VerifyMessage(w.Header().Get("X-Manifest-Key-Id"), w.Body.Bytes(), w.Header().Get("X-Manifest-Signature"))
+	if err != nil {
+		t.Fatalf("expected a valid manifest signature, got %v", err)
+	}
+
+	var m handlers.ScanManifest
+	if err := json.Unmarshal(w.Body.Bytes(), &m); err != nil {
+		t.Fatal(err)
+	}
+	want := handlers.ManifestTicket{Digest: qrtoken.Digest(qr), TicketTypeID: f.ticketTypeID}
+	if m.EventID != f.eventID || len(m.Tickets) != 1 || m.Tickets[0] != want {
+		t.Errorf("expected only the valid ticket %+v, got %+v", want, m.Tickets)
+	}
+	if len(m.TicketTypes) != 1 || m.TicketTypes[0].ID != f.ticketTypeID {
+		t.Errorf("expected the fixture's ticket type, got %+v", m.TicketTypes)
+	}
+}
+
+// TestSyncScans_EarliestWins uploads scans of one ticket out of order and
+// checks the earliest ends up as the one that let it in.
+func TestSyncScans_EarliestWins(t *testing.T) {
+	db := newTestDB(t)
+	ctx := context.Background()
+	fake := payment.NewFakeGateway("http://unused", "", "test-secret")
+	f := newCheckoutFixture(t, db, 1)
+	payFixture(t, db, fake, f)
+	scannerID := newOrganiser(t, db, f.orgID)
+	t.Cleanup(func() { deleteFixtureTickets(db, f) }) // before the scanner, as tickets refer to who scanned them
+	r := newOfflineScannerRouter(db, scannerID)
+	_, qr := signFixtureTicket(t, db, f)
+
+	doors := time.Now().Add(-time.Hour).UTC().Truncate(time.Second)
+	late := handlers.OfflineScan{ScanID: uuid.NewString(), QR: qr, ScannedAt: doors.Add(10 * time.Minute), Gate: "South"}
+	early := handlers.OfflineScan{ScanID: uuid.NewString(), QR: qr, ScannedAt: doors, Gate: "North"}
+	middle := handlers.OfflineScan{ScanID: uuid.NewString(), QR: qr, ScannedAt: doors.Add(5 * time.Minute), Gate: "East"}
+	bogus := handlers.OfflineScan{ScanID: uuid.NewString(), QR: "CARNEAU-NOPE", ScannedAt: doors}
+
+	if got := syncScans(t, r, f.eventID, late); got[0].Outcome != "redeemed" {
+		t.Fatalf("late scan alone: expected redeemed, got %+v", got[0])
+	}
+
+	got := syncScans(t, r, f.eventID, middle, early, bogus)
+	if got[1].Outcome != "redeemed" {
+		t.Errorf("early scan: expected redeemed, got %+v", got[1])
+	}
+	if got[0].Outcome != "duplicate" || got[0].FirstScan == nil || got[0].FirstScan.Gate != "North" {
+		t.Errorf("middle scan: expected a duplicate of the North scan, got %+v", got[0])
+	}
+	if got[2].Outcome != "rejected" {
+		t.Errorf("unknown ticket: expected rejected, got %+v", got[2])
+	}
+
+	// Uploading again changes nothing, but the late scan is now a duplicate
+	if again := syncScans(t, r, f.eventID, late); again[0].Outcome != "duplicate" {
+		t.Errorf("late scan re-uploaded: expected duplicate, got %+v", again[0])
+	}
+
+	var gate string
+	var redeemedAt time.Time
+	mustQuery(t, db.QueryRow(ctx, "SELECT redeemed_gate, redeemed_at FROM tickets WHERE qr_code = $1", qr).Scan(&gate, &redeemedAt))
+	if gate != "North" || !redeemedAt.Equal(doors) {
+		t.Errorf("expected the ticket redeemed at North at %s, got %s at %s", doors, gate, redeemedAt)
+	}
+	var winners, scans int
+	mustQuery(t, db.QueryRow(ctx,
+		"SELECT COUNT(*) FILTER (WHERE outcome = 'redeemed'), COUNT(*) FROM ticket_scans WHERE scan_id = ANY($1)",
+		[]string{late.ScanID, early.ScanID, middle.ScanID}).Scan(&winners, &scans))
+	if winners != 1 || scans != 3 {
+		t.Errorf("expected 3 recorded scans with 1 winner, got %d with %d", scans, winners)
+	}
+}
+
+// TestSyncScans_ScanIDsPerDevice checks a scan ID is only taken as a re-upload
+// when the same device sends it again for the same ticket and event.
+func TestSyncScans_ScanIDsPerDevice(t *testing.T) {
+	db := newTestDB(t)
+	ctx := context.Background()
+	fake := payment.NewFakeGateway("http://unused", "", "test-secret")
+	f := newCheckoutFixture(t, db, 1)
+	payFixture(t, db, fake, f)
+	scannerID := newOrganiser(t, db, f.orgID)
+	t.Cleanup(func() { deleteFixtureTickets(db, f) })
+	r := newOfflineScannerRouter(db, scannerID)
+	_, qr := signFixtureTicket(t, db, f)
+
+	other := newCheckoutFixture(t, db, 1) // another event run by the same organisation
+	_, err := db.Exec(ctx, "UPDATE events SET organisation_id = $1 WHERE id = $2", f.orgID, other.eventID)
+	mustQuery(t, err)
+	payFixture(t, db, fake, other)
+	t.Cleanup(func() { deleteFixtureTickets(db, other) })
+	_, otherQR := signFixtureTicket(t, db, other)
+
+	scanID := uuid.NewString()
+	doors := time.Now().Add(-time.Hour).UTC().Truncate(time.Second)
+	scan := handlers.OfflineScan{ScanID: scanID, QR: qr, ScannedAt: doors}
+	if got := syncDeviceScans(t, r, f.eventID, "north-tablet", scan); got[0].Outcome != "redeemed" {
+		t.Fatalf("first scan: expected redeemed, got %+v", got[0])
+	}
+
+	// The same ID from another device is a scan of its own
+	later := handlers.OfflineScan{ScanID: scanID, QR: qr, ScannedAt: doors.Add(time.Minute)}
+	if got := syncDeviceScans(t, r, f.eventID, "south-tablet", later); got[0].Outcome != "duplicate" {
+		t.Errorf("same ID from another device: expected duplicate, got %+v", got[0])
+	}
+	var scans int
+	mustQuery(t, db.QueryRow(ctx, "SELECT COUNT(*) FROM ticket_scans WHERE scan_id = $1", scanID).Scan(&scans))
+	if scans != 2 {
+		t.Errorf("expected a scan recorded per device, got %d", scans)
+	}
+
+	// Nor does the ID's earlier outcome carry over to another ticket or event
+	reused := handlers.OfflineScan{ScanID: scanID, QR: otherQR, ScannedAt: doors}
+	if got := syncDeviceScans(t, r, f.eventID, "north-tablet", reused); got[0].Outcome != "rejected" {
+		t.Errorf("another event's ticket under a synced ID: expected rejected, got %+v", got[0])
+	}
+	if got := syncDeviceScans(t, r, other.eventID, "north-tablet", scan); got[0].Outcome != "rejected" {
+		t.Errorf("synced scan uploaded to another event: expected rejected, got %+v", got[0])
+	}
+}
@@ -1,167 +1,48 @@
 package handlers
 
 import (
-	"bytes"
 	"context"
-	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
-	"mime/multipart"
-	"math/rand"
 	"net/http"
-	"net/smtp"
-	"net/textproto" // Added for textproto.MIMEHeader
-	"os"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/jackc/pgx/v5"
-	"github.com/skip2/go-qrcode"
-	"github.com/stripe/stripe-go/v83"
-	"github.com/stripe/stripe-go/v83/checkout/session"
-	"github.com/stripe/stripe-go/v83/webhook"
-	"golang.org/x/crypto/bcrypt"
+	"github.com/jackc/pgx/v5/pgtype"
 
 	_ "github.com/go-redis/redis/v8" // Added for Redis client
 	"github.com/google/uuid"       // Added for UUID generation
 
-	"github.com/tpgcig/carneauengine/server/models"
+	"github.com/tpgcig/carneauengine/server/money"
+	"github.com/tpgcig/carneauengine/server/outbox"
+	"github.com/tpgcig/carneauengine/server/payment"
+	"github.com/tpgcig/carneauengine/server/qrtoken"
+	"github.com/tpgcig/carneauengine/server/reservation"
+	"github.com/tpgcig/carneauengine/server/ticketstate"
 )
 
-func init() {
-	rand.Seed(time.Now().UnixNano())
-}
-
-var letterRunes = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789")
-
-func generateRandomString(n int) string {
-	b := make([]rune, n)
-	for i := range b {
-		b[i] = letterRunes[rand.Intn(len(letterRunes))]
-	}
-	return string(b)
-}
-
-// sendEmail helper function
-func sendEmail(to, subject, htmlBody string, qrCodeImages map[string][]byte, senderEmail, smtpHost, smtpPort, smtpUser, smtpPassword string) error {
-	var body bytes.Buffer
-	mimeWriter := multipart.NewWriter(&body)
-
-	// Create a "multipart/alternative" part for text and HTML body
-	altWriter := new(bytes.Buffer)
-	altMimeWriter := multipart.NewWriter(altWriter)
-	altMimeWriter.SetBoundary("alt-" + altMimeWriter.Boundary()) // Unique boundary for nested multipart
-	
-	// Text part (simple version of HTML)
-	textPartHeaders := make(textproto.MIMEHeader)
-	textPartHeaders.Set("Content-Type", "text/plain; charset=\"UTF-8\"")
-	textPartHeaders.Set("Content-Transfer-Encoding", "quoted-printable")
-	textPart, _ := altMimeWriter.CreatePart(textPartHeaders)
-	textPart.Write([]byte(htmlBody)) // For simplicity, sending HTML as plain text too
-
-	// HTML part with embedded images
-	relatedWriter := new(bytes.Buffer)
-	relatedMimeWriter := multipart.NewWriter(relatedWriter)
-	relatedMimeWriter.SetBoundary("rel-" + relatedMimeWriter.Boundary()) // Unique boundary for nested multipart
-
-	htmlPartHeaders := make(textproto.MIMEHeader)
-	htmlPartHeaders.Set("Content-Type", "text/html; charset=\"UTF-8\"")
-	htmlPartHeaders.Set("Content-Transfer-Encoding", "quoted-printable")
-	p, _ := relatedMimeWriter.CreatePart(htmlPartHeaders)
-	p.Write([]byte(htmlBody))
-
-	for cid, qrCodeData := range qrCodeImages {
-		imgPartHeaders := make(textproto.MIMEHeader)
-		imgPartHeaders.Set("Content-Type", "image/png")
-		imgPartHeaders.Set("Content-Transfer-Encoding", "base64")
-		imgPartHeaders.Set("Content-ID", fmt.Sprintf("<%s>", cid))
-		imgPartHeaders.Set("Content-Disposition", fmt.Sprintf("inline; filename=\"%s.png\"", cid))
-		imgPart, _ := relatedMimeWriter.CreatePart(imgPartHeaders)
-		encoder := base64.NewEncoder(base64.StdEncoding, imgPart)
-		encoder.Write(qrCodeData)
-		encoder.Close()
-	}
-	relatedMimeWriter.Close() // Close the related writer to finalize its boundary
-
-	// Add the multipart/related part to the multipart/alternative
-	relatedAltPartHeaders := make(textproto.MIMEHeader)
-	relatedAltPartHeaders.Set("Content-Type", fmt.Sprintf("multipart/related; boundary=%s", relatedMimeWriter.Boundary()))
-	relatedAltPart, _ := altMimeWriter.CreatePart(relatedAltPartHeaders)
-	relatedAltPart.Write(relatedWriter.Bytes())
-
-	altMimeWriter.Close() // Close the multipart/alternative writer
-
-	// Add the multipart/alternative part to the main body
-	altMainPartHeaders := make(textproto.MIMEHeader)
-	altMainPartHeaders.Set("Content-Type", fmt.Sprintf("multipart/alternative; boundary=%s", altMimeWriter.Boundary()))
-	altMainPart, _ := mimeWriter.CreatePart(altMainPartHeaders)
-	altMainPart.Write(altWriter.Bytes())
-
-
-	// Main email headers
-	mainHeaders := make(textproto.MIMEHeader)
-	mainHeaders.Set("From", senderEmail)
-	mainHeaders.Set("To", to)
-	mainHeaders.Set("Subject", subject)
-	mainHeaders.Set("MIME-Version", "1.0")
-	mainHeaders.Set("Content-Type", fmt.Sprintf("multipart/mixed; boundary=%s", mimeWriter.Boundary()))
-
-
-	// Combine headers and body
-	var finalMessage bytes.Buffer
-	for k := range mainHeaders {
-		finalMessage.WriteString(fmt.Sprintf("%s: %s\r\n", k, mainHeaders.Get(k)))
-	}
-	finalMessage.WriteString("\r\n")
-	finalMessage.Write(body.Bytes())
-
-	auth := smtp.PlainAuth("", smtpUser, smtpPassword, smtpHost)
-	addr := fmt.Sprintf("%s:%s", smtpHost, smtpPort)
-
-	return smtp.SendMail(addr, auth, senderEmail, []string{to}, finalMessage.Bytes())
-}
-
 // releaseRedisHolds function to clean up Redis holds if something goes wrong before Stripe session is created
 func (h *Handler) releaseRedisHolds(ctx context.Context, reservationID string) {
-	// Retrieve the map of ticketTypeID -> quantity from the reservation hash
-	reservedItems, err := h.Redis.HGetAll(ctx, "reservation:"+reservationID).Result()
-	if err != nil {
-		log.Printf("Error retrieving reserved items for reservation ID %s: %v", reservationID, err)
+	if err := h.Reservations.Release(ctx, reservationID); err != nil {
+		log.Printf("Error releasing Redis holds for reservation ID %s: %v", reservationID, err)
 		return
 	}
-
-	for ticketTypeIDStr, quantityStr := range reservedItems {
-		ticketTypeID, err := strconv.Atoi(ticketTypeIDStr)
-		if err != nil {
-			log.Printf("Error converting ticketTypeID %s to int: %v", ticketTypeIDStr, err)
-			continue
-		}
-		quantity, err := strconv.Atoi(quantityStr)
-		if err != nil {
-			log.Printf("Error converting quantity %s to int for ticketTypeID %d: %v", quantityStr, ticketTypeID, err)
-			continue
-		}
-
-		// Decrement the held quantity
-		_, err = h.Redis.HIncrBy(ctx, fmt.Sprintf("ticket_holds:%d", ticketTypeID), "held_quantity", int64(-quantity)).Result()
-		if err != nil {
-			log.Printf("Error releasing Redis hold for ticket type %d, reservation %s: %v", ticketTypeID, reservationID, err)
-		}
-	}
-	// Delete the main reservation hash
-	h.Redis.Del(ctx, "reservation:"+reservationID)
 	log.Printf("Released Redis holds for reservation ID: %s", reservationID)
 }
 
 func (h *Handler) CreateCheckoutSession(c *gin.Context) {
 	var req struct {
 		Items []struct {
-			TicketID int `json:"ticket_id"`
-			Quantity int `json:"quantity"`
+			TicketID  int               `json:"ticket_id"`
+			Quantity  int               `json:"quantity"`
+			Attendees []AttendeeDetails `json:"attendees"` // one per ticket, if the event asks questions
 		} `json:"items"`
 		Email string `json:"email"`
 	}
@@ -210,9 +91,10 @@ func (h *Handler) CreateCheckoutSession(c *gin.Context) {
 	// IMPORTANT: Select FOR UPDATE to ensure no other transaction modifies these rows
 	// between our read and the Redis update.
 	query := fmt.Sprintf(`
-		SELECT id, event_id, name, price, total_quantity, sold_quantity
-		FROM ticket_types
-		WHERE id IN (%s) FOR UPDATE`, strings.Join(placeholders, ","))
+		SELECT tt.id, tt.event_id, tt.name, tt.price, e.currency, tt.total_quantity, tt.sold_quantity
+		FROM ticket_types tt
+		JOIN events e ON e.id = tt.event_id
+		WHERE tt.id IN (%s) FOR UPDATE OF tt`, strings.Join(placeholders, ","))
 	
 	rows, err := h.DB.Query(c.Request.Context(), query, args...)
 	if err != nil {
@@ -223,34 +105,31 @@ func (h *Handler) CreateCheckoutSession(c *gin.Context) {
 	defer rows.Close()
 
 	var (
-		lineItems []*stripe.CheckoutSessionLineItemParams
-		totalAmount float64
+		lineItems []payment.LineItem
 		eventID int
 		dbTicketDetails = make(map[int]struct {
 			Name string
-			Price float64
+			Price money.Money
 			TotalQuantity int
 			SoldQuantity int
 		})
 	)
 
-	// To store ticket details for later purchase insertion
-	type ticketDetail struct {
-		TicketTypeID int
-		Quantity     int
-		Price        float64
-	}
-	var purchasedTicketDetails []ticketDetail
-
 	for rows.Next() {
 		var id, currentEventID, totalQuantity, soldQuantity int
-		var name string
-		var price float64
-		if err := rows.Scan(&id, &currentEventID, &name, &price, &totalQuantity, &soldQuantity); err != nil {
+		var name, currency string
+		var numericPrice pgtype.Numeric
+		if err := rows.Scan(&id, &currentEventID, &name, &numericPrice, &currency, &totalQuantity, &soldQuantity); err != nil {
 			log.Printf("Error scanning ticket type during reservation fetch: %v", err)
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error processing ticket information"})
 			return
 		}
+		price, err := money.FromNumeric(numericPrice, currency)
+		if err != nil {
+			log.Printf("Invalid price for ticket type %d: %v", id, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error processing ticket information"})
+			return
+		}
 
 		if eventID == 0 {
 			eventID = currentEventID
@@ -261,7 +140,7 @@ func (h *Handler) CreateCheckoutSession(c *gin.Context) {
 
 		dbTicketDetails[id] = struct {
 			Name string
-			Price float64
+			Price money.Money
 			TotalQuantity int
 			SoldQuantity int
 		}{name, price, totalQuantity, soldQuantity}
@@ -272,156 +151,112 @@ func (h *Handler) CreateCheckoutSession(c *gin.Context) {
 		return
 	}
 
-	// Prepare data for Redis Lua script
-	var (
-		redisKeys   []string
-		redisArgs   []interface{}
-		ticketTypeArgs []string // For Lua script KEY arguments
-		quantityArgs   []string // For Lua script ARG arguments
-	)
-
-	const reservationTTL = 15 * 60 // 15 minutes in seconds
+	// Check the attendee details before holding anything
+	questions, err := h.eventQuestions(c.Request.Context(), eventID)
+	if err != nil {
+		log.Printf("Error loading questions of event %d: %v", eventID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error processing ticket information"})
+		return
+	}
+	attendees := make([]string, len(req.Items))
+	for i, item := range req.Items {
+		validated, err := validateAttendees(questions, item.TicketID, item.Quantity, item.Attendees)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("%s: %v", dbTicketDetails[item.TicketID].Name, err)})
+			return
+		}
+		if validated != nil {
+			b, _ := json.Marshal(validated)
+			attendees[i] = string(b)
+		}
+	}
 
+	// Hold the requested tickets atomically; this fails without holding anything
+	// if any ticket type doesn't have enough left.
+	var reservationRequests []reservation.Request
 	for _, item := range req.Items {
 		detail := dbTicketDetails[item.TicketID]
-		requestedQty := item.Quantity
-
-		// Redis key for holding quantity
-		ticketHoldKey := fmt.Sprintf("ticket_holds:%d", item.TicketID)
-		
-		// Lua script arguments
-		ticketTypeArgs = append(ticketTypeArgs, ticketHoldKey) // KEY[1...N] = ticket_holds:id
-		quantityArgs = append(quantityArgs, fmt.Sprintf("%d", detail.TotalQuantity))
-		quantityArgs = append(quantityArgs, fmt.Sprintf("%d", detail.SoldQuantity))
-		quantityArgs = append(quantityArgs, fmt.Sprintf("%d", requestedQty))
+		reservationRequests = append(reservationRequests, reservation.Request{
+			TicketTypeID:  item.TicketID,
+			Quantity:      item.Quantity,
+			TotalQuantity: detail.TotalQuantity,
+			SoldQuantity:  detail.SoldQuantity,
+		})
 	}
-	
-	// KEYS: ticket_holds:<id1>, ticket_holds:<id2>, ...
-	// ARGS: total_qty1, sold_qty1, requested_qty1, total_qty2, sold_qty2, requested_qty2, ..., reservationID, reservationTTL
-	redisKeys = ticketTypeArgs
-	redisArgs = []interface{}{}
-	for _, arg := range quantityArgs {
-		redisArgs = append(redisArgs, arg)
-	}
-	redisArgs = append(redisArgs, reservationID)
-	redisArgs = append(redisArgs, fmt.Sprintf("%d", reservationTTL))
-
-	// Lua script for atomic reservation
-	// It iterates through each ticket type, checks availability, and reserves.
-	// If any reservation fails, it rolls back all reservations for this request.
-	// KEYS: {ticket_hold_key_1, ticket_hold_key_2, ...}
-	// ARGV: {total_qty_1, sold_qty_1, requested_qty_1, total_qty_2, sold_qty_2, requested_qty_2, ..., reservationID, reservationTTL}
-	var luaScript = `
-		local reservationId = ARGV[#ARGV - 1]
-		local reservationTTL = tonumber(ARGV[#ARGV])
-		local numTickets = (#KEYS)
-		local reservedItems = {} -- Stores successfully reserved quantities in this transaction
-		local fullReservationKey = "reservation:" .. reservationId
-
-		-- Clean up on error (optional, but good practice if intermediate writes occur)
-		local function rollback()
-			for i = 1, #reservedItems, 2 do
-				local ttId = reservedItems[i]
-				local qty = reservedItems[i+1]
-				redis.call('HINCRBY', "ticket_holds:" .. ttId, "held_quantity", -qty)
-			end
-			redis.call('DEL', fullReservationKey)
-			return 0
-		end
-
-		for i = 1, numTickets do
-			local ticketHoldKey = KEYS[i] -- e.g., ticket_holds:123
-			local totalQty = tonumber(ARGV[(i-1)*3 + 1])
-			local soldQty = tonumber(ARGV[(i-1)*3 + 2])
-			local requestedQty = tonumber(ARGV[(i-1)*3 + 3])
-			local ticketTypeId = string.match(ticketHoldKey, "ticket_holds:(%d+)") -- Extract ID
-
-			local currentHeldQty = tonumber(redis.call('HGET', ticketHoldKey, 'held_quantity') or '0')
-			local availableForSale = totalQty - soldQty - currentHeldQty
-
-			if availableForSale < requestedQty then
-				-- Not enough tickets, roll back all and return error
-				return rollback()
-			end
-
-			-- Reserve tickets by incrementing the held_quantity
-			redis.call('HINCRBY', ticketHoldKey, "held_quantity", requestedQty)
-			
-			-- Store this reservation detail in the temporary reservedItems for potential rollback
-			table.insert(reservedItems, ticketTypeId)
-			table.insert(reservedItems, requestedQty)
-
-			-- Store reservation details in a hash for this specific reservation ID
-			-- This allows the webhook to easily retrieve what was reserved by this session
-			redis.call('HSET', fullReservationKey, ticketTypeId, requestedQty)
-		end
-
-		-- Set TTL for the main reservation hash
-		redis.call('EXPIRE', fullReservationKey, reservationTTL)
-		return 1
-	`
-	// Execute the Lua script
-	val, err := h.Redis.Eval(c.Request.Context(), luaScript, redisKeys, redisArgs...).Result()
-	if err != nil {
-		log.Printf("Redis Lua script execution failed: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reserve tickets due to internal error."})
+
+	err = h.Reservations.Reserve(c.Request.Context(), reservationID, reservationRequests)
+	if errors.Is(err, reservation.ErrInvalidQuantity) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Ticket quantities must be at least 1"})
 		return
 	}
-
-	if val.(int64) == 0 { // If script returned 0, it means reservation failed (not enough tickets)
+	if errors.Is(err, reservation.ErrInsufficientStock) {
 		c.JSON(http.StatusConflict, gin.H{"error": "Not enough tickets available for some selected items. Please adjust your cart."})
 		return
 	}
+	if err != nil {
+		log.Printf("Ticket reservation failed: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reserve tickets due to internal error."})
+		return
+	}
 
 	// If we reach here, tickets are successfully reserved in Redis.
 	// Now proceed with existing logic to prepare Stripe session.
 
-	// Determine userID: existing user or new guest user
-	var currentUserID int
+	// The session expires when the hold would with its one extension, or as
+	// soon after as Stripe allows
+	held, err := h.Reservations.Get(c.Request.Context(), reservationID)
+	if err != nil {
+		log.Printf("Error reading reservation %s: %v", reservationID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reserve tickets due to internal error."})
+		return
+	}
 
 	// All checkouts are guest checkouts based on the provided email
-	user, err := h.GetUserByEmail(c.Request.Context(), req.Email) // Use h.GetUserByEmail from user.go
-	if err != nil && err != pgx.ErrNoRows { // Check for actual errors, not just no rows
-		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to check for existing user: %v", err)})
+	currentUserID, err := findOrCreateGuest(c.Request.Context(), h.DB, req.Email)
+	if err != nil {
+		log.Printf("Failed to find or create guest user: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create guest user"})
 		return
 	}
 
-	if user != nil {
-		// User exists, use their ID
-		currentUserID = user.ID
-	} else {
-		// No user found, create a new guest user
-		var guestUser models.User
-		guestUser.Email = req.Email
-		guestUser.FirstName = "Guest" // Placeholder
-		guestUser.LastName = "User"   // Placeholder
-		guestUser.Role = "guest"
+	// Calculate line items for the payment gateway and the order total
+	var totalAmount money.Money
+	for i, item := range req.Items {
+		detail := dbTicketDetails[item.TicketID]
+		qty := quantityMap[item.TicketID] // Use quantity from request, already validated by Redis
 
-		// Hash a generic "guest" password. This password will not be used for login.
-		hashedPwd, err := bcrypt.GenerateFromPassword([]byte("GUEST_USER_PLACEHOLDER_PASSWORD"), bcrypt.DefaultCost)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to hash guest password"})
-			return
+		lineItems = append(lineItems, payment.LineItem{
+			Name:      detail.Name,
+			UnitPrice: detail.Price,
+			Quantity:  qty,
+		})
+		if i == 0 {
+			totalAmount = detail.Price.Mul(qty)
+			continue
 		}
-		guestUser.PasswordHash = string(hashedPwd)
-
-		err = h.DB.QueryRow(c.Request.Context(),
-			"INSERT INTO users (email, first_name, last_name, role, password_hash) VALUES ($1, $2, $3, $4, $5) RETURNING id",
-			guestUser.Email, guestUser.FirstName, guestUser.LastName, guestUser.Role, guestUser.PasswordHash,
-		).Scan(&guestUser.ID)
-
+		totalAmount, err = totalAmount.Add(detail.Price.Mul(qty))
 		if err != nil {
-			log.Printf("Failed to create guest user: %v", err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create guest user"})
+			// All ticket types belong to one event, so this only happens if its data is inconsistent
+			log.Printf("Error totalling cart for event %d: %v", eventID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error processing ticket information"})
 			return
 		}
-		currentUserID = guestUser.ID
 	}
 
+	// Record the pending purchase and its line items together, so the webhook
+	// can fulfil the order from the database rather than from Stripe metadata
+	tx, err := h.DB.Begin(c.Request.Context())
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create pending purchase"})
+		return
+	}
+	defer tx.Rollback(c.Request.Context())
+
 	var purchaseID int
-	err = h.DB.QueryRow(c.Request.Context(),
-		"INSERT INTO purchases (user_id, event_id, total_amount, payment_status) VALUES ($1, $2, $3, $4) RETURNING id",
-		currentUserID, eventID, totalAmount, "pending",
+	err = tx.QueryRow(c.Request.Context(),
+		"INSERT INTO purchases (user_id, event_id, total_amount, currency, payment_status, reservation_id) VALUES ($1, $2, $3, $4, $5, $6) RETURNING id",
+		currentUserID, eventID, totalAmount.Numeric(), totalAmount.Currency, "pending", reservationID,
 	).Scan(&purchaseID)
 
 	if err != nil {
@@ -430,61 +265,71 @@ func (h *Handler) CreateCheckoutSession(c *gin.Context) {
 		return
 	}
 
-	// Calculate line items for Stripe and total amount
-	for _, item := range req.Items {
-		detail := dbTicketDetails[item.TicketID]
-		qty := quantityMap[item.TicketID] // Use quantity from request, already validated by Redis
-		
-		lineItems = append(lineItems, &stripe.CheckoutSessionLineItemParams{
-			PriceData: &stripe.CheckoutSessionLineItemPriceDataParams{
-				Currency: stripe.String("aud"),
-				ProductData: &stripe.CheckoutSessionLineItemPriceDataProductDataParams{
-					Name: stripe.String(detail.Name),
-				},
-				UnitAmount: stripe.Int64(int64(detail.Price * 100)), // Convert to cents
-			},
-			Quantity: stripe.Int64(int64(qty)),
-		})
-		totalAmount += detail.Price * float64(qty)
-		purchasedTicketDetails = append(purchasedTicketDetails, ticketDetail{TicketTypeID: item.TicketID, Quantity: qty, Price: detail.Price})
-	}
-	// The `totalAmount` calculation above is correct for Stripe, but `purchases.total_amount` in DB was inserted based on
-	// a previous `totalAmount` value. We need to update it or ensure it's calculated after all items are processed.
-	// For now, let's trust the current `totalAmount` which is built up during `lineItems` preparation.
-
-	// For `items` metadata, let's include the reserved quantities
-	var itemsMeta []string
-	for _, td := range purchasedTicketDetails {
-		itemsMeta = append(itemsMeta, fmt.Sprintf("%d:%d:%.2f", td.TicketTypeID, td.Quantity, td.Price))
-	}
-
-	// 4. Create Stripe Session
-	params := &stripe.CheckoutSessionParams{
-		PaymentMethodTypes: stripe.StringSlice([]string{"card"}),
-		LineItems:          lineItems,
-		Mode:               stripe.String(string(stripe.CheckoutSessionModePayment)),
-		SuccessURL:         stripe.String("http://localhost:3000/success?session_id={CHECKOUT_SESSION_ID}"), // Pass session ID
-		CancelURL:          stripe.String("http://localhost:3000/cancel"),
-		CustomerEmail:      stripe.String(req.Email),
-		Metadata: map[string]string{
-			"purchase_id":   strconv.Itoa(purchaseID),
-			"event_id":      strconv.Itoa(eventID),
-			"user_id":       strconv.Itoa(currentUserID), // Use the determined user ID
-			"items":         strings.Join(itemsMeta, ";"),
-			"reservation_id": reservationID, // Pass the Redis reservation ID
-		},
+	for i, item := range req.Items {
+		_, err = tx.Exec(c.Request.Context(),
+			"INSERT INTO purchase_items (purchase_id, ticket_type_id, quantity, unit_price, attendees) VALUES ($1, $2, $3, $4, NULLIF($5, '')::jsonb)",
+			purchaseID, item.TicketID, item.Quantity, dbTicketDetails[item.TicketID].Price.Numeric(), attendees[i],
+		)
+		if err != nil {
+			log.Printf("Failed to record purchase item for purchase %d: %v", purchaseID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create pending purchase"})
+			return
+		}
+	}
+
+	if err := tx.Commit(c.Request.Context()); err != nil {
+		log.Printf("Error committing transaction: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create pending purchase"})
+		return
 	}
 
-	s, err := session.New(params)
+	// 4. Create the hosted checkout session
+	s, err := h.Payments.CreateSession(c.Request.Context(), payment.SessionParams{
+		LineItems:     lineItems,
+		CustomerEmail: req.Email,
+		SuccessURL:    "http://localhost:3000/success?session_id=" + payment.SessionIDPlaceholder, // Pass session ID
+		CancelURL:     "http://localhost:3000/cancel?reservation_id=" + reservationID,              // Lets the cancel page release the hold
+		Metadata: map[string]string{
+			// Everything else about the order lives on the purchase and purchase_items rows
+			"purchase_id": strconv.Itoa(purchaseID),
+		},
+		ExpiresAt: sessionDeadline(held.ExpiresAt.Add(reservationExtension), time.Now()),
+	})
 	if err != nil {
-		log.Printf("Stripe session creation failed: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		log.Printf("Checkout session creation failed for purchase %d: %v", purchaseID, err)
+		// Nothing can pay for this purchase now, so close it and give its tickets back
+		if _, err := h.DB.Exec(c.Request.Context(),
+			"UPDATE purchases SET payment_status = 'failed', updated_at = now() WHERE id = $1 AND payment_status = 'pending'",
+			purchaseID); err != nil {
+			log.Printf("Error marking purchase %d failed: %v", purchaseID, err)
+		}
+		if err := h.Reservations.Release(c.Request.Context(), reservationID); err != nil {
+			log.Printf("Error releasing reservation %s after failed checkout: %v", reservationID, err)
+		}
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to start checkout. Please try again."})
 		return
 	}
 
+	// Remember the session straight away, so reconciliation can still find this
+	// purchase if its webhook never arrives
+	if _, err := h.DB.Exec(c.Request.Context(), "UPDATE purchases SET stripe_payment_id = $1 WHERE id = $2", s.ID, purchaseID); err != nil {
+		log.Printf("Error recording session %s on purchase %d: %v", s.ID, purchaseID, err)
+	}
+
 	// If Stripe session is successfully created, we don't want the defer to release holds.
 	// We could use a flag, but for now, rely on the fact that an HTTP 200 will be set.
-	c.JSON(http.StatusOK, gin.H{"url": s.URL})
+	// The reservation ID lets the client poll GET /api/reservations/:id for the hold's countdown.
+	c.JSON(http.StatusOK, gin.H{"url": s.URL, "reservation_id": reservationID})
+}
+
+// sessionDeadline is when a checkout session for a hold running out at
+// holdExpiresAt should expire: with the hold, unless that is sooner than
+// Stripe allows.
+func sessionDeadline(holdExpiresAt, now time.Time) time.Time {
+	if earliest := now.Add(minSessionLifetime); holdExpiresAt.Before(earliest) {
+		return earliest
+	}
+	return holdExpiresAt
 }
 
 func (h *Handler) StripeWebhook(c *gin.Context) {
@@ -497,224 +342,86 @@ func (h *Handler) StripeWebhook(c *gin.Context) {
 		return
 	}
 
-	endpointSecret := os.Getenv("STRIPE_WEBHOOK_SECRET")
-	event, err := webhook.ConstructEvent(payload, c.Request.Header.Get("Stripe-Signature"), endpointSecret)
-
+	event, err := h.Payments.ParseWebhook(payload, c.Request.Header)
 	if err != nil {
 		log.Printf("Error verifying webhook signature: %v", err)
 		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Error verifying webhook signature: %v", err)})
 		return
 	}
 
+	// Stripe retries deliveries, so skip events we've already applied
+	processed, err := h.stripeEventProcessed(c.Request.Context(), event.ID)
+	if err != nil {
+		log.Printf("Error checking processed Stripe events: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check webhook event"})
+		return
+	}
+	if processed {
+		log.Printf("Skipping already processed Stripe event %s (%s)", event.ID, event.Type)
+		c.JSON(http.StatusOK, gin.H{"status": "already processed"})
+		return
+	}
+
 	// Handle the event
 	switch event.Type {
-	case "checkout.session.completed":
-		var s stripe.CheckoutSession
-		err := json.Unmarshal(event.Data.Raw, &s)
-		if err != nil {
-			log.Printf("Error parsing webhook JSON: %v", err)
-			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Error parsing webhook JSON: %v", err)})
+	case payment.EventCheckoutCompleted:
+		s, ok := checkoutSession(c, event)
+		if !ok {
 			return
 		}
 
-		log.Printf("Checkout session completed for session ID: %s, Customer Email: %s\n", s.ID, s.CustomerDetails.Email)
+		// Delayed payment methods complete the session before the money arrives.
+		// Those purchases wait for checkout.session.async_payment_succeeded/failed.
+		if !s.Paid {
+			log.Printf("Checkout session %s completed but payment is still processing", s.ID)
+			if !h.markPurchaseProcessing(c, s) {
+				return
+			}
+			break
+		}
 
-		// Retrieve metadata
-		purchaseIDStr := s.Metadata["purchase_id"]
-		userIDStr := s.Metadata["user_id"]
-		itemsStr := s.Metadata["items"]
-		reservationID := s.Metadata["reservation_id"] // Retrieve the reservation ID
+		if !h.fulfilCheckoutSession(c, event, s) {
+			return
+		}
 
-		purchaseID, err := strconv.Atoi(purchaseIDStr)
-		if err != nil {
-			log.Printf("Error converting purchase_id from metadata: %v", err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid purchase_id in metadata"})
+	case payment.EventCheckoutAsyncPaymentSucceeded:
+		s, ok := checkoutSession(c, event)
+		if !ok {
 			return
 		}
-		userID, err := strconv.Atoi(userIDStr)
-		if err != nil {
-			log.Printf("Error converting user_id from metadata: %v", err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid user_id in metadata"})
+		log.Printf("Async payment succeeded for session ID: %s", s.ID)
+		if !h.fulfilCheckoutSession(c, event, s) {
 			return
 		}
 
-		// Start a database transaction for atomicity
-		tx, err := h.DB.Begin(c.Request.Context())
-		if err != nil {
-			log.Printf("Error starting transaction: %v", err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start database transaction"})
+	case payment.EventCheckoutAsyncPaymentFailed:
+		s, ok := checkoutSession(c, event)
+		if !ok {
 			return
 		}
-		// Defer rollback, will be overridden by Commit if successful
-		defer tx.Rollback(c.Request.Context())
-
-		// 1. Update purchase status
-		_, err = tx.Exec(c.Request.Context(),
-			"UPDATE purchases SET payment_status = $1, stripe_payment_id = $2 WHERE id = $3",
-			"succeeded", s.ID, purchaseID,
-		)
-		if err != nil {
-			log.Printf("Error updating purchase status: %v", err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update purchase status"})
+		log.Printf("Async payment failed for session ID: %s", s.ID)
+		if !h.closeCheckoutSession(c, s, "failed") {
 			return
 		}
 
-		// 2. Process items and create tickets
-		itemDetails := strings.Split(itemsStr, ";")
-		for _, item := range itemDetails {
-			parts := strings.Split(item, ":")
-			if len(parts) != 3 {
-				log.Printf("Invalid item format in metadata: %s", item)
-				continue
-			}
-
-			ticketTypeID, _ := strconv.Atoi(parts[0])
-			quantity, _ := strconv.Atoi(parts[1])
-
-			for i := 0; i < quantity; i++ {
-				// Generate a simple QR code (e.g., UUID or unique string)
-				qrCode := fmt.Sprintf("CARNEAU-%d-%d-%s", purchaseID, ticketTypeID, generateRandomString(10))
-
-				_, err = tx.Exec(c.Request.Context(),
-					"INSERT INTO tickets (ticket_type_id, user_id, purchase_id, qr_code, status) VALUES ($1, $2, $3, $4, $5)",
-					ticketTypeID, userID, purchaseID, qrCode, "valid",
-				)
-				if err != nil {
-					log.Printf("Error inserting ticket: %v", err)
-					c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to insert tickets"})
-					return
-				}
-
-				// Update sold quantity atomically
-				_, err = tx.Exec(c.Request.Context(),
-					"UPDATE ticket_types SET sold_quantity = sold_quantity + 1 WHERE id = $1",
-					ticketTypeID,
-				)
-				if err != nil {
-					log.Printf("Error updating sold_quantity: %v", err)
-					c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update ticket quantity"})
-					return
-				}
-			}
+	case payment.EventCheckoutExpired:
+		s, ok := checkoutSession(c, event)
+		if !ok {
+			return
 		}
-
-		// Commit the transaction
-		err = tx.Commit(c.Request.Context())
-		if err != nil {
-			log.Printf("Error committing transaction: %v", err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit database transaction"})
+		log.Printf("Checkout session expired for session ID: %s", s.ID)
+		if !h.closeCheckoutSession(c, s, "expired") {
 			return
 		}
 
-		// --- Redis Cleanup: Release the temporary holds ---
-		// After successful DB commit, remove the Redis holds
-		err = h.releaseRedisHoldsFromWebhook(c.Request.Context(), reservationID)
-		if err != nil {
-			log.Printf("Error releasing Redis holds for reservation ID %s from webhook: %v", reservationID, err)
-			// This is a non-critical error for the user, but important for inventory accuracy.
-			// Log it and possibly alert monitoring.
-		} else {
-			log.Printf("Successfully released Redis holds for reservation ID: %s via webhook.", reservationID)
-		}
-
-		// --- Email Sending Logic ---
-		// 1. Retrieve ticket and event details for the email
-		type EmailTicket struct {
-			QR             string
-			TicketTypeName string
-		}
-		var ticketsForEmail []EmailTicket
-		var eventTitle, eventLocation string
-		var eventStartTime time.Time
-
-		// rows variable needs to be declared here, outside the if block
-		var rows pgx.Rows
-		rows, err = h.DB.Query(c.Request.Context(), `
-			SELECT
-				t.qr_code,
-				tt.name AS ticket_type_name,
-				e.title AS event_title,
-				e.location AS event_location,
-				e.start_time AS event_start_time
-			FROM tickets t
-			JOIN ticket_types tt ON t.ticket_type_id = tt.id
-			JOIN events e ON tt.event_id = e.id
-			WHERE t.purchase_id = $1`, purchaseID)
-		if err != nil {
-			log.Printf("Error querying tickets for email: %v", err)
-			// Don't return error to Stripe, fulfillment is done, just log email failure
-		} else {
-			defer rows.Close()
-			for rows.Next() {
-				var et EmailTicket
-				if err := rows.Scan(&et.QR, &et.TicketTypeName, &eventTitle, &eventLocation, &eventStartTime); err != nil {
-					log.Printf("Error scanning ticket for email: %v", err)
-					continue
-				}
-				ticketsForEmail = append(ticketsForEmail, et)
-			}
-			if err = rows.Err(); err != nil {
-				log.Printf("Error iterating ticket rows for email: %v", err)
-			}
+	case payment.EventChargeRefunded:
+		if !h.applyChargeRefund(c, event) {
+			return
 		}
 
-		if len(ticketsForEmail) > 0 {
-			// 2. Generate QR code images and construct HTML body
-			var qrCodeImages = make(map[string][]byte)
-			htmlBody := `
-				<html>
-				<body>
-					<p>Dear ` + s.CustomerDetails.Email + `,</p>
-					<p>Thank you for your purchase! Here are your tickets for <strong>` + eventTitle + `</strong>.</p>
-					<p><strong>Event:</strong> ` + eventTitle + `</p>
-					<p><strong>Location:</strong> ` + eventLocation + `</p>
-					<p><strong>Date & Time:</strong> ` + eventStartTime.Format("Mon, Jan 2, 2006 3:04 PM") + `</p>
-					<hr/>
-					<h3>Your Tickets:</h3>
-					<ul>
-			`
-			for i, ticket := range ticketsForEmail {
-				cid := fmt.Sprintf("qrcode_%d", i)
-				png, err := qrcode.Encode(ticket.QR, qrcode.Medium, 256)
-				if err != nil {
-					log.Printf("Error generating QR code for ticket %s: %v", ticket.QR, err)
-					continue
-				}
-				qrCodeImages[cid] = png
-
-				htmlBody += fmt.Sprintf(`
-					<li>
-						<strong>Ticket Type:</strong> %s<br/>
-						<strong>QR Code:</strong> %s<br/>
-						<img src="cid:%s" alt="QR Code for Ticket %s" style="width:128px;height:128px;"><br/><br/>
-					</li>`, ticket.TicketTypeName, ticket.QR, cid, ticket.TicketTypeName)
-			}
-			htmlBody += `
-					</ul>
-					<p>Please present the QR codes at the event for entry.</p>
-					<p>Best regards,<br/>The Carneau Engine Team</p>
-				</body>
-				</html>`
-
-			// 3. Send the email
-			smtpHost := os.Getenv("SMTP_HOST")
-			smtpPort := os.Getenv("SMTP_PORT")
-			smtpUser := os.Getenv("SMTP_USER")
-			smtpPassword := os.Getenv("SMTP_PASSWORD")
-			senderEmail := os.Getenv("SENDER_EMAIL")
-
-			if smtpHost == "" || smtpPort == "" || smtpUser == "" || smtpPassword == "" || senderEmail == "" {
-				log.Println("SMTP environment variables not fully configured. Skipping email send.")
-			} else {
-				err = sendEmail(s.CustomerDetails.Email, "Your Tickets for "+eventTitle, htmlBody, qrCodeImages, senderEmail, smtpHost, smtpPort, smtpUser, smtpPassword)
-				if err != nil {
-					log.Printf("Failed to send ticket confirmation email to %s: %v", s.CustomerDetails.Email, err)
-				} else {
-					log.Printf("Ticket confirmation email sent to %s for purchase %d", s.CustomerDetails.Email, purchaseID)
-				}
-			}
-		} else {
-			log.Printf("No tickets found for email confirmation for purchase %d", purchaseID)
+	case payment.EventChargeDisputeCreated, payment.EventChargeDisputeUpdated, payment.EventChargeDisputeClosed:
+		if !h.applyDispute(c, event) {
+			return
 		}
 
 	case "payment_intent.succeeded":
@@ -725,38 +432,450 @@ func (h *Handler) StripeWebhook(c *gin.Context) {
 		log.Printf("Unhandled event type: %s\n", event.Type)
 	}
 
+	// Fulfilment records its event inside its own transaction; this covers the rest,
+	// whose updates are guarded by purchase status and so are safe to repeat.
+	if _, err := recordStripeEvent(c.Request.Context(), h.DB, event); err != nil {
+		log.Printf("Error recording Stripe event %s: %v", event.ID, err)
+	}
+
 	c.JSON(http.StatusOK, gin.H{"status": "success"})
 }
 
-// releaseRedisHoldsFromWebhook is called by the webhook to clean up Redis holds after DB commit
-func (h *Handler) releaseRedisHoldsFromWebhook(ctx context.Context, reservationID string) error {
-	reservedItems, err := h.Redis.HGetAll(ctx, "reservation:"+reservationID).Result()
+// stripeEventProcessed reports whether a webhook event has already been applied.
+func (h *Handler) stripeEventProcessed(ctx context.Context, eventID string) (bool, error) {
+	var processed bool
+	err := h.DB.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM stripe_events WHERE event_id = $1)", eventID).Scan(&processed)
+	return processed, err
+}
+
+// recordStripeEvent marks a webhook event as applied. It returns false if the
+// event was already recorded. Inside a transaction, a concurrent delivery of the
+// same event blocks on the primary key until the first one commits, then sees
+// the conflict, so only one of them goes on to apply it.
+func recordStripeEvent(ctx context.Context, db dbExecer, event *payment.Event) (bool, error) {
+	tag, err := db.Exec(ctx,
+		"INSERT INTO stripe_events (event_id, event_type) VALUES ($1, $2) ON CONFLICT (event_id) DO NOTHING",
+		event.ID, string(event.Type),
+	)
 	if err != nil {
-		return fmt.Errorf("error retrieving reserved items for reservation ID %s: %w", reservationID, err)
+		return false, err
 	}
+	return tag.RowsAffected() == 1, nil
+}
 
-	for ticketTypeIDStr, quantityStr := range reservedItems {
-		ticketTypeID, err := strconv.Atoi(ticketTypeIDStr)
-		if err != nil {
-			log.Printf("Error converting ticketTypeID %s to int in webhook cleanup: %v", ticketTypeIDStr, err)
-			continue
+// checkoutSession returns the checkout session carried by a webhook event.
+// It writes the error response itself and returns false if there isn't one.
+func checkoutSession(c *gin.Context, event *payment.Event) (*payment.Session, bool) {
+	if event.Session == nil {
+		log.Printf("Webhook event %s (%s) carries no checkout session", event.ID, event.Type)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Webhook event has no checkout session"})
+		return nil, false
+	}
+	return event.Session, true
+}
+
+// markPurchaseProcessing records that a session completed with a payment that
+// has not cleared yet. Tickets are issued once the payment settles.
+func (h *Handler) markPurchaseProcessing(c *gin.Context, s *payment.Session) bool {
+	purchaseID, ok := sessionPurchaseID(c, s)
+	if !ok {
+		return false
+	}
+
+	_, err := h.DB.Exec(c.Request.Context(),
+		"UPDATE purchases SET payment_status = $1, stripe_payment_id = $2, updated_at = now() WHERE id = $3 AND payment_status = $4",
+		"processing", s.ID, purchaseID, "pending",
+	)
+	if err != nil {
+		log.Printf("Error updating purchase status: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update purchase status"})
+		return false
+	}
+	return true
+}
+
+// closeCheckoutSession moves a purchase that will never be paid for into a
+// terminal status and gives its held tickets back. Purchases that have already
+// been fulfilled or closed are left untouched.
+func (h *Handler) closeCheckoutSession(c *gin.Context, s *payment.Session, status string) bool {
+	purchaseID, ok := sessionPurchaseID(c, s)
+	if !ok {
+		return false
+	}
+
+	tx, err := h.DB.Begin(c.Request.Context())
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start database transaction"})
+		return false
+	}
+	defer tx.Rollback(c.Request.Context())
+
+	var reservationID string
+	err = tx.QueryRow(c.Request.Context(),
+		"UPDATE purchases SET payment_status = $1, stripe_payment_id = $2, updated_at = now() WHERE id = $3 AND payment_status IN ('pending', 'processing') RETURNING COALESCE(reservation_id, '')",
+		status, s.ID, purchaseID,
+	).Scan(&reservationID)
+	if err == pgx.ErrNoRows {
+		log.Printf("Purchase %d is no longer open, leaving it as is for session %s", purchaseID, s.ID)
+		return true
+	}
+	if err != nil {
+		log.Printf("Error updating purchase status: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update purchase status"})
+		return false
+	}
+
+	if err := enqueueReservationJob(c.Request.Context(), tx, jobReleaseReservation, reservationID); err != nil {
+		log.Printf("Error queueing release of reservation %s: %v", reservationID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to queue hold release"})
+		return false
+	}
+	if !commitOrFail(c, tx) {
+		return false
+	}
+	log.Printf("Purchase %d marked %s for session %s", purchaseID, status, s.ID)
+	return true
+}
+
+// sessionPurchaseID reads the purchase ID that CreateCheckoutSession put in the
+// session metadata. It writes the error response itself and returns false if
+// the ID is missing or malformed.
+func sessionPurchaseID(c *gin.Context, s *payment.Session) (int, bool) {
+	purchaseID, err := strconv.Atoi(s.Metadata["purchase_id"])
+	if err != nil {
+		log.Printf("Error converting purchase_id from metadata: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid purchase_id in metadata"})
+		return 0, false
+	}
+	return purchaseID, true
+}
+
+// fulfilCheckoutSession records a paid purchase: it marks the purchase as
+// succeeded, issues the tickets and queues the release of the Redis holds and
+// the buyer's email in the outbox.
+// Replayed events and purchases that are already fulfilled are acknowledged
+// without doing anything. It writes the error response itself and returns
+// false if fulfilment failed.
+func (h *Handler) fulfilCheckoutSession(c *gin.Context, event *payment.Event, s *payment.Session) bool {
+	customerEmail := s.CustomerEmail
+	log.Printf("Checkout session completed for session ID: %s, Customer Email: %s\n", s.ID, customerEmail)
+
+	purchaseID, ok := sessionPurchaseID(c, s)
+	if !ok {
+		return false
+	}
+
+	// Start a database transaction for atomicity
+	tx, err := h.DB.Begin(c.Request.Context())
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start database transaction"})
+		return false
+	}
+	// Defer rollback, will be overridden by Commit if successful
+	defer tx.Rollback(c.Request.Context())
+
+	// 1. Claim the event, so a concurrent delivery of it can't fulfil twice
+	recorded, err := recordStripeEvent(c.Request.Context(), tx, event)
+	if err != nil {
+		log.Printf("Error recording Stripe event %s: %v", event.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record webhook event"})
+		return false
+	}
+	if !recorded {
+		log.Printf("Stripe event %s was already processed by another delivery", event.ID)
+		return true
+	}
+
+	// 2. Lock the purchase, and leave it alone if it has been fulfilled or closed already
+	var userID, eventID int
+	var reservationID, paymentStatus, currency string
+	var totalAmount pgtype.Numeric
+	err = tx.QueryRow(c.Request.Context(),
+		"SELECT user_id, event_id, COALESCE(reservation_id, ''), payment_status, total_amount, currency FROM purchases WHERE id = $1 FOR UPDATE",
+		purchaseID,
+	).Scan(&userID, &eventID, &reservationID, &paymentStatus, &totalAmount, &currency)
+	if err != nil && err != pgx.ErrNoRows {
+		log.Printf("Error loading purchase %d: %v", purchaseID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update purchase status"})
+		return false
+	}
+	if err == pgx.ErrNoRows || (paymentStatus != "pending" && paymentStatus != "processing") {
+		log.Printf("Purchase %d is not awaiting payment, skipping fulfilment for event %s", purchaseID, event.ID)
+		if err := tx.Commit(c.Request.Context()); err != nil {
+			log.Printf("Error committing transaction: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit database transaction"})
+			return false
+		}
+		return true
+	}
+
+	// 3. Only issue tickets if we were paid exactly what we asked for. Anything
+	// else is held for a person to look at rather than guessed at here.
+	expected, err := money.FromNumeric(totalAmount, currency)
+	if err != nil {
+		log.Printf("Error reading total for purchase %d: %v", purchaseID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read purchase total"})
+		return false
+	}
+	_, err = tx.Exec(c.Request.Context(),
+		"UPDATE purchases SET payment_status = $1, stripe_payment_id = $2, payment_id = NULLIF($3, ''), updated_at = now() WHERE id = $4",
+		"succeeded", s.ID, s.PaymentID, purchaseID,
+	)
+	if err != nil {
+		log.Printf("Error updating purchase status: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update purchase status"})
+		return false
+	}
+	if s.AmountTotal != expected {
+		log.Printf("Purchase %d was paid %s but expected %s, marking it for review", purchaseID, s.AmountTotal, expected)
+		return holdForReview(c, tx, purchaseID, reservationID, fmt.Sprintf("paid %s but the order total is %s", s.AmountTotal, expected))
+	}
+
+	// 4. Load the line items recorded at checkout
+	items, err := purchaseItems(c.Request.Context(), tx, purchaseID)
+	if err != nil {
+		log.Printf("Error loading items for purchase %d: %v", purchaseID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load purchase items"})
+		return false
+	}
+	if len(items) == 0 {
+		// Never mark a paid order fulfilled with nothing issued; fail loudly so it gets looked at
+		log.Printf("Purchase %d has no items to fulfil for session %s", purchaseID, s.ID)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Purchase has no items"})
+		return false
+	}
+
+	// 5. Create tickets, in a savepoint so a sold-out type undoes the types before it
+	issue, err := tx.Begin(c.Request.Context())
+	if err != nil {
+		log.Printf("Error starting savepoint: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start database transaction"})
+		return false
+	}
+	err = issueTickets(c.Request.Context(), issue, h.TicketSigner, purchaseID, userID, eventID, items)
+	var soldOut *soldOutError
+	if errors.As(err, &soldOut) {
+		issue.Rollback(c.Request.Context())
+		log.Printf("Purchase %d was paid but %v, marking it for review", purchaseID, soldOut)
+		return holdForReview(c, tx, purchaseID, reservationID, soldOut.Error())
+	}
+	if err == nil {
+		err = issue.Commit(c.Request.Context())
+	}
+	if err != nil {
+		log.Printf("Error issuing tickets for purchase %d: %v", purchaseID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to insert tickets"})
+		return false
+	}
+
+	// 6. Queue the side effects, so they happen if and only if the sale is recorded.
+	// The outbox worker retries them; Stripe doesn't have to.
+	if err := enqueueReservationJob(c.Request.Context(), tx, jobCommitReservation, reservationID); err != nil {
+		log.Printf("Error queueing commit of reservation %s: %v", reservationID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to queue hold release"})
+		return false
+	}
+	err = outbox.Enqueue(c.Request.Context(), tx, jobSendTicketEmail, ticketEmailJob{PurchaseID: purchaseID, Email: customerEmail})
+	if err != nil {
+		log.Printf("Error queueing ticket email for purchase %d: %v", purchaseID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to queue ticket email"})
+		return false
+	}
+
+	// Commit the transaction
+	return commitOrFail(c, tx)
+}
+
+// holdForReview parks a paid purchase that can't be fulfilled as it stands,
+// e.g. because it was underpaid or its tickets sold out, so an organiser can
+// look at it and refund it. No tickets are issued, so its holds are released
+// for other buyers. It commits tx, writes any error response itself and
+// returns false if it failed.
+func holdForReview(c *gin.Context, tx pgx.Tx, purchaseID int, reservationID, reason string) bool {
+	_, err := tx.Exec(c.Request.Context(),
+		"UPDATE purchases SET payment_status = 'needs_review', review_reason = $1, updated_at = now() WHERE id = $2",
+		reason, purchaseID,
+	)
+	if err != nil {
+		log.Printf("Error updating purchase status: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update purchase status"})
+		return false
+	}
+	if err := enqueueReservationJob(c.Request.Context(), tx, jobReleaseReservation, reservationID); err != nil {
+		log.Printf("Error queueing release of reservation %s: %v", reservationID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to queue hold release"})
+		return false
+	}
+	return commitOrFail(c, tx)
+}
+
+// soldOutError is returned by issueTickets when a ticket type doesn't have
+// enough places left for the order.
+type soldOutError struct {
+	TicketTypeID int
+	Quantity     int
+}
+
+func (e *soldOutError) Error() string {
+	return fmt.Sprintf("ticket type %d has fewer than %d places left", e.TicketTypeID, e.Quantity)
+}
+
+// issueTickets issues an order's tickets with one insert, and counts them as
+// sold with one update per ticket type. The update refuses to take
+// sold_quantity past total_quantity, in which case a *soldOutError is
+// returned and the caller must roll back. Each ticket's QR code is a token
+// signed by signer, so it needs the ticket's ID before the insert. Attendee
+// details given at checkout go on the tickets in order, with their answers.
+func issueTickets(ctx context.Context, tx pgx.Tx, signer *qrtoken.Signer, purchaseID, userID, eventID int, items []purchaseItem) error {
+	var typeIDs []int
+	quantities := make(map[int]int)
+	var ticketTypeIDs []int
+	var attendees []attendee
+	for _, item := range items {
+		if _, ok := quantities[item.TicketTypeID]; !ok {
+			typeIDs = append(typeIDs, item.TicketTypeID)
+		}
+		quantities[item.TicketTypeID] += item.Quantity
+		for i := 0; i < item.Quantity; i++ {
+			ticketTypeIDs = append(ticketTypeIDs, item.TicketTypeID)
+			var a attendee
+			if i < len(item.Attendees) {
+				a = item.Attendees[i]
+			}
+			attendees = append(attendees, a)
 		}
-		quantity, err := strconv.Atoi(quantityStr)
+	}
+
+	for _, id := range typeIDs {
+		tag, err := tx.Exec(ctx,
+			"UPDATE ticket_types SET sold_quantity = sold_quantity + $1 WHERE id = $2 AND sold_quantity + $1 <= total_quantity",
+			quantities[id], id,
+		)
 		if err != nil {
-			log.Printf("Error converting quantity %s to int in webhook cleanup for ticketTypeID %d: %v", quantityStr, ticketTypeID, err)
-			continue
+			return fmt.Errorf("updating sold_quantity of ticket type %d: %w", id, err)
 		}
+		if tag.RowsAffected() == 0 {
+			return &soldOutError{TicketTypeID: id, Quantity: quantities[id]}
+		}
+	}
 
-		// Decrement the held quantity
-		_, err = h.Redis.HIncrBy(ctx, fmt.Sprintf("ticket_holds:%d", ticketTypeID), "held_quantity", int64(-quantity)).Result()
+	ticketIDs, err := nextTicketIDs(ctx, tx, len(ticketTypeIDs))
+	if err != nil {
+		return fmt.Errorf("allocating ticket IDs: %w", err)
+	}
+	qrCodes := make([]string, len(ticketIDs))
+	issuedAt := time.Now()
+	for i, id := range ticketIDs {
+		qrCodes[i], err = signer.Sign(qrtoken.Claims{TicketID: id, EventID: eventID, TicketTypeID: ticketTypeIDs[i], IssuedAt: issuedAt})
 		if err != nil {
-			return fmt.Errorf("error releasing Redis hold for ticket type %d, reservation %s: %w", ticketTypeID, reservationID, err)
+			return fmt.Errorf("signing ticket %d: %w", id, err)
 		}
 	}
-	// Delete the main reservation hash
-	_, err = h.Redis.Del(ctx, "reservation:"+reservationID).Result()
+
+	names := make([]string, len(ticketIDs))
+	emails := make([]string, len(ticketIDs))
+	var answerTicketIDs, answerQuestionIDs []int
+	var answerValues []string
+	for i, a := range attendees {
+		names[i], emails[i] = a.Name, a.Email
+		questionIDs := make([]int, 0, len(a.Answers))
+		for id := range a.Answers {
+			questionIDs = append(questionIDs, id)
+		}
+		sort.Ints(questionIDs)
+		for _, id := range questionIDs {
+			answerTicketIDs = append(answerTicketIDs, ticketIDs[i])
+			answerQuestionIDs = append(answerQuestionIDs, id)
+			answerValues = append(answerValues, a.Answers[id])
+		}
+	}
+
+	_, err = tx.Exec(ctx, `
+		INSERT INTO tickets (id, ticket_type_id, user_id, purchase_id, qr_code, status, attendee_name, attendee_email)
+		SELECT t.id, t.ticket_type_id, $1, $2, t.qr_code, 'valid', NULLIF(t.name, ''), NULLIF(t.email, '')
+		FROM unnest($3::int[], $4::int[], $5::text[], $6::text[], $7::text[]) AS t(id, ticket_type_id, qr_code, name, email)`,
+		userID, purchaseID, ticketIDs, ticketTypeIDs, qrCodes, names, emails,
+	)
 	if err != nil {
-		return fmt.Errorf("error deleting main reservation hash for ID %s: %w", reservationID, err)
+		return fmt.Errorf("inserting tickets: %w", err)
+	}
+	if len(answerTicketIDs) > 0 {
+		// Answers keep the question's label, so they still read right if it's deleted
+		_, err = tx.Exec(ctx, `
+			INSERT INTO ticket_answers (ticket_id, question_id, label, value)
+			SELECT a.ticket_id, a.question_id, q.label, a.value
+			FROM unnest($1::int[], $2::int[], $3::text[]) AS a(ticket_id, question_id, value)
+			JOIN registration_questions q ON q.id = a.question_id`,
+			answerTicketIDs, answerQuestionIDs, answerValues,
+		)
+		if err != nil {
+			return fmt.Errorf("inserting attendee answers: %w", err)
+		}
+	}
+	if err := ticketstate.RecordIssued(ctx, tx, ticketIDs, 0, fmt.Sprintf("issued for purchase %d", purchaseID)); err != nil {
+		return fmt.Errorf("recording ticket history: %w", err)
 	}
 	return nil
 }
+
+// nextTicketIDs takes n IDs from the tickets sequence.
+func nextTicketIDs(ctx context.Context, tx pgx.Tx, n int) ([]int, error) {
+	rows, err := tx.Query(ctx, "SELECT nextval('tickets_id_seq')::int FROM generate_series(1, $1)", n)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := make([]int, 0, n)
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// purchaseItem is one line of an order, as recorded in purchase_items.
+type purchaseItem struct {
+	TicketTypeID int
+	Quantity     int
+	UnitPrice    money.Money
+	Attendees    []attendee // who each ticket is for, if given at checkout
+}
+
+// purchaseItems loads the line items recorded for a purchase at checkout.
+func purchaseItems(ctx context.Context, tx pgx.Tx, purchaseID int) ([]purchaseItem, error) {
+	rows, err := tx.Query(ctx,
+		"SELECT pi.ticket_type_id, pi.quantity, pi.unit_price, p.currency, pi.attendees FROM purchase_items pi JOIN purchases p ON p.id = pi.purchase_id WHERE pi.purchase_id = $1 ORDER BY pi.id",
+		purchaseID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var items []purchaseItem
+	for rows.Next() {
+		var item purchaseItem
+		var unitPrice pgtype.Numeric
+		var currency string
+		var attendees []byte
+		if err := rows.Scan(&item.TicketTypeID, &item.Quantity, &unitPrice, &currency, &attendees); err != nil {
+			return nil, err
+		}
+		if item.UnitPrice, err = money.FromNumeric(unitPrice, currency); err != nil {
+			return nil, err
+		}
+		if attendees != nil {
+			if err := json.Unmarshal(attendees, &item.Attendees); err != nil {
+				return nil, fmt.Errorf("decoding attendees: %w", err)
+			}
+		}
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
@@ -0,0 +1,52 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+
+	"github.com/tpgcig/carneauengine/server/ticketstate"
+)
+
+// GetTicketHistory lists every status change of a ticket, oldest first, for
+// organisers of its event.
+func (h *Handler) GetTicketHistory(c *gin.Context) {
+	ticketID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ticket ID"})
+		return
+	}
+	ctx := c.Request.Context()
+
+	var eventID int
+	var status string
+	err = h.DB.QueryRow(ctx, `
+		SELECT tt.event_id, COALESCE(t.status, 'valid')
+		FROM tickets t
+		JOIN ticket_types tt ON tt.id = t.ticket_type_id
+		WHERE t.id = $1`, ticketID,
+	).Scan(&eventID, &status)
+	if err == pgx.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Ticket not found"})
+		return
+	}
+	if err != nil {
+		log.Printf("Error loading ticket %d: %v", ticketID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load ticket"})
+		return
+	}
+	if !h.authorizeEventOrganiser(c, eventID) {
+		return
+	}
+
+	history, err := ticketstate.History(ctx, h.DB, ticketID)
+	if err != nil {
+		log.Printf("Error loading history of ticket %d: %v", ticketID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load ticket history"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"ticket_id": ticketID, "status": status, "history": history})
+}
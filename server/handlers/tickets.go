@@ -6,6 +6,9 @@ import (
 	"strings"
 
 	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5/pgtype"
+
+	"github.com/tpgcig/carneauengine/server/money"
 )
 
 type Tickets struct {
@@ -15,7 +18,7 @@ type Tickets struct {
 type TicketCartType struct {
 		ID    int     `json:"id"`
 		Name  string  `json:"name"`
-		Price float64 `json:"price"`
+		Price money.Money `json:"price"`
 }
 
 func (h *Handler) GetTicketTypes(c *gin.Context) {
@@ -34,7 +37,7 @@ func (h *Handler) GetTicketTypes(c *gin.Context) {
 		args[i] = id
 	}
 
-	query := fmt.Sprintf("SELECT id, name, price FROM ticket_types WHERE id IN (%s)", strings.Join(placeholders, ","))
+	query := fmt.Sprintf("SELECT tt.id, tt.name, tt.price, e.currency FROM ticket_types tt JOIN events e ON e.id = tt.event_id WHERE tt.id IN (%s)", strings.Join(placeholders, ","))
 	rows, err := h.DB.Query(context.Background(), query, args...)
 
 	if err != nil {
@@ -48,11 +51,18 @@ func (h *Handler) GetTicketTypes(c *gin.Context) {
 
 	for rows.Next() {
 		var ticket TicketCartType
-		err := rows.Scan(&ticket.ID, &ticket.Name, &ticket.Price)
+		var price pgtype.Numeric
+		var currency string
+		err := rows.Scan(&ticket.ID, &ticket.Name, &price, &currency)
 		if (err != nil) {
 			c.JSON(500, gin.H{"error": err.Error()})
 			return
 		}
+		ticket.Price, err = money.FromNumeric(price, currency)
+		if err != nil {
+			c.JSON(500, gin.H{"error": err.Error()})
+			return
+		}
 		result[ticket.ID] = ticket
 	}
 
@@ -0,0 +1,518 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+
+	"github.com/tpgcig/carneauengine/server/mailer"
+	"github.com/tpgcig/carneauengine/server/outbox"
+	"github.com/tpgcig/carneauengine/server/qrtoken"
+	"github.com/tpgcig/carneauengine/server/ticketstate"
+)
+
+// Ticket transfer statuses.
+const (
+	transferPending   = "pending"
+	transferAccepted  = "accepted"
+	transferCancelled = "cancelled"
+)
+
+const (
+	// transferLinkTTL is how long a transfer can wait to be accepted, unless
+	// the event's transfer cut-off comes first.
+	transferLinkTTL = 7 * 24 * time.Hour
+	// transferAcceptURL is the page recipients accept transfers on; the token
+	// goes on the end.
+	transferAcceptURL = "http://localhost:3000/transfers/accept?token="
+)
+
+type StartTransferRequest struct {
+	QR    string `json:"qr" binding:"required"` // the ticket's current QR payload
+	Email string `json:"email" binding:"required,email"`
+}
+
+type CancelTransferRequest struct {
+	QR string `json:"qr" binding:"required"`
+}
+
+type TicketTransfer struct {
+	ID          int       `json:"id"`
+	TicketID    int       `json:"ticket_id"`
+	EventTitle  string    `json:"event_title"`
+	TicketType  string    `json:"ticket_type"`
+	ToEmail     string    `json:"to_email"`
+	Status      string    `json:"status"`
+	ExpiresAt   time.Time `json:"expires_at"`
+	NewTicketID *int      `json:"new_ticket_id,omitempty"`
+}
+
+// transferEmailJob names the transfer to email an accept link for. As with
+// lookup links, the token is made when the email is sent.
+type transferEmailJob struct {
+	TransferID int    `json:"transfer_id"`
+	Email      string `json:"email"`
+}
+
+// transferEmail is the data of the ticket_transfer template.
+type transferEmail struct {
+	From       string // the sender's email, if known
+	TicketType string
+	EventTitle string
+	Link       string
+	ExpiresAt  time.Time
+}
+
+// hashLinkToken is what's stored of the token in an emailed link, such as a
+// transfer's, so the database alone can't be used to follow the link.
+func hashLinkToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// newLinkToken returns a random token for an emailed link.
+func newLinkToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// scannedTicketOrFail is findScannedTicket for handlers. It writes the error
+// response itself and returns false if the QR payload isn't a current ticket.
+func (h *Handler) scannedTicketOrFail(c *gin.Context, qr string) (int, bool) {
+	ticketID, err := h.findScannedTicket(c.Request.Context(), qr)
+	switch {
+	case err == nil:
+		return ticketID, true
+	case errors.Is(err, pgx.ErrNoRows):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Ticket not found"})
+	case errors.Is(err, errQRReplaced):
+		c.JSON(http.StatusConflict, gin.H{"error": "This QR code has been replaced by a newer one"})
+	case errors.Is(err, qrtoken.ErrMalformed), errors.Is(err, qrtoken.ErrUnknownKey), errors.Is(err, qrtoken.ErrBadSignature):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ticket"})
+	default:
+		log.Printf("Error looking up ticket by QR code: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to look up ticket"})
+	}
+	return 0, false
+}
+
+// StartTicketTransfer offers one of the authenticated user's tickets to someone
+// else by email. Guests authenticate with the JWT from their lookup link. The
+// recipient is emailed a link to AcceptTicketTransfer; until they accept, the
+// ticket stays valid for the sender. Starting a new transfer cancels any
+// pending one for the ticket.
+func (h *Handler) StartTicketTransfer(c *gin.Context) {
+	var req StartTransferRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	req.Email = strings.TrimSpace(req.Email)
+	ticketID, ok := h.scannedTicketOrFail(c, req.QR)
+	if !ok {
+		return
+	}
+	ctx := c.Request.Context()
+
+	tx, err := h.DB.Begin(ctx)
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start transfer"})
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	var status, eventTitle, ticketType string
+	var holderID *int
+	var holderEmail *string
+	var enabled, open bool
+	var cutoff time.Time
+	err = tx.QueryRow(ctx, `
+		SELECT COALESCE(t.status, 'valid'), t.user_id, holder.email, e.title, tt.name, e.transfers_enabled,
+			e.start_time - make_interval(mins => e.transfer_cutoff_minutes),
+			now() < e.start_time - make_interval(mins => e.transfer_cutoff_minutes)
+		FROM tickets t
+		JOIN ticket_types tt ON tt.id = t.ticket_type_id
+		JOIN events e ON e.id = tt.event_id
+		LEFT JOIN users holder ON holder.id = t.user_id
+		WHERE t.id = $1
+		FOR UPDATE OF t`, ticketID,
+	).Scan(&status, &holderID, &holderEmail, &eventTitle, &ticketType, &enabled, &cutoff, &open)
+	if err != nil {
+		log.Printf("Error loading ticket %d for transfer: %v", ticketID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start transfer"})
+		return
+	}
+	switch {
+	case holderID == nil || *holderID != c.GetInt("userID"):
+		c.JSON(http.StatusForbidden, gin.H{"error": "You don't hold this ticket"})
+		return
+	case ticketstate.Status(status) != ticketstate.Valid:
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("Ticket is %s", status)})
+		return
+	case !enabled:
+		c.JSON(http.StatusConflict, gin.H{"error": "Tickets for this event can't be transferred"})
+		return
+	case !open:
+		c.JSON(http.StatusConflict, gin.H{"error": "Transfers for this event have closed", "closed_at": cutoff})
+		return
+	case holderEmail != nil && strings.EqualFold(*holderEmail, req.Email):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "This ticket already belongs to that email address"})
+		return
+	}
+
+	if _, err := tx.Exec(ctx, "UPDATE ticket_transfers SET status = 'cancelled' WHERE ticket_id = $1 AND status = 'pending'", ticketID); err != nil {
+		log.Printf("Error cancelling earlier transfers of ticket %d: %v", ticketID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start transfer"})
+		return
+	}
+
+	transfer := TicketTransfer{TicketID: ticketID, EventTitle: eventTitle, TicketType: ticketType, ToEmail: req.Email, Status: transferPending}
+	err = tx.QueryRow(ctx, `
+		INSERT INTO ticket_transfers (ticket_id, from_user_id, to_email, expires_at)
+		VALUES ($1, $2, $3, LEAST(now() + make_interval(secs => $4), $5))
+		RETURNING id, expires_at`,
+		ticketID, holderID, req.Email, transferLinkTTL.Seconds(), cutoff,
+	).Scan(&transfer.ID, &transfer.ExpiresAt)
+	if err != nil {
+		log.Printf("Error recording transfer of ticket %d: %v", ticketID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start transfer"})
+		return
+	}
+
+	err = outbox.Enqueue(ctx, tx, jobSendTransferEmail, transferEmailJob{TransferID: transfer.ID, Email: req.Email})
+	if err != nil {
+		log.Printf("Error queueing transfer email for transfer %d: %v", transfer.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start transfer"})
+		return
+	}
+	if err := tx.Commit(ctx); err != nil {
+		log.Printf("Error committing transfer of ticket %d: %v", ticketID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start transfer"})
+		return
+	}
+
+	log.Printf("Transfer %d of ticket %d to %s started", transfer.ID, ticketID, req.Email)
+	c.JSON(http.StatusCreated, transfer)
+}
+
+// CancelTicketTransfer withdraws a pending transfer of one of the
+// authenticated user's tickets. Like starting one, it takes the ticket's QR
+// code.
+func (h *Handler) CancelTicketTransfer(c *gin.Context) {
+	var req CancelTransferRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	ticketID, ok := h.scannedTicketOrFail(c, req.QR)
+	if !ok {
+		return
+	}
+
+	var transferID int
+	err := h.DB.QueryRow(c.Request.Context(), `
+		UPDATE ticket_transfers tr SET status = 'cancelled'
+		FROM tickets t
+		WHERE t.id = tr.ticket_id AND tr.ticket_id = $1 AND tr.status = 'pending' AND t.user_id = $2
+		RETURNING tr.id`,
+		ticketID, c.GetInt("userID"),
+	).Scan(&transferID)
+	if err == pgx.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "You have no pending transfer of this ticket"})
+		return
+	}
+	if err != nil {
+		log.Printf("Error cancelling transfer of ticket %d: %v", ticketID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to cancel transfer"})
+		return
+	}
+	log.Printf("Transfer %d of ticket %d cancelled", transferID, ticketID)
+	c.JSON(http.StatusOK, gin.H{"id": transferID, "status": transferCancelled})
+}
+
+// GetTicketTransfer shows the recipient what a transfer link is for.
+func (h *Handler) GetTicketTransfer(c *gin.Context) {
+	var t TicketTransfer
+	err := h.DB.QueryRow(c.Request.Context(), `
+		SELECT tr.id, tr.ticket_id, e.title, tt.name, tr.to_email,
+			CASE WHEN tr.status = 'pending' AND tr.expires_at < now() THEN 'expired' ELSE tr.status END,
+			tr.expires_at, tr.new_ticket_id
+		FROM ticket_transfers tr
+		JOIN tickets tk ON tk.id = tr.ticket_id
+		JOIN ticket_types tt ON tt.id = tk.ticket_type_id
+		JOIN events e ON e.id = tt.event_id
+		WHERE tr.token_hash = $1`, hashLinkToken(c.Param("token")),
+	).Scan(&t.ID, &t.TicketID, &t.EventTitle, &t.TicketType, &t.ToEmail, &t.Status, &t.ExpiresAt, &t.NewTicketID)
+	if err == pgx.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Transfer not found"})
+		return
+	}
+	if err != nil {
+		log.Printf("Error loading transfer: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load transfer"})
+		return
+	}
+	c.JSON(http.StatusOK, t)
+}
+
+// AcceptTicketTransfer completes a transfer from its emailed link. The
+// sender's ticket becomes transferred, so its QR code stops working, and the
+// recipient gets a new ticket of the same type with a new QR code, emailed to
+// them. The recipient's guest account is only created once the transfer is
+// known to be acceptable, so dead links can't be used to create users.
+func (h *Handler) AcceptTicketTransfer(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	tx, err := h.DB.Begin(ctx)
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to accept transfer"})
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	var transferID, oldTicketID, ticketTypeID, purchaseID, eventID int
+	var status, ticketStatus, toEmail string
+	var expired, open bool
+	err = tx.QueryRow(ctx, `
+		SELECT tr.id, tr.status, tr.to_email, tr.expires_at < now(), tk.id, COALESCE(tk.status, 'valid'),
+			tk.ticket_type_id, tk.purchase_id, tt.event_id,
+			e.transfers_enabled AND now() < e.start_time - make_interval(mins => e.transfer_cutoff_minutes)
+		FROM ticket_transfers tr
+		JOIN tickets tk ON tk.id = tr.ticket_id
+		JOIN ticket_types tt ON tt.id = tk.ticket_type_id
+		JOIN events e ON e.id = tt.event_id
+		WHERE tr.token_hash = $1
+		FOR UPDATE OF tr, tk`, hashLinkToken(c.Param("token")),
+	).Scan(&transferID, &status, &toEmail, &expired, &oldTicketID, &ticketStatus, &ticketTypeID, &purchaseID, &eventID, &open)
+	if err == pgx.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Transfer not found"})
+		return
+	}
+	if err != nil {
+		log.Printf("Error locking transfer: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to accept transfer"})
+		return
+	}
+	switch {
+	case status == transferAccepted:
+		c.JSON(http.StatusConflict, gin.H{"error": "This transfer has already been accepted"})
+		return
+	case status == transferCancelled:
+		c.JSON(http.StatusGone, gin.H{"error": "This transfer was cancelled"})
+		return
+	case expired || !open:
+		c.JSON(http.StatusGone, gin.H{"error": "This transfer link has expired"})
+		return
+	case ticketstate.Status(ticketStatus) != ticketstate.Valid:
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("Ticket is %s", ticketStatus)})
+		return
+	}
+
+	recipientID, err := findOrCreateGuest(ctx, tx, toEmail)
+	if err != nil {
+		log.Printf("Error finding or creating transfer recipient %s: %v", toEmail, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to accept transfer"})
+		return
+	}
+
+	err = ticketstate.Transition(ctx, tx, []int{oldTicketID}, ticketstate.Change{
+		To:      ticketstate.Transferred,
+		ActorID: recipientID,
+		Reason:  fmt.Sprintf("transfer %d to %s", transferID, toEmail),
+	})
+	if err != nil {
+		log.Printf("Error marking ticket %d transferred: %v", oldTicketID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to accept transfer"})
+		return
+	}
+	newTicketID, qr, err := reissueTicket(ctx, tx, h.TicketSigner, oldTicketID, purchaseID, recipientID, eventID, ticketTypeID,
+		fmt.Sprintf("transferred from ticket %d", oldTicketID))
+	if err != nil {
+		log.Printf("Error issuing ticket for transfer %d: %v", transferID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to accept transfer"})
+		return
+	}
+	_, err = tx.Exec(ctx,
+		"UPDATE ticket_transfers SET status = 'accepted', accepted_at = now(), new_ticket_id = $1 WHERE id = $2",
+		newTicketID, transferID)
+	if err != nil {
+		log.Printf("Error updating transfer %d: %v", transferID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to accept transfer"})
+		return
+	}
+	err = outbox.Enqueue(ctx, tx, jobSendTicketEmail, ticketEmailJob{PurchaseID: purchaseID, Email: toEmail, TicketIDs: []int{newTicketID}})
+	if err != nil {
+		log.Printf("Error queueing ticket email for transfer %d: %v", transferID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to accept transfer"})
+		return
+	}
+	if err := tx.Commit(ctx); err != nil {
+		log.Printf("Error committing transfer %d: %v", transferID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to accept transfer"})
+		return
+	}
+
+	log.Printf("Transfer %d accepted: ticket %d replaced by ticket %d for %s", transferID, oldTicketID, newTicketID, toEmail)
+	c.JSON(http.StatusOK, gin.H{"ticket_id": newTicketID, "qr_code": qr, "event_id": eventID})
+}
+
+// reissueTicket issues a new valid ticket of a type to a user, with a new
+// signed QR code, in place of oldTicketID, which has left the user it was
+// issued to. The attendee details and registration answers carry over, so the
+// organiser's attendee list still has them. The place it takes was already
+// sold, so sold_quantity is left alone.
+func reissueTicket(ctx context.Context, tx pgx.Tx, signer *qrtoken.Signer, oldTicketID, purchaseID, userID, eventID, ticketTypeID int, reason string) (int, string, error) {
+	ids, err := nextTicketIDs(ctx, tx, 1)
+	if err != nil {
+		return 0, "", fmt.Errorf("allocating ticket ID: %w", err)
+	}
+	qr, err := signer.Sign(qrtoken.Claims{TicketID: ids[0], EventID: eventID, TicketTypeID: ticketTypeID})
+	if err != nil {
+		return 0, "", fmt.Errorf("signing ticket %d: %w", ids[0], err)
+	}
+	_, err = tx.Exec(ctx, `
+		INSERT INTO tickets (id, ticket_type_id, user_id, purchase_id, qr_code, status, attendee_name, attendee_email)
+		SELECT $1, $2, $3, $4, $5, 'valid', attendee_name, attendee_email FROM tickets WHERE id = $6`,
+		ids[0], ticketTypeID, userID, purchaseID, qr, oldTicketID)
+	if err != nil {
+		return 0, "", fmt.Errorf("inserting ticket: %w", err)
+	}
+	_, err = tx.Exec(ctx, `
+		INSERT INTO ticket_answers (ticket_id, question_id, label, value)
+		SELECT $1, question_id, label, value FROM ticket_answers WHERE ticket_id = $2 ORDER BY id`,
+		ids[0], oldTicketID)
+	if err != nil {
+		return 0, "", fmt.Errorf("copying attendee answers: %w", err)
+	}
+	if err := ticketstate.RecordIssued(ctx, tx, ids, userID, reason); err != nil {
+		return 0, "", fmt.Errorf("recording ticket history: %w", err)
+	}
+	return ids[0], qr, nil
+}
+
+// sendTransferEmail emails a transfer's recipient the link to accept it. It
+// runs as an outbox job. Transfers no longer pending by the time it runs are
+// skipped. The link's token is made here, and replaces any an earlier run of
+// the job emailed.
+func (h *Handler) sendTransferEmail(ctx context.Context, job transferEmailJob) error {
+	var status, eventTitle, ticketType string
+	var eventID int
+	var expiresAt time.Time
+	var sender *string
+	err := h.DB.QueryRow(ctx, `
+		SELECT tr.status, tr.expires_at, e.id, e.title, tt.name, u.email
+		FROM ticket_transfers tr
+		JOIN tickets tk ON tk.id = tr.ticket_id
+		JOIN ticket_types tt ON tt.id = tk.ticket_type_id
+		JOIN events e ON e.id = tt.event_id
+		LEFT JOIN users u ON u.id = tr.from_user_id
+		WHERE tr.id = $1`, job.TransferID,
+	).Scan(&status, &expiresAt, &eventID, &eventTitle, &ticketType, &sender)
+	if err == pgx.ErrNoRows {
+		return outbox.Permanent(fmt.Errorf("transfer %d not found", job.TransferID))
+	}
+	if err != nil {
+		return fmt.Errorf("loading transfer %d: %w", job.TransferID, err)
+	}
+	if status != transferPending {
+		log.Printf("Transfer %d is %s; not emailing %s", job.TransferID, status, job.Email)
+		return nil
+	}
+
+	brand, err := h.eventBranding(ctx, eventID)
+	if err != nil {
+		return fmt.Errorf("loading email branding for event %d: %w", eventID, err)
+	}
+
+	token, err := newLinkToken()
+	if err != nil {
+		return fmt.Errorf("generating transfer token: %w", err)
+	}
+	tag, err := h.DB.Exec(ctx,
+		"UPDATE ticket_transfers SET token_hash = $1 WHERE id = $2 AND status = 'pending'",
+		hashLinkToken(token), job.TransferID)
+	if err != nil {
+		return fmt.Errorf("saving token for transfer %d: %w", job.TransferID, err)
+	}
+	if tag.RowsAffected() == 0 {
+		log.Printf("Transfer %d is no longer pending; not emailing %s", job.TransferID, job.Email)
+		return nil
+	}
+
+	data := transferEmail{From: "Someone", TicketType: ticketType, EventTitle: eventTitle, Link: transferAcceptURL + token, ExpiresAt: expiresAt}
+	if sender != nil {
+		data.From = *sender
+	}
+	content, err := mailer.Render("ticket_transfer", brand, data)
+	if err != nil {
+		return outbox.Permanent(err)
+	}
+
+	sent, err := h.sendMail(ctx, content.Message(job.Email))
+	if err != nil {
+		return fmt.Errorf("sending transfer email to %s: %w", job.Email, err)
+	}
+	if sent {
+		log.Printf("Transfer email sent to %s for transfer %d", job.Email, job.TransferID)
+	}
+	return nil
+}
+
+type TransferPolicyRequest struct {
+	Enabled       *bool `json:"enabled"`
+	CutoffMinutes *int  `json:"cutoff_minutes" binding:"omitempty,min=0"`
+}
+
+// UpdateTransferPolicy sets whether an event's tickets can be transferred and
+// how many minutes before the event starts transfers close.
+func (h *Handler) UpdateTransferPolicy(c *gin.Context) {
+	eventID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid event ID"})
+		return
+	}
+	var req TransferPolicyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !h.authorizeEventOrganiser(c, eventID) {
+		return
+	}
+
+	var enabled bool
+	var cutoff int
+	err = h.DB.QueryRow(c.Request.Context(), `
+		UPDATE events
+		SET transfers_enabled = COALESCE($2, transfers_enabled),
+			transfer_cutoff_minutes = COALESCE($3, transfer_cutoff_minutes),
+			updated_at = now()
+		WHERE id = $1
+		RETURNING transfers_enabled, transfer_cutoff_minutes`,
+		eventID, req.Enabled, req.CutoffMinutes,
+	).Scan(&enabled, &cutoff)
+	if err != nil {
+		log.Printf("Error updating transfer policy of event %d: %v", eventID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update transfer policy"})
+		return
+	}
+	log.Printf("Transfer policy of event %d set by user %d: enabled=%t, cutoff %d minutes", eventID, c.GetInt("userID"), enabled, cutoff)
+	c.JSON(http.StatusOK, gin.H{"event_id": eventID, "enabled": enabled, "cutoff_minutes": cutoff})
+}
@@ -0,0 +1,205 @@
+package handlers_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	netmail "net/mail"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/tpgcig/carneauengine/server/handlers"
+	"github.com/tpgcig/carneauengine/server/mailer"
+	"github.com/tpgcig/carneauengine/server/outbox"
+	"github.com/tpgcig/carneauengine/server/payment"
+)
+
+// newTransferRouter serves the transfer endpoints, with starting and
+// cancelling them done as userID would after AuthMiddleware.
+func newTransferRouter(db *pgxpool.Pool, userID int) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	h := &handlers.Handler{DB: db, TicketSigner: testTicketSigner, TicketKeys: testTicketKeys}
+	r := gin.New()
+	holder := r.Group("/", func(c *gin.Context) {
+		c.Set("userID", userID)
+		c.Set("userRole", "ticket_holder")
+	})
+	holder.POST("/api/tickets/transfers", h.StartTicketTransfer)
+	holder.POST("/api/tickets/transfers/cancel", h.CancelTicketTransfer)
+	r.GET("/api/transfers/:token", h.GetTicketTransfer)
+	r.POST("/api/transfers/:token/accept", h.AcceptTicketTransfer)
+	return r
+}
+
+func postJSON(r *gin.Engine, path string, body any) *httptest.ResponseRecorder {
+	b, _ := json.Marshal(body)
+	req := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(b))
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+// startTransfer starts a transfer of qr to email, delivers the email it
+// queues and returns the token from the link in it.
+func startTransfer(t *testing.T, db *pgxpool.Pool, r *gin.Engine, qr, email string) string {
+	t.Helper()
+	w := postJSON(r, "/api/tickets/transfers", handlers.StartTransferRequest{QR: qr, Email: email})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("start transfer: expected 201, got %d: %s", w.Code, w.Body)
+	}
+	var transfer handlers.TicketTransfer
+	if err := json.Unmarshal(w.Body.Bytes(), &transfer); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	t.Cleanup(func() { db.Exec(ctx, "DELETE FROM outbox WHERE payload->>'transfer_id' = $1", fmt.Sprint(transfer.ID)) })
+
+	fileMailer, err := mailer.NewFileMailer(t.TempDir(), netmail.Address{Address: "tickets@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	worker := outbox.NewWorker(db)
+	(&handlers.Handler{DB: db, Mailer: fileMailer}).RegisterJobs(worker)
+	emails := checkoutServer{mail: fileMailer, worker: worker}.emailsTo(t, email)
+	if len(emails) != 1 {
+		t.Fatalf("expected 1 transfer email to %s, got %d", email, len(emails))
+	}
+	token := emailedLinkToken(t, emails[0])
+
+	var payload string
+	mustQuery(t, db.QueryRow(ctx,
+		"SELECT payload::text FROM outbox WHERE kind = 'send_transfer_email' AND payload->>'transfer_id' = $1",
+		fmt.Sprint(transfer.ID)).Scan(&payload))
+	if strings.Contains(payload, token) {
+		t.Error("expected the link's token to be kept out of the outbox")
+	}
+	return token
+}
+
+func TestTicketTransfer(t *testing.T) {
+	db := newTestDB(t)
+	ctx := context.Background()
+	fake := payment.NewFakeGateway("http://unused", "", "test-secret")
+	f := newCheckoutFixture(t, db, 1)
+	payFixture(t, db, fake, f)
+	scannerID := newOrganiser(t, db, f.orgID)
+	t.Cleanup(func() { deleteFixtureTickets(db, f) })
+	_, err := db.Exec(ctx, "UPDATE events SET start_time = now() + interval '1 day' WHERE id = $1", f.eventID)
+	mustQuery(t, err)
+	oldTicketID, qr := signFixtureTicket(t, db, f)
+	r := newTransferRouter(db, f.userID)
+	_, err = db.Exec(ctx, "UPDATE tickets SET attendee_name = 'Ada', attendee_email = 'ada@example.com' WHERE id = $1", oldTicketID)
+	mustQuery(t, err)
+	_, err = db.Exec(ctx, "INSERT INTO ticket_answers (ticket_id, label, value) VALUES ($1, 'Diet', 'Vegan')", oldTicketID)
+	mustQuery(t, err)
+
+	recipient := fmt.Sprintf("Friend-%s@example.com", uuid.New())
+	t.Cleanup(func() { db.Exec(ctx, "DELETE FROM users WHERE email = $1", recipient) }) // after the tickets are gone
+
+	// Only the ticket's holder can transfer it
+	if w := postJSON(newTransferRouter(db, scannerID), "/api/tickets/transfers", handlers.StartTransferRequest{QR: qr, Email: recipient}); w.Code != http.StatusForbidden {
+		t.Errorf("transfer by someone else: expected 403, got %d: %s", w.Code, w.Body)
+	}
+
+	// A second transfer replaces the first, whose link stops working, and
+	// doesn't give its recipient an account
+	replaced := fmt.Sprintf("Someone-Else-%s@example.com", uuid.New())
+	stale := startTransfer(t, db, r, qr, replaced)
+	token := startTransfer(t, db, r, qr, recipient)
+	if w := postJSON(r, "/api/transfers/"+stale+"/accept", nil); w.Code != http.StatusGone {
+		t.Errorf("replaced transfer: expected 410, got %d: %s", w.Code, w.Body)
+	}
+	var users int
+	mustQuery(t, db.QueryRow(ctx, "SELECT COUNT(*) FROM users WHERE email = $1", replaced).Scan(&users))
+	if users != 0 {
+		t.Errorf("replaced transfer: expected no user created for %s, got %d", replaced, users)
+	}
+
+	w := postJSON(r, "/api/transfers/"+token+"/accept", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("accept: expected 200, got %d: %s", w.Code, w.Body)
+	}
+	var accepted struct {
+		TicketID int    `json:"ticket_id"`
+		QRCode   string `json:"qr_code"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &accepted); err != nil {
+		t.Fatal(err)
+	}
+	if accepted.TicketID == oldTicketID || accepted.QRCode == qr || !strings.HasPrefix(accepted.QRCode, "CT1.") {
+		t.Errorf("expected a new ticket with a new QR code, got %+v", accepted)
+	}
+
+	var oldStatus, newStatus, holder string
+	mustQuery(t, db.QueryRow(ctx, "SELECT status FROM tickets WHERE id = $1", oldTicketID).Scan(&oldStatus))
+	mustQuery(t, db.QueryRow(ctx,
+		"SELECT t.status, u.email FROM tickets t JOIN users u ON u.id = t.user_id WHERE t.id = $1",
+		accepted.TicketID).Scan(&newStatus, &holder))
+	if oldStatus != "transferred" || newStatus != "valid" || holder != recipient {
+		t.Errorf("expected the old ticket transferred and the new one valid for %s, got %s, %s for %s", recipient, oldStatus, newStatus, holder)
+	}
+	var attendee string
+	mustQuery(t, db.QueryRow(ctx, `
+		SELECT t.attendee_name || '|' || t.attendee_email || '|' || string_agg(a.label || '=' || a.value, ',')
+		FROM tickets t JOIN ticket_answers a ON a.ticket_id = t.id
+		WHERE t.id = $1
+		GROUP BY t.id`, accepted.TicketID).Scan(&attendee))
+	if attendee != "Ada|ada@example.com|Diet=Vegan" {
+		t.Errorf("expected the attendee details carried over to the new ticket, got %q", attendee)
+	}
+	var emailed int
+	mustQuery(t, db.QueryRow(ctx,
+		"SELECT COUNT(*) FROM outbox WHERE kind = 'send_ticket_email' AND payload->>'email' = $1 AND payload->'ticket_ids' = $2::jsonb",
+		recipient, fmt.Sprintf("[%d]", accepted.TicketID)).Scan(&emailed))
+	if emailed != 1 {
+		t.Errorf("expected the new ticket emailed to the recipient once, got %d", emailed)
+	}
+
+	// The sender's QR code no longer gets in, and the link can't be used twice
+	if code, resp := scanTicket(t, newScannerRouter(db, scannerID), qr, f.eventID, ""); code != http.StatusConflict {
+		t.Errorf("old QR code: expected 409, got %d (%s)", code, resp.Error)
+	}
+	if w := postJSON(r, "/api/transfers/"+token+"/accept", nil); w.Code != http.StatusConflict {
+		t.Errorf("second accept: expected 409, got %d: %s", w.Code, w.Body)
+	}
+	if w := postJSON(r, "/api/tickets/transfers", handlers.StartTransferRequest{QR: qr, Email: "again@example.com"}); w.Code != http.StatusConflict {
+		t.Errorf("transferring the old ticket again: expected 409, got %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestTicketTransfer_Cutoff(t *testing.T) {
+	db := newTestDB(t)
+	ctx := context.Background()
+	fake := payment.NewFakeGateway("http://unused", "", "test-secret")
+	f := newCheckoutFixture(t, db, 1)
+	payFixture(t, db, fake, f)
+	_, err := db.Exec(ctx,
+		"UPDATE events SET start_time = now() + interval '30 minutes', transfer_cutoff_minutes = 60 WHERE id = $1", f.eventID)
+	mustQuery(t, err)
+	_, qr := signFixtureTicket(t, db, f)
+	r := newTransferRouter(db, f.userID)
+
+	if w := postJSON(r, "/api/tickets/transfers", handlers.StartTransferRequest{QR: qr, Email: "late@example.com"}); w.Code != http.StatusConflict {
+		t.Errorf("inside the cut-off: expected 409, got %d: %s", w.Code, w.Body)
+	}
+
+	_, err = db.Exec(ctx, "UPDATE events SET transfer_cutoff_minutes = 10 WHERE id = $1", f.eventID)
+	mustQuery(t, err)
+	token := startTransfer(t, db, r, qr, "early@example.com")
+	if w := postJSON(newTransferRouter(db, f.userID+1), "/api/tickets/transfers/cancel", handlers.CancelTransferRequest{QR: qr}); w.Code != http.StatusNotFound {
+		t.Errorf("cancel by someone else: expected 404, got %d: %s", w.Code, w.Body)
+	}
+	if w := postJSON(r, "/api/tickets/transfers/cancel", handlers.CancelTransferRequest{QR: qr}); w.Code != http.StatusOK {
+		t.Fatalf("cancel: expected 200, got %d: %s", w.Code, w.Body)
+	}
+	if w := postJSON(r, "/api/transfers/"+token+"/accept", nil); w.Code != http.StatusGone {
+		t.Errorf("cancelled transfer: expected 410, got %d: %s", w.Code, w.Body)
+	}
+}
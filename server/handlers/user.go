@@ -12,6 +12,7 @@ import (
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/jackc/pgx/v5"
 	"github.com/tpgcig/carneauengine/server/models"
+	"golang.org/x/crypto/bcrypt"
 )
 
 // JWT Claims struct
@@ -43,6 +44,34 @@ func (h *Handler) GetUserByEmail(ctx context.Context, email string) (*models.Use
 	return &user, nil
 }
 
+// findOrCreateGuest returns the ID of the user with an email, creating a
+// guest user for it if there is none yet. Guests can't log in. db may be a
+// transaction, so the guest is only created if the rest of it commits.
+func findOrCreateGuest(ctx context.Context, db dbQueryer, email string) (int, error) {
+	var id int
+	err := db.QueryRow(ctx, "SELECT id FROM users WHERE email = $1", email).Scan(&id)
+	if err != pgx.ErrNoRows {
+		return id, err
+	}
+
+	// Hash a generic "guest" password. This password will not be used for login.
+	hashedPwd, err := bcrypt.GenerateFromPassword([]byte("GUEST_USER_PLACEHOLDER_PASSWORD"), bcrypt.DefaultCost)
+	if err != nil {
+		return 0, fmt.Errorf("hashing guest password: %w", err)
+	}
+	err = db.QueryRow(ctx, `
+		INSERT INTO users (email, first_name, last_name, role, password_hash)
+		VALUES ($1, 'Guest', 'User', 'guest', $2)
+		ON CONFLICT (email) DO NOTHING
+		RETURNING id`, email, string(hashedPwd),
+	).Scan(&id)
+	if err == pgx.ErrNoRows {
+		// Created by a concurrent request since we looked
+		err = db.QueryRow(ctx, "SELECT id FROM users WHERE email = $1", email).Scan(&id)
+	}
+	return id, err
+}
+
 // Register handles new user registration.
 func (h *Handler) Register(c *gin.Context) {
 	var newUser models.User
@@ -113,24 +142,14 @@ func (h *Handler) Login(c *gin.Context) {
 	}
 
 	// NEW: Role-based login restriction - only allow 'organizer' role to log in
-	if user.Role != "organizer" {
+	// Admins and door staff are created directly in the database and log in the same way
+	if user.Role != "organizer" && user.Role != "admin" && user.Role != "staff" {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Access denied: Only organizers can log in directly."})
 		return
 	}
 
 	// Generate JWT
-	expirationTime := time.Now().Add(tokenExpiresIn)
-	claims := &Claims{
-		UserID: user.ID,
-		Email:  user.Email,
-		Role:   user.Role,
-		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(expirationTime),
-		},
-	}
-
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	tokenString, err := token.SignedString(jwtKey)
+	tokenString, _, err := signToken(user.ID, user.Email, user.Role, tokenExpiresIn)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
 		return
@@ -139,6 +158,21 @@ func (h *Handler) Login(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"token": tokenString})
 }
 
+// signToken returns a JWT for a user, acting with role, that lasts ttl.
+func signToken(userID int, email, role string, ttl time.Duration) (string, time.Time, error) {
+	expiresAt := time.Now().Add(ttl)
+	claims := &Claims{
+		UserID: userID,
+		Email:  email,
+		Role:   role,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+		},
+	}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(jwtKey)
+	return token, expiresAt, err
+}
+
 // AuthMiddleware is a Gin middleware to validate JWTs.
 func AuthMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
@@ -190,6 +224,22 @@ func AuthMiddleware() gin.HandlerFunc {
 	}
 }
 
+// RequireRole is a Gin middleware, used after AuthMiddleware, that only lets
+// through users with one of the given roles.
+func RequireRole(roles ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		role := c.GetString("userRole")
+		for _, r := range roles {
+			if role == r {
+				c.Next()
+				return
+			}
+		}
+		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+		c.Abort()
+	}
+}
+
 func (h *Handler) UpdateUser(c *gin.Context) {
 	// Return JSON response
 	c.JSON(http.StatusOK, gin.H{
@@ -0,0 +1,432 @@
+package handlers_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/stripe/stripe-go/v83"
+	"github.com/stripe/stripe-go/v83/webhook"
+
+	"github.com/tpgcig/carneauengine/server/handlers"
+	"github.com/tpgcig/carneauengine/server/outbox"
+	"github.com/tpgcig/carneauengine/server/payment"
+	"github.com/tpgcig/carneauengine/server/qrtoken"
+	"github.com/tpgcig/carneauengine/server/reservation"
+)
+
+const testWebhookSecret = "whsec_test_secret"
+
+// testTicketSigner signs the QR codes of tickets issued in tests, and
+// testTicketKeys verifies them.
+var testTicketSigner, testTicketKeys = newTestTicketKeys()
+
+func newTestTicketKeys() (*qrtoken.Signer, *qrtoken.Keyring) {
+	signer, err := qrtoken.GenerateSigner("test")
+	if err != nil {
+		panic(err)
+	}
+	keys := qrtoken.NewKeyring()
+	if err := keys.Add(signer.KeyID(), signer.PublicKey()); err != nil {
+		panic(err)
+	}
+	return signer, keys
+}
+
+// newTestDB connects to TEST_DATABASE_URL, which must point at a throwaway
+// database loaded with schema.sql.
+func newTestDB(t *testing.T) *pgxpool.Pool {
+	t.Helper()
+	dbURL := os.Getenv("TEST_DATABASE_URL")
+	if dbURL == "" {
+		t.Skip("TEST_DATABASE_URL not set — skipping")
+	}
+	pool, err := pgxpool.New(context.Background(), dbURL)
+	if err != nil {
+		t.Skipf("Postgres not reachable — skipping: %v", err)
+	}
+	if err := pool.Ping(context.Background()); err != nil {
+		pool.Close()
+		t.Skipf("Postgres not reachable — skipping: %v", err)
+	}
+	t.Cleanup(pool.Close) // registered first, so it runs after every fixture cleanup
+	return pool
+}
+
+// checkoutFixture is a pending purchase of `quantity` tickets of one type.
+type checkoutFixture struct {
+	orgID        int
+	eventID      int
+	ticketTypeID int
+	userID       int
+	purchaseID   int
+	reservation  string
+	quantity     int
+}
+
+func newCheckoutFixture(t *testing.T, db *pgxpool.Pool, quantity int) checkoutFixture {
+	t.Helper()
+	ctx := context.Background()
+	f := checkoutFixture{quantity: quantity, reservation: uuid.New().String()}
+
+	mustQuery(t, db.QueryRow(ctx, "INSERT INTO organisations (name) VALUES ('Webhook Test Org') RETURNING id").Scan(&f.orgID))
+	mustQuery(t, db.QueryRow(ctx,
+		"INSERT INTO events (organisation_id, title, start_time, end_time) VALUES ($1, 'Webhook Test Event', now(), now()) RETURNING id",
+		f.orgID).Scan(&f.eventID))
+	mustQuery(t, db.QueryRow(ctx,
+		"INSERT INTO ticket_types (event_id, name, price, total_quantity, sold_quantity) VALUES ($1, 'GA', 10.00, 10, 0) RETURNING id",
+		f.eventID).Scan(&f.ticketTypeID))
+	mustQuery(t, db.QueryRow(ctx,
+		"INSERT INTO users (email, role, password_hash) VALUES ($1, 'guest', 'x') RETURNING id",
+		fmt.Sprintf("webhook-%s@example.com", uuid.New())).Scan(&f.userID))
+	mustQuery(t, db.QueryRow(ctx,
+		"INSERT INTO purchases (user_id, event_id, total_amount, payment_status, reservation_id) VALUES ($1, $2, $3, 'pending', $4) RETURNING id",
+		f.userID, f.eventID, 10*quantity, f.reservation).Scan(&f.purchaseID))
+	_, err := db.Exec(ctx,
+		"INSERT INTO purchase_items (purchase_id, ticket_type_id, quantity, unit_price) VALUES ($1, $2, $3, 10.00)",
+		f.purchaseID, f.ticketTypeID, quantity)
+	mustQuery(t, err)
+
+	t.Cleanup(func() {
+		db.Exec(ctx, "DELETE FROM outbox WHERE payload->>'purchase_id' = $1 OR payload->>'reservation_id' = $2", fmt.Sprint(f.purchaseID), f.reservation)
+		deleteFixtureTickets(db, f)
+		db.Exec(ctx, "DELETE FROM purchases WHERE id = $1", f.purchaseID)
+		db.Exec(ctx, "DELETE FROM users WHERE id = $1", f.userID)
+		db.Exec(ctx, "DELETE FROM ticket_types WHERE id = $1", f.ticketTypeID)
+		db.Exec(ctx, "DELETE FROM events WHERE id = $1", f.eventID)
+		db.Exec(ctx, "DELETE FROM organisations WHERE id = $1", f.orgID)
+	})
+	return f
+}
+
+// deleteFixtureTickets deletes the fixture's tickets and the rows referring
+// to them.
+func deleteFixtureTickets(db *pgxpool.Pool, f checkoutFixture) {
+	ctx := context.Background()
+	for _, table := range []string{"ticket_scans", "ticket_events", "ticket_transfers"} {
+		db.Exec(ctx, "DELETE FROM "+table+" WHERE ticket_id IN (SELECT id FROM tickets WHERE purchase_id = $1)", f.purchaseID)
+	}
+	db.Exec(ctx, "DELETE FROM tickets WHERE purchase_id = $1", f.purchaseID)
+}
+
+func mustQuery(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatalf("query failed: %v", err)
+	}
+}
+
+// checkoutEvent builds the JSON payload of a Stripe event for the fixture's
+// checkout session, paid in full.
+func (f checkoutFixture) checkoutEvent(t *testing.T, eventID, eventType string) []byte {
+	t.Helper()
+	return f.checkoutEventPaying(t, eventID, eventType, int64(1000*f.quantity))
+}
+
+// checkoutEventPaying is checkoutEvent with the session's amount_total, in cents, set to paid.
+func (f checkoutFixture) checkoutEventPaying(t *testing.T, eventID, eventType string, paid int64) []byte {
+	t.Helper()
+	session := map[string]interface{}{
+		"id":             "cs_test_" + eventID,
+		"object":         "checkout.session",
+		"payment_status": "paid",
+		"amount_total":   paid,
+		"currency":       "aud",
+		"customer_email": "buyer@example.com",
+		"metadata": map[string]string{
+			"purchase_id": fmt.Sprint(f.purchaseID),
+		},
+	}
+	raw, err := json.Marshal(session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := json.Marshal(map[string]interface{}{
+		"id":          eventID,
+		"object":      "event",
+		"api_version": stripe.APIVersion,
+		"type":        eventType,
+		"data":        map[string]json.RawMessage{"object": raw},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return payload
+}
+
+func newWebhookRouter(t *testing.T, db *pgxpool.Pool) *gin.Engine {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+
+	h := &handlers.Handler{
+		DB:           db,
+		Reservations: reservation.NewMemoryReserver(15 * time.Minute),
+		Payments:     payment.NewStripeGateway(testWebhookSecret),
+		TicketSigner: testTicketSigner,
+		TicketKeys:   testTicketKeys,
+	}
+	r := gin.New()
+	r.POST("/stripe-webhook", h.StripeWebhook)
+	return r
+}
+
+func deliver(r *gin.Engine, payload []byte) int {
+	signed := webhook.GenerateTestSignedPayload(&webhook.UnsignedPayload{
+		Payload:   payload,
+		Secret:    testWebhookSecret,
+		Timestamp: time.Now(),
+	})
+	req := httptest.NewRequest(http.MethodPost, "/stripe-webhook", bytes.NewReader(payload))
+	req.Header.Set("Stripe-Signature", signed.Header)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w.Code
+}
+
+func assertFulfilledOnce(t *testing.T, db *pgxpool.Pool, f checkoutFixture) {
+	t.Helper()
+	ctx := context.Background()
+
+	var tickets, sold int
+	var status string
+	mustQuery(t, db.QueryRow(ctx, "SELECT COUNT(*) FROM tickets WHERE purchase_id = $1", f.purchaseID).Scan(&tickets))
+	mustQuery(t, db.QueryRow(ctx, "SELECT sold_quantity FROM ticket_types WHERE id = $1", f.ticketTypeID).Scan(&sold))
+	mustQuery(t, db.QueryRow(ctx, "SELECT payment_status FROM purchases WHERE id = $1", f.purchaseID).Scan(&status))
+
+	if tickets != f.quantity {
+		t.Errorf("expected %d tickets issued, got %d", f.quantity, tickets)
+	}
+	if sold != f.quantity {
+		t.Errorf("expected sold_quantity=%d, got %d", f.quantity, sold)
+	}
+	if status != "succeeded" {
+		t.Errorf("expected purchase status succeeded, got %s", status)
+	}
+
+	rows, err := db.Query(ctx, "SELECT id, ticket_type_id, qr_code FROM tickets WHERE purchase_id = $1", f.purchaseID)
+	mustQuery(t, err)
+	defer rows.Close()
+	for rows.Next() {
+		var id, ticketTypeID int
+		var qr string
+		mustQuery(t, rows.Scan(&id, &ticketTypeID, &qr))
+		claims, err := testTicketKeys.Verify(qr)
+		if err != nil {
+			t.Errorf("ticket %d: QR code does not verify: %v", id, err)
+			continue
+		}
+		if claims.TicketID != id || claims.EventID != f.eventID || claims.TicketTypeID != ticketTypeID {
+			t.Errorf("ticket %d: QR code claims %+v", id, claims)
+		}
+	}
+
+	var emails, commits int
+	mustQuery(t, db.QueryRow(ctx, "SELECT COUNT(*) FROM outbox WHERE kind = 'send_ticket_email' AND payload->>'purchase_id' = $1", fmt.Sprint(f.purchaseID)).Scan(&emails))
+	mustQuery(t, db.QueryRow(ctx, "SELECT COUNT(*) FROM outbox WHERE kind = 'commit_reservation' AND payload->>'reservation_id' = $1", f.reservation).Scan(&commits))
+	if emails != 1 || commits != 1 {
+		t.Errorf("expected one ticket email and one reservation commit queued, got %d and %d", emails, commits)
+	}
+}
+
+// TestStripeWebhook_ReplayedEventAppliedOnce replays the same completed event
+// the way Stripe's retries do and checks the order is only fulfilled once.
+func TestStripeWebhook_ReplayedEventAppliedOnce(t *testing.T) {
+	db := newTestDB(t)
+	r := newWebhookRouter(t, db)
+
+	f := newCheckoutFixture(t, db, 2)
+	eventID := "evt_test_" + uuid.New().String()
+	t.Cleanup(func() { db.Exec(context.Background(), "DELETE FROM stripe_events WHERE event_id = $1", eventID) })
+	payload := f.checkoutEvent(t, eventID, "checkout.session.completed")
+
+	for i := 0; i < 3; i++ {
+		if code := deliver(r, payload); code != http.StatusOK {
+			t.Fatalf("delivery %d: expected 200, got %d", i+1, code)
+		}
+	}
+
+	assertFulfilledOnce(t, db, f)
+}
+
+// TestStripeWebhook_ConcurrentDeliveriesAppliedOnce delivers the same event
+// several times at once and checks only one delivery fulfils the order.
+func TestStripeWebhook_ConcurrentDeliveriesAppliedOnce(t *testing.T) {
+	const deliveries = 5
+
+	db := newTestDB(t)
+	r := newWebhookRouter(t, db)
+
+	f := newCheckoutFixture(t, db, 3)
+	eventID := "evt_test_" + uuid.New().String()
+	t.Cleanup(func() { db.Exec(context.Background(), "DELETE FROM stripe_events WHERE event_id = $1", eventID) })
+	payload := f.checkoutEvent(t, eventID, "checkout.session.completed")
+
+	var wg sync.WaitGroup
+	for i := 0; i < deliveries; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if code := deliver(r, payload); code != http.StatusOK {
+				t.Errorf("expected 200, got %d", code)
+			}
+		}()
+	}
+	wg.Wait()
+
+	assertFulfilledOnce(t, db, f)
+}
+
+// TestStripeWebhook_DistinctEventsForSamePurchase checks the purchase status
+// guard: a completed event followed by an async success for the same session
+// must not issue a second set of tickets.
+func TestStripeWebhook_DistinctEventsForSamePurchase(t *testing.T) {
+	db := newTestDB(t)
+	r := newWebhookRouter(t, db)
+
+	f := newCheckoutFixture(t, db, 1)
+	completedID := "evt_test_" + uuid.New().String()
+	asyncID := "evt_test_" + uuid.New().String()
+	t.Cleanup(func() {
+		db.Exec(context.Background(), "DELETE FROM stripe_events WHERE event_id IN ($1, $2)", completedID, asyncID)
+	})
+
+	if code := deliver(r, f.checkoutEvent(t, completedID, "checkout.session.completed")); code != http.StatusOK {
+		t.Fatalf("completed: expected 200, got %d", code)
+	}
+	if code := deliver(r, f.checkoutEvent(t, asyncID, "checkout.session.async_payment_succeeded")); code != http.StatusOK {
+		t.Fatalf("async_payment_succeeded: expected 200, got %d", code)
+	}
+
+	assertFulfilledOnce(t, db, f)
+}
+
+// TestStripeWebhook_AmountMismatchNeedsReview checks that a session paid for a
+// different amount than the purchase total issues no tickets.
+func TestStripeWebhook_AmountMismatchNeedsReview(t *testing.T) {
+	db := newTestDB(t)
+	r := newWebhookRouter(t, db)
+	ctx := context.Background()
+
+	f := newCheckoutFixture(t, db, 2)
+	eventID := "evt_test_" + uuid.New().String()
+	t.Cleanup(func() { db.Exec(ctx, "DELETE FROM stripe_events WHERE event_id = $1", eventID) })
+
+	if code := deliver(r, f.checkoutEventPaying(t, eventID, "checkout.session.completed", 1000)); code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+
+	assertHeldForReview(t, db, f)
+}
+
+// TestStripeWebhook_SoldOutNeedsReview pays for more tickets than are left,
+// e.g. after an organiser cut the capacity mid-checkout, and checks the order
+// is held for review instead of overselling.
+func TestStripeWebhook_SoldOutNeedsReview(t *testing.T) {
+	db := newTestDB(t)
+	r := newWebhookRouter(t, db)
+	ctx := context.Background()
+
+	f := newCheckoutFixture(t, db, 2)
+	_, err := db.Exec(ctx, "UPDATE ticket_types SET total_quantity = 1 WHERE id = $1", f.ticketTypeID)
+	mustQuery(t, err)
+	eventID := "evt_test_" + uuid.New().String()
+	t.Cleanup(func() { db.Exec(ctx, "DELETE FROM stripe_events WHERE event_id = $1", eventID) })
+
+	if code := deliver(r, f.checkoutEvent(t, eventID, "checkout.session.completed")); code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+	assertHeldForReview(t, db, f)
+}
+
+func assertHeldForReview(t *testing.T, db *pgxpool.Pool, f checkoutFixture) {
+	t.Helper()
+	ctx := context.Background()
+
+	var tickets, sold, releases int
+	var status, reason string
+	mustQuery(t, db.QueryRow(ctx, "SELECT COUNT(*) FROM tickets WHERE purchase_id = $1", f.purchaseID).Scan(&tickets))
+	mustQuery(t, db.QueryRow(ctx, "SELECT sold_quantity FROM ticket_types WHERE id = $1", f.ticketTypeID).Scan(&sold))
+	mustQuery(t, db.QueryRow(ctx, "SELECT payment_status, COALESCE(review_reason, '') FROM purchases WHERE id = $1", f.purchaseID).Scan(&status, &reason))
+	mustQuery(t, db.QueryRow(ctx, "SELECT COUNT(*) FROM outbox WHERE kind = 'release_reservation' AND payload->>'reservation_id' = $1", f.reservation).Scan(&releases))
+
+	if status != "needs_review" || reason == "" {
+		t.Errorf("expected purchase status needs_review with a reason, got %s %q", status, reason)
+	}
+	if tickets != 0 || sold != 0 {
+		t.Errorf("expected no tickets issued, got %d tickets and sold_quantity=%d", tickets, sold)
+	}
+	if releases != 1 {
+		t.Errorf("expected the holds queued for release, got %d jobs", releases)
+	}
+}
+
+// TestStripeWebhook_ClosedSessionsReleaseHold delivers the events for a session
+// that will never be paid and checks the purchase is closed and its hold given
+// back, unless the purchase has already been paid for.
+func TestStripeWebhook_ClosedSessionsReleaseHold(t *testing.T) {
+	db := newTestDB(t)
+	ctx := context.Background()
+
+	cases := []struct {
+		eventType string
+		from      string // the purchase's status when the event arrives
+		want      string
+		released  bool
+	}{
+		{"checkout.session.expired", "pending", "expired", true},
+		{"checkout.session.async_payment_failed", "processing", "failed", true},
+		{"checkout.session.expired", "succeeded", "succeeded", false},
+		{"checkout.session.async_payment_failed", "succeeded", "succeeded", false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.eventType+" when "+tc.from, func(t *testing.T) {
+			f := newCheckoutFixture(t, db, 2)
+			_, err := db.Exec(ctx, "UPDATE purchases SET payment_status = $1 WHERE id = $2", tc.from, f.purchaseID)
+			mustQuery(t, err)
+
+			reserver := reservation.NewMemoryReserver(15 * time.Minute)
+			err = reserver.Reserve(ctx, f.reservation, []reservation.Request{{TicketTypeID: f.ticketTypeID, Quantity: f.quantity, TotalQuantity: 10}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			h := &handlers.Handler{DB: db, Reservations: reserver, Payments: payment.NewStripeGateway(testWebhookSecret)}
+			worker := outbox.NewWorker(db)
+			h.RegisterJobs(worker)
+			gin.SetMode(gin.TestMode)
+			r := gin.New()
+			r.POST("/stripe-webhook", h.StripeWebhook)
+
+			eventID := "evt_test_" + uuid.New().String()
+			t.Cleanup(func() { db.Exec(ctx, "DELETE FROM stripe_events WHERE event_id = $1", eventID) })
+			if code := deliver(r, f.checkoutEvent(t, eventID, tc.eventType)); code != http.StatusOK {
+				t.Fatalf("expected 200, got %d", code)
+			}
+			if _, err := worker.RunOnce(ctx); err != nil {
+				t.Fatal(err)
+			}
+
+			var status string
+			mustQuery(t, db.QueryRow(ctx, "SELECT payment_status FROM purchases WHERE id = $1", f.purchaseID).Scan(&status))
+			if status != tc.want {
+				t.Errorf("expected purchase %s, got %s", tc.want, status)
+			}
+			held := reserver.Held(f.ticketTypeID)
+			if tc.released && held != 0 {
+				t.Errorf("expected the hold released, still holding %d", held)
+			}
+			if !tc.released && held != f.quantity {
+				t.Errorf("expected the hold left alone, holding %d", held)
+			}
+		})
+	}
+}
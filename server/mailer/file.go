@@ -0,0 +1,54 @@
+package mailer
+
+import (
+	"context"
+	"fmt"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// FileMailer writes each message to its own .eml file in a directory instead
+// of sending it. Mail clients open them as they would have been received.
+type FileMailer struct {
+	dir  string
+	from mail.Address
+
+	mu   sync.Mutex
+	seq  int
+	sent []string // paths written, in order
+}
+
+// NewFileMailer returns a mailer that writes to dir, creating it if needed.
+func NewFileMailer(dir string, from mail.Address) (*FileMailer, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &FileMailer{dir: dir, from: from}, nil
+}
+
+func (m *FileMailer) Send(ctx context.Context, msg *Message) error {
+	raw, err := msg.withSender(m.from).Bytes()
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.seq++
+	path := filepath.Join(m.dir, fmt.Sprintf("%s-%04d.eml", time.Now().UTC().Format("20060102T150405.000000000"), m.seq))
+	if err := os.WriteFile(path, raw, 0o644); err != nil {
+		return err
+	}
+	m.sent = append(m.sent, path)
+	return nil
+}
+
+// Sent returns the paths of the files written so far, oldest first.
+func (m *FileMailer) Sent() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]string(nil), m.sent...)
+}
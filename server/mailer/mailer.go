@@ -0,0 +1,211 @@
+// Package mailer sends the emails the server renders from its templates. SMTP
+// delivers them for real; the file mailer writes them out as .eml files, so
+// emails can be read and tested without a mail server.
+package mailer
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// ErrNoRecipient is returned by Send for a message with no To address.
+var ErrNoRecipient = errors.New("mailer: message has no recipient")
+
+// Mailer sends messages. Implementations fill in the sender they were
+// configured with for any part of From the message leaves empty.
+type Mailer interface {
+	Send(ctx context.Context, msg *Message) error
+}
+
+// Message is an email with a plain text body, an HTML body, or both.
+type Message struct {
+	From    mail.Address // Address or Name left empty get the mailer's
+	To      string
+	ReplyTo string
+	Subject string
+	Text    string
+	HTML    string
+	Inline  []Inline // images the HTML refers to as cid:ContentID
+}
+
+// Inline is an image embedded in a message's HTML.
+type Inline struct {
+	ContentID   string
+	ContentType string
+	Data        []byte
+}
+
+// withSender returns a copy of msg with from's name and address standing in
+// for any left empty.
+func (msg Message) withSender(from mail.Address) *Message {
+	if msg.From.Address == "" {
+		msg.From.Address = from.Address
+	}
+	if msg.From.Name == "" {
+		msg.From.Name = from.Name
+	}
+	return &msg
+}
+
+// Bytes encodes the message as RFC 5322 with MIME bodies: text and HTML as
+// quoted-printable alternatives, with inline images alongside the HTML.
+func (msg *Message) Bytes() ([]byte, error) {
+	if msg.To == "" {
+		return nil, ErrNoRecipient
+	}
+	to, err := mail.ParseAddress(msg.To)
+	if err != nil {
+		return nil, fmt.Errorf("mailer: bad recipient %q: %w", msg.To, err)
+	}
+
+	var buf bytes.Buffer
+	header := func(k, v string) { fmt.Fprintf(&buf, "%s: %s\r\n", k, v) }
+	header("From", msg.From.String())
+	header("To", to.String())
+	if msg.ReplyTo != "" {
+		replyTo, err := mail.ParseAddress(msg.ReplyTo)
+		if err != nil {
+			return nil, fmt.Errorf("mailer: bad reply-to %q: %w", msg.ReplyTo, err)
+		}
+		header("Reply-To", replyTo.String())
+	}
+	header("Subject", mime.QEncoding.Encode("utf-8", msg.Subject))
+	header("Date", time.Now().Format(time.RFC1123Z))
+	header("Message-ID", messageID(msg.From.Address))
+	header("MIME-Version", "1.0")
+
+	var body bytes.Buffer
+	contentType, err := writeBody(&body, msg)
+	if err != nil {
+		return nil, err
+	}
+	header("Content-Type", contentType)
+	if !strings.HasPrefix(contentType, "multipart/") {
+		header("Content-Transfer-Encoding", "quoted-printable")
+	}
+	buf.WriteString("\r\n")
+	buf.Write(body.Bytes())
+	return buf.Bytes(), nil
+}
+
+// writeBody writes the body of msg to w and returns its Content-Type.
+func writeBody(w io.Writer, msg *Message) (string, error) {
+	switch {
+	case msg.HTML == "":
+		return "text/plain; charset=utf-8", writeQP(w, msg.Text)
+	case msg.Text == "":
+		return writeHTML(w, msg)
+	}
+	alt := multipart.NewWriter(w)
+	part, err := alt.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {"text/plain; charset=utf-8"},
+		"Content-Transfer-Encoding": {"quoted-printable"},
+	})
+	if err != nil {
+		return "", err
+	}
+	if err := writeQP(part, msg.Text); err != nil {
+		return "", err
+	}
+	var html bytes.Buffer
+	htmlType, err := writeHTML(&html, msg)
+	if err != nil {
+		return "", err
+	}
+	h := textproto.MIMEHeader{"Content-Type": {htmlType}}
+	if len(msg.Inline) == 0 {
+		h.Set("Content-Transfer-Encoding", "quoted-printable")
+	}
+	if part, err = alt.CreatePart(h); err != nil {
+		return "", err
+	}
+	if _, err := part.Write(html.Bytes()); err != nil {
+		return "", err
+	}
+	if err := alt.Close(); err != nil {
+		return "", err
+	}
+	return mime.FormatMediaType("multipart/alternative", map[string]string{"boundary": alt.Boundary()}), nil
+}
+
+// writeHTML writes the HTML body of msg, with its inline images if it has
+// any, and returns its Content-Type.
+func writeHTML(w io.Writer, msg *Message) (string, error) {
+	if len(msg.Inline) == 0 {
+		return "text/html; charset=utf-8", writeQP(w, msg.HTML)
+	}
+	related := multipart.NewWriter(w)
+	part, err := related.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {"text/html; charset=utf-8"},
+		"Content-Transfer-Encoding": {"quoted-printable"},
+	})
+	if err != nil {
+		return "", err
+	}
+	if err := writeQP(part, msg.HTML); err != nil {
+		return "", err
+	}
+	for _, img := range msg.Inline {
+		part, err := related.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {img.ContentType},
+			"Content-Transfer-Encoding": {"base64"},
+			"Content-ID":                {"<" + img.ContentID + ">"},
+			"Content-Disposition":       {mime.FormatMediaType("inline", map[string]string{"filename": img.ContentID})},
+		})
+		if err != nil {
+			return "", err
+		}
+		if err := writeBase64(part, img.Data); err != nil {
+			return "", err
+		}
+	}
+	if err := related.Close(); err != nil {
+		return "", err
+	}
+	return mime.FormatMediaType("multipart/related", map[string]string{"boundary": related.Boundary(), "type": "text/html"}), nil
+}
+
+func writeQP(w io.Writer, s string) error {
+	qp := quotedprintable.NewWriter(w)
+	if _, err := io.WriteString(qp, strings.ReplaceAll(s, "\r\n", "\n")); err != nil {
+		return err
+	}
+	return qp.Close()
+}
+
+// writeBase64 writes data base64-encoded in lines of 76 characters, as MIME
+// requires.
+func writeBase64(w io.Writer, data []byte) error {
+	encoded := base64.StdEncoding.EncodeToString(data)
+	for len(encoded) > 76 {
+		if _, err := io.WriteString(w, encoded[:76]+"\r\n"); err != nil {
+			return err
+		}
+		encoded = encoded[76:]
+	}
+	_, err := io.WriteString(w, encoded+"\r\n")
+	return err
+}
+
+func messageID(from string) string {
+	domain := "localhost"
+	if at := strings.LastIndex(from, "@"); at >= 0 {
+		domain = from[at+1:]
+	}
+	b := make([]byte, 12)
+	rand.Read(b)
+	return "<" + hex.EncodeToString(b) + "@" + domain + ">"
+}
@@ -0,0 +1,302 @@
+package mailer_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"html/template"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tpgcig/carneauengine/server/mailer"
+)
+
+// parts reads a message's leaf MIME parts by Content-Type, decoded.
+func parts(t *testing.T, raw []byte) (*mail.Message, map[string][]byte) {
+	t.Helper()
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := map[string][]byte{}
+	var walk func(contentType, encoding string, body io.Reader)
+	walk = func(contentType, encoding string, body io.Reader) {
+		mediaType, params, err := mime.ParseMediaType(contentType)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.HasPrefix(mediaType, "multipart/") {
+			r := multipart.NewReader(body, params["boundary"])
+			for {
+				p, err := r.NextRawPart()
+				if err == io.EOF {
+					return
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				walk(p.Header.Get("Content-Type"), p.Header.Get("Content-Transfer-Encoding"), p)
+			}
+		}
+		switch encoding {
+		case "quoted-printable":
+			body = quotedprintable.NewReader(body)
+		case "base64":
+			body = base64.NewDecoder(base64.StdEncoding, body)
+		}
+		b, err := io.ReadAll(body)
+		if err != nil {
+			t.Fatalf("decoding %s part: %v", mediaType, err)
+		}
+		found[mediaType] = b
+	}
+	walk(msg.Header.Get("Content-Type"), msg.Header.Get("Content-Transfer-Encoding"), msg.Body)
+	return msg, found
+}
+
+func TestMessageBytes(t *testing.T) {
+	long := strings.Repeat("Façade ", 30)
+	raw, err := (&mailer.Message{
+		From:    mail.Address{Name: "Café Events", Address: "tickets@example.com"},
+		To:      "ada@example.com",
+		ReplyTo: "help@example.com",
+		Subject: "Your tickets for Zoë's Gala ✨",
+		Text:    long,
+		HTML:    "<p>" + long + "</p>",
+		Inline:  []mailer.Inline{{ContentID: "qr_0", ContentType: "image/png", Data: bytes.Repeat([]byte{0, 1, 2, 250}, 100)}},
+	}).Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, line := range strings.Split(string(raw), "\r\n") {
+		if len(line) > 998 {
+			t.Fatalf("line %d is %d octets long", i, len(line))
+		}
+		for _, r := range line {
+			if r > 127 {
+				t.Fatalf("line %d isn't 7-bit: %q", i, line)
+			}
+		}
+	}
+
+	msg, found := parts(t, raw)
+	dec := new(mime.WordDecoder)
+	subject, err := dec.DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil || subject != "Your tickets for Zoë's Gala ✨" {
+		t.Errorf("subject: got %q, %v", subject, err)
+	}
+	from, err := msg.Header.AddressList("From")
+	if err != nil || len(from) != 1 || from[0].Name != "Café Events" {
+		t.Errorf("from: got %v, %v", from, err)
+	}
+	if got := msg.Header.Get("Reply-To"); got != "<help@example.com>" {
+		t.Errorf("reply-to: got %q", got)
+	}
+	if string(found["text/plain"]) != long {
+		t.Errorf("text part: got %q", found["text/plain"])
+	}
+	if string(found["text/html"]) != "<p>"+long+"</p>" {
+		t.Errorf("HTML part: got %q", found["text/html"])
+	}
+	if len(found["image/png"]) != 400 {
+		t.Errorf("expected the 400 byte image back, got %d bytes", len(found["image/png"]))
+	}
+}
+
+func TestMessageBytes_TextOnly(t *testing.T) {
+	raw, err := (&mailer.Message{From: mail.Address{Address: "a@example.com"}, To: "b@example.com", Text: "naïve"}).Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, found := parts(t, raw)
+	if ct := msg.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Errorf("expected a text/plain message, got %q", ct)
+	}
+	if string(found["text/plain"]) != "naïve" {
+		t.Errorf("got %q", found["text/plain"])
+	}
+
+	if _, err := (&mailer.Message{Text: "x"}).Bytes(); err != mailer.ErrNoRecipient {
+		t.Errorf("no recipient: expected ErrNoRecipient, got %v", err)
+	}
+}
+
+type event struct {
+	Title     string
+	Location  string
+	StartTime time.Time
+}
+
+type ticket struct {
+	TypeName, QR string
+	ImageSrc     template.URL
+}
+
+type confirmation struct {
+	Recipient   string
+	Transferred bool
+	Event       event
+	Tickets     []ticket
+}
+
+func TestRender_EscapesHTML(t *testing.T) {
+	content, err := mailer.Render("ticket_confirmation", mailer.Branding{}, confirmation{
+		Recipient: "ada@example.com",
+		Event:     event{Title: "Rock & <Roll>", Location: "Hall", StartTime: time.Date(2026, 3, 1, 19, 30, 0, 0, time.UTC)},
+		Tickets:   []ticket{{TypeName: "GA", QR: "CT1.x", ImageSrc: "cid:qrcode_0"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content.Subject != "Your Tickets for Rock & <Roll>" {
+		t.Errorf("subject: got %q", content.Subject)
+	}
+	if !strings.Contains(content.Text, "Rock & <Roll>") || strings.Contains(content.Text, "&amp;") {
+		t.Errorf("expected the text body unescaped, got %q", content.Text)
+	}
+	if !strings.Contains(content.HTML, "Rock &amp; &lt;Roll&gt;") || strings.Contains(content.HTML, "<Roll>") {
+		t.Errorf("expected the title escaped in HTML, got %q", content.HTML)
+	}
+	if !strings.Contains(content.HTML, `src="cid:qrcode_0"`) || !strings.Contains(content.Text, "Sun, Mar 1, 2026 7:30 PM") {
+		t.Errorf("expected the QR image and start time, got %q / %q", content.HTML, content.Text)
+	}
+
+	if !strings.Contains(content.Text, "The Carneau Engine Team") || !strings.Contains(content.HTML, "#111827") {
+		t.Errorf("expected the default sign-off and colour, got %q / %q", content.Text, content.HTML)
+	}
+
+	if _, err := mailer.Render("nope", mailer.Branding{}, nil); err == nil {
+		t.Error("expected an unknown template to fail")
+	}
+}
+
+func TestRender_Branding(t *testing.T) {
+	brand := mailer.Branding{
+		SenderName: "Mike's <Gigs>",
+		ReplyTo:    "box@mikesgigs.example",
+		LogoURL:    "https://mikesgigs.example/logo.png",
+		Colour:     "#ff6600",
+		Footer:     "Mike's Gigs Ltd\n1 High Street",
+	}
+	content, err := mailer.Render("ticket_confirmation", brand, confirmation{
+		Recipient: "ada@example.com",
+		Event:     event{Title: "Gig", StartTime: time.Date(2026, 3, 1, 19, 30, 0, 0, time.UTC)},
+		Tickets:   []ticket{{TypeName: "GA", QR: "CT1.x"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"Mike's <Gigs>", "Mike's Gigs Ltd\n1 High Street"} {
+		if !strings.Contains(content.Text, want) {
+			t.Errorf("expected %q in the text body, got %q", want, content.Text)
+		}
+	}
+	for _, want := range []string{"Mike&#39;s &lt;Gigs&gt;", `src="https://mikesgigs.example/logo.png"`, "#ff6600", "1 High Street"} {
+		if !strings.Contains(content.HTML, want) {
+			t.Errorf("expected %q in the HTML body, got %q", want, content.HTML)
+		}
+	}
+
+	// Renders don't leak branding into each other
+	plain, err := mailer.Render("ticket_confirmation", mailer.Branding{}, confirmation{Event: event{Title: "Gig"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(plain.HTML, "Mike") || strings.Contains(plain.HTML, "#ff6600") {
+		t.Errorf("expected no branding in an unbranded render, got %q", plain.HTML)
+	}
+
+	msg := content.Message("ada@example.com")
+	if msg.From.Name != "Mike's <Gigs>" || msg.ReplyTo != "box@mikesgigs.example" {
+		t.Errorf("expected the branded sender and reply-to, got %q / %q", msg.From.Name, msg.ReplyTo)
+	}
+}
+
+func TestFileMailer(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "mail")
+	m, err := mailer.NewFileMailer(dir, mail.Address{Name: "Carneau Engine", Address: "tickets@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, to := range []string{"ada@example.com", "bob@example.com"} {
+		if err := m.Send(context.Background(), &mailer.Message{To: to, Subject: "Hi", Text: "Hello"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sent := m.Sent()
+	if len(sent) != 2 || filepath.Ext(sent[0]) != ".eml" {
+		t.Fatalf("expected 2 .eml files, got %v", sent)
+	}
+	raw, err := os.ReadFile(sent[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, _ := parts(t, raw)
+	if got := msg.Header.Get("To"); got != "<bob@example.com>" {
+		t.Errorf("expected the second file to be to bob, got %q", got)
+	}
+	if got := msg.Header.Get("From"); got != `"Carneau Engine" <tickets@example.com>` {
+		t.Errorf("expected the mailer's sender, got %q", got)
+	}
+}
+
+func TestRender_EventReminder(t *testing.T) {
+	content, err := mailer.Render("event_reminder", mailer.Branding{}, struct {
+		Recipient string
+		StartsIn  string
+		MapURL    string
+		Event     event
+		Tickets   []ticket
+	}{
+		Recipient: "ada@example.com",
+		StartsIn:  "2 hours",
+		MapURL:    "https://maps.example/?q=Town+Hall",
+		Event:     event{Title: "Gig", Location: "Town Hall", StartTime: time.Date(2026, 3, 1, 19, 30, 0, 0, time.UTC)},
+		Tickets:   []ticket{{TypeName: "GA", QR: "CT1.x", ImageSrc: "cid:qrcode_0"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content.Subject != "Reminder: Gig starts in 2 hours" {
+		t.Errorf("subject: got %q", content.Subject)
+	}
+	if !strings.Contains(content.Text, "Venue: Town Hall") || !strings.Contains(content.Text, "- GA: CT1.x") {
+		t.Errorf("expected the venue and ticket in the text body, got %q", content.Text)
+	}
+	if !strings.Contains(content.HTML, `href="https://maps.example/?q=Town&#43;Hall"`) || !strings.Contains(content.HTML, `src="cid:qrcode_0"`) {
+		t.Errorf("expected the map link and QR image in the HTML, got %q", content.HTML)
+	}
+}
+
+func TestRender_BroadcastEscapesBody(t *testing.T) {
+	content, err := mailer.Render("broadcast", mailer.Branding{}, struct {
+		Subject string
+		Body    string
+		Event   event
+	}{
+		Subject: "Venue change",
+		Body:    "We've moved.\n<script>alert(1)</script>",
+		Event:   event{Title: "Gig", StartTime: time.Date(2026, 3, 1, 19, 30, 0, 0, time.UTC)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content.Subject != "Gig: Venue change" {
+		t.Errorf("subject: got %q", content.Subject)
+	}
+	if strings.Contains(content.HTML, "<script>") || !strings.Contains(content.HTML, "&lt;script&gt;") {
+		t.Errorf("expected the body escaped in HTML, got %q", content.HTML)
+	}
+	if !strings.Contains(content.Text, "We've moved.\n<script>") {
+		t.Errorf("expected the body as written in the text, got %q", content.Text)
+	}
+}
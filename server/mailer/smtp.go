@@ -0,0 +1,38 @@
+package mailer
+
+import (
+	"context"
+	"net"
+	"net/mail"
+	"net/smtp"
+)
+
+// SMTPMailer sends messages through an SMTP server.
+type SMTPMailer struct {
+	addr string
+	auth smtp.Auth
+	from mail.Address
+}
+
+// NewSMTPMailer returns a mailer that sends through host:port, logging in as
+// user, from the given sender.
+func NewSMTPMailer(host, port, user, password string, from mail.Address) *SMTPMailer {
+	return &SMTPMailer{
+		addr: net.JoinHostPort(host, port),
+		auth: smtp.PlainAuth("", user, password, host),
+		from: from,
+	}
+}
+
+func (m *SMTPMailer) Send(ctx context.Context, msg *Message) error {
+	msg = msg.withSender(m.from)
+	raw, err := msg.Bytes()
+	if err != nil {
+		return err
+	}
+	to, err := mail.ParseAddress(msg.To)
+	if err != nil {
+		return err
+	}
+	return smtp.SendMail(m.addr, m.auth, msg.From.Address, []string{to.Address}, raw)
+}
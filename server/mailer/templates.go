@@ -0,0 +1,134 @@
+package mailer
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	htmltemplate "html/template"
+	"net/mail"
+	"strings"
+	texttemplate "text/template"
+	"time"
+)
+
+// Each email is a pair of templates in templates/: NAME.txt, whose "subject"
+// template is the subject line, and NAME.html, which fills in the "content" of
+// layout.html. Both get the same data, and the sender's Branding from the
+// brand function.
+//
+//go:embed templates
+var templateFS embed.FS
+
+var funcs = map[string]any{
+	"datetime": func(t time.Time) string { return t.Format("Mon, Jan 2, 2006 3:04 PM") },
+	"brand":    func() Branding { return Branding{} }, // replaced for each render
+}
+
+// Branding is how an organisation's emails look and who they come from. Empty
+// fields fall back to the Carneau Engine defaults.
+type Branding struct {
+	SenderName string // the From name, and who the email is signed by
+	ReplyTo    string
+	LogoURL    string
+	Colour     string // accent colour, as #rgb or #rrggbb
+	Footer     string
+}
+
+// SignOff is who the email is signed by.
+func (b Branding) SignOff() string {
+	if b.SenderName != "" {
+		return b.SenderName
+	}
+	return "The Carneau Engine Team"
+}
+
+// AccentColour is the colour the HTML is accented with.
+func (b Branding) AccentColour() string {
+	if b.Colour != "" {
+		return b.Colour
+	}
+	return "#111827"
+}
+
+type emailTemplate struct {
+	text *texttemplate.Template
+	html *htmltemplate.Template
+}
+
+var templates = map[string]emailTemplate{}
+
+func init() {
+	names, err := templateFS.ReadDir("templates")
+	if err != nil {
+		panic(err)
+	}
+	for _, entry := range names {
+		name, ok := strings.CutSuffix(entry.Name(), ".txt")
+		if !ok {
+			continue
+		}
+		templates[name] = emailTemplate{
+			text: texttemplate.Must(texttemplate.New(entry.Name()).Funcs(funcs).ParseFS(templateFS, "templates/"+name+".txt")),
+			html: htmltemplate.Must(htmltemplate.New("layout.html").Funcs(funcs).ParseFS(templateFS, "templates/layout.html", "templates/"+name+".html")),
+		}
+	}
+}
+
+// Content is a rendered email, ready to go in a Message.
+type Content struct {
+	Subject string
+	Text    string
+	HTML    string
+	Brand   Branding
+}
+
+// Render renders the email called name with data, branded with brand.
+func Render(name string, brand Branding, data any) (Content, error) {
+	t, ok := templates[name]
+	if !ok {
+		return Content{}, fmt.Errorf("mailer: no email template %q", name)
+	}
+	// The parsed templates are never executed themselves, so they can be cloned
+	// to bind this render's branding
+	brandFunc := map[string]any{"brand": func() Branding { return brand }}
+	textT, err := t.text.Clone()
+	if err != nil {
+		return Content{}, err
+	}
+	htmlT, err := t.html.Clone()
+	if err != nil {
+		return Content{}, err
+	}
+	textT.Funcs(brandFunc)
+	htmlT.Funcs(brandFunc)
+
+	var subject, text, html bytes.Buffer
+	if err := textT.ExecuteTemplate(&subject, "subject", data); err != nil {
+		return Content{}, fmt.Errorf("mailer: rendering subject of %s: %w", name, err)
+	}
+	if err := textT.Execute(&text, data); err != nil {
+		return Content{}, fmt.Errorf("mailer: rendering text of %s: %w", name, err)
+	}
+	if err := htmlT.Execute(&html, data); err != nil {
+		return Content{}, fmt.Errorf("mailer: rendering HTML of %s: %w", name, err)
+	}
+	return Content{
+		Subject: strings.Join(strings.Fields(subject.String()), " "),
+		Text:    strings.TrimSpace(text.String()) + "\n",
+		HTML:    html.String(),
+		Brand:   brand,
+	}, nil
+}
+
+// Message makes a message to the given address from the content, from and
+// replied to as its branding says.
+func (c Content) Message(to string) *Message {
+	return &Message{
+		From:    mail.Address{Name: c.Brand.SenderName},
+		To:      to,
+		ReplyTo: c.Brand.ReplyTo,
+		Subject: c.Subject,
+		Text:    c.Text,
+		HTML:    c.HTML,
+	}
+}
@@ -3,6 +3,8 @@ package main
 import (
 	"context"
 	"log"
+	"net/http"
+	"net/mail"
 	"os"
 	"time"
 
@@ -13,6 +15,11 @@ import (
 	"github.com/stripe/stripe-go/v83"
 	"github.com/tpgcig/carneauengine/server/db"
 	"github.com/tpgcig/carneauengine/server/handlers"
+	"github.com/tpgcig/carneauengine/server/mailer"
+	"github.com/tpgcig/carneauengine/server/outbox"
+	"github.com/tpgcig/carneauengine/server/payment"
+	"github.com/tpgcig/carneauengine/server/qrtoken"
+	"github.com/tpgcig/carneauengine/server/reservation"
 )
 
 func init() {
@@ -48,25 +55,156 @@ func main() {
 	}
 	defer rdb.Close()
 
-	h := handlers.NewHandler(conn, rdb);
+	// PAYMENT_GATEWAY=fake takes payments through a local stand-in for Stripe,
+	// so checkout can be run end to end without network access
+	var payments payment.Gateway
+	var fakeGateway *payment.FakeGateway
+	if os.Getenv("PAYMENT_GATEWAY") == "fake" {
+		fakeGateway = payment.NewFakeGateway("http://localhost:8080/fake-pay", "http://localhost:8080/stripe-webhook", os.Getenv("FAKE_GATEWAY_SECRET"))
+		payments = fakeGateway
+		log.Println("Using the fake payment gateway")
+	} else {
+		payments = payment.NewStripeGateway(os.Getenv("STRIPE_WEBHOOK_SECRET"))
+	}
+
+	// Ticket QR codes are signed with TICKET_SIGNING_KEY. When rotating it, move
+	// the old key's public half into TICKET_VERIFY_KEYS so issued tickets still scan.
+	var ticketSigner *qrtoken.Signer
+	var ticketKeys *qrtoken.Keyring
+	if key := os.Getenv("TICKET_SIGNING_KEY"); key != "" {
+		ticketSigner, ticketKeys, err = qrtoken.Load(key, os.Getenv("TICKET_VERIFY_KEYS"))
+		if err != nil {
+			log.Fatalf("Loading ticket signing keys failed: %v", err)
+		}
+	} else {
+		log.Println("TICKET_SIGNING_KEY not set; signing tickets with a temporary key that won't survive a restart")
+		ticketSigner, err = qrtoken.GenerateSigner("dev")
+		if err != nil {
+			log.Fatalf("Generating ticket signing key failed: %v", err)
+		}
+		ticketKeys = qrtoken.NewKeyring()
+		if err := ticketKeys.Add(ticketSigner.KeyID(), ticketSigner.PublicKey()); err != nil {
+			log.Fatalf("Adding ticket verify key failed: %v", err)
+		}
+	}
+
+	// MAILER=file writes emails to .eml files in MAIL_DIR instead of sending
+	// them, for reading and testing them locally. Otherwise they go by SMTP, if
+	// it's configured.
+	sender := mail.Address{Name: os.Getenv("SENDER_NAME"), Address: os.Getenv("SENDER_EMAIL")}
+	if sender.Name == "" {
+		sender.Name = "Carneau Engine"
+	}
+	var emails mailer.Mailer
+	smtpHost, smtpPort, smtpUser, smtpPassword := os.Getenv("SMTP_HOST"), os.Getenv("SMTP_PORT"), os.Getenv("SMTP_USER"), os.Getenv("SMTP_PASSWORD")
+	switch {
+	case os.Getenv("MAILER") == "file":
+		dir := os.Getenv("MAIL_DIR")
+		if dir == "" {
+			dir = "mail"
+		}
+		if sender.Address == "" {
+			sender.Address = "tickets@localhost"
+		}
+		fileMailer, err := mailer.NewFileMailer(dir, sender)
+		if err != nil {
+			log.Fatalf("Creating mail directory failed: %v", err)
+		}
+		emails = fileMailer
+		log.Printf("Writing emails to %s instead of sending them", dir)
+	case smtpHost != "" && smtpPort != "" && smtpUser != "" && smtpPassword != "" && sender.Address != "":
+		emails = mailer.NewSMTPMailer(smtpHost, smtpPort, smtpUser, smtpPassword, sender)
+	default:
+		log.Println("SMTP environment variables not fully configured. Emails will not be sent.")
+	}
+
+	h := handlers.NewHandler(conn, rdb, payments, ticketSigner, ticketKeys, emails);
+
+	// Give back ticket holds for buyers who abandoned checkout
+	go reservation.RunReaper(context.Background(), h.Reservations, 30*time.Second)
+
+	// Deliver the side effects the webhook queues: hold releases and ticket emails
+	worker := outbox.NewWorker(conn)
+	h.RegisterJobs(worker)
+	go worker.Run(context.Background(), 5*time.Second)
+
+	// Queue reminder emails as events come up
+	go h.RunReminders(context.Background(), time.Minute)
+
+	// Finish refunds a failed request left pending
+	go h.RunRefundRecovery(context.Background(), time.Minute)
 
 	// Public routes
 	r.GET("/api/events", h.GetSummarisedEvents)
 	r.GET("/api/events/:id", h.GetEvent)
+	r.GET("/api/events/:id/questions", h.GetRegistrationQuestions)
+	r.GET("/api/ticket-keys", h.GetTicketKeys)
 	r.POST("/api/ticketTypes", h.GetTicketTypes)
 	r.POST("/register", h.Register)
 	r.POST("/login", h.Login)
 	r.POST("/create-checkout-session", h.CreateCheckoutSession) // Moved to public
 	r.GET("/api/purchases/:stripeSessionId", h.GetPurchaseByStripeSessionID) // New endpoint for purchase details
+	r.GET("/api/reservations/:id", h.GetReservation)
+	r.DELETE("/api/reservations/:id", h.CancelReservation)
+	r.POST("/api/reservations/:id/extend", h.ExtendReservation)
+
+	// Transfers are accepted by the token emailed to the recipient, who may
+	// not have an account yet
+	r.GET("/api/transfers/:token", h.GetTicketTransfer)
+	r.POST("/api/transfers/:token/accept", h.AcceptTicketTransfer)
+
+	// Guests get back to their tickets through a single-use link emailed to them
+	r.POST("/api/tickets/lookup", h.RequestTicketLookup)
+	r.POST("/api/tickets/lookup/:token", h.RedeemTicketLookup)
 
 	// Stripe webhook is public as it's called by Stripe
 	r.POST("/stripe-webhook", h.StripeWebhook)
 
+	// The fake gateway's hosted pay page, standing in for Stripe Checkout
+	if fakeGateway != nil {
+		r.Any("/fake-pay/*path", gin.WrapH(http.StripPrefix("/fake-pay", fakeGateway)))
+	}
+
 	// Protected routes (require authentication)
 	protected := r.Group("/")
 	protected.Use(handlers.AuthMiddleware())
 	{
 		// Add other protected routes here later, e.g., for user profile, managing events
+		protected.GET("/api/my-tickets", h.GetMyTickets)
+		protected.POST("/api/my-tickets/:id/resend", h.ResendMyTickets)
+
+		// Guests start and cancel transfers with the JWT from their lookup link
+		protected.POST("/api/tickets/transfers", h.StartTicketTransfer)
+		protected.POST("/api/tickets/transfers/cancel", h.CancelTicketTransfer)
+
+		organiser := protected.Group("/")
+		organiser.Use(handlers.RequireRole("organizer"))
+		organiser.POST("/api/purchases/:id/refunds", h.CreateRefund)
+		organiser.GET("/api/disputes", h.GetDisputes)
+		organiser.GET("/api/tickets/:id/history", h.GetTicketHistory)
+		organiser.PUT("/api/events/:id/transfer-policy", h.UpdateTransferPolicy)
+		organiser.PUT("/api/events/:id/reminders", h.UpdateReminderPolicy)
+		organiser.POST("/api/events/:id/questions", h.CreateRegistrationQuestion)
+		organiser.DELETE("/api/events/:id/questions/:questionId", h.DeleteRegistrationQuestion)
+		organiser.GET("/api/events/:id/attendees", h.GetEventAttendees)
+		organiser.POST("/api/events/:id/broadcasts", h.CreateBroadcast)
+		organiser.GET("/api/events/:id/broadcasts", h.GetBroadcasts)
+		organiser.GET("/api/events/:id/broadcasts/:broadcastId", h.GetBroadcast)
+		organiser.GET("/api/organisations/:id/email-branding", h.GetEmailBranding)
+		organiser.PUT("/api/organisations/:id/email-branding", h.UpdateEmailBranding)
+		organiser.GET("/api/organisations/:id/email-preview", h.PreviewEmail)
+
+		// Door staff scan tickets for the organisations they are members of
+		scanner := protected.Group("/")
+		scanner.Use(handlers.RequireRole("organizer", "staff"))
+		scanner.POST("/api/tickets/verify", h.VerifyTicket)
+		scanner.GET("/api/events/:id/scan-manifest", h.GetScanManifest)
+		scanner.POST("/api/events/:id/scans\\:batch", h.SyncScans) // the colon is literal: /scans:batch
+
+		admin := protected.Group("/api/admin")
+		admin.Use(handlers.RequireRole("admin"))
+		admin.GET("/outbox", h.GetOutboxJobs)
+		admin.POST("/outbox/:id/retry", h.RetryOutboxJob)
 	}
 
 	// Start server on port 8080 (default)
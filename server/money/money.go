@@ -0,0 +1,91 @@
+// Package money represents prices as whole minor units (cents) with a
+// currency, so amounts never pass through floating point on their way between
+// Postgres, our API and Stripe.
+package money
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// minorUnitExp is the number of decimal places in the minor unit. Every
+// currency we sell in has cents; Stripe's unit_amount uses the same scale.
+const minorUnitExp = 2
+
+var (
+	// ErrCurrencyMismatch is returned when adding amounts in different currencies.
+	ErrCurrencyMismatch = errors.New("money: currency mismatch")
+	// ErrSubMinorUnit is returned when a decimal amount has fractions of a cent.
+	ErrSubMinorUnit = errors.New("money: amount is not a whole number of minor units")
+)
+
+// Money is an amount in the currency's minor unit, e.g. 1250 AUD is $12.50.
+type Money struct {
+	Amount   int64  `json:"amount"`
+	Currency string `json:"currency"` // ISO 4217, lower case as Stripe uses it
+}
+
+// New returns amount minor units of currency.
+func New(amount int64, currency string) Money {
+	return Money{Amount: amount, Currency: strings.ToLower(currency)}
+}
+
+// FromNumeric converts a Postgres numeric, such as ticket_types.price, into
+// Money. It fails rather than rounding if the value has fractions of a cent.
+func FromNumeric(n pgtype.Numeric, currency string) (Money, error) {
+	if !n.Valid || n.NaN || n.InfinityModifier != pgtype.Finite {
+		return Money{}, fmt.Errorf("money: cannot convert numeric %v", n)
+	}
+
+	amount := new(big.Int).Set(n.Int)
+	exp := int64(n.Exp) + minorUnitExp
+	if exp >= 0 {
+		amount.Mul(amount, new(big.Int).Exp(big.NewInt(10), big.NewInt(exp), nil))
+	} else {
+		var rem big.Int
+		amount.QuoRem(amount, new(big.Int).Exp(big.NewInt(10), big.NewInt(-exp), nil), &rem)
+		if rem.Sign() != 0 {
+			return Money{}, ErrSubMinorUnit
+		}
+	}
+	if !amount.IsInt64() {
+		return Money{}, fmt.Errorf("money: %v overflows int64 minor units", n)
+	}
+	return New(amount.Int64(), currency), nil
+}
+
+// Numeric returns the amount in major units for storing in a numeric column.
+func (m Money) Numeric() pgtype.Numeric {
+	return pgtype.Numeric{Int: big.NewInt(m.Amount), Exp: -minorUnitExp, Valid: true}
+}
+
+// Mul returns the price of n of something costing m.
+func (m Money) Mul(n int) Money {
+	return Money{Amount: m.Amount * int64(n), Currency: m.Currency}
+}
+
+// Add returns m + o. Both must be in the same currency.
+func (m Money) Add(o Money) (Money, error) {
+	if m.Currency != o.Currency {
+		return Money{}, ErrCurrencyMismatch
+	}
+	return Money{Amount: m.Amount + o.Amount, Currency: m.Currency}, nil
+}
+
+// Decimal formats the amount in major units, e.g. "12.50".
+func (m Money) Decimal() string {
+	sign, amount := "", m.Amount
+	if amount < 0 {
+		sign, amount = "-", -amount
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, amount/100, amount%100)
+}
+
+// String formats the amount with its currency code, e.g. "12.50 AUD".
+func (m Money) String() string {
+	return m.Decimal() + " " + strings.ToUpper(m.Currency)
+}
@@ -0,0 +1,72 @@
+package money_test
+
+import (
+	"errors"
+	"math/big"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgtype"
+
+	"github.com/tpgcig/carneauengine/server/money"
+)
+
+func numeric(digits int64, exp int32) pgtype.Numeric {
+	return pgtype.Numeric{Int: big.NewInt(digits), Exp: exp, Valid: true}
+}
+
+func TestFromNumeric(t *testing.T) {
+	cases := []struct {
+		name string
+		in   pgtype.Numeric
+		want int64
+	}{
+		{"two decimals", numeric(1999, -2), 1999},
+		{"whole dollars", numeric(25, 0), 2500},
+		{"trailing zeros", numeric(12500, -3), 1250},
+		// 0.1 + 0.2 style values are where float64 cents went wrong
+		{"float trap", numeric(29, -2), 29},
+	}
+	for _, tc := range cases {
+		got, err := money.FromNumeric(tc.in, "AUD")
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if got.Amount != tc.want || got.Currency != "aud" {
+			t.Errorf("%s: expected %d aud, got %d %s", tc.name, tc.want, got.Amount, got.Currency)
+		}
+	}
+}
+
+func TestFromNumeric_RejectsFractionsOfACent(t *testing.T) {
+	if _, err := money.FromNumeric(numeric(10005, -3), "aud"); !errors.Is(err, money.ErrSubMinorUnit) {
+		t.Fatalf("expected ErrSubMinorUnit, got %v", err)
+	}
+}
+
+func TestNumericRoundTrip(t *testing.T) {
+	m := money.New(4567, "aud")
+	got, err := money.FromNumeric(m.Numeric(), m.Currency)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != m {
+		t.Errorf("expected %v, got %v", m, got)
+	}
+}
+
+func TestAddAndMul(t *testing.T) {
+	total, err := money.New(1010, "aud").Mul(3).Add(money.New(5, "aud"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total.Amount != 3035 {
+		t.Errorf("expected 3035, got %d", total.Amount)
+	}
+	if total.String() != "30.35 AUD" {
+		t.Errorf("expected 30.35 AUD, got %s", total)
+	}
+
+	if _, err := money.New(100, "aud").Add(money.New(100, "nzd")); !errors.Is(err, money.ErrCurrencyMismatch) {
+		t.Errorf("expected ErrCurrencyMismatch, got %v", err)
+	}
+}
@@ -0,0 +1,171 @@
+// Package outbox runs side effects of a database change, such as emailing a
+// buyer or releasing Redis holds, reliably. Jobs are written to the outbox
+// table in the same transaction as the change, so they exist exactly when it
+// committed, and a Worker delivers them afterwards with retries. Jobs that
+// keep failing are parked as dead until someone retries them.
+package outbox
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// Job statuses.
+const (
+	StatusPending = "pending" // waiting for RunAt
+	StatusRunning = "running" // claimed by a worker until LockedUntil
+	StatusDone    = "done"
+	StatusDead    = "dead" // gave up; needs Retry
+)
+
+// DefaultMaxAttempts is how many times a job is tried before it is dead.
+const DefaultMaxAttempts = 10
+
+var (
+	// ErrNotFound is returned by Get and Retry for unknown jobs.
+	ErrNotFound = errors.New("outbox: job not found")
+	// ErrRunning is returned by Retry for a job a worker is running right now.
+	ErrRunning = errors.New("outbox: job is running")
+)
+
+// Job is one side effect waiting in, or delivered from, the outbox.
+type Job struct {
+	ID          int             `json:"id"`
+	Kind        string          `json:"kind"`
+	Payload     json.RawMessage `json:"payload"`
+	Status      string          `json:"status"`
+	Attempts    int             `json:"attempts"`
+	MaxAttempts int             `json:"max_attempts"`
+	RunAt       time.Time       `json:"run_at"`
+	LastError   string          `json:"last_error,omitempty"`
+	CreatedAt   time.Time       `json:"created_at"`
+	UpdatedAt   time.Time       `json:"updated_at"`
+	DoneAt      *time.Time      `json:"done_at,omitempty"`
+}
+
+// Execer is satisfied by pgx transactions and pools.
+type Execer interface {
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+}
+
+// Querier is satisfied by pgx transactions and pools.
+type Querier interface {
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
+// Enqueue adds a job of the given kind to the outbox. Pass the transaction
+// making the change the job belongs to, so the job only exists if it commits.
+// payload is stored as JSON and handed to the kind's HandlerFunc.
+func Enqueue(ctx context.Context, db Execer, kind string, payload any) error {
+	return EnqueueAfter(ctx, db, kind, payload, 0)
+}
+
+// EnqueueAfter is Enqueue for a job that shouldn't run until delay has
+// passed, for spreading out jobs that would otherwise all run at once.
+func EnqueueAfter(ctx context.Context, db Execer, kind string, payload any, delay time.Duration) error {
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("outbox: encoding %s payload: %w", kind, err)
+	}
+	_, err = db.Exec(ctx,
+		"INSERT INTO outbox (kind, payload, max_attempts, run_at) VALUES ($1, $2, $3, now() + make_interval(secs => $4))",
+		kind, string(raw), DefaultMaxAttempts, delay.Seconds(),
+	)
+	return err
+}
+
+const jobColumns = `id, kind, payload::text, status, attempts, max_attempts, run_at,
+	COALESCE(last_error, ''), created_at, updated_at, done_at`
+
+func scanJob(row pgx.Row) (Job, error) {
+	var j Job
+	var payload string
+	err := row.Scan(&j.ID, &j.Kind, &payload, &j.Status, &j.Attempts, &j.MaxAttempts, &j.RunAt,
+		&j.LastError, &j.CreatedAt, &j.UpdatedAt, &j.DoneAt)
+	j.Payload = json.RawMessage(payload)
+	return j, err
+}
+
+// List returns up to limit jobs, newest first. An empty status lists jobs in
+// every status.
+func List(ctx context.Context, db Querier, status string, limit int) ([]Job, error) {
+	rows, err := db.Query(ctx, `
+		SELECT `+jobColumns+`
+		FROM outbox
+		WHERE $1 = '' OR status = $1
+		ORDER BY id DESC
+		LIMIT $2`, status, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	jobs := []Job{}
+	for rows.Next() {
+		j, err := scanJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, j)
+	}
+	return jobs, rows.Err()
+}
+
+// Get returns one job.
+func Get(ctx context.Context, db Querier, id int) (Job, error) {
+	j, err := scanJob(db.QueryRow(ctx, "SELECT "+jobColumns+" FROM outbox WHERE id = $1", id))
+	if err == pgx.ErrNoRows {
+		return j, ErrNotFound
+	}
+	return j, err
+}
+
+// Retry queues a job to run again straight away with a fresh set of
+// attempts. It is meant for dead jobs, once whatever killed them is fixed,
+// but also re-runs done ones.
+func Retry(ctx context.Context, db Querier, id int) (Job, error) {
+	j, err := scanJob(db.QueryRow(ctx, `
+		UPDATE outbox
+		SET status = 'pending', attempts = 0, run_at = now(), locked_until = NULL, updated_at = now()
+		WHERE id = $1 AND status <> 'running'
+		RETURNING `+jobColumns, id))
+	if err != pgx.ErrNoRows {
+		return j, err
+	}
+	if _, err := Get(ctx, db, id); err != nil {
+		return j, err
+	}
+	return j, ErrRunning
+}
+
+// Backoff is how long to wait before the next try of a job that has failed
+// attempts times: 10 seconds, doubling each time, up to an hour.
+func Backoff(attempts int) time.Duration {
+	d := 10 * time.Second
+	for i := 1; i < attempts && d < time.Hour; i++ {
+		d *= 2
+	}
+	if d > time.Hour {
+		d = time.Hour
+	}
+	return d
+}
+
+// permanentError marks a failure that retrying won't fix.
+type permanentError struct{ err error }
+
+func (e permanentError) Error() string { return e.err.Error() }
+func (e permanentError) Unwrap() error { return e.err }
+
+// Permanent wraps err so the worker kills the job at once instead of retrying
+// it, e.g. for a payload that can't be decoded.
+func Permanent(err error) error {
+	return permanentError{err}
+}
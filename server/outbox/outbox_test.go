@@ -0,0 +1,239 @@
+package outbox_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/tpgcig/carneauengine/server/outbox"
+)
+
+func newTestDB(t *testing.T) *pgxpool.Pool {
+	t.Helper()
+	dbURL := os.Getenv("TEST_DATABASE_URL")
+	if dbURL == "" {
+		t.Skip("TEST_DATABASE_URL not set — skipping")
+	}
+	pool, err := pgxpool.New(context.Background(), dbURL)
+	if err != nil {
+		t.Skipf("Postgres not reachable — skipping: %v", err)
+	}
+	if err := pool.Ping(context.Background()); err != nil {
+		pool.Close()
+		t.Skipf("Postgres not reachable — skipping: %v", err)
+	}
+	t.Cleanup(pool.Close)
+	return pool
+}
+
+// enqueue adds a job of a kind unique to the test, so other tests' jobs in the
+// same database are left alone, and returns the kind and the job.
+func enqueue(t *testing.T, db *pgxpool.Pool, payload any) (string, outbox.Job) {
+	t.Helper()
+	ctx := context.Background()
+	kind := "test_" + uuid.New().String()
+	if err := outbox.Enqueue(ctx, db, kind, payload); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Exec(ctx, "DELETE FROM outbox WHERE kind = $1", kind) })
+
+	var id int
+	if err := db.QueryRow(ctx, "SELECT id FROM outbox WHERE kind = $1", kind).Scan(&id); err != nil {
+		t.Fatal(err)
+	}
+	job, err := outbox.Get(ctx, db, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return kind, job
+}
+
+// runDue makes a job due now, whatever its backoff, and runs the worker.
+func runDue(t *testing.T, w *outbox.Worker, id int) outbox.Job {
+	t.Helper()
+	ctx := context.Background()
+	if _, err := w.DB.Exec(ctx, "UPDATE outbox SET run_at = now() WHERE id = $1 AND status = 'pending'", id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.RunOnce(ctx); err != nil {
+		t.Fatal(err)
+	}
+	job, err := outbox.Get(ctx, w.DB, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return job
+}
+
+func TestBackoff(t *testing.T) {
+	for _, tc := range []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, 10 * time.Second},
+		{2, 20 * time.Second},
+		{4, 80 * time.Second},
+		{9, 2560 * time.Second},
+		{10, time.Hour},
+		{50, time.Hour},
+	} {
+		if got := outbox.Backoff(tc.attempts); got != tc.want {
+			t.Errorf("Backoff(%d) = %s, want %s", tc.attempts, got, tc.want)
+		}
+	}
+}
+
+func TestWorker_DeliversJob(t *testing.T) {
+	db := newTestDB(t)
+	kind, job := enqueue(t, db, map[string]int{"purchase_id": 7})
+
+	var got map[string]int
+	w := outbox.NewWorker(db)
+	w.Handle(kind, func(ctx context.Context, payload json.RawMessage) error {
+		return json.Unmarshal(payload, &got)
+	})
+
+	job = runDue(t, w, job.ID)
+	if job.Status != outbox.StatusDone || job.DoneAt == nil || job.Attempts != 1 {
+		t.Errorf("expected job done after one attempt, got %+v", job)
+	}
+	if got["purchase_id"] != 7 {
+		t.Errorf("expected the handler to get the payload, got %v", got)
+	}
+}
+
+// TestWorker_LeasesEachJobAsItRuns runs a job that outlasts the lease and
+// checks the job after it still has a lease of its own when it starts.
+func TestWorker_LeasesEachJobAsItRuns(t *testing.T) {
+	db := newTestDB(t)
+	ctx := context.Background()
+	slowKind, slow := enqueue(t, db, struct{}{})
+	nextKind, next := enqueue(t, db, struct{}{})
+	if _, err := db.Exec(ctx, "UPDATE outbox SET run_at = now() - interval '1 minute' WHERE id = ANY($1)", []int{slow.ID, next.ID}); err != nil {
+		t.Fatal(err)
+	}
+
+	w := outbox.NewWorker(db)
+	w.Lease = time.Second
+	w.Handle(slowKind, func(ctx context.Context, payload json.RawMessage) error {
+		time.Sleep(1500 * time.Millisecond)
+		return nil
+	})
+	var leased bool
+	w.Handle(nextKind, func(ctx context.Context, payload json.RawMessage) error {
+		return db.QueryRow(ctx, "SELECT locked_until > now() FROM outbox WHERE id = $1", next.ID).Scan(&leased)
+	})
+
+	if _, err := w.RunOnce(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if !leased {
+		t.Error("expected the second job to be leased when it started")
+	}
+	for _, id := range []int{slow.ID, next.ID} {
+		job, err := outbox.Get(ctx, db, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if job.Status != outbox.StatusDone || job.Attempts != 1 {
+			t.Errorf("expected job %d done after one attempt, got %+v", id, job)
+		}
+	}
+}
+
+func TestWorker_RetriesThenDeadLetters(t *testing.T) {
+	db := newTestDB(t)
+	ctx := context.Background()
+	kind, job := enqueue(t, db, struct{}{})
+	if _, err := db.Exec(ctx, "UPDATE outbox SET max_attempts = 3 WHERE id = $1", job.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	calls := 0
+	w := outbox.NewWorker(db)
+	w.Handle(kind, func(context.Context, json.RawMessage) error {
+		calls++
+		if calls > 3 {
+			return nil
+		}
+		return errors.New("smtp timeout")
+	})
+
+	job = runDue(t, w, job.ID)
+	if job.Status != outbox.StatusPending || job.LastError != "smtp timeout" || !job.RunAt.After(job.UpdatedAt) {
+		t.Errorf("expected job back off after a failure, got %+v", job)
+	}
+	runDue(t, w, job.ID)
+	job = runDue(t, w, job.ID)
+	if job.Status != outbox.StatusDead || job.Attempts != 3 {
+		t.Fatalf("expected job dead after 3 attempts, got %+v", job)
+	}
+
+	// Dead jobs stay put until retried
+	if job = runDue(t, w, job.ID); job.Status != outbox.StatusDead {
+		t.Errorf("expected dead job left alone, got %+v", job)
+	}
+	if job, err := outbox.Retry(ctx, db, job.ID); err != nil || job.Status != outbox.StatusPending || job.Attempts != 0 {
+		t.Fatalf("expected retry to requeue the job, got %+v, %v", job, err)
+	}
+	if job = runDue(t, w, job.ID); job.Status != outbox.StatusDone {
+		t.Errorf("expected retried job done, got %+v", job)
+	}
+}
+
+func TestWorker_PermanentErrorDeadLettersAtOnce(t *testing.T) {
+	db := newTestDB(t)
+	kind, job := enqueue(t, db, struct{}{})
+
+	w := outbox.NewWorker(db)
+	w.Handle(kind, func(context.Context, json.RawMessage) error {
+		return outbox.Permanent(errors.New("bad payload"))
+	})
+
+	if job = runDue(t, w, job.ID); job.Status != outbox.StatusDead || job.Attempts != 1 {
+		t.Errorf("expected job dead after one attempt, got %+v", job)
+	}
+}
+
+func TestRetry_UnknownJob(t *testing.T) {
+	db := newTestDB(t)
+	if _, err := outbox.Retry(context.Background(), db, -1); !errors.Is(err, outbox.ErrNotFound) {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestEnqueueAfter_WaitsForDelay(t *testing.T) {
+	db := newTestDB(t)
+	ctx := context.Background()
+	kind := "test_" + uuid.New().String()
+	if err := outbox.EnqueueAfter(ctx, db, kind, map[string]int{}, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Exec(ctx, "DELETE FROM outbox WHERE kind = $1", kind) })
+	var id int
+	if err := db.QueryRow(ctx, "SELECT id FROM outbox WHERE kind = $1", kind).Scan(&id); err != nil {
+		t.Fatal(err)
+	}
+
+	runs := 0
+	w := outbox.NewWorker(db)
+	w.Handle(kind, func(context.Context, json.RawMessage) error {
+		runs++
+		return nil
+	})
+	if _, err := w.RunOnce(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if runs != 0 {
+		t.Fatalf("expected the job to wait, but it ran %d time(s)", runs)
+	}
+	if job := runDue(t, w, id); job.Status != outbox.StatusDone || runs != 1 {
+		t.Errorf("expected the job done once due, got %+v after %d run(s)", job, runs)
+	}
+}
@@ -0,0 +1,176 @@
+package outbox
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// HandlerFunc delivers one job. Returning an error retries the job later,
+// unless it is wrapped with Permanent. Jobs can run more than once, e.g. if
+// the worker dies before recording success, so handlers must be idempotent.
+type HandlerFunc func(ctx context.Context, payload json.RawMessage) error
+
+// Worker claims due jobs from the outbox and runs them. Several workers can
+// share one outbox; each job is claimed by one at a time.
+type Worker struct {
+	DB        *pgxpool.Pool
+	BatchSize int           // most jobs run per poll
+	Lease     time.Duration // how long a job may run before another worker may take it over
+
+	handlers map[string]HandlerFunc
+}
+
+// NewWorker returns a worker with no handlers registered.
+func NewWorker(db *pgxpool.Pool) *Worker {
+	return &Worker{
+		DB:        db,
+		BatchSize: 20,
+		Lease:     2 * time.Minute,
+		handlers:  make(map[string]HandlerFunc),
+	}
+}
+
+// Handle registers the handler for jobs of a kind.
+func (w *Worker) Handle(kind string, fn HandlerFunc) {
+	w.handlers[kind] = fn
+}
+
+// Run polls for due jobs every interval until ctx is done.
+func (w *Worker) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			// Keep going while there's a backlog, rather than one batch per tick
+			for {
+				n, err := w.RunOnce(ctx)
+				if err != nil {
+					log.Printf("Error running outbox jobs: %v", err)
+				}
+				if err != nil || n < w.BatchSize {
+					break
+				}
+			}
+		}
+	}
+}
+
+type claimedJob struct {
+	id          int
+	kind        string
+	payload     json.RawMessage
+	attempts    int
+	maxAttempts int
+}
+
+// RunOnce runs due jobs, up to BatchSize, and returns how many it ran. Jobs
+// are claimed one at a time, just before they run, so each gets its whole
+// lease however long the ones before it took. Jobs whose worker died mid-run
+// are taken over once their lease runs out.
+func (w *Worker) RunOnce(ctx context.Context) (int, error) {
+	n := 0
+	for n < w.BatchSize {
+		j, err := w.claim(ctx)
+		if err != nil {
+			return n, err
+		}
+		if j == nil {
+			break
+		}
+		if err := w.finish(ctx, *j, w.run(ctx, *j)); err != nil {
+			// The lease runs out and another poll picks the job up again
+			log.Printf("Error recording outcome of outbox job %d: %v", j.id, err)
+		}
+		n++
+	}
+	return n, nil
+}
+
+// claim leases the next due job to this worker, or returns nil if none is due.
+func (w *Worker) claim(ctx context.Context) (*claimedJob, error) {
+	var j claimedJob
+	var payload string
+	err := w.DB.QueryRow(ctx, `
+		UPDATE outbox
+		SET status = 'running', attempts = attempts + 1,
+			locked_until = now() + make_interval(secs => $1), updated_at = now()
+		WHERE id = (
+			SELECT id FROM outbox
+			WHERE (status = 'pending' AND run_at <= now())
+				OR (status = 'running' AND locked_until < now())
+			ORDER BY run_at, id
+			LIMIT 1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING id, kind, payload::text, attempts, max_attempts`,
+		w.Lease.Seconds(),
+	).Scan(&j.id, &j.kind, &payload, &j.attempts, &j.maxAttempts)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	j.payload = json.RawMessage(payload)
+	return &j, nil
+}
+
+// run calls a job's handler, stopping it before its lease runs out.
+func (w *Worker) run(ctx context.Context, j claimedJob) (err error) {
+	fn, ok := w.handlers[j.kind]
+	if !ok {
+		return fmt.Errorf("no handler for job kind %q", j.kind)
+	}
+	ctx, cancel := context.WithTimeout(ctx, w.Lease)
+	defer cancel()
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return fn(ctx, j.payload)
+}
+
+// finish records the outcome of running a job: done, back to pending after a
+// backoff, or dead once it has run out of attempts. Nothing is recorded if
+// another worker has taken the job over since, as its outcome is the one
+// that counts.
+func (w *Worker) finish(ctx context.Context, j claimedJob, runErr error) error {
+	if runErr == nil {
+		_, err := w.DB.Exec(ctx, `
+			UPDATE outbox
+			SET status = 'done', done_at = now(), locked_until = NULL, last_error = NULL, updated_at = now()
+			WHERE id = $1 AND status = 'running' AND attempts = $2`, j.id, j.attempts)
+		return err
+	}
+
+	var permanent permanentError
+	if errors.As(runErr, &permanent) || j.attempts >= j.maxAttempts {
+		log.Printf("Outbox job %d (%s) is dead after %d attempt(s): %v", j.id, j.kind, j.attempts, runErr)
+		_, err := w.DB.Exec(ctx, `
+			UPDATE outbox
+			SET status = 'dead', locked_until = NULL, last_error = $2, updated_at = now()
+			WHERE id = $1 AND status = 'running' AND attempts = $3`, j.id, runErr.Error(), j.attempts)
+		return err
+	}
+
+	backoff := Backoff(j.attempts)
+	log.Printf("Outbox job %d (%s) failed, retrying in %s: %v", j.id, j.kind, backoff, runErr)
+	_, err := w.DB.Exec(ctx, `
+		UPDATE outbox
+		SET status = 'pending', run_at = now() + make_interval(secs => $2), locked_until = NULL,
+			last_error = $3, updated_at = now()
+		WHERE id = $1 AND status = 'running' AND attempts = $4`, j.id, backoff.Seconds(), runErr.Error(), j.attempts)
+	return err
+}
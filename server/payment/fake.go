@@ -0,0 +1,429 @@
+package payment
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/tpgcig/carneauengine/server/money"
+)
+
+const (
+	// FakeSignatureHeader carries the fake gateway's webhook signature, in the
+	// same "t=<unix time>,v1=<hex HMAC-SHA256 of "t.payload">" form Stripe uses.
+	FakeSignatureHeader = "Fake-Signature"
+	// fakeSignatureTolerance is how old a signed callback may be.
+	fakeSignatureTolerance = 5 * time.Minute
+)
+
+// FakeGateway is an in-process stand-in for Stripe. It serves a hosted "pay"
+// page for each session and, when the buyer pays, posts a signed
+// checkout.session.completed callback to WebhookURL, so the whole checkout can
+// run with no network. Mount it under BaseURL with http.StripPrefix.
+type FakeGateway struct {
+	BaseURL    string // where the gateway's pages are served, e.g. http://localhost:8080/fake-pay
+	WebhookURL string // where callbacks are posted
+
+	secret []byte
+	client *http.Client
+	mux    *http.ServeMux
+
+	mu       sync.Mutex
+	sessions map[string]*fakeSession
+	disputes map[string]*Dispute
+	refunds  map[string]Refund // by idempotency key
+}
+
+type fakeSession struct {
+	Session
+	params   SessionParams
+	chargeID string
+	refunded int64
+}
+
+// NewFakeGateway returns a fake gateway that signs callbacks with secret. An
+// empty secret gets a random one, which is fine while the same process both
+// sends and verifies the callbacks.
+func NewFakeGateway(baseURL, webhookURL, secret string) *FakeGateway {
+	key := []byte(secret)
+	if len(key) == 0 {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			panic(err)
+		}
+	}
+	g := &FakeGateway{
+		BaseURL:    strings.TrimSuffix(baseURL, "/"),
+		WebhookURL: webhookURL,
+		secret:     key,
+		client:     &http.Client{Timeout: 10 * time.Second},
+		mux:        http.NewServeMux(),
+		sessions:   make(map[string]*fakeSession),
+		disputes:   make(map[string]*Dispute),
+		refunds:    make(map[string]Refund),
+	}
+	g.mux.HandleFunc("GET /sessions/{id}", g.servePayPage)
+	g.mux.HandleFunc("POST /sessions/{id}", g.handlePayPage)
+	return g
+}
+
+func (g *FakeGateway) CreateSession(ctx context.Context, p SessionParams) (*Session, error) {
+	if len(p.LineItems) == 0 {
+		return nil, fmt.Errorf("payment: session has no line items")
+	}
+	total := p.LineItems[0].UnitPrice.Mul(p.LineItems[0].Quantity)
+	for _, item := range p.LineItems[1:] {
+		var err error
+		if total, err = total.Add(item.UnitPrice.Mul(item.Quantity)); err != nil {
+			return nil, err
+		}
+	}
+
+	id := "cs_fake_" + uuid.New().String()
+	s := &fakeSession{
+		Session: Session{
+			ID:            id,
+			URL:           g.BaseURL + "/sessions/" + id,
+			Status:        SessionOpen,
+			CustomerEmail: p.CustomerEmail,
+			AmountTotal:   total,
+			PaymentID:     "pi_fake_" + uuid.New().String(),
+			Metadata:      p.Metadata,
+		},
+		params:   p,
+		chargeID: "ch_fake_" + uuid.New().String(),
+	}
+
+	g.mu.Lock()
+	g.sessions[id] = s
+	g.mu.Unlock()
+
+	out := s.Session
+	return &out, nil
+}
+
+// Complete pays for a session and delivers its checkout.session.completed
+// callback, as if the buyer had pressed Pay. Integration tests can call it
+// directly instead of going through the page.
+func (g *FakeGateway) Complete(ctx context.Context, sessionID string) error {
+	g.mu.Lock()
+	s, ok := g.sessions[sessionID]
+	if !ok {
+		g.mu.Unlock()
+		return ErrSessionNotFound
+	}
+	if s.Status == SessionOpen && !s.params.ExpiresAt.IsZero() && !time.Now().Before(s.params.ExpiresAt) {
+		s.Status = SessionExpired
+	}
+	if s.Status != SessionOpen {
+		g.mu.Unlock()
+		return fmt.Errorf("payment: session %s is %s", sessionID, s.Status)
+	}
+	s.Status, s.Paid = SessionComplete, true
+	session := s.Session
+	g.mu.Unlock()
+
+	err := g.send(ctx, &Event{ID: "evt_fake_" + uuid.New().String(), Type: EventCheckoutCompleted, Session: &session})
+	if err != nil {
+		// Leave the session payable so the buyer can try again
+		g.mu.Lock()
+		s.Status, s.Paid = SessionOpen, false
+		g.mu.Unlock()
+	}
+	return err
+}
+
+func (g *FakeGateway) GetSession(ctx context.Context, sessionID string) (*Session, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	s, ok := g.sessions[sessionID]
+	if !ok {
+		return nil, ErrSessionNotFound
+	}
+	out := s.Session
+	return &out, nil
+}
+
+func (g *FakeGateway) ExpireSession(ctx context.Context, sessionID string) (*Session, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	s, ok := g.sessions[sessionID]
+	if !ok {
+		return nil, ErrSessionNotFound
+	}
+	if s.Status != SessionOpen {
+		return nil, fmt.Errorf("payment: session %s is %s", sessionID, s.Status)
+	}
+	s.Status = SessionExpired
+	session := s.Session
+
+	// Like Stripe, confirm it with a callback after the call returns
+	go func() {
+		if err := g.send(context.Background(), &Event{ID: "evt_fake_" + uuid.New().String(), Type: EventCheckoutExpired, Session: &session}); err != nil {
+			log.Printf("Fake gateway: %v", err)
+		}
+	}()
+
+	out := s.Session
+	return &out, nil
+}
+
+func (g *FakeGateway) ParseWebhook(payload []byte, header http.Header) (*Event, error) {
+	var timestamp int64
+	var signature []byte
+	for _, part := range strings.Split(header.Get(FakeSignatureHeader), ",") {
+		key, value, _ := strings.Cut(part, "=")
+		switch key {
+		case "t":
+			timestamp, _ = strconv.ParseInt(value, 10, 64)
+		case "v1":
+			signature, _ = hex.DecodeString(value)
+		}
+	}
+	if timestamp == 0 || signature == nil {
+		return nil, ErrInvalidSignature
+	}
+	if age := time.Since(time.Unix(timestamp, 0)); age > fakeSignatureTolerance || age < -fakeSignatureTolerance {
+		return nil, ErrInvalidSignature
+	}
+	if !hmac.Equal(signature, g.sign(timestamp, payload)) {
+		return nil, ErrInvalidSignature
+	}
+
+	var e Event
+	if err := json.Unmarshal(payload, &e); err != nil {
+		return nil, fmt.Errorf("payment: decoding fake event: %w", err)
+	}
+	return &e, nil
+}
+
+func (g *FakeGateway) Refund(ctx context.Context, p RefundParams) (*Refund, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	// Like Stripe, a retry with the same key gets the first refund back
+	// rather than refunding again
+	if r, ok := g.refunds[p.IdempotencyKey]; ok && p.IdempotencyKey != "" {
+		return &r, nil
+	}
+
+	for _, s := range g.sessions {
+		if s.PaymentID != p.PaymentID {
+			continue
+		}
+		if !s.Paid {
+			return nil, fmt.Errorf("payment: payment %s has not been taken", p.PaymentID)
+		}
+		remaining := s.AmountTotal.Amount - s.refunded
+		amount := p.Amount.Amount
+		if amount == 0 {
+			amount = remaining
+		}
+		if amount <= 0 || amount > remaining {
+			return nil, fmt.Errorf("payment: cannot refund %d of the %d left on %s", amount, remaining, p.PaymentID)
+		}
+		s.refunded += amount
+
+		// Stripe confirms refunds with a webhook some time after the API call
+		// returns; do the same, so callers can't rely on it arriving first
+		event := &Event{ID: "evt_fake_" + uuid.New().String(), Type: EventChargeRefunded, Charge: &Charge{
+			ID:             s.chargeID,
+			PaymentID:      s.PaymentID,
+			Amount:         s.AmountTotal,
+			AmountRefunded: money.New(s.refunded, s.AmountTotal.Currency),
+		}}
+		go func() {
+			if err := g.send(context.Background(), event); err != nil {
+				log.Printf("Fake gateway: %v", err)
+			}
+		}()
+
+		r := Refund{
+			ID:     "re_fake_" + uuid.New().String(),
+			Amount: money.New(amount, s.AmountTotal.Currency),
+			Status: "succeeded",
+		}
+		if p.IdempotencyKey != "" {
+			g.refunds[p.IdempotencyKey] = r
+		}
+		return &r, nil
+	}
+	return nil, ErrSessionNotFound
+}
+
+// OpenDispute files a chargeback for the whole of a paid payment and delivers
+// its charge.dispute.created callback, as the buyer's bank would.
+func (g *FakeGateway) OpenDispute(ctx context.Context, paymentID, reason string) (*Dispute, error) {
+	g.mu.Lock()
+	var d *Dispute
+	for _, s := range g.sessions {
+		if s.PaymentID == paymentID && s.Paid {
+			d = &Dispute{
+				ID:        "dp_fake_" + uuid.New().String(),
+				ChargeID:  s.chargeID,
+				PaymentID: s.PaymentID,
+				Amount:    s.AmountTotal,
+				Reason:    reason,
+				Status:    DisputeNeedsResponse,
+			}
+			g.disputes[d.ID] = d
+			break
+		}
+	}
+	var dispute Dispute
+	if d != nil {
+		dispute = *d
+	}
+	g.mu.Unlock()
+
+	if d == nil {
+		return nil, ErrSessionNotFound
+	}
+	if err := g.send(ctx, &Event{ID: "evt_fake_" + uuid.New().String(), Type: EventChargeDisputeCreated, Dispute: &dispute}); err != nil {
+		return nil, err
+	}
+	return &dispute, nil
+}
+
+// UpdateDispute moves a dispute to status and delivers the matching
+// charge.dispute.updated or, for won and lost, charge.dispute.closed callback.
+func (g *FakeGateway) UpdateDispute(ctx context.Context, disputeID string, status DisputeStatus) error {
+	g.mu.Lock()
+	d, ok := g.disputes[disputeID]
+	if !ok {
+		g.mu.Unlock()
+		return fmt.Errorf("payment: dispute %s not found", disputeID)
+	}
+	d.Status = status
+	dispute := *d
+	g.mu.Unlock()
+
+	eventType := EventChargeDisputeUpdated
+	if status.Closed() {
+		eventType = EventChargeDisputeClosed
+	}
+	return g.send(ctx, &Event{ID: "evt_fake_" + uuid.New().String(), Type: eventType, Dispute: &dispute})
+}
+
+// ServeHTTP serves the hosted pay page at /sessions/{id}, relative to BaseURL.
+func (g *FakeGateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	g.mux.ServeHTTP(w, r)
+}
+
+var payPage = template.Must(template.New("pay").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Fake checkout</title></head>
+<body style="font-family: sans-serif; max-width: 32em; margin: 3em auto;">
+  <h1>Fake checkout</h1>
+  <p>No money moves here. This page stands in for Stripe in local development.</p>
+  <table>
+    {{range .Items}}<tr><td>{{.Quantity}} &times; {{.Name}}</td><td>{{.UnitPrice.Mul .Quantity}}</td></tr>
+    {{end}}<tr><th>Total</th><th>{{.Total}}</th></tr>
+  </table>
+  <p>Paying as {{.Email}}</p>
+  <form method="post">
+    <button name="action" value="pay">Pay</button>
+    <button name="action" value="cancel">Cancel</button>
+  </form>
+</body>
+</html>
+`))
+
+func (g *FakeGateway) servePayPage(w http.ResponseWriter, r *http.Request) {
+	g.mu.Lock()
+	s, ok := g.sessions[r.PathValue("id")]
+	var data struct {
+		Items []LineItem
+		Total money.Money
+		Email string
+	}
+	if ok {
+		data.Items, data.Total, data.Email = s.params.LineItems, s.AmountTotal, s.CustomerEmail
+	}
+	g.mu.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := payPage.Execute(&buf, data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(buf.Bytes())
+}
+
+func (g *FakeGateway) handlePayPage(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	g.mu.Lock()
+	s, ok := g.sessions[id]
+	var params SessionParams
+	if ok {
+		params = s.params
+	}
+	g.mu.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	if r.FormValue("action") != "pay" {
+		http.Redirect(w, r, params.CancelURL, http.StatusSeeOther)
+		return
+	}
+	if err := g.Complete(r.Context(), id); err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	http.Redirect(w, r, strings.ReplaceAll(params.SuccessURL, SessionIDPlaceholder, id), http.StatusSeeOther)
+}
+
+// send posts a signed event to WebhookURL and fails unless it is accepted.
+func (g *FakeGateway) send(ctx context.Context, e *Event) error {
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, g.WebhookURL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	timestamp := time.Now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(FakeSignatureHeader, fmt.Sprintf("t=%d,v1=%s", timestamp, hex.EncodeToString(g.sign(timestamp, payload))))
+
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("payment: delivering %s: %w", e.Type, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("payment: webhook rejected %s with status %d", e.Type, resp.StatusCode)
+	}
+	return nil
+}
+
+func (g *FakeGateway) sign(timestamp int64, payload []byte) []byte {
+	mac := hmac.New(sha256.New, g.secret)
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
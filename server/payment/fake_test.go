@@ -0,0 +1,308 @@
+package payment_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tpgcig/carneauengine/server/money"
+	"github.com/tpgcig/carneauengine/server/payment"
+)
+
+// callbackRecorder is a webhook endpoint that verifies and keeps every
+// callback the fake gateway sends it.
+type callbackRecorder struct {
+	gateway *payment.FakeGateway
+
+	mu       sync.Mutex
+	events   []*payment.Event
+	payloads [][]byte
+	headers  []http.Header
+}
+
+func (rec *callbackRecorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	payload, _ := io.ReadAll(r.Body)
+	event, err := rec.gateway.ParseWebhook(payload, r.Header)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	rec.mu.Lock()
+	rec.events = append(rec.events, event)
+	rec.payloads = append(rec.payloads, payload)
+	rec.headers = append(rec.headers, r.Header.Clone())
+	rec.mu.Unlock()
+}
+
+// newFakeGateway returns a fake gateway serving its pages from a test server
+// and posting callbacks to rec.
+func newFakeGateway(t *testing.T) (*payment.FakeGateway, *callbackRecorder) {
+	t.Helper()
+	rec := &callbackRecorder{}
+	hooks := httptest.NewServer(rec)
+	t.Cleanup(hooks.Close)
+
+	mux := http.NewServeMux()
+	pages := httptest.NewServer(mux)
+	t.Cleanup(pages.Close)
+
+	g := payment.NewFakeGateway(pages.URL+"/fake-pay", hooks.URL, "test-secret")
+	mux.Handle("/fake-pay/", http.StripPrefix("/fake-pay", g))
+	rec.gateway = g
+	return g, rec
+}
+
+func newSession(t *testing.T, g *payment.FakeGateway) *payment.Session {
+	t.Helper()
+	s, err := g.CreateSession(context.Background(), payment.SessionParams{
+		LineItems: []payment.LineItem{
+			{Name: "GA", UnitPrice: money.New(2550, "aud"), Quantity: 2},
+			{Name: "VIP", UnitPrice: money.New(9900, "aud"), Quantity: 1},
+		},
+		CustomerEmail: "buyer@example.com",
+		SuccessURL:    "http://shop.test/success?session_id=" + payment.SessionIDPlaceholder,
+		CancelURL:     "http://shop.test/cancel",
+		Metadata:      map[string]string{"purchase_id": "42"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestFakeGateway_CompleteSendsSignedCallback(t *testing.T) {
+	g, rec := newFakeGateway(t)
+	s := newSession(t, g)
+
+	if err := g.Complete(context.Background(), s.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rec.events) != 1 {
+		t.Fatalf("expected 1 callback, got %d", len(rec.events))
+	}
+	e := rec.events[0]
+	if e.Type != payment.EventCheckoutCompleted {
+		t.Errorf("expected %s, got %s", payment.EventCheckoutCompleted, e.Type)
+	}
+	if e.Session == nil || e.Session.ID != s.ID || !e.Session.Paid {
+		t.Fatalf("expected paid session %s, got %+v", s.ID, e.Session)
+	}
+	if e.Session.Metadata["purchase_id"] != "42" {
+		t.Errorf("expected metadata to round trip, got %v", e.Session.Metadata)
+	}
+	if want := money.New(15000, "aud"); e.Session.AmountTotal != want {
+		t.Errorf("expected total %v, got %v", want, e.Session.AmountTotal)
+	}
+
+	if err := g.Complete(context.Background(), s.ID); err == nil {
+		t.Error("expected completing a session twice to fail")
+	}
+}
+
+func TestFakeGateway_ExpiredSessionCannotBePaid(t *testing.T) {
+	g, rec := newFakeGateway(t)
+	s, err := g.CreateSession(context.Background(), payment.SessionParams{
+		LineItems: []payment.LineItem{{Name: "GA", UnitPrice: money.New(2550, "aud"), Quantity: 1}},
+		ExpiresAt: time.Now().Add(-time.Second),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := g.Complete(context.Background(), s.ID); err == nil {
+		t.Fatal("expected paying after ExpiresAt to fail")
+	}
+	if len(rec.events) != 0 {
+		t.Errorf("expected no callbacks, got %d", len(rec.events))
+	}
+	got, err := g.GetSession(context.Background(), s.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Status != payment.SessionExpired {
+		t.Errorf("expected the session to be %s, got %s", payment.SessionExpired, got.Status)
+	}
+}
+
+func TestFakeGateway_ExpireSession(t *testing.T) {
+	g, rec := newFakeGateway(t)
+	s := newSession(t, g)
+
+	expired, err := g.ExpireSession(context.Background(), s.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expired.Status != payment.SessionExpired {
+		t.Errorf("expected %s, got %s", payment.SessionExpired, expired.Status)
+	}
+	if err := g.Complete(context.Background(), s.ID); err == nil {
+		t.Error("expected paying an expired session to fail")
+	}
+	if _, err := g.ExpireSession(context.Background(), s.ID); err == nil {
+		t.Error("expected expiring a session twice to fail")
+	}
+
+	// The callback is sent after ExpireSession returns
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		rec.mu.Lock()
+		n := len(rec.events)
+		rec.mu.Unlock()
+		if n > 0 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if len(rec.events) != 1 || rec.events[0].Type != payment.EventCheckoutExpired {
+		t.Fatalf("expected one %s callback, got %d", payment.EventCheckoutExpired, len(rec.events))
+	}
+}
+
+func TestFakeGateway_RejectsBadSignatures(t *testing.T) {
+	g, rec := newFakeGateway(t)
+	if err := g.Complete(context.Background(), newSession(t, g).ID); err != nil {
+		t.Fatal(err)
+	}
+	payload, header := rec.payloads[0], rec.headers[0]
+
+	tampered := []byte(strings.Replace(string(payload), `"42"`, `"43"`, 1))
+	if _, err := g.ParseWebhook(tampered, header); !errors.Is(err, payment.ErrInvalidSignature) {
+		t.Errorf("tampered payload: expected ErrInvalidSignature, got %v", err)
+	}
+
+	other := payment.NewFakeGateway("http://unused", "http://unused", "another-secret")
+	if _, err := other.ParseWebhook(payload, header); !errors.Is(err, payment.ErrInvalidSignature) {
+		t.Errorf("wrong secret: expected ErrInvalidSignature, got %v", err)
+	}
+
+	if _, err := g.ParseWebhook(payload, http.Header{}); !errors.Is(err, payment.ErrInvalidSignature) {
+		t.Errorf("missing header: expected ErrInvalidSignature, got %v", err)
+	}
+}
+
+func TestFakeGateway_PayPage(t *testing.T) {
+	g, rec := newFakeGateway(t)
+	s := newSession(t, g)
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+
+	resp, err := client.Get(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), "150.00 AUD") {
+		t.Fatalf("expected pay page showing the total, got %d: %s", resp.StatusCode, body)
+	}
+
+	resp, err = client.PostForm(s.URL, url.Values{"action": {"pay"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSeeOther {
+		t.Fatalf("expected redirect after paying, got %d", resp.StatusCode)
+	}
+	if want := "http://shop.test/success?session_id=" + s.ID; resp.Header.Get("Location") != want {
+		t.Errorf("expected redirect to %s, got %s", want, resp.Header.Get("Location"))
+	}
+	if len(rec.events) != 1 {
+		t.Errorf("expected 1 callback, got %d", len(rec.events))
+	}
+}
+
+func TestFakeGateway_Refund(t *testing.T) {
+	g, _ := newFakeGateway(t)
+	s := newSession(t, g)
+	ctx := context.Background()
+
+	if _, err := g.Refund(ctx, payment.RefundParams{PaymentID: s.PaymentID}); err == nil {
+		t.Error("expected refunding an unpaid session to fail")
+	}
+	if err := g.Complete(ctx, s.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	first := payment.RefundParams{PaymentID: s.PaymentID, Amount: money.New(2550, "aud"), IdempotencyKey: "refund-1"}
+	r, err := g.Refund(ctx, first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Amount.Amount != 2550 {
+		t.Errorf("expected 2550 refunded, got %d", r.Amount.Amount)
+	}
+	retried, err := g.Refund(ctx, first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if retried.ID != r.ID {
+		t.Errorf("expected a retry with the same key to return refund %s, got %s", r.ID, retried.ID)
+	}
+
+	r, err = g.Refund(ctx, payment.RefundParams{PaymentID: s.PaymentID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Amount.Amount != 12450 {
+		t.Errorf("expected the remaining 12450 refunded, got %d", r.Amount.Amount)
+	}
+
+	if _, err := g.Refund(ctx, payment.RefundParams{PaymentID: s.PaymentID, Amount: money.New(1, "aud")}); err == nil {
+		t.Error("expected refunding past the total to fail")
+	}
+}
+
+func TestFakeGateway_Dispute(t *testing.T) {
+	g, rec := newFakeGateway(t)
+	s := newSession(t, g)
+	ctx := context.Background()
+
+	if _, err := g.OpenDispute(ctx, s.PaymentID, "fraudulent"); !errors.Is(err, payment.ErrSessionNotFound) {
+		t.Errorf("expected disputing an unpaid session to fail, got %v", err)
+	}
+	if err := g.Complete(ctx, s.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := g.OpenDispute(ctx, s.PaymentID, "fraudulent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := g.UpdateDispute(ctx, d.ID, payment.DisputeUnderReview); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.UpdateDispute(ctx, d.ID, payment.DisputeWon); err != nil {
+		t.Fatal(err)
+	}
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	want := []payment.EventType{
+		payment.EventCheckoutCompleted,
+		payment.EventChargeDisputeCreated,
+		payment.EventChargeDisputeUpdated,
+		payment.EventChargeDisputeClosed,
+	}
+	if len(rec.events) != len(want) {
+		t.Fatalf("expected %d callbacks, got %d", len(want), len(rec.events))
+	}
+	for i, e := range rec.events {
+		if e.Type != want[i] {
+			t.Errorf("callback %d: expected %s, got %s", i, want[i], e.Type)
+		}
+	}
+	closed := rec.events[3].Dispute
+	if closed == nil || closed.PaymentID != s.PaymentID || closed.Status != payment.DisputeWon || closed.Amount != s.AmountTotal {
+		t.Errorf("unexpected closed dispute %+v", closed)
+	}
+}
@@ -0,0 +1,162 @@
+// Package payment puts the payment provider behind an interface, so checkout,
+// webhooks and refunds work the same against Stripe and against the local fake
+// gateway used for offline development and integration tests.
+package payment
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/tpgcig/carneauengine/server/money"
+)
+
+// SessionIDPlaceholder in a SuccessURL is replaced with the session's ID when
+// the buyer is sent back to us, the same way Stripe does it.
+const SessionIDPlaceholder = "{CHECKOUT_SESSION_ID}"
+
+// EventType names a webhook event. The values are Stripe's event names, which
+// is also what gets recorded in stripe_events.
+type EventType string
+
+const (
+	EventCheckoutCompleted             EventType = "checkout.session.completed"
+	EventCheckoutAsyncPaymentSucceeded EventType = "checkout.session.async_payment_succeeded"
+	EventCheckoutAsyncPaymentFailed    EventType = "checkout.session.async_payment_failed"
+	EventCheckoutExpired               EventType = "checkout.session.expired"
+	EventChargeRefunded                EventType = "charge.refunded"
+	EventChargeDisputeCreated          EventType = "charge.dispute.created"
+	EventChargeDisputeUpdated          EventType = "charge.dispute.updated"
+	EventChargeDisputeClosed           EventType = "charge.dispute.closed"
+)
+
+// SessionStatus is where a hosted checkout is up to, in Stripe's terms.
+type SessionStatus string
+
+const (
+	SessionOpen     SessionStatus = "open"     // the buyer hasn't finished yet
+	SessionComplete SessionStatus = "complete" // finished; Paid says whether the money has arrived
+	SessionExpired  SessionStatus = "expired"  // abandoned and no longer payable
+)
+
+var (
+	// ErrInvalidSignature is returned by ParseWebhook when a callback is not
+	// signed by the gateway, or the signature is too old.
+	ErrInvalidSignature = errors.New("payment: invalid webhook signature")
+	// ErrSessionNotFound is returned by the fake gateway for unknown sessions
+	// and payments.
+	ErrSessionNotFound = errors.New("payment: session not found")
+)
+
+// LineItem is one priced line on the gateway's checkout page.
+type LineItem struct {
+	Name      string
+	UnitPrice money.Money
+	Quantity  int
+}
+
+// SessionParams describes a hosted checkout to create.
+type SessionParams struct {
+	LineItems     []LineItem
+	CustomerEmail string
+	SuccessURL    string // may contain SessionIDPlaceholder
+	CancelURL     string
+	Metadata      map[string]string
+	// ExpiresAt is when the session stops being payable. Stripe needs it to be
+	// at least 30 minutes after the session is created; zero leaves Stripe's
+	// 24 hour default.
+	ExpiresAt time.Time
+}
+
+// Session is a hosted checkout, as created or as reported by a webhook.
+type Session struct {
+	ID            string            `json:"id"`
+	URL           string            `json:"url,omitempty"`
+	Status        SessionStatus     `json:"status"`
+	Paid          bool              `json:"paid"` // false while a delayed payment method is still clearing
+	CustomerEmail string            `json:"customer_email"`
+	AmountTotal   money.Money       `json:"amount_total"`
+	PaymentID     string            `json:"payment_id,omitempty"` // what Refund needs to find the payment
+	Metadata      map[string]string `json:"metadata"`
+}
+
+// Charge is the money taken for a completed session, as reported by charge
+// events. AmountRefunded is the running total of every refund on it so far.
+type Charge struct {
+	ID             string      `json:"id"`
+	PaymentID      string      `json:"payment_id"`
+	Amount         money.Money `json:"amount"`
+	AmountRefunded money.Money `json:"amount_refunded"`
+}
+
+// DisputeStatus is where a chargeback is up to, in Stripe's terms.
+type DisputeStatus string
+
+const (
+	DisputeWarningNeedsResponse DisputeStatus = "warning_needs_response"
+	DisputeWarningUnderReview   DisputeStatus = "warning_under_review"
+	DisputeWarningClosed        DisputeStatus = "warning_closed" // an inquiry that never became a chargeback
+	DisputeNeedsResponse        DisputeStatus = "needs_response"
+	DisputeUnderReview          DisputeStatus = "under_review"
+	DisputeWon                  DisputeStatus = "won"
+	DisputeLost                 DisputeStatus = "lost"
+)
+
+// Closed reports whether the dispute has been decided.
+func (s DisputeStatus) Closed() bool {
+	return s == DisputeWon || s == DisputeLost || s == DisputeWarningClosed
+}
+
+// Dispute is a chargeback, or an inquiry that may become one, filed by the
+// buyer's bank against a payment.
+type Dispute struct {
+	ID        string        `json:"id"`
+	ChargeID  string        `json:"charge_id"`
+	PaymentID string        `json:"payment_id"`
+	Amount    money.Money   `json:"amount"`
+	Reason    string        `json:"reason"`
+	Status    DisputeStatus `json:"status"`
+}
+
+// Event is a verified webhook callback. Session is set for checkout events,
+// Charge for charge events and Dispute for charge.dispute events.
+type Event struct {
+	ID      string    `json:"id"`
+	Type    EventType `json:"type"`
+	Session *Session  `json:"session,omitempty"`
+	Charge  *Charge   `json:"charge,omitempty"`
+	Dispute *Dispute  `json:"dispute,omitempty"`
+}
+
+// RefundParams asks for money back on a payment. A zero Amount refunds
+// whatever is left of the payment.
+type RefundParams struct {
+	PaymentID      string
+	Amount         money.Money
+	IdempotencyKey string
+}
+
+// Refund is a refund the gateway has accepted.
+type Refund struct {
+	ID     string
+	Amount money.Money
+	Status string
+}
+
+// Gateway is a payment provider.
+type Gateway interface {
+	// CreateSession starts a hosted checkout and returns where to send the buyer.
+	CreateSession(ctx context.Context, params SessionParams) (*Session, error)
+	// GetSession fetches the gateway's current record of a session.
+	GetSession(ctx context.Context, sessionID string) (*Session, error)
+	// ExpireSession stops an open session from being paid. The gateway later
+	// confirms it with a checkout.session.expired event. It fails for a session
+	// that is no longer open.
+	ExpireSession(ctx context.Context, sessionID string) (*Session, error)
+	// ParseWebhook verifies a callback's signature and decodes it.
+	ParseWebhook(payload []byte, header http.Header) (*Event, error)
+	// Refund returns money on a completed payment. The gateway later confirms
+	// it with a charge.refunded event.
+	Refund(ctx context.Context, params RefundParams) (*Refund, error)
+}
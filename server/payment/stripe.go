@@ -0,0 +1,169 @@
+package payment
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/stripe/stripe-go/v83"
+	"github.com/stripe/stripe-go/v83/checkout/session"
+	"github.com/stripe/stripe-go/v83/refund"
+	"github.com/stripe/stripe-go/v83/webhook"
+
+	"github.com/tpgcig/carneauengine/server/money"
+)
+
+// StripeGateway takes payments through Stripe Checkout. It uses the API key
+// set in stripe.Key.
+type StripeGateway struct {
+	webhookSecret string
+}
+
+// NewStripeGateway returns a gateway that verifies webhooks with webhookSecret.
+func NewStripeGateway(webhookSecret string) *StripeGateway {
+	return &StripeGateway{webhookSecret: webhookSecret}
+}
+
+func (g *StripeGateway) CreateSession(ctx context.Context, p SessionParams) (*Session, error) {
+	var lineItems []*stripe.CheckoutSessionLineItemParams
+	for _, item := range p.LineItems {
+		lineItems = append(lineItems, &stripe.CheckoutSessionLineItemParams{
+			PriceData: &stripe.CheckoutSessionLineItemPriceDataParams{
+				Currency: stripe.String(item.UnitPrice.Currency),
+				ProductData: &stripe.CheckoutSessionLineItemPriceDataProductDataParams{
+					Name: stripe.String(item.Name),
+				},
+				UnitAmount: stripe.Int64(item.UnitPrice.Amount),
+			},
+			Quantity: stripe.Int64(int64(item.Quantity)),
+		})
+	}
+
+	params := &stripe.CheckoutSessionParams{
+		PaymentMethodTypes: stripe.StringSlice([]string{"card"}),
+		LineItems:          lineItems,
+		Mode:               stripe.String(string(stripe.CheckoutSessionModePayment)),
+		SuccessURL:         stripe.String(p.SuccessURL),
+		CancelURL:          stripe.String(p.CancelURL),
+		CustomerEmail:      stripe.String(p.CustomerEmail),
+		Metadata:           p.Metadata,
+	}
+	if !p.ExpiresAt.IsZero() {
+		params.ExpiresAt = stripe.Int64(p.ExpiresAt.Unix())
+	}
+	params.Context = ctx
+
+	s, err := session.New(params)
+	if err != nil {
+		return nil, err
+	}
+	return stripeSession(s), nil
+}
+
+func (g *StripeGateway) GetSession(ctx context.Context, sessionID string) (*Session, error) {
+	params := &stripe.CheckoutSessionParams{}
+	params.Context = ctx
+
+	s, err := session.Get(sessionID, params)
+	if err != nil {
+		return nil, err
+	}
+	return stripeSession(s), nil
+}
+
+func (g *StripeGateway) ExpireSession(ctx context.Context, sessionID string) (*Session, error) {
+	params := &stripe.CheckoutSessionExpireParams{}
+	params.Context = ctx
+
+	s, err := session.Expire(sessionID, params)
+	if err != nil {
+		return nil, err
+	}
+	return stripeSession(s), nil
+}
+
+func (g *StripeGateway) ParseWebhook(payload []byte, header http.Header) (*Event, error) {
+	event, err := webhook.ConstructEvent(payload, header.Get("Stripe-Signature"), g.webhookSecret)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidSignature, err)
+	}
+
+	e := &Event{ID: event.ID, Type: EventType(event.Type)}
+	if strings.HasPrefix(string(event.Type), "checkout.session.") {
+		var s stripe.CheckoutSession
+		if err := json.Unmarshal(event.Data.Raw, &s); err != nil {
+			return nil, fmt.Errorf("payment: decoding checkout session: %w", err)
+		}
+		e.Session = stripeSession(&s)
+	}
+	if strings.HasPrefix(string(event.Type), "charge.dispute.") {
+		var d stripe.Dispute
+		if err := json.Unmarshal(event.Data.Raw, &d); err != nil {
+			return nil, fmt.Errorf("payment: decoding dispute: %w", err)
+		}
+		e.Dispute = &Dispute{
+			ID:     d.ID,
+			Amount: money.New(d.Amount, string(d.Currency)),
+			Reason: string(d.Reason),
+			Status: DisputeStatus(d.Status),
+		}
+		if d.Charge != nil {
+			e.Dispute.ChargeID = d.Charge.ID
+		}
+		if d.PaymentIntent != nil {
+			e.Dispute.PaymentID = d.PaymentIntent.ID
+		}
+	} else if strings.HasPrefix(string(event.Type), "charge.") {
+		var ch stripe.Charge
+		if err := json.Unmarshal(event.Data.Raw, &ch); err != nil {
+			return nil, fmt.Errorf("payment: decoding charge: %w", err)
+		}
+		e.Charge = &Charge{
+			ID:             ch.ID,
+			Amount:         money.New(ch.Amount, string(ch.Currency)),
+			AmountRefunded: money.New(ch.AmountRefunded, string(ch.Currency)),
+		}
+		if ch.PaymentIntent != nil {
+			e.Charge.PaymentID = ch.PaymentIntent.ID
+		}
+	}
+	return e, nil
+}
+
+func (g *StripeGateway) Refund(ctx context.Context, p RefundParams) (*Refund, error) {
+	params := &stripe.RefundParams{PaymentIntent: stripe.String(p.PaymentID)}
+	if p.Amount.Amount > 0 {
+		params.Amount = stripe.Int64(p.Amount.Amount)
+	}
+	if p.IdempotencyKey != "" {
+		params.SetIdempotencyKey(p.IdempotencyKey)
+	}
+	params.Context = ctx
+
+	r, err := refund.New(params)
+	if err != nil {
+		return nil, err
+	}
+	return &Refund{ID: r.ID, Amount: money.New(r.Amount, string(r.Currency)), Status: string(r.Status)}, nil
+}
+
+func stripeSession(s *stripe.CheckoutSession) *Session {
+	out := &Session{
+		ID:            s.ID,
+		URL:           s.URL,
+		Status:        SessionStatus(s.Status),
+		Paid:          s.PaymentStatus != stripe.CheckoutSessionPaymentStatusUnpaid,
+		CustomerEmail: s.CustomerEmail,
+		AmountTotal:   money.New(s.AmountTotal, string(s.Currency)),
+		Metadata:      s.Metadata,
+	}
+	if s.CustomerDetails != nil && s.CustomerDetails.Email != "" {
+		out.CustomerEmail = s.CustomerDetails.Email
+	}
+	if s.PaymentIntent != nil {
+		out.PaymentID = s.PaymentIntent.ID
+	}
+	return out
+}
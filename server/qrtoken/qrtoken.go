@@ -0,0 +1,293 @@
+// Package qrtoken signs the payloads printed in ticket QR codes, so a scanner
+// can tell a real ticket from a made-up one with nothing but a public key.
+//
+// A token looks like CT1.<key ID>.<claims>.<signature>, with the claims and
+// the Ed25519 signature base64url-encoded. The signature covers everything
+// before it. The key ID says which key signed it, so keys can be rotated: new
+// tickets are signed with the current key while tickets already issued keep
+// verifying against the retired keys' public halves.
+package qrtoken
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Prefix starts every token, and names the format's version.
+const Prefix = "CT1"
+
+// nonceSize is how many random bytes each token carries, so two tokens are
+// never the same even for the same ticket and second.
+const nonceSize = 8
+
+var (
+	// ErrMalformed is returned for anything that isn't a token in this format.
+	ErrMalformed = errors.New("qrtoken: malformed token")
+	// ErrUnknownKey is returned for tokens signed with a key the keyring doesn't have.
+	ErrUnknownKey = errors.New("qrtoken: unknown signing key")
+	// ErrBadSignature is returned for tokens whose signature doesn't match.
+	ErrBadSignature = errors.New("qrtoken: invalid signature")
+)
+
+var b64 = base64.RawURLEncoding
+
+// Claims is what a token says about its ticket.
+type Claims struct {
+	TicketID     int       `json:"ticket_id"`
+	EventID      int       `json:"event_id"`
+	TicketTypeID int       `json:"ticket_type_id"`
+	IssuedAt     time.Time `json:"issued_at"`
+	KeyID        string    `json:"key_id"` // set by Verify
+}
+
+func (c Claims) marshal(nonce []byte) []byte {
+	buf := make([]byte, 0, 4*binary.MaxVarintLen64+nonceSize)
+	buf = binary.AppendUvarint(buf, uint64(c.TicketID))
+	buf = binary.AppendUvarint(buf, uint64(c.EventID))
+	buf = binary.AppendUvarint(buf, uint64(c.TicketTypeID))
+	buf = binary.AppendUvarint(buf, uint64(c.IssuedAt.Unix()))
+	return append(buf, nonce...)
+}
+
+func unmarshalClaims(buf []byte) (*Claims, error) {
+	var fields [4]uint64
+	for i := range fields {
+		v, n := binary.Uvarint(buf)
+		if n <= 0 {
+			return nil, ErrMalformed
+		}
+		fields[i], buf = v, buf[n:]
+	}
+	if len(buf) != nonceSize {
+		return nil, ErrMalformed
+	}
+	return &Claims{
+		TicketID:     int(fields[0]),
+		EventID:      int(fields[1]),
+		TicketTypeID: int(fields[2]),
+		IssuedAt:     time.Unix(int64(fields[3]), 0).UTC(),
+	}, nil
+}
+
+// Signer signs tokens with one Ed25519 key.
+type Signer struct {
+	keyID string
+	key   ed25519.PrivateKey
+}
+
+// NewSigner returns a signer for key, known to verifiers as keyID.
+func NewSigner(keyID string, key ed25519.PrivateKey) (*Signer, error) {
+	if err := validKeyID(keyID); err != nil {
+		return nil, err
+	}
+	if len(key) != ed25519.PrivateKeySize {
+		return nil, fmt.Errorf("qrtoken: key %s is not an Ed25519 private key", keyID)
+	}
+	return &Signer{keyID: keyID, key: key}, nil
+}
+
+// GenerateSigner returns a signer for a new random key.
+func GenerateSigner(keyID string) (*Signer, error) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return NewSigner(keyID, key)
+}
+
+// ParseSigner reads a signer from "<key ID>:<base64url seed>", the form
+// String produces.
+func ParseSigner(s string) (*Signer, error) {
+	keyID, encoded, ok := strings.Cut(strings.TrimSpace(s), ":")
+	if !ok {
+		return nil, fmt.Errorf("qrtoken: signing key must look like <key ID>:<seed>")
+	}
+	seed, err := b64.DecodeString(encoded)
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("qrtoken: signing key %s has an invalid seed", keyID)
+	}
+	return NewSigner(keyID, ed25519.NewKeyFromSeed(seed))
+}
+
+// String encodes the signer's private key for ParseSigner. Keep it secret.
+func (s *Signer) String() string {
+	return s.keyID + ":" + b64.EncodeToString(s.key.Seed())
+}
+
+// KeyID names the signer's key.
+func (s *Signer) KeyID() string {
+	return s.keyID
+}
+
+// PublicKey is what verifiers need to check the signer's tokens.
+func (s *Signer) PublicKey() ed25519.PublicKey {
+	return s.key.Public().(ed25519.PublicKey)
+}
+
+// Sign returns a token for c. A zero IssuedAt is taken as now.
+func (s *Signer) Sign(c Claims) (string, error) {
+	if c.TicketID <= 0 || c.EventID <= 0 || c.TicketTypeID <= 0 {
+		return "", fmt.Errorf("qrtoken: claims need a ticket, event and ticket type")
+	}
+	if c.IssuedAt.IsZero() {
+		c.IssuedAt = time.Now()
+	}
+	nonce := make([]byte, nonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	signed := Prefix + "." + s.keyID + "." + b64.EncodeToString(c.marshal(nonce))
+	return signed + "." + b64.EncodeToString(ed25519.Sign(s.key, []byte(signed))), nil
+}
+
+// Keyring holds the public keys tokens are verified against: the current
+// signing key and any retired ones whose tickets are still out there.
+type Keyring struct {
+	keys map[string]ed25519.PublicKey
+}
+
+// NewKeyring returns an empty keyring.
+func NewKeyring() *Keyring {
+	return &Keyring{keys: make(map[string]ed25519.PublicKey)}
+}
+
+// Add trusts tokens signed by the key with the given ID.
+func (k *Keyring) Add(keyID string, key ed25519.PublicKey) error {
+	if err := validKeyID(keyID); err != nil {
+		return err
+	}
+	if len(key) != ed25519.PublicKeySize {
+		return fmt.Errorf("qrtoken: key %s is not an Ed25519 public key", keyID)
+	}
+	k.keys[keyID] = key
+	return nil
+}
+
+// AddEncoded adds keys given as comma-separated "<key ID>:<base64url public
+// key>" pairs, the form PublicKeys returns them in.
+func (k *Keyring) AddEncoded(s string) error {
+	for _, pair := range strings.Split(s, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		keyID, encoded, ok := strings.Cut(strings.TrimSpace(pair), ":")
+		if !ok {
+			return fmt.Errorf("qrtoken: verify key must look like <key ID>:<public key>")
+		}
+		key, err := b64.DecodeString(encoded)
+		if err != nil {
+			return fmt.Errorf("qrtoken: verify key %s: %w", keyID, err)
+		}
+		if err := k.Add(keyID, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PublicKeys returns every trusted key, base64url-encoded, by key ID. This is
+// what offline scanners download.
+func (k *Keyring) PublicKeys() map[string]string {
+	out := make(map[string]string, len(k.keys))
+	for id, key := range k.keys {
+		out[id] = b64.EncodeToString(key)
+	}
+	return out
+}
+
+// Verify checks a token's signature and returns its claims.
+func (k *Keyring) Verify(token string) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 4 || parts[0] != Prefix {
+		return nil, ErrMalformed
+	}
+	key, ok := k.keys[parts[1]]
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+	sig, err := b64.DecodeString(parts[3])
+	if err != nil {
+		return nil, ErrMalformed
+	}
+	signed := token[:len(token)-len(parts[3])-1]
+	if !ed25519.Verify(key, []byte(signed), sig) {
+		return nil, ErrBadSignature
+	}
+
+	payload, err := b64.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrMalformed
+	}
+	c, err := unmarshalClaims(payload)
+	if err != nil {
+		return nil, err
+	}
+	c.KeyID = parts[1]
+	return c, nil
+}
+
+// messagePrefix is prepended to everything SignMessage signs, so a signed
+// message can never pass for a token or the other way round.
+const messagePrefix = Prefix + "-MSG\n"
+
+// SignMessage signs an arbitrary message, such as a scanner manifest, and
+// returns the base64url signature.
+func (s *Signer) SignMessage(msg []byte) string {
+	return b64.EncodeToString(ed25519.Sign(s.key, append([]byte(messagePrefix), msg...)))
+}
+
+// VerifyMessage checks a signature made by SignMessage with the given key.
+func (k *Keyring) VerifyMessage(keyID string, msg []byte, sig string) error {
+	key, ok := k.keys[keyID]
+	if !ok {
+		return ErrUnknownKey
+	}
+	raw, err := b64.DecodeString(sig)
+	if err != nil {
+		return ErrMalformed
+	}
+	if !ed25519.Verify(key, append([]byte(messagePrefix), msg...), raw) {
+		return ErrBadSignature
+	}
+	return nil
+}
+
+// Digest is the short hash offline scanners match a scanned QR payload
+// against: the first 16 bytes of its SHA-256, base64url-encoded. It works for
+// legacy payloads as well as tokens.
+func Digest(payload string) string {
+	sum := sha256.Sum256([]byte(payload))
+	return b64.EncodeToString(sum[:16])
+}
+
+func validKeyID(keyID string) error {
+	if keyID == "" || strings.ContainsAny(keyID, ".:,") {
+		return fmt.Errorf("qrtoken: key ID %q must be non-empty without '.', ':' or ','", keyID)
+	}
+	return nil
+}
+
+// Load returns the signer for signingKey, in ParseSigner's form, and a
+// keyring trusting it along with the retired keys in verifyKeys, in
+// AddEncoded's form.
+func Load(signingKey, verifyKeys string) (*Signer, *Keyring, error) {
+	signer, err := ParseSigner(signingKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	keys := NewKeyring()
+	if err := keys.AddEncoded(verifyKeys); err != nil {
+		return nil, nil, err
+	}
+	if err := keys.Add(signer.KeyID(), signer.PublicKey()); err != nil {
+		return nil, nil, err
+	}
+	return signer, keys, nil
+}
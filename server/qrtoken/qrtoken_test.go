@@ -0,0 +1,161 @@
+package qrtoken_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tpgcig/carneauengine/server/qrtoken"
+)
+
+func newSigner(t *testing.T, keyID string) *qrtoken.Signer {
+	t.Helper()
+	s, err := qrtoken.GenerateSigner(keyID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestSignVerify(t *testing.T) {
+	s := newSigner(t, "2026-10")
+	keys := qrtoken.NewKeyring()
+	if err := keys.Add(s.KeyID(), s.PublicKey()); err != nil {
+		t.Fatal(err)
+	}
+
+	issued := time.Date(2026, 10, 17, 9, 30, 0, 0, time.UTC)
+	token, err := s.Sign(qrtoken.Claims{TicketID: 123456, EventID: 42, TicketTypeID: 7, IssuedAt: issued})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(token, "CT1.2026-10.") || len(token) > 140 {
+		t.Errorf("unexpected token %q (%d chars)", token, len(token))
+	}
+
+	c, err := keys.Verify(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := qrtoken.Claims{TicketID: 123456, EventID: 42, TicketTypeID: 7, IssuedAt: issued, KeyID: "2026-10"}
+	if *c != want {
+		t.Errorf("expected %+v, got %+v", want, *c)
+	}
+
+	again, _ := s.Sign(qrtoken.Claims{TicketID: 123456, EventID: 42, TicketTypeID: 7, IssuedAt: issued})
+	if again == token {
+		t.Error("expected two tokens for the same ticket to differ")
+	}
+}
+
+func TestVerify_Rejects(t *testing.T) {
+	s := newSigner(t, "current")
+	other := newSigner(t, "current")
+	keys := qrtoken.NewKeyring()
+	keys.Add(s.KeyID(), s.PublicKey())
+
+	token, err := s.Sign(qrtoken.Claims{TicketID: 1, EventID: 2, TicketTypeID: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(token, ".")
+	forged, _ := other.Sign(qrtoken.Claims{TicketID: 1, EventID: 2, TicketTypeID: 3})
+	unknown, _ := newSigner(t, "unknown").Sign(qrtoken.Claims{TicketID: 1, EventID: 2, TicketTypeID: 3})
+	swapped, _ := s.Sign(qrtoken.Claims{TicketID: 99, EventID: 2, TicketTypeID: 3})
+
+	for name, tc := range map[string]struct {
+		token string
+		want  error
+	}{
+		"old format":       {"CARNEAU-1-3-abcdefghij", qrtoken.ErrMalformed},
+		"empty":            {"", qrtoken.ErrMalformed},
+		"forged signature": {forged, qrtoken.ErrBadSignature},
+		"unknown key":      {unknown, qrtoken.ErrUnknownKey},
+		"swapped claims":   {strings.Join([]string{parts[0], parts[1], strings.Split(swapped, ".")[2], parts[3]}, "."), qrtoken.ErrBadSignature},
+		"truncated":        {token[:len(token)-4], qrtoken.ErrBadSignature},
+	} {
+		if _, err := keys.Verify(tc.token); !errors.Is(err, tc.want) {
+			t.Errorf("%s: expected %v, got %v", name, tc.want, err)
+		}
+	}
+}
+
+// TestLoad_Rotation signs with a new key while tickets from the retired one,
+// trusted through its public key alone, still verify.
+func TestLoad_Rotation(t *testing.T) {
+	old := newSigner(t, "2026-04")
+	oldToken, err := old.Sign(qrtoken.Claims{TicketID: 1, EventID: 2, TicketTypeID: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	retired := qrtoken.NewKeyring()
+	retired.Add(old.KeyID(), old.PublicKey())
+
+	current := newSigner(t, "2026-10")
+	signer, keys, err := qrtoken.Load(current.String(), "2026-04:"+retired.PublicKeys()["2026-04"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if signer.KeyID() != "2026-10" {
+		t.Errorf("expected to sign with 2026-10, got %s", signer.KeyID())
+	}
+	newToken, err := signer.Sign(qrtoken.Claims{TicketID: 4, EventID: 2, TicketTypeID: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, token := range []string{oldToken, newToken} {
+		if _, err := keys.Verify(token); err != nil {
+			t.Errorf("expected %s to verify, got %v", token, err)
+		}
+	}
+	if got := len(keys.PublicKeys()); got != 2 {
+		t.Errorf("expected 2 published keys, got %d", got)
+	}
+}
+
+func TestParseSigner_Invalid(t *testing.T) {
+	for _, s := range []string{"", "no-seed", "k:not base64!", "k:c2hvcnQ", "a.b:" + strings.Repeat("A", 43)} {
+		if _, err := qrtoken.ParseSigner(s); err == nil {
+			t.Errorf("expected ParseSigner(%q) to fail", s)
+		}
+	}
+}
+
+func TestSignMessage(t *testing.T) {
+	s := newSigner(t, "current")
+	keys := qrtoken.NewKeyring()
+	keys.Add(s.KeyID(), s.PublicKey())
+
+	msg := []byte(`{"event_id":42}`)
+	sig := s.SignMessage(msg)
+	if err := keys.VerifyMessage("current", msg, sig); err != nil {
+		t.Fatalf("expected message to verify, got %v", err)
+	}
+	if err := keys.VerifyMessage("current", []byte(`{"event_id":43}`), sig); !errors.Is(err, qrtoken.ErrBadSignature) {
+		t.Errorf("altered message: expected ErrBadSignature, got %v", err)
+	}
+	if err := keys.VerifyMessage("retired", msg, sig); !errors.Is(err, qrtoken.ErrUnknownKey) {
+		t.Errorf("unknown key: expected ErrUnknownKey, got %v", err)
+	}
+
+	// A message signature must not make a token out of the same bytes
+	token, err := s.Sign(qrtoken.Claims{TicketID: 1, EventID: 2, TicketTypeID: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := token[:strings.LastIndex(token, ".")]
+	if _, err := keys.Verify(signed + "." + s.SignMessage([]byte(signed))); !errors.Is(err, qrtoken.ErrBadSignature) {
+		t.Errorf("message signature as token: expected ErrBadSignature, got %v", err)
+	}
+}
+
+func TestDigest(t *testing.T) {
+	d := qrtoken.Digest("CARNEAU-ABC123")
+	if len(d) != 22 || d != qrtoken.Digest("CARNEAU-ABC123") {
+		t.Errorf("expected a stable 22-character digest, got %q", d)
+	}
+	if d == qrtoken.Digest("CARNEAU-ABC124") {
+		t.Error("expected different payloads to have different digests")
+	}
+}
@@ -0,0 +1,145 @@
+package reservation
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+var _ Reserver = (*MemoryReserver)(nil)
+
+// MemoryReserver keeps holds in process memory behind a single mutex. It has
+// the same semantics as RedisReserver and exists so tests and local tooling can
+// exercise reservation logic without a live Redis.
+type MemoryReserver struct {
+	mu           sync.Mutex
+	ttl          time.Duration
+	held         map[int]int // ticketTypeID -> held quantity
+	reservations map[string]*Reservation
+
+	// Now is the clock used for deadlines. Tests may replace it to move time forward.
+	Now func() time.Time
+}
+
+// NewMemoryReserver returns an in-memory Reserver whose holds last ttl.
+func NewMemoryReserver(ttl time.Duration) *MemoryReserver {
+	return &MemoryReserver{
+		ttl:          ttl,
+		held:         make(map[int]int),
+		reservations: make(map[string]*Reservation),
+		Now:          time.Now,
+	}
+}
+
+// Held returns the quantity currently held for a ticket type.
+func (m *MemoryReserver) Held(ticketTypeID int) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.held[ticketTypeID]
+}
+
+func (m *MemoryReserver) Reserve(ctx context.Context, reservationID string, reqs []Request) error {
+	if err := validate(reqs); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// Check everything before holding anything, so a failure leaves no partial hold
+	for _, req := range reqs {
+		if req.TotalQuantity-req.SoldQuantity-m.held[req.TicketTypeID] < req.Quantity {
+			return ErrInsufficientStock
+		}
+	}
+
+	res := &Reservation{
+		ID:        reservationID,
+		Items:     make(map[int]int, len(reqs)),
+		ExpiresAt: m.Now().Add(m.ttl),
+	}
+	for _, req := range reqs {
+		m.held[req.TicketTypeID] += req.Quantity
+		res.Items[req.TicketTypeID] = req.Quantity
+	}
+	m.reservations[reservationID] = res
+	return nil
+}
+
+func (m *MemoryReserver) Release(ctx context.Context, reservationID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.release(reservationID)
+	return nil
+}
+
+func (m *MemoryReserver) Commit(ctx context.Context, reservationID string) error {
+	return m.Release(ctx, reservationID)
+}
+
+func (m *MemoryReserver) Get(ctx context.Context, reservationID string) (*Reservation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	res, ok := m.reservations[reservationID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	cp := *res
+	cp.Items = make(map[int]int, len(res.Items))
+	for id, qty := range res.Items {
+		cp.Items[id] = qty
+	}
+	return &cp, nil
+}
+
+func (m *MemoryReserver) Extend(ctx context.Context, reservationID string, by time.Duration) (*Reservation, error) {
+	m.mu.Lock()
+	res, ok := m.reservations[reservationID]
+	switch {
+	case !ok:
+		m.mu.Unlock()
+		return nil, ErrNotFound
+	case res.Expired(m.Now()):
+		m.mu.Unlock()
+		return nil, ErrExpired
+	case res.Extended:
+		m.mu.Unlock()
+		return nil, ErrAlreadyExtended
+	}
+	res.ExpiresAt = res.ExpiresAt.Add(by)
+	res.Extended = true
+	m.mu.Unlock()
+
+	return m.Get(ctx, reservationID)
+}
+
+func (m *MemoryReserver) ReleaseExpired(ctx context.Context) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.Now()
+	released := 0
+	for id, res := range m.reservations {
+		if res.Expired(now) {
+			m.release(id)
+			released++
+		}
+	}
+	return released, nil
+}
+
+// release must be called with m.mu held.
+func (m *MemoryReserver) release(reservationID string) {
+	res, ok := m.reservations[reservationID]
+	if !ok {
+		return
+	}
+	for ticketTypeID, qty := range res.Items {
+		m.held[ticketTypeID] -= qty
+		if m.held[ticketTypeID] < 0 {
+			m.held[ticketTypeID] = 0
+		}
+	}
+	delete(m.reservations, reservationID)
+}
@@ -0,0 +1,277 @@
+package reservation
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	redis "github.com/go-redis/redis/v8"
+)
+
+const (
+	// expiriesKey is a sorted set of reservation IDs scored by their expiry
+	// deadline (unix seconds, Redis server clock).
+	expiriesKey = "reservation_expiries"
+	// reaperBatchSize caps how many reservations one sweep releases, so a single
+	// script call never blocks Redis for long.
+	reaperBatchSize = 100
+)
+
+// reserveScript holds tickets atomically.
+// It iterates through each ticket type, checks availability, and reserves.
+// If any reservation fails, it rolls back all reservations for this request.
+// KEYS: {ticket_hold_key_1, ticket_hold_key_2, ...}
+// ARGV: {total_qty_1, sold_qty_1, requested_qty_1, total_qty_2, sold_qty_2, requested_qty_2, ..., reservationID, reservationTTL, reservationGrace}
+var reserveScript = redis.NewScript(`
+local reservationId = ARGV[#ARGV - 2]
+local reservationTTL = tonumber(ARGV[#ARGV - 1])
+local reservationGrace = tonumber(ARGV[#ARGV])
+local numTickets = (#KEYS)
+local reservedItems = {} -- Stores successfully reserved quantities in this transaction
+local fullReservationKey = "reservation:" .. reservationId
+
+-- Clean up on error (optional, but good practice if intermediate writes occur)
+local function rollback()
+	for i = 1, #reservedItems, 2 do
+		local ttId = reservedItems[i]
+		local qty = reservedItems[i+1]
+		redis.call('HINCRBY', "ticket_holds:" .. ttId, "held_quantity", -qty)
+	end
+	redis.call('DEL', fullReservationKey)
+	return 0
+end
+
+for i = 1, numTickets do
+	local ticketHoldKey = KEYS[i] -- e.g., ticket_holds:123
+	local totalQty = tonumber(ARGV[(i-1)*3 + 1])
+	local soldQty = tonumber(ARGV[(i-1)*3 + 2])
+	local requestedQty = tonumber(ARGV[(i-1)*3 + 3])
+	local ticketTypeId = string.match(ticketHoldKey, "ticket_holds:(%d+)") -- Extract ID
+
+	local currentHeldQty = tonumber(redis.call('HGET', ticketHoldKey, 'held_quantity') or '0')
+	local availableForSale = totalQty - soldQty - currentHeldQty
+
+	if availableForSale < requestedQty then
+		-- Not enough tickets, roll back all and return error
+		return rollback()
+	end
+
+	-- Reserve tickets by incrementing the held_quantity
+	redis.call('HINCRBY', ticketHoldKey, "held_quantity", requestedQty)
+
+	-- Store this reservation detail in the temporary reservedItems for potential rollback
+	table.insert(reservedItems, ticketTypeId)
+	table.insert(reservedItems, requestedQty)
+
+	-- Store reservation details in a hash for this specific reservation ID
+	-- This allows the webhook to easily retrieve what was reserved by this session
+	redis.call('HSET', fullReservationKey, ticketTypeId, requestedQty)
+end
+
+-- Record the deadline for the reaper, using the Redis clock so every
+-- server agrees on when the hold runs out
+local now = tonumber(redis.call('TIME')[1])
+redis.call('ZADD', "` + expiriesKey + `", now + reservationTTL, reservationId)
+
+-- Keep the hash past the deadline so the reaper can still see what to give back
+redis.call('EXPIRE', fullReservationKey, reservationTTL + reservationGrace)
+return 1
+`)
+
+// luaReleaseReservation gives back everything held by one reservation and
+// forgets it. It is shared by the release script and the expiry sweep so both
+// paths decrement held_quantity exactly once: whoever runs first deletes the
+// hash, and the other finds nothing left to release.
+const luaReleaseReservation = `
+local function releaseReservation(reservationId)
+	local reservationKey = "reservation:" .. reservationId
+	local items = redis.call('HGETALL', reservationKey)
+	for i = 1, #items, 2 do
+		local holdKey = "ticket_holds:" .. items[i]
+		local held = redis.call('HINCRBY', holdKey, "held_quantity", -tonumber(items[i+1]))
+		if held < 0 then
+			-- Never let a stale release push availability above the real supply
+			redis.call('HSET', holdKey, "held_quantity", 0)
+		end
+	end
+	redis.call('DEL', reservationKey, "reservation_extensions:" .. reservationId)
+	redis.call('ZREM', "` + expiriesKey + `", reservationId)
+	return #items / 2
+end
+`
+
+// releaseScript releases a single reservation regardless of its deadline.
+// ARGV: {reservationID}
+var releaseScript = redis.NewScript(luaReleaseReservation + `
+return releaseReservation(ARGV[1])
+`)
+
+// releaseExpiredScript releases up to ARGV[1] reservations whose deadline has
+// passed according to the Redis server clock.
+// ARGV: {batchSize}
+var releaseExpiredScript = redis.NewScript(luaReleaseReservation + `
+local now = tonumber(redis.call('TIME')[1])
+local expired = redis.call('ZRANGEBYSCORE', "` + expiriesKey + `", '-inf', now, 'LIMIT', 0, tonumber(ARGV[1]))
+for _, reservationId in ipairs(expired) do
+	releaseReservation(reservationId)
+end
+return #expired
+`)
+
+// extendScript pushes back the deadline of a live reservation, at most once.
+// It returns the new deadline, or -1 if the reservation is gone, -2 if it has
+// expired and -3 if it has already been extended.
+// ARGV: {reservationID, extendBySeconds, reservationGrace}
+var extendScript = redis.NewScript(`
+local reservationId = ARGV[1]
+local extendBy = tonumber(ARGV[2])
+local reservationGrace = tonumber(ARGV[3])
+local fullReservationKey = "reservation:" .. reservationId
+local extensionsKey = "reservation_extensions:" .. reservationId
+
+local deadline = redis.call('ZSCORE', "` + expiriesKey + `", reservationId)
+if not deadline or redis.call('EXISTS', fullReservationKey) == 0 then
+	return -1
+end
+deadline = tonumber(deadline)
+
+local now = tonumber(redis.call('TIME')[1])
+if deadline <= now then
+	return -2
+end
+if redis.call('EXISTS', extensionsKey) == 1 then
+	return -3
+end
+
+local newDeadline = deadline + extendBy
+redis.call('ZADD', "` + expiriesKey + `", newDeadline, reservationId)
+redis.call('SET', extensionsKey, 1)
+redis.call('EXPIRE', fullReservationKey, newDeadline - now + reservationGrace)
+redis.call('EXPIRE', extensionsKey, newDeadline - now + reservationGrace)
+return newDeadline
+`)
+
+var _ Reserver = (*RedisReserver)(nil)
+
+// RedisReserver keeps holds in Redis so every API server shares one view of
+// what is held. Each operation is a single Lua script, so it is atomic with
+// respect to every other operation.
+type RedisReserver struct {
+	rdb   *redis.Client
+	ttl   time.Duration
+	grace time.Duration
+}
+
+// NewRedisReserver returns a Reserver whose holds last ttl. The reservation
+// hash is kept for a further grace period after its deadline so the reaper can
+// still read what to give back; the deadline itself is what decides expiry.
+func NewRedisReserver(rdb *redis.Client, ttl, grace time.Duration) *RedisReserver {
+	return &RedisReserver{rdb: rdb, ttl: ttl, grace: grace}
+}
+
+func (r *RedisReserver) Reserve(ctx context.Context, reservationID string, reqs []Request) error {
+	if err := validate(reqs); err != nil {
+		return err
+	}
+
+	// KEYS: ticket_holds:<id1>, ticket_holds:<id2>, ...
+	// ARGS: total_qty1, sold_qty1, requested_qty1, ..., reservationID, reservationTTL, reservationGrace
+	keys := make([]string, 0, len(reqs))
+	args := make([]interface{}, 0, len(reqs)*3+3)
+	for _, req := range reqs {
+		keys = append(keys, fmt.Sprintf("ticket_holds:%d", req.TicketTypeID))
+		args = append(args, req.TotalQuantity, req.SoldQuantity, req.Quantity)
+	}
+	args = append(args, reservationID, int(r.ttl.Seconds()), int(r.grace.Seconds()))
+
+	val, err := reserveScript.Run(ctx, r.rdb, keys, args...).Int()
+	if err != nil {
+		return fmt.Errorf("reservation: reserve script failed: %w", err)
+	}
+	if val == 0 {
+		return ErrInsufficientStock
+	}
+	return nil
+}
+
+func (r *RedisReserver) Release(ctx context.Context, reservationID string) error {
+	if err := releaseScript.Run(ctx, r.rdb, nil, reservationID).Err(); err != nil {
+		return fmt.Errorf("reservation: release %s: %w", reservationID, err)
+	}
+	return nil
+}
+
+func (r *RedisReserver) Commit(ctx context.Context, reservationID string) error {
+	// Once sold_quantity includes these tickets the hold is simply dropped,
+	// which is the same Redis operation as a release.
+	if err := releaseScript.Run(ctx, r.rdb, nil, reservationID).Err(); err != nil {
+		return fmt.Errorf("reservation: commit %s: %w", reservationID, err)
+	}
+	return nil
+}
+
+func (r *RedisReserver) Get(ctx context.Context, reservationID string) (*Reservation, error) {
+	pipe := r.rdb.Pipeline()
+	itemsCmd := pipe.HGetAll(ctx, "reservation:"+reservationID)
+	scoreCmd := pipe.ZScore(ctx, expiriesKey, reservationID)
+	extendedCmd := pipe.Exists(ctx, "reservation_extensions:"+reservationID)
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return nil, fmt.Errorf("reservation: get %s: %w", reservationID, err)
+	}
+
+	fields := itemsCmd.Val()
+	deadline, err := scoreCmd.Result()
+	if len(fields) == 0 || err == redis.Nil {
+		return nil, ErrNotFound
+	}
+
+	res := &Reservation{
+		ID:        reservationID,
+		Items:     make(map[int]int, len(fields)),
+		ExpiresAt: time.Unix(int64(deadline), 0),
+		Extended:  extendedCmd.Val() == 1,
+	}
+	for ticketTypeIDStr, quantityStr := range fields {
+		ticketTypeID, err := strconv.Atoi(ticketTypeIDStr)
+		if err != nil {
+			return nil, fmt.Errorf("reservation: bad ticket type %q in %s: %w", ticketTypeIDStr, reservationID, err)
+		}
+		quantity, err := strconv.Atoi(quantityStr)
+		if err != nil {
+			return nil, fmt.Errorf("reservation: bad quantity %q in %s: %w", quantityStr, reservationID, err)
+		}
+		res.Items[ticketTypeID] = quantity
+	}
+	return res, nil
+}
+
+func (r *RedisReserver) Extend(ctx context.Context, reservationID string, by time.Duration) (*Reservation, error) {
+	val, err := extendScript.Run(ctx, r.rdb, nil, reservationID, int(by.Seconds()), int(r.grace.Seconds())).Int()
+	if err != nil {
+		return nil, fmt.Errorf("reservation: extend %s: %w", reservationID, err)
+	}
+	switch val {
+	case -1:
+		return nil, ErrNotFound
+	case -2:
+		return nil, ErrExpired
+	case -3:
+		return nil, ErrAlreadyExtended
+	}
+	return r.Get(ctx, reservationID)
+}
+
+func (r *RedisReserver) ReleaseExpired(ctx context.Context) (int, error) {
+	total := 0
+	for {
+		n, err := releaseExpiredScript.Run(ctx, r.rdb, nil, reaperBatchSize).Int()
+		if err != nil {
+			return total, fmt.Errorf("reservation: release expired: %w", err)
+		}
+		total += n
+		if n < reaperBatchSize {
+			return total, nil
+		}
+	}
+}
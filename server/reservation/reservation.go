@@ -0,0 +1,101 @@
+// Package reservation holds tickets for a buyer while they check out, so two
+// buyers can never be promised the same last ticket.
+package reservation
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+)
+
+var (
+	// ErrInsufficientStock is returned by Reserve when any requested ticket type
+	// cannot be fully held. Nothing is held when it is returned.
+	ErrInsufficientStock = errors.New("reservation: not enough tickets available")
+	// ErrInvalidQuantity is returned by Reserve for a zero or negative quantity.
+	ErrInvalidQuantity = errors.New("reservation: quantity must be positive")
+	// ErrNotFound is returned by Get and Extend when the reservation does not
+	// exist or has already been released.
+	ErrNotFound = errors.New("reservation: not found")
+	// ErrExpired is returned by Extend when the reservation's deadline has passed.
+	ErrExpired = errors.New("reservation: expired")
+	// ErrAlreadyExtended is returned by Extend for a reservation that has
+	// already used its one extension.
+	ErrAlreadyExtended = errors.New("reservation: already extended")
+)
+
+// Request asks for Quantity tickets of one type. TotalQuantity and
+// SoldQuantity are the supply as currently recorded in the database.
+type Request struct {
+	TicketTypeID  int
+	Quantity      int
+	TotalQuantity int
+	SoldQuantity  int
+}
+
+// Reservation is a live hold on tickets for one checkout attempt.
+type Reservation struct {
+	ID        string
+	Items     map[int]int // ticketTypeID -> quantity
+	ExpiresAt time.Time
+	Extended  bool // whether the one allowed extension has been used
+}
+
+// Expired reports whether the hold has run out at the given time.
+func (r *Reservation) Expired(now time.Time) bool {
+	return !r.ExpiresAt.After(now)
+}
+
+// Reserver places and releases temporary holds on ticket inventory.
+type Reserver interface {
+	// Reserve atomically holds every request under reservationID, or nothing.
+	Reserve(ctx context.Context, reservationID string, reqs []Request) error
+	// Release gives a reservation's held tickets back to the pool. It is used
+	// when a checkout is abandoned or fails, and is a no-op for unknown IDs.
+	Release(ctx context.Context, reservationID string) error
+	// Commit drops a reservation's holds once the sale has been recorded in the
+	// database, so the tickets are now counted by sold_quantity instead.
+	Commit(ctx context.Context, reservationID string) error
+	// Get returns the items and deadline of a reservation.
+	Get(ctx context.Context, reservationID string) (*Reservation, error)
+	// Extend pushes a live reservation's deadline back by the given duration.
+	// Each reservation can be extended once.
+	Extend(ctx context.Context, reservationID string, by time.Duration) (*Reservation, error)
+	// ReleaseExpired releases every reservation whose deadline has passed and
+	// returns how many were released.
+	ReleaseExpired(ctx context.Context) (int, error)
+}
+
+// RunReaper sweeps expired reservations every interval until ctx is done.
+// Buyers who abandon checkout never reach the webhook, so without this their
+// held tickets would stay unavailable forever.
+func RunReaper(ctx context.Context, r Reserver, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			n, err := r.ReleaseExpired(ctx)
+			if err != nil {
+				log.Printf("Error releasing expired reservations: %v", err)
+				continue
+			}
+			if n > 0 {
+				log.Printf("Released %d expired reservation(s)", n)
+			}
+		}
+	}
+}
+
+func validate(reqs []Request) error {
+	for _, req := range reqs {
+		if req.Quantity <= 0 {
+			return ErrInvalidQuantity
+		}
+	}
+	return nil
+}
@@ -0,0 +1,356 @@
+package reservation_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	redis "github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+
+	"github.com/tpgcig/carneauengine/server/reservation"
+)
+
+func newTestRedis(t *testing.T) *redis.Client {
+	t.Helper()
+	rdb := redis.NewClient(&redis.Options{Addr: "localhost:6379", DB: 1}) // DB 1 = test isolation
+	if err := rdb.Ping(context.Background()).Err(); err != nil {
+		t.Skipf("Redis not reachable at localhost:6379 — skipping: %v", err)
+	}
+	return rdb
+}
+
+// backend is one Reserver implementation under test, plus a way to read how
+// many tickets of a type it currently holds.
+type backend struct {
+	reserver reservation.Reserver
+	held     func(ticketTypeID int) int
+}
+
+// forEachBackend runs fn against the in-memory reserver and, when Redis is
+// reachable, the Redis reserver. ttl of 0 makes every hold expire immediately.
+func forEachBackend(t *testing.T, ttl time.Duration, ticketTypeIDs []int, fn func(t *testing.T, b backend)) {
+	t.Run("memory", func(t *testing.T) {
+		m := reservation.NewMemoryReserver(ttl)
+		fn(t, backend{reserver: m, held: m.Held})
+	})
+
+	t.Run("redis", func(t *testing.T) {
+		ctx := context.Background()
+		rdb := newTestRedis(t)
+		defer rdb.Close()
+
+		keys := []string{"reservation_expiries"}
+		for _, id := range ticketTypeIDs {
+			keys = append(keys, fmt.Sprintf("ticket_holds:%d", id))
+		}
+		// Clean state before and after the test
+		rdb.Del(ctx, keys...)
+		defer rdb.Del(ctx, keys...)
+
+		held := func(ticketTypeID int) int {
+			n, _ := rdb.HGet(ctx, fmt.Sprintf("ticket_holds:%d", ticketTypeID), "held_quantity").Int()
+			return n
+		}
+		fn(t, backend{reserver: reservation.NewRedisReserver(rdb, ttl, time.Hour), held: held})
+	})
+}
+
+// TestNoOversell_ConcurrentReservations is the core correctness test.
+// It simulates N buyers simultaneously trying to claim tickets for an event
+// that only has `totalTickets` available. After all goroutines finish it
+// asserts that held_quantity never exceeded the supply.
+func TestNoOversell_ConcurrentReservations(t *testing.T) {
+	const (
+		ticketTypeID = 9999 // synthetic ID, won't exist in dev DB
+		totalTickets = 5    // intentionally scarce
+		soldTickets  = 0
+		buyers       = 50 // concurrent buyers — far more than available tickets
+	)
+
+	forEachBackend(t, 15*time.Minute, []int{ticketTypeID}, func(t *testing.T, b backend) {
+		ctx := context.Background()
+
+		var (
+			wg        sync.WaitGroup
+			mu        sync.Mutex
+			succeeded int
+			rejected  int
+		)
+
+		for i := 0; i < buyers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				err := b.reserver.Reserve(ctx, uuid.New().String(), []reservation.Request{
+					// each buyer wants 1 ticket
+					{TicketTypeID: ticketTypeID, Quantity: 1, TotalQuantity: totalTickets, SoldQuantity: soldTickets},
+				})
+
+				mu.Lock()
+				defer mu.Unlock()
+				switch {
+				case err == nil:
+					succeeded++
+				case errors.Is(err, reservation.ErrInsufficientStock):
+					rejected++
+				default:
+					t.Errorf("Reserve error: %v", err)
+				}
+			}()
+		}
+
+		wg.Wait()
+
+		held := b.held(ticketTypeID)
+		t.Logf("buyers=%d  succeeded=%d  rejected=%d  held_quantity=%d  totalTickets=%d",
+			buyers, succeeded, rejected, held, totalTickets)
+
+		if held > totalTickets {
+			t.Errorf("OVERSOLD: held_quantity=%d exceeded totalTickets=%d", held, totalTickets)
+		}
+		if succeeded != totalTickets {
+			t.Errorf("expected exactly %d successes, got %d", totalTickets, succeeded)
+		}
+		if succeeded+rejected != buyers {
+			t.Errorf("successes+rejections should equal buyers: %d+%d != %d", succeeded, rejected, buyers)
+		}
+	})
+}
+
+// TestReservation_RollbackOnPartialFailure verifies that if a multi-ticket
+// reservation can't be fully satisfied, no partial hold is left behind.
+func TestReservation_RollbackOnPartialFailure(t *testing.T) {
+	const (
+		typeA = 9991
+		typeB = 9992
+	)
+
+	forEachBackend(t, 15*time.Minute, []int{typeA, typeB}, func(t *testing.T, b backend) {
+		// typeA has 5 available, typeB has 0 available
+		// Reservation should fail and typeA should NOT be held
+		err := b.reserver.Reserve(context.Background(), uuid.New().String(), []reservation.Request{
+			{TicketTypeID: typeA, Quantity: 1, TotalQuantity: 5, SoldQuantity: 0},
+			{TicketTypeID: typeB, Quantity: 1, TotalQuantity: 0, SoldQuantity: 0}, // will fail
+		})
+		if !errors.Is(err, reservation.ErrInsufficientStock) {
+			t.Errorf("expected ErrInsufficientStock when one ticket type is unavailable, got %v", err)
+		}
+
+		// typeA hold must be zero — rollback should have cleaned it up
+		if held := b.held(typeA); held != 0 {
+			t.Errorf("partial hold was NOT rolled back: ticket_holds:%d held_quantity=%d", typeA, held)
+		}
+	})
+}
+
+// TestReservation_GetAndCommit verifies that a reservation reports what it
+// holds, and that committing it drops the hold exactly once.
+func TestReservation_GetAndCommit(t *testing.T) {
+	const ticketTypeID = 9995
+
+	forEachBackend(t, 15*time.Minute, []int{ticketTypeID}, func(t *testing.T, b backend) {
+		ctx := context.Background()
+		reservationID := uuid.New().String()
+
+		err := b.reserver.Reserve(ctx, reservationID, []reservation.Request{
+			{TicketTypeID: ticketTypeID, Quantity: 3, TotalQuantity: 10, SoldQuantity: 0},
+		})
+		if err != nil {
+			t.Fatalf("Reserve: %v", err)
+		}
+
+		res, err := b.reserver.Get(ctx, reservationID)
+		if err != nil {
+			t.Fatalf("Get: %v", err)
+		}
+		if res.Items[ticketTypeID] != 3 {
+			t.Errorf("expected 3 tickets held under the reservation, got %d", res.Items[ticketTypeID])
+		}
+		if res.Expired(time.Now()) {
+			t.Errorf("fresh reservation already expired at %v", res.ExpiresAt)
+		}
+
+		// A second commit, like a retried webhook, must not give the hold back twice
+		for i := 0; i < 2; i++ {
+			if err := b.reserver.Commit(ctx, reservationID); err != nil {
+				t.Fatalf("Commit: %v", err)
+			}
+		}
+		if held := b.held(ticketTypeID); held != 0 {
+			t.Errorf("expected held_quantity=0 after commit, got %d", held)
+		}
+		if _, err := b.reserver.Get(ctx, reservationID); !errors.Is(err, reservation.ErrNotFound) {
+			t.Errorf("expected ErrNotFound after commit, got %v", err)
+		}
+	})
+}
+
+// TestReaper_ReleasesAbandonedReservations verifies that holds whose deadline
+// has passed are given back.
+func TestReaper_ReleasesAbandonedReservations(t *testing.T) {
+	const ticketTypeID = 9993
+
+	forEachBackend(t, 0, []int{ticketTypeID}, func(t *testing.T, b backend) {
+		ctx := context.Background()
+		abandoned := uuid.New().String()
+
+		err := b.reserver.Reserve(ctx, abandoned, []reservation.Request{
+			{TicketTypeID: ticketTypeID, Quantity: 2, TotalQuantity: 5, SoldQuantity: 0},
+		})
+		if err != nil {
+			t.Fatalf("Reserve: %v", err)
+		}
+
+		released, err := b.reserver.ReleaseExpired(ctx)
+		if err != nil {
+			t.Fatalf("ReleaseExpired: %v", err)
+		}
+		if released != 1 {
+			t.Errorf("expected 1 reservation released, got %d", released)
+		}
+		if held := b.held(ticketTypeID); held != 0 {
+			t.Errorf("expected held_quantity=0 after sweeping, got %d", held)
+		}
+		if _, err := b.reserver.Get(ctx, abandoned); !errors.Is(err, reservation.ErrNotFound) {
+			t.Errorf("expected abandoned reservation to be gone, got %v", err)
+		}
+	})
+}
+
+// TestReaper_KeepsLiveReservations verifies that a sweep leaves holds that
+// have not reached their deadline alone.
+func TestReaper_KeepsLiveReservations(t *testing.T) {
+	const ticketTypeID = 9996
+
+	forEachBackend(t, 15*time.Minute, []int{ticketTypeID}, func(t *testing.T, b backend) {
+		ctx := context.Background()
+		live := uuid.New().String()
+
+		err := b.reserver.Reserve(ctx, live, []reservation.Request{
+			{TicketTypeID: ticketTypeID, Quantity: 1, TotalQuantity: 5, SoldQuantity: 0},
+		})
+		if err != nil {
+			t.Fatalf("Reserve: %v", err)
+		}
+		defer b.reserver.Release(ctx, live)
+
+		if released, err := b.reserver.ReleaseExpired(ctx); err != nil || released != 0 {
+			t.Errorf("expected nothing released, got %d (err=%v)", released, err)
+		}
+		if held := b.held(ticketTypeID); held != 1 {
+			t.Errorf("live hold was released: held_quantity=%d", held)
+		}
+	})
+}
+
+// TestReaper_ConcurrentSweepsReleaseOnce verifies that racing sweeps and
+// explicit releases never give the same hold back twice, which would let us
+// sell more than we have.
+func TestReaper_ConcurrentSweepsReleaseOnce(t *testing.T) {
+	const (
+		ticketTypeID = 9994
+		holds        = 20
+		sweepers     = 10
+	)
+
+	forEachBackend(t, 0, []int{ticketTypeID}, func(t *testing.T, b backend) {
+		ctx := context.Background()
+
+		ids := make([]string, holds)
+		for i := range ids {
+			ids[i] = uuid.New().String()
+			err := b.reserver.Reserve(ctx, ids[i], []reservation.Request{
+				{TicketTypeID: ticketTypeID, Quantity: 1, TotalQuantity: holds, SoldQuantity: 0},
+			})
+			if err != nil {
+				t.Fatalf("Reserve: %v", err)
+			}
+		}
+
+		var wg sync.WaitGroup
+		for i := 0; i < sweepers; i++ {
+			wg.Add(2)
+			go func() {
+				defer wg.Done()
+				if _, err := b.reserver.ReleaseExpired(ctx); err != nil {
+					t.Errorf("ReleaseExpired: %v", err)
+				}
+			}()
+			go func(id string) {
+				defer wg.Done()
+				if err := b.reserver.Release(ctx, id); err != nil {
+					t.Errorf("Release: %v", err)
+				}
+			}(ids[i])
+		}
+		wg.Wait()
+
+		if held := b.held(ticketTypeID); held != 0 {
+			t.Errorf("expected held_quantity=0 after sweeping, got %d", held)
+		}
+	})
+}
+
+// TestReservation_ExtendOnce verifies that a live hold can be extended exactly
+// once, and that an expired hold cannot be revived.
+func TestReservation_ExtendOnce(t *testing.T) {
+	const ticketTypeID = 9997
+
+	forEachBackend(t, 15*time.Minute, []int{ticketTypeID}, func(t *testing.T, b backend) {
+		ctx := context.Background()
+		reservationID := uuid.New().String()
+
+		err := b.reserver.Reserve(ctx, reservationID, []reservation.Request{
+			{TicketTypeID: ticketTypeID, Quantity: 1, TotalQuantity: 5, SoldQuantity: 0},
+		})
+		if err != nil {
+			t.Fatalf("Reserve: %v", err)
+		}
+		defer b.reserver.Release(ctx, reservationID)
+
+		before, err := b.reserver.Get(ctx, reservationID)
+		if err != nil {
+			t.Fatalf("Get: %v", err)
+		}
+
+		after, err := b.reserver.Extend(ctx, reservationID, 5*time.Minute)
+		if err != nil {
+			t.Fatalf("Extend: %v", err)
+		}
+		if got := after.ExpiresAt.Sub(before.ExpiresAt); got != 5*time.Minute {
+			t.Errorf("expected deadline to move by 5m, moved by %v", got)
+		}
+		if !after.Extended {
+			t.Error("expected reservation to be marked as extended")
+		}
+
+		if _, err := b.reserver.Extend(ctx, reservationID, 5*time.Minute); !errors.Is(err, reservation.ErrAlreadyExtended) {
+			t.Errorf("expected ErrAlreadyExtended on second extension, got %v", err)
+		}
+		if _, err := b.reserver.Extend(ctx, uuid.New().String(), 5*time.Minute); !errors.Is(err, reservation.ErrNotFound) {
+			t.Errorf("expected ErrNotFound for unknown reservation, got %v", err)
+		}
+	})
+
+	forEachBackend(t, 0, []int{ticketTypeID}, func(t *testing.T, b backend) {
+		ctx := context.Background()
+		reservationID := uuid.New().String()
+
+		err := b.reserver.Reserve(ctx, reservationID, []reservation.Request{
+			{TicketTypeID: ticketTypeID, Quantity: 1, TotalQuantity: 5, SoldQuantity: 0},
+		})
+		if err != nil {
+			t.Fatalf("Reserve: %v", err)
+		}
+		defer b.reserver.Release(ctx, reservationID)
+
+		if _, err := b.reserver.Extend(ctx, reservationID, 5*time.Minute); !errors.Is(err, reservation.ErrExpired) {
+			t.Errorf("expected ErrExpired for a hold past its deadline, got %v", err)
+		}
+	})
+}
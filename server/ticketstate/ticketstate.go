@@ -0,0 +1,216 @@
+// Package ticketstate defines the lifecycle of a ticket and is the one place
+// ticket statuses change. Every change is checked against the allowed
+// transitions and written to the ticket_events table, with who made it and
+// why, in the same transaction as the change itself.
+//
+//	valid ──> redeemed | voided | transferred | refunded | disputed
+//	disputed ──> valid | voided
+//
+// Redeemed, voided, transferred and refunded tickets are final.
+package ticketstate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// Status is where a ticket is in its lifecycle.
+type Status string
+
+const (
+	Valid       Status = "valid"       // can be used to get in
+	Redeemed    Status = "redeemed"    // scanned at the door
+	Voided      Status = "voided"      // cancelled, e.g. after a lost chargeback
+	Transferred Status = "transferred" // given to someone else, who has a new ticket
+	Refunded    Status = "refunded"    // paid back
+	Disputed    Status = "disputed"    // held while the buyer's bank disputes the payment
+)
+
+var transitions = map[Status][]Status{
+	Valid:    {Redeemed, Voided, Transferred, Refunded, Disputed},
+	Disputed: {Valid, Voided},
+}
+
+// Statuses lists every status.
+var Statuses = []Status{Valid, Redeemed, Voided, Transferred, Refunded, Disputed}
+
+// ErrNotFound is returned by Transition when a ticket doesn't exist.
+var ErrNotFound = errors.New("ticketstate: ticket not found")
+
+// Parse returns the status named s.
+func Parse(s string) (Status, error) {
+	for _, status := range Statuses {
+		if string(status) == s {
+			return status, nil
+		}
+	}
+	return "", fmt.Errorf("ticketstate: unknown status %q", s)
+}
+
+// CanTransition reports whether a ticket may move from one status to another.
+func CanTransition(from, to Status) bool {
+	for _, s := range transitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+// TransitionError is returned by Transition for a ticket that may not make
+// the change asked for.
+type TransitionError struct {
+	TicketID int
+	From, To Status
+}
+
+func (e *TransitionError) Error() string {
+	return fmt.Sprintf("ticketstate: ticket %d cannot go from %s to %s", e.TicketID, e.From, e.To)
+}
+
+// DB is satisfied by pgx transactions and pools.
+type DB interface {
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+}
+
+// Change is a status change and the reason for it.
+type Change struct {
+	To      Status
+	ActorID int    // the user making the change; 0 for the system, e.g. a payment webhook
+	Reason  string // why, for the history
+}
+
+// Transition moves tickets to c.To and records it in their history. Pass the
+// transaction making the change; the tickets stay locked until it ends. If
+// any ticket may not make the move, none do and a *TransitionError is
+// returned.
+func Transition(ctx context.Context, db DB, ticketIDs []int, c Change) error {
+	if len(ticketIDs) == 0 {
+		return nil
+	}
+	rows, err := db.Query(ctx,
+		"SELECT id, COALESCE(status, 'valid') FROM tickets WHERE id = ANY($1) ORDER BY id FOR UPDATE",
+		ticketIDs)
+	if err != nil {
+		return err
+	}
+	current := make(map[int]Status, len(ticketIDs))
+	for rows.Next() {
+		var id int
+		var status string
+		if err := rows.Scan(&id, &status); err != nil {
+			rows.Close()
+			return err
+		}
+		current[id] = Status(status)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	ids := make([]int, 0, len(current))
+	from := make([]string, 0, len(current))
+	for _, id := range ticketIDs {
+		status, ok := current[id]
+		if !ok {
+			return fmt.Errorf("%w: %d", ErrNotFound, id)
+		}
+		if !CanTransition(status, c.To) {
+			return &TransitionError{TicketID: id, From: status, To: c.To}
+		}
+		delete(current, id) // in case an ID is passed twice
+		ids = append(ids, id)
+		from = append(from, string(status))
+	}
+
+	if _, err := db.Exec(ctx, "UPDATE tickets SET status = $1 WHERE id = ANY($2)", string(c.To), ids); err != nil {
+		return err
+	}
+	return record(ctx, db, ids, from, c)
+}
+
+// RecordIssued starts the history of newly issued tickets, which are valid.
+func RecordIssued(ctx context.Context, db DB, ticketIDs []int, actorID int, reason string) error {
+	return record(ctx, db, ticketIDs, make([]string, len(ticketIDs)), Change{To: Valid, ActorID: actorID, Reason: reason})
+}
+
+// record writes ticket_events rows; an empty from status is stored as NULL.
+func record(ctx context.Context, db DB, ticketIDs []int, from []string, c Change) error {
+	if len(ticketIDs) == 0 {
+		return nil
+	}
+	_, err := db.Exec(ctx, `
+		INSERT INTO ticket_events (ticket_id, from_status, to_status, actor_id, reason)
+		SELECT e.ticket_id, NULLIF(e.from_status, ''), $3, NULLIF($4, 0), NULLIF($5, '')
+		FROM unnest($1::int[], $2::text[]) AS e(ticket_id, from_status)`,
+		ticketIDs, from, string(c.To), c.ActorID, c.Reason)
+	return err
+}
+
+// PurchaseTickets returns the IDs of a purchase's tickets in a status, locking
+// them.
+func PurchaseTickets(ctx context.Context, db DB, purchaseID int, status Status) ([]int, error) {
+	rows, err := db.Query(ctx,
+		"SELECT id FROM tickets WHERE purchase_id = $1 AND COALESCE(status, 'valid') = $2 ORDER BY id FOR UPDATE",
+		purchaseID, string(status))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// Event is one entry in a ticket's history.
+type Event struct {
+	ID         int       `json:"id"`
+	TicketID   int       `json:"ticket_id"`
+	From       Status    `json:"from,omitempty"` // empty when the ticket was issued
+	To         Status    `json:"to"`
+	ActorID    *int      `json:"actor_id,omitempty"`
+	ActorEmail string    `json:"actor_email,omitempty"`
+	Reason     string    `json:"reason,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// History returns a ticket's history, oldest first.
+func History(ctx context.Context, db DB, ticketID int) ([]Event, error) {
+	rows, err := db.Query(ctx, `
+		SELECT e.id, e.ticket_id, COALESCE(e.from_status, ''), e.to_status, e.actor_id,
+			COALESCE(u.email, ''), COALESCE(e.reason, ''), e.created_at
+		FROM ticket_events e
+		LEFT JOIN users u ON u.id = e.actor_id
+		WHERE e.ticket_id = $1
+		ORDER BY e.id`, ticketID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []Event{}
+	for rows.Next() {
+		var e Event
+		var from, to string
+		if err := rows.Scan(&e.ID, &e.TicketID, &from, &to, &e.ActorID, &e.ActorEmail, &e.Reason, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		e.From, e.To = Status(from), Status(to)
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
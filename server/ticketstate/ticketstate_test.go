@@ -0,0 +1,120 @@
+package ticketstate_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/tpgcig/carneauengine/server/ticketstate"
+)
+
+func newTestDB(t *testing.T) *pgxpool.Pool {
+	t.Helper()
+	dbURL := os.Getenv("TEST_DATABASE_URL")
+	if dbURL == "" {
+		t.Skip("TEST_DATABASE_URL not set — skipping")
+	}
+	pool, err := pgxpool.New(context.Background(), dbURL)
+	if err != nil {
+		t.Skipf("Postgres not reachable — skipping: %v", err)
+	}
+	if err := pool.Ping(context.Background()); err != nil {
+		pool.Close()
+		t.Skipf("Postgres not reachable — skipping: %v", err)
+	}
+	t.Cleanup(pool.Close)
+	return pool
+}
+
+func TestCanTransition(t *testing.T) {
+	allowed := map[[2]ticketstate.Status]bool{
+		{ticketstate.Valid, ticketstate.Redeemed}:    true,
+		{ticketstate.Valid, ticketstate.Voided}:      true,
+		{ticketstate.Valid, ticketstate.Transferred}: true,
+		{ticketstate.Valid, ticketstate.Refunded}:    true,
+		{ticketstate.Valid, ticketstate.Disputed}:    true,
+		{ticketstate.Disputed, ticketstate.Valid}:    true,
+		{ticketstate.Disputed, ticketstate.Voided}:   true,
+	}
+	for _, from := range ticketstate.Statuses {
+		for _, to := range ticketstate.Statuses {
+			if got, want := ticketstate.CanTransition(from, to), allowed[[2]ticketstate.Status{from, to}]; got != want {
+				t.Errorf("CanTransition(%s, %s) = %v, want %v", from, to, got, want)
+			}
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	for _, s := range ticketstate.Statuses {
+		if got, err := ticketstate.Parse(string(s)); err != nil || got != s {
+			t.Errorf("Parse(%q) = %q, %v", s, got, err)
+		}
+	}
+	if _, err := ticketstate.Parse("used"); err == nil {
+		t.Error("expected an unknown status to fail")
+	}
+}
+
+func TestTransition(t *testing.T) {
+	db := newTestDB(t)
+	ctx := context.Background()
+
+	var first, second int
+	if err := db.QueryRow(ctx, "INSERT INTO tickets (status) VALUES ('valid') RETURNING id").Scan(&first); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.QueryRow(ctx, "INSERT INTO tickets (status) VALUES ('redeemed') RETURNING id").Scan(&second); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Exec(ctx, "DELETE FROM ticket_events WHERE ticket_id IN ($1, $2)", first, second)
+		db.Exec(ctx, "DELETE FROM tickets WHERE id IN ($1, $2)", first, second)
+	})
+
+	transition := func(ids []int, change ticketstate.Change) error {
+		tx, err := db.Begin(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tx.Rollback(ctx)
+		if err := ticketstate.Transition(ctx, tx, ids, change); err != nil {
+			return err
+		}
+		return tx.Commit(ctx)
+	}
+
+	// One ticket that can't move stops the others moving too
+	var te *ticketstate.TransitionError
+	err := transition([]int{first, second}, ticketstate.Change{To: ticketstate.Disputed})
+	if !errors.As(err, &te) || te.TicketID != second || te.From != ticketstate.Redeemed {
+		t.Fatalf("expected a TransitionError for ticket %d, got %v", second, err)
+	}
+
+	if err := transition([]int{first}, ticketstate.Change{To: ticketstate.Disputed, Reason: "dispute opened"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := transition([]int{first}, ticketstate.Change{To: ticketstate.Valid, Reason: "dispute won"}); err != nil {
+		t.Fatal(err)
+	}
+
+	history, err := ticketstate.History(ctx, db, first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 2 ||
+		history[0].From != ticketstate.Valid || history[0].To != ticketstate.Disputed || history[0].Reason != "dispute opened" ||
+		history[1].From != ticketstate.Disputed || history[1].To != ticketstate.Valid || history[1].ActorID != nil {
+		t.Errorf("unexpected history %+v", history)
+	}
+	if history, _ := ticketstate.History(ctx, db, second); len(history) != 0 {
+		t.Errorf("expected no history for the ticket that didn't move, got %+v", history)
+	}
+
+	if err := transition([]int{-1}, ticketstate.Change{To: ticketstate.Voided}); !errors.Is(err, ticketstate.ErrNotFound) {
+		t.Errorf("unknown ticket: expected ErrNotFound, got %v", err)
+	}
+}